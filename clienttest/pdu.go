@@ -17,6 +17,7 @@ const (
 	Ipv6Prefix    = 6
 	EndOfDataType = 7
 	CacheReset    = 8
+	RouterKey     = 9
 	ErrorReport   = 10
 	Aspa          = 11
 )
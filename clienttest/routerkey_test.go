@@ -0,0 +1,78 @@
+package clienttest
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouterKeyEndToEnd(t *testing.T) {
+	addr, srv := SetupTestServerWithURLs(t, nil)
+
+	srv.UpdateRouterKeys([]server.RouterKey{
+		{ASN: 64496, SKI: [20]byte{1, 2, 3}, SPKI: []byte{0x30, 0x59}},
+	})
+
+	client, err := NewRTRClient(addr, 2*time.Second)
+	require.NoError(t, err)
+	defer client.Close()
+
+	// Router Key PDUs are defined from version 1 onwards
+	require.NoError(t, client.Send(BuildResetQuery(1)))
+
+	foundKey := false
+	for {
+		resp, err := ReadNextPDU(client.conn)
+		require.NoError(t, err)
+		if resp.Type == RouterKey {
+			foundKey = true
+			require.Equal(t, uint32(32+2), resp.Length)
+		}
+		if resp.Type == EndOfDataType {
+			break
+		}
+	}
+
+	require.True(t, foundKey, "Expected Router Key PDU not found")
+}
+
+func TestUnifiedUpstreamEndToEnd(t *testing.T) {
+	hits := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		fmt.Fprintln(w, `{
+			"roas": [{"asn": 13335, "prefix": "1.1.1.0/24", "maxLength": 24}],
+			"aspas": [{"customer_asid": 65001, "providers": [65002]}],
+			"bgpsec_keys": [{"asn": 65001, "ski": "0102030405060708090A0B0C0D0E0F1011121314", "pubkey": "MFk="}]
+		}`)
+	}))
+	defer ts.Close()
+
+	addr, _ := SetupTestServerWithUpstreams(t, []string{ts.URL})
+	require.Equal(t, 1, hits, "unified upstream should be fetched once per refresh")
+
+	client, err := NewRTRClient(addr, 2*time.Second)
+	require.NoError(t, err)
+	defer client.Close()
+
+	require.NoError(t, client.Send(BuildResetQuery(2)))
+
+	counts := map[uint8]int{}
+	for {
+		resp, err := ReadNextPDU(client.conn)
+		require.NoError(t, err)
+		counts[resp.Type]++
+		if resp.Type == EndOfDataType {
+			break
+		}
+	}
+
+	require.Equal(t, 1, counts[Ipv4Prefix])
+	require.Equal(t, 1, counts[Aspa])
+	require.Equal(t, 1, counts[RouterKey])
+}
@@ -114,3 +114,43 @@ func SetupTestServerWithAllURLs(t *testing.T, roaURLs, aspaURLs []string) (strin
 
 	return addr, srv
 }
+
+// SetupTestServerWithUpstreams starts a local RPKI-RTR server fed only by unified upstream URLs.
+func SetupTestServerWithUpstreams(t *testing.T, upstreamURLs []string) (string, *server.Server) {
+	t.Helper()
+
+	upstreams := make([]config.Upstream, 0, len(upstreamURLs))
+	for _, u := range upstreamURLs {
+		upstreams = append(upstreams, config.Upstream{URL: u})
+	}
+	cfg := &config.Config{
+		ListenAddr:      "127.0.0.1:0",
+		GRPCAddr:        "127.0.0.1:0",
+		LogLevel:        "error",
+		Upstreams:       upstreams,
+		RefreshInterval: config.DefaultRefreshInterval,
+	}
+	logger := zap.NewNop().Sugar()
+
+	srv := server.New(cfg, logger)
+
+	if err := srv.TriggerRefresh(context.Background()); err != nil {
+		t.Fatalf("Failed to load initial data: %v", err)
+	}
+
+	l, err := net.Listen("tcp", cfg.ListenAddr)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := l.Addr().String()
+
+	go func() {
+		_ = srv.ServeListener(l)
+	}()
+
+	t.Cleanup(func() {
+		srv.Stop(1 * time.Second)
+	})
+
+	return addr, srv
+}
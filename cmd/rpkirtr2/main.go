@@ -4,6 +4,7 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"os/signal"
@@ -14,6 +15,7 @@ import (
 	"github.com/mellowdrifter/rpkirtr2/internal/config"
 	"github.com/mellowdrifter/rpkirtr2/internal/logging"
 	"github.com/mellowdrifter/rpkirtr2/internal/server"
+	"github.com/mellowdrifter/rpkirtr2/internal/tracing"
 )
 
 const (
@@ -33,16 +35,26 @@ func main() {
 	debug.SetGCPercent(50)
 
 	// Set up logger
-	logger := logging.New(cfg.LogLevel)
+	logger, level, syncLogs, err := logging.Build(cfg.LogLevel, cfg.Logging)
+	if err != nil {
+		log.Fatalf("failed to set up logging: %v", err)
+	}
+	defer syncLogs()
 
 	logger.Info("Starting daemon...")
 
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		logger.Fatalw("Failed to set up tracing", "error", err)
+	}
+
 	// Create and start the server
 	srv := server.New(cfg, logger)
+	srv.SetAtomicLevel(level)
 
 	go func() {
 		if err := srv.Start(); err != nil {
-			logger.Fatalf("server failed: %v", err)
+			logger.Fatalw("Server failed", "error", err)
 		}
 	}()
 
@@ -51,11 +63,18 @@ func main() {
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
 	sig := <-sigCh
-	logger.Infof("Signal received: %s, shutting down gracefully...", sig)
+	logger.Infow("Signal received, shutting down gracefully...", "signal", sig)
 
 	if err := srv.Stop(shutdownTimeout); err != nil {
-		logger.Errorf("Shutdown error: %v", err)
+		logger.Errorw("Shutdown error", "error", err)
 	} else {
 		logger.Info("Daemon shut down cleanly")
 	}
+
+	// Flush spans still buffered for the exporter
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Errorw("Failed to flush traces", "error", err)
+	}
 }
@@ -1,9 +1,14 @@
 package config
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
 	"os"
+	"slices"
 
 	"gopkg.in/yaml.v3"
 )
@@ -15,14 +20,303 @@ var (
 	}
 )
 
+// Upstream is a single upstream source containing any mix of ROAs, ASPAs
+// and BGPsec router keys. HTTP upstreams, such as rpki-client's json output,
+// are fetched and parsed once per refresh cycle. RTR upstreams are another
+// RTR cache which is mirrored over a persistent connection.
+type Upstream struct {
+	Type   string `yaml:"type"`   // one of the UpstreamType* constants; empty means http
+	URL    string `yaml:"url"`    // document URL, or host:port for RTR upstreams
+	Format string `yaml:"format"` // one of the Format* constants; empty means auto-detect
+
+	// VerifyKey is the path to a PEM encoded ECDSA public key. When set, the
+	// document must carry a valid GoRTR style signature or it is refused.
+	VerifyKey string `yaml:"verify_key"`
+
+	// HTTP client settings. Upstreams without any of these share a default client.
+	ClientCert    string            `yaml:"client_cert"`     // PEM client certificate for mTLS
+	ClientKey     string            `yaml:"client_key"`      // PEM private key for client_cert
+	CAFile        string            `yaml:"ca_file"`         // PEM CA bundle replacing the system roots
+	Headers       map[string]string `yaml:"headers"`         // extra request headers, e.g. Authorization
+	Proxy         string            `yaml:"proxy"`           // proxy URL; the environment is used when empty
+	TLSMinVersion string            `yaml:"tls_min_version"` // one of TLSVersions
+}
+
+// TLSVersions maps the accepted tls_min_version values to crypto/tls constants.
+var TLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// HasClientOptions reports whether the upstream needs its own HTTP client.
+func (u Upstream) HasClientOptions() bool {
+	return u.ClientCert != "" || u.CAFile != "" || len(u.Headers) > 0 || u.Proxy != "" || u.TLSMinVersion != ""
+}
+
+// GRPCTLS enables TLS on the gRPC listener, and client certificates when
+// ClientCAFile is set.
+type GRPCTLS struct {
+	CertFile          string `yaml:"cert_file"`           // PEM server certificate, re-read on every handshake
+	KeyFile           string `yaml:"key_file"`            // PEM private key for cert_file
+	ClientCAFile      string `yaml:"client_ca_file"`      // PEM CA bundle verifying client certificates
+	RequireClientCert bool   `yaml:"require_client_cert"` // refuse connections without a valid client certificate
+}
+
+// Enabled reports whether the gRPC listener uses TLS.
+func (t GRPCTLS) Enabled() bool {
+	return t.CertFile != ""
+}
+
+// GRPCAuth maps gRPC callers to roles. Callers are identified by a bearer
+// token or by the name in a verified client certificate, and otherwise get
+// AnonymousRole.
+type GRPCAuth struct {
+	Tokens        []GRPCToken      `yaml:"tokens"`
+	ClientCerts   []GRPCClientCert `yaml:"client_certs"`
+	AnonymousRole string           `yaml:"anonymous_role"` // one of the Role* constants; empty means RoleRead
+}
+
+type GRPCToken struct {
+	Name  string `yaml:"name"` // identifies the caller in logs
+	Token string `yaml:"token"`
+	Role  string `yaml:"role"`
+}
+
+// GRPCClientCert grants a role to client certificates whose common name or a
+// DNS name matches Name.
+type GRPCClientCert struct {
+	Name string `yaml:"name"`
+	Role string `yaml:"role"`
+}
+
+// Tracing exports OpenTelemetry spans for refresh cycles and RTR queries.
+type Tracing struct {
+	Exporter    string  `yaml:"exporter"`     // one of the Tracing* constants; empty disables tracing
+	Endpoint    string  `yaml:"endpoint"`     // OTLP gRPC collector host:port; OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4317 when empty
+	Insecure    bool    `yaml:"insecure"`     // send OTLP without TLS, e.g. to a collector on the same host
+	SampleRatio float64 `yaml:"sample_ratio"` // fraction of traces recorded; all when unset
+	ServiceName string  `yaml:"service_name"` // service.name of the spans; "rpkirtr2" when empty
+}
+
+// Tracing exporters
+const (
+	TracingOTLP   = "otlp"   // OTLP over gRPC to a collector
+	TracingStdout = "stdout" // JSON spans on standard output, for debugging
+)
+
+// Audit keeps a durable record of every change served to routers, as one
+// JSON Lines file per UTC day.
+type Audit struct {
+	Dir    string `yaml:"dir"`     // directory for the audit files; auditing is off when empty
+	MaxAge uint32 `yaml:"max_age"` // days to keep audit files; forever when unset
+}
+
+// ACL restricts the source addresses allowed to connect to a listener. Allow
+// and Deny hold prefixes or single addresses. Deny takes precedence, and an
+// empty Allow admits every address that is not denied.
+type ACL struct {
+	Allow       []string `yaml:"allow"`
+	Deny        []string `yaml:"deny"`
+	ErrorReport bool     `yaml:"error_report"` // RTR only: send an Error Report before closing refused connections
+}
+
+// Prefixes parses Allow and Deny. A single address is a host prefix.
+func (a ACL) Prefixes() (allow, deny []netip.Prefix, err error) {
+	if allow, err = parsePrefixes(a.Allow); err != nil {
+		return nil, nil, err
+	}
+	if deny, err = parsePrefixes(a.Deny); err != nil {
+		return nil, nil, err
+	}
+	return allow, deny, nil
+}
+
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, e := range entries {
+		if addr, err := netip.ParseAddr(e); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix or address %q", e)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// RTRLimits protects the RTR listener from too many connections and from
+// routers that query too often. Limits are off when unset.
+type RTRLimits struct {
+	MaxConnections      uint32 `yaml:"max_connections"`        // sessions in total
+	MaxConnectionsPerIP uint32 `yaml:"max_connections_per_ip"` // sessions from one source address
+	QueriesPerMinute    uint32 `yaml:"queries_per_minute"`     // Reset and Serial Queries per session; replies beyond it are delayed
+	QueryBurst          uint32 `yaml:"query_burst"`            // queries answered without delay after a quiet period; DefaultQueryBurst when unset
+	IdleTimeout         uint32 `yaml:"idle_timeout"`           // seconds a session may stay open before its first query; DefaultIdleTimeout when unset
+}
+
+// View restricts the data sent to some routers, such as IPv4-only routers or
+// lab routers that should get a reduced dataset. Routers connecting from one
+// of Clients get only the VRPs matching every filter that is set. Views match
+// source addresses only: the RTR listener is plain TCP, with no TLS identity
+// to match on.
+type View struct {
+	Name        string   `yaml:"name"`         // identifies the view in logs and ListClients
+	Clients     []string `yaml:"clients"`      // source prefixes or addresses of the routers using the view
+	AFI         string   `yaml:"afi"`          // one of the AFI* constants to send a single address family; both when empty
+	Prefixes    []string `yaml:"prefixes"`     // send only VRPs within or covering these; all when empty
+	ASNs        []uint32 `yaml:"asns"`         // send only VRPs with these origin ASNs; all when empty
+	ExcludeASPA bool     `yaml:"exclude_aspa"` // send no ASPAs
+}
+
+// ParsePrefixes parses Clients and Prefixes. A single address is a host prefix.
+func (v View) ParsePrefixes() (clients, prefixes []netip.Prefix, err error) {
+	if clients, err = parsePrefixes(v.Clients); err != nil {
+		return nil, nil, fmt.Errorf("clients: %v", err)
+	}
+	if prefixes, err = parsePrefixes(v.Prefixes); err != nil {
+		return nil, nil, fmt.Errorf("prefixes: %v", err)
+	}
+	return clients, prefixes, nil
+}
+
+// Address families for View.AFI
+const (
+	AFIIPv4 = "ipv4"
+	AFIIPv6 = "ipv6"
+)
+
+// Logging controls the format and destinations of the daemon's log.
+type Logging struct {
+	Encoding string      `yaml:"encoding"` // one of the LogEncoding* constants; console when empty
+	Outputs  []string    `yaml:"outputs"`  // LogOutput* constants or file paths; stdout when empty
+	Rotation LogRotation `yaml:"rotation"` // applies to file outputs
+	Sampling LogSampling `yaml:"sampling"`
+}
+
+// LogRotation rotates log files by size and removes old ones by age and count.
+type LogRotation struct {
+	MaxSize    int  `yaml:"max_size"`    // megabytes before a file is rotated; 100 when unset
+	MaxAge     int  `yaml:"max_age"`     // days to keep rotated files; no limit when unset
+	MaxBackups int  `yaml:"max_backups"` // rotated files to keep; no limit when unset
+	Compress   bool `yaml:"compress"`    // gzip rotated files
+}
+
+// LogSampling limits repeated per-client messages such as query logs. Each
+// second the first Initial entries with the same level and message are
+// logged, then every Thereafter-th. Other messages are never sampled.
+// Sampling is off when Initial is unset.
+type LogSampling struct {
+	Initial    int `yaml:"initial"`
+	Thereafter int `yaml:"thereafter"` // drop all after Initial when unset
+}
+
+// Log encodings
+const (
+	LogEncodingConsole = "console"
+	LogEncodingJSON    = "json"
+)
+
+// Log outputs other than file paths
+const (
+	LogOutputStdout   = "stdout"
+	LogOutputStderr   = "stderr"
+	LogOutputSyslog   = "syslog"   // local syslog daemon, with the LOG_DAEMON facility
+	LogOutputJournald = "journald" // systemd journal, with the fields as journal fields
+)
+
+// gRPC roles. Admin includes read.
+const (
+	RoleNone  = "none"
+	RoleRead  = "read"
+	RoleAdmin = "admin"
+)
+
+// Upstream types
+const (
+	UpstreamTypeHTTP = "http"
+	UpstreamTypeRTR  = "rtr"
+)
+
+// IsRTR reports whether the upstream is another RTR cache.
+func (u Upstream) IsRTR() bool {
+	return u.Type == UpstreamTypeRTR
+}
+
+// Upstream document formats
+const (
+	FormatAuto              = "auto"
+	FormatRPKIClient        = "rpki-client"        // rpki-client json
+	FormatRoutinatorJSONExt = "routinator-jsonext" // Routinator jsonext, with per-VRP source information
+	FormatGoRTR             = "gortr"              // OctoRPKI / GoRTR / StayRTR signed JSON
+	FormatCSV               = "csv"                // rpki-client and Routinator csv
+	FormatOpenBGPD          = "openbgpd"           // OpenBGPD roa-set and aspa-set text
+)
+
+// Formats lists every supported upstream format.
+var Formats = []string{
+	FormatAuto,
+	FormatRPKIClient,
+	FormatRoutinatorJSONExt,
+	FormatGoRTR,
+	FormatCSV,
+	FormatOpenBGPD,
+}
+
 type Config struct {
-	ListenAddr      string   `yaml:"listen_addr"`      // e.g. ":8282"
-	GRPCAddr        string   `yaml:"grpc_addr"`        // e.g. ":50051"
-	LogLevel        string   `yaml:"log_level"`        // "info", "debug", etc.
-	RPKIURLs        []string `yaml:"rpki_urls"`        // URLs to fetch RPKI data from, e.g. ["http://rpki.example.com/roa.json"]
-	ASPAURLs        []string `yaml:"aspa_urls"`        // URLs to fetch ASPA data from, e.g. ["http://rpki.example.com/aspa.json"]
-	RefreshInterval uint32   `yaml:"refresh_interval"` // how often to fetch new data (seconds)
-	TestMode        bool     `yaml:"test_mode"`
+	ListenAddr      string     `yaml:"listen_addr"`      // e.g. ":8282"
+	GRPCAddr        string     `yaml:"grpc_addr"`        // e.g. ":50051", or "unix:///run/rpkirtr2/grpc.sock" for a Unix socket
+	HTTPAddr        string     `yaml:"http_addr"`        // HTTP/JSON gateway, e.g. ":8080"; disabled when empty
+	LogLevel        string     `yaml:"log_level"`        // "info", "debug", etc.
+	RPKIURLs        []string   `yaml:"rpki_urls"`        // URLs to fetch RPKI data from, e.g. ["http://rpki.example.com/roa.json"]
+	ASPAURLs        []string   `yaml:"aspa_urls"`        // URLs to fetch ASPA data from, e.g. ["http://rpki.example.com/aspa.json"]
+	Upstreams       []Upstream `yaml:"upstreams"`        // Unified upstreams providing ROAs, ASPAs and router keys in one document
+	RefreshInterval uint32     `yaml:"refresh_interval"` // how often to fetch new data (seconds)
+	TestMode        bool       `yaml:"test_mode"`
+
+	FetchTimeout     uint32 `yaml:"fetch_timeout"`      // per-request HTTP timeout (seconds)
+	RetryMinInterval uint32 `yaml:"retry_min_interval"` // delay before the first retry of a failed upstream (seconds)
+	RetryMaxInterval uint32 `yaml:"retry_max_interval"` // cap for the exponential retry delay (seconds)
+
+	// ReadyMaxAge is how recently some upstream must have been fetched or
+	// synced for the server to report ready, in seconds. Twice the refresh
+	// interval when unset.
+	ReadyMaxAge uint32 `yaml:"ready_max_age"`
+
+	// CompressVRPs leaves out VRPs made redundant by a covering VRP for the
+	// same origin, which gives the same validation results with fewer VRPs.
+	CompressVRPs bool `yaml:"compress_vrps"`
+
+	// AdminToken is a bearer token with the admin role, kept as a shorthand
+	// for a single entry in GRPCAuth.Tokens.
+	AdminToken string `yaml:"admin_token"`
+
+	GRPCTLS  GRPCTLS  `yaml:"grpc_tls"`
+	GRPCAuth GRPCAuth `yaml:"grpc_auth"`
+
+	// OverridesFile is where local overrides added through the admin service
+	// are kept. They are lost on restart when it is empty.
+	OverridesFile string `yaml:"overrides_file"`
+
+	// RTRACL and GRPCACL restrict who may connect to the RTR listener and to
+	// the gRPC listener and HTTP gateway.
+	RTRACL  ACL `yaml:"rtr_acl"`
+	GRPCACL ACL `yaml:"grpc_acl"`
+
+	RTRLimits RTRLimits `yaml:"rtr_limits"`
+
+	// Views are tried in order; routers matching none get all data.
+	Views []View `yaml:"views"`
+
+	Audit   Audit   `yaml:"audit"`
+	Logging Logging `yaml:"logging"`
+	Tracing Tracing `yaml:"tracing"`
+
+	args []string // command line the config was loaded from, for Reload
 }
 
 const (
@@ -30,6 +324,15 @@ const (
 	DefaultRefreshInterval = uint32(3600) // 1 - 86400
 	DefaultRetryInterval   = uint32(600)  // 1 - 7200
 	DefaultExpireInterval  = uint32(7200) // 600 - 172800
+
+	// Upstream fetch defaults in seconds
+	DefaultFetchTimeout     = uint32(60)
+	DefaultRetryMinInterval = uint32(30)
+	DefaultRetryMaxInterval = uint32(900)
+
+	// RTR session limits
+	DefaultQueryBurst  = uint32(5)
+	DefaultIdleTimeout = uint32(120) // seconds
 )
 
 type urlList []string
@@ -50,7 +353,7 @@ func Load() (*Config, error) {
 
 // LoadWithArgs is like Load but allows passing a custom FlagSet and arguments, mainly for testing.
 func LoadWithArgs(fs *flag.FlagSet, args []string) (*Config, error) {
-	var urls, aspaUrls urlList
+	var urls, aspaUrls, upstreamUrls, rtrUpstreams urlList
 	var testMode = fs.Bool("testmode", false, "hidden flag for test mode")
 
 	cfg := &Config{
@@ -58,16 +361,23 @@ func LoadWithArgs(fs *flag.FlagSet, args []string) (*Config, error) {
 		GRPCAddr:        ":50051",
 		LogLevel:        "info",
 		RefreshInterval: DefaultRefreshInterval,
+
+		FetchTimeout:     DefaultFetchTimeout,
+		RetryMinInterval: DefaultRetryMinInterval,
+		RetryMaxInterval: DefaultRetryMaxInterval,
 	}
 
 	// CLI flags
 	configFile := fs.String("config", "", "Path to YAML configuration file")
 	listen := fs.String("listen", cfg.ListenAddr, "Address to listen on (e.g. :8282)")
-	grpcAddr := fs.String("grpc-listen", cfg.GRPCAddr, "gRPC Stats address to listen on (e.g. :50051)")
+	grpcAddr := fs.String("grpc-listen", cfg.GRPCAddr, "gRPC Stats address to listen on (e.g. :50051 or unix:///run/rpkirtr2/grpc.sock)")
+	httpAddr := fs.String("http-listen", cfg.HTTPAddr, "HTTP/JSON gateway address to listen on (e.g. :8080); disabled when empty")
 	loglevel := fs.String("loglevel", cfg.LogLevel, "Log level (debug, info, warn, error)")
 	refresh := fs.Uint("refresh", uint(cfg.RefreshInterval), "How often to fetch new data (seconds)")
 	fs.Var(&urls, "rpki-url", "RPKI JSON URL (can be specified multiple times)")
 	fs.Var(&aspaUrls, "aspa-url", "ASPA JSON URL (can be specified multiple times)")
+	fs.Var(&upstreamUrls, "upstream-url", "Unified JSON URL providing ROAs, ASPAs and router keys (can be specified multiple times)")
+	fs.Var(&rtrUpstreams, "rtr-upstream", "host:port of an RTR cache to mirror (can be specified multiple times)")
 
 	fs.Usage = func() {
 		fmt.Println("Usage:")
@@ -108,16 +418,226 @@ func LoadWithArgs(fs *flag.FlagSet, args []string) (*Config, error) {
 	}
 
 	// Apply flag overrides (if they were set)
-	applyFlagOverrides(cfg, setFlags, listen, grpcAddr, loglevel, refresh, urls, aspaUrls, testMode)
+	applyFlagOverrides(cfg, setFlags, listen, grpcAddr, httpAddr, loglevel, refresh, urls, aspaUrls, testMode)
+	if setFlags["upstream-url"] || setFlags["rtr-upstream"] {
+		cfg.Upstreams = make([]Upstream, 0, len(upstreamUrls)+len(rtrUpstreams))
+		for _, u := range upstreamUrls {
+			cfg.Upstreams = append(cfg.Upstreams, Upstream{URL: u})
+		}
+		for _, u := range rtrUpstreams {
+			cfg.Upstreams = append(cfg.Upstreams, Upstream{Type: UpstreamTypeRTR, URL: u})
+		}
+	}
+
+	cfg.args = args
+
+	for _, u := range cfg.Upstreams {
+		if err := u.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.validateGRPC(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validateACLs(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.RTRLimits.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validateViews(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Logging.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Tracing.validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.RetryMaxInterval < cfg.RetryMinInterval {
+		return nil, fmt.Errorf("retry_max_interval (%d) must not be less than retry_min_interval (%d)", cfg.RetryMaxInterval, cfg.RetryMinInterval)
+	}
 
-	// Final fallback for URLs if still empty
-	if len(cfg.RPKIURLs) == 0 {
+	// Final fallback for URLs if no upstream of any kind is configured
+	if len(cfg.RPKIURLs) == 0 && len(cfg.Upstreams) == 0 {
 		cfg.RPKIURLs = RPKIURLs
 	}
 
 	return cfg, nil
 }
 
+// Reload loads the configuration again from the same command line and config
+// file, so that edits to the file are picked up.
+func (c *Config) Reload() (*Config, error) {
+	return LoadWithArgs(flag.NewFlagSet("reload", flag.ContinueOnError), c.args)
+}
+
+func (c *Config) validateGRPC() error {
+	t := c.GRPCTLS
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("grpc_tls: cert_file and key_file must be set together")
+	}
+	if (t.ClientCAFile != "" || t.RequireClientCert) && !t.Enabled() {
+		return fmt.Errorf("grpc_tls: client certificates need cert_file and key_file")
+	}
+	if t.RequireClientCert && t.ClientCAFile == "" {
+		return fmt.Errorf("grpc_tls: require_client_cert needs client_ca_file")
+	}
+
+	a := c.GRPCAuth
+	if a.AnonymousRole != "" && !validRole(a.AnonymousRole) {
+		return fmt.Errorf("grpc_auth: unknown anonymous_role %q", a.AnonymousRole)
+	}
+	for _, tok := range a.Tokens {
+		if tok.Token == "" {
+			return fmt.Errorf("grpc_auth: token %q is empty", tok.Name)
+		}
+		if !validRole(tok.Role) || tok.Role == RoleNone {
+			return fmt.Errorf("grpc_auth: token %q has unknown role %q", tok.Name, tok.Role)
+		}
+	}
+	if len(a.ClientCerts) > 0 && t.ClientCAFile == "" {
+		return fmt.Errorf("grpc_auth: client_certs need grpc_tls.client_ca_file")
+	}
+	for _, cc := range a.ClientCerts {
+		if cc.Name == "" {
+			return fmt.Errorf("grpc_auth: client certificate entry without a name")
+		}
+		if !validRole(cc.Role) || cc.Role == RoleNone {
+			return fmt.Errorf("grpc_auth: client certificate %q has unknown role %q", cc.Name, cc.Role)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateACLs() error {
+	if _, _, err := c.RTRACL.Prefixes(); err != nil {
+		return fmt.Errorf("rtr_acl: %v", err)
+	}
+	if _, _, err := c.GRPCACL.Prefixes(); err != nil {
+		return fmt.Errorf("grpc_acl: %v", err)
+	}
+	if c.GRPCACL.ErrorReport {
+		return fmt.Errorf("grpc_acl: error_report is only supported for rtr_acl")
+	}
+	return nil
+}
+
+func (l RTRLimits) validate() error {
+	if l.QueryBurst != 0 && l.QueriesPerMinute == 0 {
+		return fmt.Errorf("rtr_limits: query_burst needs queries_per_minute")
+	}
+	if l.MaxConnections != 0 && l.MaxConnectionsPerIP > l.MaxConnections {
+		return fmt.Errorf("rtr_limits: max_connections_per_ip (%d) must not exceed max_connections (%d)", l.MaxConnectionsPerIP, l.MaxConnections)
+	}
+	return nil
+}
+
+func (c *Config) validateViews() error {
+	names := make(map[string]bool)
+	for _, v := range c.Views {
+		if v.Name == "" {
+			return fmt.Errorf("views: view without a name")
+		}
+		if names[v.Name] {
+			return fmt.Errorf("views: duplicate view %q", v.Name)
+		}
+		names[v.Name] = true
+		if len(v.Clients) == 0 {
+			return fmt.Errorf("view %s: no clients", v.Name)
+		}
+		if _, _, err := v.ParsePrefixes(); err != nil {
+			return fmt.Errorf("view %s: %v", v.Name, err)
+		}
+		switch v.AFI {
+		case "", AFIIPv4, AFIIPv6:
+		default:
+			return fmt.Errorf("view %s: unknown afi %q", v.Name, v.AFI)
+		}
+	}
+	return nil
+}
+
+func (l Logging) validate() error {
+	switch l.Encoding {
+	case "", LogEncodingConsole, LogEncodingJSON:
+	default:
+		return fmt.Errorf("logging: unknown encoding %q", l.Encoding)
+	}
+	for _, out := range l.Outputs {
+		if out == "" {
+			return fmt.Errorf("logging: empty output")
+		}
+	}
+	r := l.Rotation
+	if r.MaxSize < 0 || r.MaxAge < 0 || r.MaxBackups < 0 {
+		return fmt.Errorf("logging: rotation limits must not be negative")
+	}
+	if l.Sampling.Initial < 0 || l.Sampling.Thereafter < 0 {
+		return fmt.Errorf("logging: sampling values must not be negative")
+	}
+	return nil
+}
+
+func (t Tracing) validate() error {
+	switch t.Exporter {
+	case "", TracingOTLP, TracingStdout:
+	default:
+		return fmt.Errorf("tracing: unknown exporter %q", t.Exporter)
+	}
+	if t.SampleRatio < 0 || t.SampleRatio > 1 {
+		return fmt.Errorf("tracing: sample_ratio %v must be between 0 and 1", t.SampleRatio)
+	}
+	if t.Exporter != TracingOTLP && (t.Endpoint != "" || t.Insecure) {
+		return fmt.Errorf("tracing: endpoint and insecure need the %s exporter", TracingOTLP)
+	}
+	return nil
+}
+
+func validRole(role string) bool {
+	return role == RoleNone || role == RoleRead || role == RoleAdmin
+}
+
+func (u Upstream) validate() error {
+	switch u.Type {
+	case "", UpstreamTypeHTTP:
+		if u.Format != "" && !slices.Contains(Formats, u.Format) {
+			return fmt.Errorf("upstream %s: unknown format %q", u.URL, u.Format)
+		}
+		if u.VerifyKey != "" && u.Format != "" && u.Format != FormatAuto && u.Format != FormatGoRTR {
+			return fmt.Errorf("upstream %s: signature verification is only supported for the %s format", u.URL, FormatGoRTR)
+		}
+		if (u.ClientCert == "") != (u.ClientKey == "") {
+			return fmt.Errorf("upstream %s: client_cert and client_key must be set together", u.URL)
+		}
+		if _, ok := TLSVersions[u.TLSMinVersion]; u.TLSMinVersion != "" && !ok {
+			return fmt.Errorf("upstream %s: unknown tls_min_version %q", u.URL, u.TLSMinVersion)
+		}
+		if u.Proxy != "" {
+			if p, err := url.Parse(u.Proxy); err != nil || p.Scheme == "" || p.Host == "" {
+				return fmt.Errorf("upstream %s: invalid proxy %q", u.URL, u.Proxy)
+			}
+		}
+	case UpstreamTypeRTR:
+		if _, _, err := net.SplitHostPort(u.URL); err != nil {
+			return fmt.Errorf("rtr upstream %s: expected host:port: %v", u.URL, err)
+		}
+		if u.Format != "" || u.VerifyKey != "" || u.HasClientOptions() || u.ClientKey != "" {
+			return fmt.Errorf("rtr upstream %s: format, verify_key and HTTP client settings are not supported", u.URL)
+		}
+	default:
+		return fmt.Errorf("upstream %s: unknown type %q", u.URL, u.Type)
+	}
+	return nil
+}
+
 func mergeConfig(cfg *Config, fileCfg Config, setFlags map[string]bool) {
 	if !setFlags["listen"] && fileCfg.ListenAddr != "" {
 		cfg.ListenAddr = fileCfg.ListenAddr
@@ -125,6 +645,9 @@ func mergeConfig(cfg *Config, fileCfg Config, setFlags map[string]bool) {
 	if !setFlags["grpc-listen"] && fileCfg.GRPCAddr != "" {
 		cfg.GRPCAddr = fileCfg.GRPCAddr
 	}
+	if !setFlags["http-listen"] && fileCfg.HTTPAddr != "" {
+		cfg.HTTPAddr = fileCfg.HTTPAddr
+	}
 	if !setFlags["loglevel"] && fileCfg.LogLevel != "" {
 		cfg.LogLevel = fileCfg.LogLevel
 	}
@@ -134,21 +657,51 @@ func mergeConfig(cfg *Config, fileCfg Config, setFlags map[string]bool) {
 	if !setFlags["aspa-url"] && len(fileCfg.ASPAURLs) > 0 {
 		cfg.ASPAURLs = fileCfg.ASPAURLs
 	}
+	if !setFlags["upstream-url"] && !setFlags["rtr-upstream"] && len(fileCfg.Upstreams) > 0 {
+		cfg.Upstreams = fileCfg.Upstreams
+	}
 	if !setFlags["refresh"] && fileCfg.RefreshInterval != 0 {
 		cfg.RefreshInterval = fileCfg.RefreshInterval
 	}
 	if !setFlags["testmode"] {
 		cfg.TestMode = fileCfg.TestMode
 	}
+	if fileCfg.FetchTimeout != 0 {
+		cfg.FetchTimeout = fileCfg.FetchTimeout
+	}
+	if fileCfg.RetryMinInterval != 0 {
+		cfg.RetryMinInterval = fileCfg.RetryMinInterval
+	}
+	if fileCfg.RetryMaxInterval != 0 {
+		cfg.RetryMaxInterval = fileCfg.RetryMaxInterval
+	}
+	if fileCfg.ReadyMaxAge != 0 {
+		cfg.ReadyMaxAge = fileCfg.ReadyMaxAge
+	}
+	cfg.CompressVRPs = fileCfg.CompressVRPs
+	cfg.AdminToken = fileCfg.AdminToken
+	cfg.GRPCTLS = fileCfg.GRPCTLS
+	cfg.GRPCAuth = fileCfg.GRPCAuth
+	cfg.OverridesFile = fileCfg.OverridesFile
+	cfg.RTRACL = fileCfg.RTRACL
+	cfg.GRPCACL = fileCfg.GRPCACL
+	cfg.RTRLimits = fileCfg.RTRLimits
+	cfg.Views = fileCfg.Views
+	cfg.Audit = fileCfg.Audit
+	cfg.Logging = fileCfg.Logging
+	cfg.Tracing = fileCfg.Tracing
 }
 
-func applyFlagOverrides(cfg *Config, setFlags map[string]bool, listen, grpcAddr, loglevel *string, refresh *uint, urls, aspaUrls urlList, testMode *bool) {
+func applyFlagOverrides(cfg *Config, setFlags map[string]bool, listen, grpcAddr, httpAddr, loglevel *string, refresh *uint, urls, aspaUrls urlList, testMode *bool) {
 	if setFlags["listen"] {
 		cfg.ListenAddr = *listen
 	}
 	if setFlags["grpc-listen"] {
 		cfg.GRPCAddr = *grpcAddr
 	}
+	if setFlags["http-listen"] {
+		cfg.HTTPAddr = *httpAddr
+	}
 	if setFlags["loglevel"] {
 		cfg.LogLevel = *loglevel
 	}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"flag"
+	"net/netip"
 	"os"
 	"testing"
 
@@ -15,6 +16,7 @@ func TestLoad(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Equal(t, ":8282", cfg.ListenAddr)
 		assert.Equal(t, ":50051", cfg.GRPCAddr)
+		assert.Empty(t, cfg.HTTPAddr)
 		assert.Equal(t, "info", cfg.LogLevel)
 		assert.Equal(t, RPKIURLs, cfg.RPKIURLs)
 	})
@@ -47,6 +49,7 @@ rpki_urls:
 	t.Run("FlagOverridesConfig", func(t *testing.T) {
 		content := `
 listen_addr: ":9000"
+http_addr: ":8080"
 log_level: "debug"
 `
 		tmpfile, err := os.CreateTemp("", "config*.yaml")
@@ -58,12 +61,445 @@ log_level: "debug"
 		tmpfile.Close()
 
 		fs := flag.NewFlagSet("test", flag.ContinueOnError)
-		cfg, err := LoadWithArgs(fs, []string{"-config", tmpfile.Name(), "-listen", ":9999", "-loglevel", "warn"})
+		cfg, err := LoadWithArgs(fs, []string{"-config", tmpfile.Name(), "-listen", ":9999", "-loglevel", "warn", "-http-listen", "127.0.0.1:8081"})
 		assert.NoError(t, err)
 		assert.Equal(t, ":9999", cfg.ListenAddr)
+		assert.Equal(t, "127.0.0.1:8081", cfg.HTTPAddr)
 		assert.Equal(t, "warn", cfg.LogLevel)
 	})
 
+	t.Run("UnifiedUpstreams", func(t *testing.T) {
+		content := `
+upstreams:
+  - url: "https://console.rpki-client.org/rpki.json"
+`
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		assert.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+
+		_, err = tmpfile.Write([]byte(content))
+		assert.NoError(t, err)
+		tmpfile.Close()
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg, err := LoadWithArgs(fs, []string{"-config", tmpfile.Name()})
+		assert.NoError(t, err)
+		assert.Equal(t, []Upstream{{URL: "https://console.rpki-client.org/rpki.json"}}, cfg.Upstreams)
+		// Default ROA URLs must not be added when a unified upstream is configured
+		assert.Empty(t, cfg.RPKIURLs)
+
+		fs = flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg, err = LoadWithArgs(fs, []string{"-config", tmpfile.Name(), "-upstream-url", "url1"})
+		assert.NoError(t, err)
+		assert.Equal(t, []Upstream{{URL: "url1"}}, cfg.Upstreams)
+	})
+
+	t.Run("UnknownUpstreamFormat", func(t *testing.T) {
+		content := `
+upstreams:
+  - url: "https://example.com/vrps.xml"
+    format: "xml"
+`
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		assert.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+
+		_, err = tmpfile.Write([]byte(content))
+		assert.NoError(t, err)
+		tmpfile.Close()
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		_, err = LoadWithArgs(fs, []string{"-config", tmpfile.Name()})
+		assert.Error(t, err)
+	})
+
+	t.Run("RTRUpstreams", func(t *testing.T) {
+		content := `
+upstreams:
+  - type: rtr
+    url: "rtr.example.net:8282"
+`
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		assert.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+
+		_, err = tmpfile.Write([]byte(content))
+		assert.NoError(t, err)
+		tmpfile.Close()
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg, err := LoadWithArgs(fs, []string{"-config", tmpfile.Name()})
+		assert.NoError(t, err)
+		assert.Equal(t, []Upstream{{Type: UpstreamTypeRTR, URL: "rtr.example.net:8282"}}, cfg.Upstreams)
+		assert.True(t, cfg.Upstreams[0].IsRTR())
+		assert.Empty(t, cfg.RPKIURLs)
+
+		fs = flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg, err = LoadWithArgs(fs, []string{"-upstream-url", "url1", "-rtr-upstream", "192.0.2.1:323"})
+		assert.NoError(t, err)
+		assert.Equal(t, []Upstream{{URL: "url1"}, {Type: UpstreamTypeRTR, URL: "192.0.2.1:323"}}, cfg.Upstreams)
+
+		fs = flag.NewFlagSet("test", flag.ContinueOnError)
+		_, err = LoadWithArgs(fs, []string{"-rtr-upstream", "no-port"})
+		assert.Error(t, err)
+	})
+
+	t.Run("VerifyKeyFormat", func(t *testing.T) {
+		assert.NoError(t, Upstream{URL: "u", Format: FormatGoRTR, VerifyKey: "cf.pub"}.validate())
+		assert.NoError(t, Upstream{URL: "u", VerifyKey: "cf.pub"}.validate())
+		assert.Error(t, Upstream{URL: "u", Format: FormatCSV, VerifyKey: "cf.pub"}.validate())
+		assert.Error(t, Upstream{Type: UpstreamTypeRTR, URL: "host:323", VerifyKey: "cf.pub"}.validate())
+	})
+
+	t.Run("HTTPClientOptions", func(t *testing.T) {
+		content := `
+upstreams:
+  - url: "https://validator.internal/rpki.json"
+    client_cert: "/etc/rpkirtr2/client.pem"
+    client_key: "/etc/rpkirtr2/client.key"
+    ca_file: "/etc/rpkirtr2/ca.pem"
+    tls_min_version: "1.3"
+    proxy: "http://proxy.example.net:3128"
+    headers:
+      Authorization: "Bearer s3cr3t"
+`
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		assert.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+
+		_, err = tmpfile.Write([]byte(content))
+		assert.NoError(t, err)
+		tmpfile.Close()
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg, err := LoadWithArgs(fs, []string{"-config", tmpfile.Name()})
+		assert.NoError(t, err)
+		u := cfg.Upstreams[0]
+		assert.True(t, u.HasClientOptions())
+		assert.Equal(t, "Bearer s3cr3t", u.Headers["Authorization"])
+		assert.Equal(t, "1.3", u.TLSMinVersion)
+		assert.Equal(t, "http://proxy.example.net:3128", u.Proxy)
+
+		assert.False(t, Upstream{URL: "u"}.HasClientOptions())
+		assert.Error(t, Upstream{URL: "u", ClientCert: "c.pem"}.validate())
+		assert.Error(t, Upstream{URL: "u", TLSMinVersion: "1.4"}.validate())
+		assert.Error(t, Upstream{URL: "u", Proxy: "proxy:3128"}.validate())
+		assert.Error(t, Upstream{Type: UpstreamTypeRTR, URL: "host:323", CAFile: "ca.pem"}.validate())
+	})
+
+	t.Run("GRPCSecurity", func(t *testing.T) {
+		content := `
+grpc_addr: "unix:///run/rpkirtr2/grpc.sock"
+grpc_tls:
+  cert_file: "/etc/rpkirtr2/grpc.pem"
+  key_file: "/etc/rpkirtr2/grpc.key"
+  client_ca_file: "/etc/rpkirtr2/clients.pem"
+grpc_auth:
+  anonymous_role: none
+  tokens:
+    - name: monitoring
+      token: "r3ad"
+      role: read
+  client_certs:
+    - name: noc.example.net
+      role: admin
+`
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		assert.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+
+		_, err = tmpfile.Write([]byte(content))
+		assert.NoError(t, err)
+		tmpfile.Close()
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg, err := LoadWithArgs(fs, []string{"-config", tmpfile.Name()})
+		assert.NoError(t, err)
+		assert.Equal(t, "unix:///run/rpkirtr2/grpc.sock", cfg.GRPCAddr)
+		assert.True(t, cfg.GRPCTLS.Enabled())
+		assert.Equal(t, "/etc/rpkirtr2/clients.pem", cfg.GRPCTLS.ClientCAFile)
+		assert.Equal(t, RoleNone, cfg.GRPCAuth.AnonymousRole)
+		assert.Equal(t, []GRPCToken{{Name: "monitoring", Token: "r3ad", Role: RoleRead}}, cfg.GRPCAuth.Tokens)
+		assert.Equal(t, []GRPCClientCert{{Name: "noc.example.net", Role: RoleAdmin}}, cfg.GRPCAuth.ClientCerts)
+
+		invalid := []Config{
+			{GRPCTLS: GRPCTLS{CertFile: "c.pem"}},
+			{GRPCTLS: GRPCTLS{ClientCAFile: "ca.pem"}},
+			{GRPCTLS: GRPCTLS{CertFile: "c.pem", KeyFile: "c.key", RequireClientCert: true}},
+			{GRPCAuth: GRPCAuth{AnonymousRole: "root"}},
+			{GRPCAuth: GRPCAuth{Tokens: []GRPCToken{{Name: "t", Role: RoleRead}}}},
+			{GRPCAuth: GRPCAuth{Tokens: []GRPCToken{{Name: "t", Token: "x", Role: RoleNone}}}},
+			{GRPCAuth: GRPCAuth{ClientCerts: []GRPCClientCert{{Name: "n", Role: RoleRead}}}},
+		}
+		for _, c := range invalid {
+			assert.Error(t, c.validateGRPC(), "%+v", c)
+		}
+	})
+
+	t.Run("Tracing", func(t *testing.T) {
+		content := `
+tracing:
+  exporter: otlp
+  endpoint: "localhost:4317"
+  insecure: true
+  sample_ratio: 0.25
+`
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		assert.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+
+		_, err = tmpfile.Write([]byte(content))
+		assert.NoError(t, err)
+		tmpfile.Close()
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg, err := LoadWithArgs(fs, []string{"-config", tmpfile.Name()})
+		assert.NoError(t, err)
+		assert.Equal(t, Tracing{Exporter: TracingOTLP, Endpoint: "localhost:4317", Insecure: true, SampleRatio: 0.25}, cfg.Tracing)
+
+		invalid := []Tracing{
+			{Exporter: "jaeger"},
+			{Exporter: TracingOTLP, SampleRatio: 1.5},
+			{Exporter: TracingStdout, Endpoint: "localhost:4317"},
+			{Insecure: true},
+		}
+		for _, tr := range invalid {
+			assert.Error(t, tr.validate(), "%+v", tr)
+		}
+	})
+
+	t.Run("Audit", func(t *testing.T) {
+		content := `
+audit:
+  dir: /var/lib/rpkirtr2/audit
+  max_age: 400
+`
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		assert.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+
+		_, err = tmpfile.Write([]byte(content))
+		assert.NoError(t, err)
+		tmpfile.Close()
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg, err := LoadWithArgs(fs, []string{"-config", tmpfile.Name()})
+		assert.NoError(t, err)
+		assert.Equal(t, Audit{Dir: "/var/lib/rpkirtr2/audit", MaxAge: 400}, cfg.Audit)
+	})
+
+	t.Run("ACLs", func(t *testing.T) {
+		content := `
+rtr_acl:
+  allow: [192.0.2.0/24, "2001:db8::/32"]
+  deny: [192.0.2.66]
+  error_report: true
+grpc_acl:
+  allow: [10.0.0.0/8]
+`
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		assert.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+
+		_, err = tmpfile.Write([]byte(content))
+		assert.NoError(t, err)
+		tmpfile.Close()
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg, err := LoadWithArgs(fs, []string{"-config", tmpfile.Name()})
+		assert.NoError(t, err)
+		assert.True(t, cfg.RTRACL.ErrorReport)
+		allow, deny, err := cfg.RTRACL.Prefixes()
+		assert.NoError(t, err)
+		assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("2001:db8::/32")}, allow)
+		assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("192.0.2.66/32")}, deny)
+		assert.Equal(t, []string{"10.0.0.0/8"}, cfg.GRPCACL.Allow)
+
+		invalid := []Config{
+			{RTRACL: ACL{Allow: []string{"192.0.2.0/33"}}},
+			{RTRACL: ACL{Deny: []string{"example.com"}}},
+			{GRPCACL: ACL{ErrorReport: true}},
+		}
+		for _, c := range invalid {
+			assert.Error(t, c.validateACLs(), "%+v", c)
+		}
+	})
+
+	t.Run("RTRLimits", func(t *testing.T) {
+		content := `
+rtr_limits:
+  max_connections: 1000
+  max_connections_per_ip: 4
+  queries_per_minute: 6
+  query_burst: 3
+  idle_timeout: 30
+`
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		assert.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+
+		_, err = tmpfile.Write([]byte(content))
+		assert.NoError(t, err)
+		tmpfile.Close()
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg, err := LoadWithArgs(fs, []string{"-config", tmpfile.Name()})
+		assert.NoError(t, err)
+		assert.Equal(t, RTRLimits{MaxConnections: 1000, MaxConnectionsPerIP: 4, QueriesPerMinute: 6, QueryBurst: 3, IdleTimeout: 30}, cfg.RTRLimits)
+
+		invalid := []RTRLimits{
+			{QueryBurst: 3},
+			{MaxConnections: 2, MaxConnectionsPerIP: 4},
+		}
+		for _, l := range invalid {
+			assert.Error(t, l.validate(), "%+v", l)
+		}
+	})
+
+	t.Run("Views", func(t *testing.T) {
+		content := `
+views:
+  - name: ipv4-only
+    clients: [192.0.2.0/24]
+    afi: ipv4
+  - name: lab
+    clients: ["2001:db8:1::1", 198.51.100.7]
+    prefixes: [10.0.0.0/8]
+    asns: [64496, 64497]
+    exclude_aspa: true
+`
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		assert.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+
+		_, err = tmpfile.Write([]byte(content))
+		assert.NoError(t, err)
+		tmpfile.Close()
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg, err := LoadWithArgs(fs, []string{"-config", tmpfile.Name()})
+		assert.NoError(t, err)
+		assert.Equal(t, []View{
+			{Name: "ipv4-only", Clients: []string{"192.0.2.0/24"}, AFI: AFIIPv4},
+			{Name: "lab", Clients: []string{"2001:db8:1::1", "198.51.100.7"}, Prefixes: []string{"10.0.0.0/8"}, ASNs: []uint32{64496, 64497}, ExcludeASPA: true},
+		}, cfg.Views)
+		clients, prefixes, err := cfg.Views[1].ParsePrefixes()
+		assert.NoError(t, err)
+		assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("2001:db8:1::1/128"), netip.MustParsePrefix("198.51.100.7/32")}, clients)
+		assert.Equal(t, []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}, prefixes)
+
+		invalid := [][]View{
+			{{Clients: []string{"192.0.2.0/24"}}},
+			{{Name: "a", Clients: []string{"192.0.2.0/24"}}, {Name: "a", Clients: []string{"198.51.100.0/24"}}},
+			{{Name: "a"}},
+			{{Name: "a", Clients: []string{"192.0.2.0/24"}, AFI: "ipx"}},
+			{{Name: "a", Clients: []string{"192.0.2.0/24"}, Prefixes: []string{"10/8"}}},
+		}
+		for _, views := range invalid {
+			assert.Error(t, (&Config{Views: views}).validateViews(), "%+v", views)
+		}
+	})
+
+	t.Run("Logging", func(t *testing.T) {
+		content := `
+logging:
+  encoding: json
+  outputs: [stdout, /var/log/rpkirtr2/rpkirtr2.log, journald]
+  rotation:
+    max_size: 50
+    max_age: 14
+    compress: true
+  sampling:
+    initial: 10
+    thereafter: 100
+`
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		assert.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+
+		_, err = tmpfile.Write([]byte(content))
+		assert.NoError(t, err)
+		tmpfile.Close()
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg, err := LoadWithArgs(fs, []string{"-config", tmpfile.Name()})
+		assert.NoError(t, err)
+		assert.Equal(t, Logging{
+			Encoding: LogEncodingJSON,
+			Outputs:  []string{LogOutputStdout, "/var/log/rpkirtr2/rpkirtr2.log", LogOutputJournald},
+			Rotation: LogRotation{MaxSize: 50, MaxAge: 14, Compress: true},
+			Sampling: LogSampling{Initial: 10, Thereafter: 100},
+		}, cfg.Logging)
+
+		invalid := []Logging{
+			{Encoding: "logfmt"},
+			{Outputs: []string{""}},
+			{Rotation: LogRotation{MaxSize: -1}},
+			{Sampling: LogSampling{Initial: -1}},
+		}
+		for _, l := range invalid {
+			assert.Error(t, l.validate(), "%+v", l)
+		}
+	})
+
+	t.Run("FetchRetrySettings", func(t *testing.T) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg, err := LoadWithArgs(fs, []string{})
+		assert.NoError(t, err)
+		assert.Equal(t, DefaultFetchTimeout, cfg.FetchTimeout)
+		assert.Equal(t, DefaultRetryMinInterval, cfg.RetryMinInterval)
+		assert.Equal(t, DefaultRetryMaxInterval, cfg.RetryMaxInterval)
+		assert.Zero(t, cfg.ReadyMaxAge)
+
+		content := `
+fetch_timeout: 10
+retry_min_interval: 5
+retry_max_interval: 4
+`
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		assert.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+
+		_, err = tmpfile.Write([]byte(content))
+		assert.NoError(t, err)
+		tmpfile.Close()
+
+		fs = flag.NewFlagSet("test", flag.ContinueOnError)
+		_, err = LoadWithArgs(fs, []string{"-config", tmpfile.Name()})
+		assert.Error(t, err, "max interval below min interval must be rejected")
+
+		assert.NoError(t, os.WriteFile(tmpfile.Name(), []byte("ready_max_age: 1800\n"), 0o600))
+		fs = flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg, err = LoadWithArgs(fs, []string{"-config", tmpfile.Name()})
+		assert.NoError(t, err)
+		assert.Equal(t, uint32(1800), cfg.ReadyMaxAge)
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		tmpfile, err := os.CreateTemp("", "config*.yaml")
+		assert.NoError(t, err)
+		defer os.Remove(tmpfile.Name())
+		assert.NoError(t, os.WriteFile(tmpfile.Name(), []byte("log_level: info\nadmin_token: s3cr3t\noverrides_file: /var/lib/rpkirtr2/overrides.json\n"), 0o600))
+
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg, err := LoadWithArgs(fs, []string{"-config", tmpfile.Name(), "-refresh", "120"})
+		assert.NoError(t, err)
+		assert.Equal(t, "s3cr3t", cfg.AdminToken)
+		assert.Equal(t, "/var/lib/rpkirtr2/overrides.json", cfg.OverridesFile)
+
+		assert.NoError(t, os.WriteFile(tmpfile.Name(), []byte("log_level: debug\nrefresh_interval: 300\n"), 0o600))
+		reloaded, err := cfg.Reload()
+		assert.NoError(t, err)
+		assert.Equal(t, "debug", reloaded.LogLevel)
+		assert.Equal(t, uint32(120), reloaded.RefreshInterval, "flags still override the file")
+		assert.Empty(t, reloaded.AdminToken)
+		assert.Equal(t, "info", cfg.LogLevel, "the original config is not modified")
+
+		assert.NoError(t, os.WriteFile(tmpfile.Name(), []byte("retry_min_interval: 10\nretry_max_interval: 5\n"), 0o600))
+		_, err = cfg.Reload()
+		assert.Error(t, err)
+	})
+
 	t.Run("MultipleURLsFlag", func(t *testing.T) {
 		fs := flag.NewFlagSet("test", flag.ContinueOnError)
 		cfg, err := LoadWithArgs(fs, []string{"-rpki-url", "url1", "-rpki-url", "url2"})
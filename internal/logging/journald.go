@@ -0,0 +1,102 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-systemd/v22/journal"
+	"go.uber.org/zap/zapcore"
+)
+
+// journaldCore sends each entry to the systemd journal, keeping the
+// structured fields as journal fields so that they can be filtered with
+// journalctl, e.g. journalctl CLIENT=192.0.2.1:41234.
+type journaldCore struct {
+	zapcore.LevelEnabler
+	fields []zapcore.Field
+}
+
+func newJournaldCore(level zapcore.LevelEnabler) (zapcore.Core, func() error, error) {
+	if !journal.Enabled() {
+		return nil, nil, errors.New("systemd journal is not available")
+	}
+	return &journaldCore{LevelEnabler: level}, nil, nil
+}
+
+func (c *journaldCore) With(fields []zapcore.Field) zapcore.Core {
+	return &journaldCore{
+		LevelEnabler: c.LevelEnabler,
+		fields:       append(c.fields[:len(c.fields):len(c.fields)], fields...),
+	}
+}
+
+func (c *journaldCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *journaldCore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range c.fields {
+		f.AddTo(enc)
+	}
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+
+	vars := make(map[string]string, len(enc.Fields)+3)
+	for k, v := range enc.Fields {
+		vars[journalField(k)] = fmt.Sprint(v)
+	}
+	vars["SYSLOG_IDENTIFIER"] = "rpkirtr2"
+	if ent.Caller.Defined {
+		vars["CODE_FILE"] = ent.Caller.File
+		vars["CODE_LINE"] = fmt.Sprint(ent.Caller.Line)
+	}
+	if ent.Stack != "" {
+		vars["STACKTRACE"] = ent.Stack
+	}
+	return journal.Send(ent.Message, journalPriority(ent.Level), vars)
+}
+
+func (c *journaldCore) Sync() error {
+	return nil
+}
+
+// journalField converts a log field key to a valid journal field name, which
+// is made of upper case letters, digits and underscores and may not start
+// with an underscore.
+func journalField(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key)
+	if name == "" || name[0] == '_' || name[0] >= '0' && name[0] <= '9' {
+		name = "F" + name
+	}
+	return name
+}
+
+func journalPriority(level zapcore.Level) journal.Priority {
+	switch level {
+	case zapcore.DebugLevel:
+		return journal.PriDebug
+	case zapcore.InfoLevel:
+		return journal.PriInfo
+	case zapcore.WarnLevel:
+		return journal.PriWarning
+	case zapcore.ErrorLevel:
+		return journal.PriErr
+	default:
+		return journal.PriCrit
+	}
+}
@@ -1,52 +1,165 @@
 package logging
 
 import (
+	"errors"
+	"fmt"
+	"os"
 	"strings"
+	"time"
 
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 // New returns a configured zap.Logger based on log level string.
 // Use "debug", "info", "warn", "error" (case-insensitive).
 func New(level string) *zap.SugaredLogger {
-	var zapLevel zapcore.Level
+	logger, _ := NewWithLevel(level)
+	return logger
+}
+
+// NewWithLevel is like New but also returns the logger's level, which can be
+// changed at runtime. It logs to stdout in the console encoding.
+func NewWithLevel(level string) (*zap.SugaredLogger, zap.AtomicLevel) {
+	logger, atomicLevel, _, err := Build(level, config.Logging{})
+	if err != nil {
+		panic("cannot initialize logger: " + err.Error())
+	}
+	return logger, atomicLevel
+}
+
+// Build returns a logger writing to every output in cfg, its level, which can
+// be changed at runtime, and a function that flushes and closes the outputs.
+func Build(level string, cfg config.Logging) (*zap.SugaredLogger, zap.AtomicLevel, func() error, error) {
+	zapLevel, _ := ParseLevel(level)
+	atomicLevel := zap.NewAtomicLevelAt(zapLevel)
+
+	outputs := cfg.Outputs
+	if len(outputs) == 0 {
+		outputs = []string{config.LogOutputStdout}
+	}
+
+	var cores []zapcore.Core
+	var closers []func() error
+	closeAll := func() error {
+		var errs []error
+		for _, c := range closers {
+			errs = append(errs, c())
+		}
+		return errors.Join(errs...)
+	}
+	for _, out := range outputs {
+		core, closer, err := newCore(out, cfg, atomicLevel)
+		if err != nil {
+			_ = closeAll()
+			return nil, atomicLevel, nil, fmt.Errorf("log output %s: %w", out, err)
+		}
+		cores = append(cores, core)
+		if closer != nil {
+			closers = append(closers, closer)
+		}
+	}
+
+	logger := zap.New(zapcore.NewTee(cores...), zap.AddCaller(), zap.AddStacktrace(zap.ErrorLevel), zap.ErrorOutput(zapcore.Lock(os.Stderr)))
+	sync := func() error {
+		// Syncing a terminal fails on some platforms, which is not worth reporting
+		_ = logger.Sync()
+		return closeAll()
+	}
+	return logger.Sugar(), atomicLevel, sync, nil
+}
+
+// Sampled returns logger with the sampling in s, for messages repeated per
+// client such as query logs. Other messages are never sampled, so that
+// repeated errors are not hidden. Loggers derived from the result share its
+// counts.
+func Sampled(logger *zap.SugaredLogger, s config.LogSampling) *zap.SugaredLogger {
+	if s.Initial <= 0 {
+		return logger
+	}
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewSamplerWithOptions(core, time.Second, s.Initial, s.Thereafter)
+	}))
+}
+
+// newCore returns the core writing to out and, for outputs that hold
+// resources, a function releasing them.
+func newCore(out string, cfg config.Logging, level zap.AtomicLevel) (zapcore.Core, func() error, error) {
+	switch out {
+	case config.LogOutputStdout:
+		return zapcore.NewCore(newEncoder(cfg.Encoding, isTerminal(os.Stdout), true), zapcore.Lock(os.Stdout), level), nil, nil
+	case config.LogOutputStderr:
+		return zapcore.NewCore(newEncoder(cfg.Encoding, isTerminal(os.Stderr), true), zapcore.Lock(os.Stderr), level), nil, nil
+	case config.LogOutputSyslog:
+		// syslog adds its own timestamp
+		return newSyslogCore(newEncoder(cfg.Encoding, false, false), level)
+	case config.LogOutputJournald:
+		return newJournaldCore(level)
+	}
+
+	r := cfg.Rotation
+	file := &lumberjack.Logger{
+		Filename:   out,
+		MaxSize:    r.MaxSize,
+		MaxAge:     r.MaxAge,
+		MaxBackups: r.MaxBackups,
+		Compress:   r.Compress,
+	}
+	return zapcore.NewCore(newEncoder(cfg.Encoding, false, true), zapcore.AddSync(file), level), file.Close, nil
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe or file.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// newEncoder returns an encoder for encoding. Levels are colored only in the
+// console encoding, and only when color is set for a terminal stream.
+func newEncoder(encoding string, color, timestamps bool) zapcore.Encoder {
+	encCfg := zapcore.EncoderConfig{
+		TimeKey:        "ts",
+		LevelKey:       "level",
+		NameKey:        "logger",
+		CallerKey:      "caller",
+		MessageKey:     "msg",
+		StacktraceKey:  "stacktrace",
+		LineEnding:     zapcore.DefaultLineEnding,
+		EncodeLevel:    zapcore.CapitalLevelEncoder,
+		EncodeTime:     zapcore.ISO8601TimeEncoder,
+		EncodeDuration: zapcore.StringDurationEncoder,
+		EncodeCaller:   zapcore.ShortCallerEncoder,
+	}
+	if !timestamps {
+		encCfg.TimeKey = zapcore.OmitKey
+	}
+	if encoding == config.LogEncodingJSON {
+		encCfg.EncodeLevel = zapcore.LowercaseLevelEncoder
+		encCfg.EncodeTime = zapcore.RFC3339NanoTimeEncoder
+		encCfg.EncodeDuration = zapcore.SecondsDurationEncoder
+		return zapcore.NewJSONEncoder(encCfg)
+	}
+	if color {
+		encCfg.EncodeLevel = zapcore.CapitalColorLevelEncoder
+	}
+	return zapcore.NewConsoleEncoder(encCfg)
+}
+
+// ParseLevel converts a log level string to a zap level. Unknown levels
+// return info and false.
+func ParseLevel(level string) (zapcore.Level, bool) {
 	switch strings.ToLower(level) {
 	case "debug":
-		zapLevel = zap.DebugLevel
+		return zap.DebugLevel, true
+	case "info":
+		return zap.InfoLevel, true
 	case "warn":
-		zapLevel = zap.WarnLevel
+		return zap.WarnLevel, true
 	case "error":
-		zapLevel = zap.ErrorLevel
+		return zap.ErrorLevel, true
 	default:
-		zapLevel = zap.InfoLevel
-	}
-
-	config := zap.Config{
-		Level:            zap.NewAtomicLevelAt(zapLevel),
-		Development:      false,
-		Encoding:         "console", // Use "json" in production if desired
-		OutputPaths:      []string{"stdout"},
-		ErrorOutputPaths: []string{"stderr"},
-		EncoderConfig: zapcore.EncoderConfig{
-			TimeKey:        "ts",
-			LevelKey:       "level",
-			NameKey:        "logger",
-			CallerKey:      "caller",
-			MessageKey:     "msg",
-			StacktraceKey:  "stacktrace",
-			LineEnding:     zapcore.DefaultLineEnding,
-			EncodeLevel:    zapcore.CapitalColorLevelEncoder,
-			EncodeTime:     zapcore.ISO8601TimeEncoder,
-			EncodeDuration: zapcore.StringDurationEncoder,
-			EncodeCaller:   zapcore.ShortCallerEncoder,
-		},
-	}
-
-	logger, err := config.Build()
-	if err != nil {
-		panic("cannot initialize logger: " + err.Error())
+		return zap.InfoLevel, false
 	}
-
-	return logger.Sugar()
 }
@@ -0,0 +1,57 @@
+package logging
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildJSONFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rpkirtr2.log")
+	logger, level, sync, err := Build("info", config.Logging{
+		Encoding: config.LogEncodingJSON,
+		Outputs:  []string{path},
+	})
+	require.NoError(t, err)
+
+	client := Sampled(logger, config.LogSampling{Initial: 2}).With("client", "192.0.2.1:41234")
+	for range 5 {
+		client.Infow("Received Serial Query PDU", "version", 2, "serial", 42)
+	}
+	for range 3 {
+		logger.Errorw("Failed to fetch upstream", "upstream", "https://rpki.example.net/rpki.json")
+	}
+	logger.Debug("hidden")
+	level.SetLevel(-1)
+	logger.Debug("shown")
+	require.NoError(t, sync())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 6, "client messages keep the first 2 repeats, others are not sampled and the level hides debug")
+
+	var entry map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, "info", entry["level"])
+	assert.Equal(t, "Received Serial Query PDU", entry["msg"])
+	assert.Equal(t, "192.0.2.1:41234", entry["client"])
+	assert.EqualValues(t, 2, entry["version"])
+	assert.EqualValues(t, 42, entry["serial"])
+	assert.NotContains(t, string(data), "\x1b[", "files are never colored")
+	assert.Contains(t, lines[5], `"msg":"shown"`)
+}
+
+func TestJournalField(t *testing.T) {
+	assert.Equal(t, "CLIENT", journalField("client"))
+	assert.Equal(t, "ROAS_ADDED", journalField("roas_added"))
+	assert.Equal(t, "PDU_VERSION", journalField("pdu-version"))
+	assert.Equal(t, "F_ID", journalField("_id"))
+	assert.Equal(t, "F1", journalField("1"))
+}
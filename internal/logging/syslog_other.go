@@ -0,0 +1,13 @@
+//go:build windows || plan9
+
+package logging
+
+import (
+	"errors"
+
+	"go.uber.org/zap/zapcore"
+)
+
+func newSyslogCore(zapcore.Encoder, zapcore.LevelEnabler) (zapcore.Core, func() error, error) {
+	return nil, nil, errors.New("syslog is not supported on this platform")
+}
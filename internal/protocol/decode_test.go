@@ -105,6 +105,24 @@ func TestSerialQueryRoundTrip(t *testing.T) {
 	require.Equal(t, orig, got)
 }
 
+func TestWriteRouterKeyRoundTrip(t *testing.T) {
+	ski := [20]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}
+	spki := []byte{0x30, 0x59, 0x30, 0x13}
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteRouterKey(&buf, 1, Announce, ski, 64496, spki))
+	require.Equal(t, 32+len(spki), buf.Len())
+
+	got, err := GetPDU(&buf)
+	require.NoError(t, err)
+	rk, ok := got.(*RouterKeyPDU)
+	require.True(t, ok)
+	require.Equal(t, Announce, rk.Flags())
+	require.Equal(t, ski, rk.SKI())
+	require.Equal(t, uint32(64496), rk.ASN())
+	require.Equal(t, spki, rk.SubjectPublicKeyInfo())
+}
+
 func TestSerialQuerySession(t *testing.T) {
 	session := uint16(1234)
 	pdu := NewSerialQueryPDU(1, session, 42)
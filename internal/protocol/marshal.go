@@ -266,3 +266,16 @@ func WriteAspa(w io.Writer, ver Version, flags uint8, casn uint32, pasns []uint3
 	}
 	return writeFull(w, buf)
 }
+
+// WriteRouterKey writes a Router Key PDU directly to the writer.
+func WriteRouterKey(w io.Writer, ver Version, flags uint8, ski [20]byte, asn uint32, spki []byte) error {
+	buf := make([]byte, 32+len(spki))
+	buf[0] = byte(ver)
+	buf[1] = byte(RouterKey)
+	buf[2] = flags
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(buf)))
+	copy(buf[8:28], ski[:])
+	binary.BigEndian.PutUint32(buf[28:], asn)
+	copy(buf[32:], spki)
+	return writeFull(w, buf)
+}
@@ -57,6 +57,10 @@ func (s *SerialNotifyPDU) Version() Version {
 	return s.version
 }
 
+func (s *SerialNotifyPDU) Session() uint16 {
+	return s.session
+}
+
 type SerialQueryPDU struct {
 	/*
 		0          8          16         24        31
@@ -179,6 +183,10 @@ func NewCacheResponsePDU(ver Version, session uint16) *CacheResponsePDU {
 	}
 }
 
+func (c *CacheResponsePDU) Session() uint16 {
+	return c.session
+}
+
 type Ipv4PrefixPDU struct {
 	/*
 		0          8          16         24        31
@@ -239,6 +247,26 @@ func (i *Ipv4PrefixPDU) Version() Version {
 	return i.version
 }
 
+func (i *Ipv4PrefixPDU) Flags() uint8 {
+	return i.flags
+}
+
+func (i *Ipv4PrefixPDU) PrefixLength() uint8 {
+	return i.min
+}
+
+func (i *Ipv4PrefixPDU) MaxLength() uint8 {
+	return i.max
+}
+
+func (i *Ipv4PrefixPDU) Prefix() [4]byte {
+	return i.prefix
+}
+
+func (i *Ipv4PrefixPDU) ASN() uint32 {
+	return i.asn
+}
+
 type Ipv6PrefixPDU struct {
 	/*
 		0          8          16         24        31
@@ -303,6 +331,26 @@ func (i *Ipv6PrefixPDU) Version() Version {
 	return i.version
 }
 
+func (i *Ipv6PrefixPDU) Flags() uint8 {
+	return i.flags
+}
+
+func (i *Ipv6PrefixPDU) PrefixLength() uint8 {
+	return i.min
+}
+
+func (i *Ipv6PrefixPDU) MaxLength() uint8 {
+	return i.max
+}
+
+func (i *Ipv6PrefixPDU) Prefix() [16]byte {
+	return i.prefix
+}
+
+func (i *Ipv6PrefixPDU) ASN() uint32 {
+	return i.asn
+}
+
 type EndOfDataPDU struct {
 	/*
 		0          8          16         24        31
@@ -363,6 +411,26 @@ func (e *EndOfDataPDU) Version() Version {
 	return e.version
 }
 
+func (e *EndOfDataPDU) Session() uint16 {
+	return e.session
+}
+
+func (e *EndOfDataPDU) Serial() uint32 {
+	return e.serial
+}
+
+func (e *EndOfDataPDU) Refresh() uint32 {
+	return e.refresh
+}
+
+func (e *EndOfDataPDU) Retry() uint32 {
+	return e.retry
+}
+
+func (e *EndOfDataPDU) Expire() uint32 {
+	return e.expire
+}
+
 type cacheResetPDU struct {
 	/*
 		0          8          16         24        31
@@ -461,6 +529,23 @@ func (r *RouterKeyPDU) Version() Version {
 	return r.version
 }
 
+// Flags returns the announce/withdraw flags, carried in the high byte of the session field.
+func (r *RouterKeyPDU) Flags() uint8 {
+	return uint8(r.session >> 8)
+}
+
+func (r *RouterKeyPDU) SKI() [20]byte {
+	return r.ski
+}
+
+func (r *RouterKeyPDU) ASN() uint32 {
+	return r.asn
+}
+
+func (r *RouterKeyPDU) SubjectPublicKeyInfo() []byte {
+	return r.skiInfo
+}
+
 type ErrorReportPDU struct {
 	/*
 		0          8          16         24        31
@@ -532,6 +617,10 @@ func (e *ErrorReportPDU) Code() ErrorCode {
 	return e.code
 }
 
+func (e *ErrorReportPDU) Text() string {
+	return string(e.text)
+}
+
 type AspaPDU struct {
 	/*
 	   0          8          16         24        31
@@ -581,3 +670,15 @@ func (a *AspaPDU) Type() PDUType {
 func (a *AspaPDU) Version() Version {
 	return a.version
 }
+
+func (a *AspaPDU) Flags() uint8 {
+	return a.flags
+}
+
+func (a *AspaPDU) CustomerASN() uint32 {
+	return a.casn
+}
+
+func (a *AspaPDU) ProviderASNs() []uint32 {
+	return a.pasn
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"github.com/mellowdrifter/rpkirtr2/internal/protocol"
+)
+
+// Listener names used in logs and metrics.
+const (
+	listenerRTR  = "rtr"
+	listenerGRPC = "grpc"
+	listenerHTTP = "http"
+)
+
+// Reasons a connection is refused on accept, used in logs and metrics.
+const (
+	refusedACL        = "acl"
+	refusedMaxConns   = "max_connections"
+	refusedMaxConnsIP = "max_connections_per_ip"
+)
+
+// acl is the parsed form of a config.ACL.
+type acl struct {
+	allow, deny []netip.Prefix
+	errorReport bool
+}
+
+// newACL parses an access list that has already been validated.
+func newACL(c config.ACL) *acl {
+	allow, deny, _ := c.Prefixes()
+	return &acl{allow: allow, deny: deny, errorReport: c.ErrorReport}
+}
+
+// permits reports whether a connection from addr is allowed. Addresses that
+// are not IP, such as those of Unix socket peers, are always allowed.
+func (a *acl) permits(addr net.Addr) bool {
+	ip, ok := sourceIP(addr)
+	if !ok {
+		return true
+	}
+	for _, p := range a.deny {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, p := range a.allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// acls returns the access lists of the RTR and the gRPC and HTTP listeners.
+func (s *Server) acls() (rtr, grpc *acl) {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.rtrACL, s.grpcACL
+}
+
+// admit checks a new connection against the access list of its listener
+// and, for RTR, the connection limits. Refused connections are counted and
+// closed. An admitted RTR connection must be given back with releaseConn.
+func (s *Server) admit(conn net.Conn, listener string) bool {
+	rtr, grpc := s.acls()
+	a := grpc
+	if listener == listenerRTR {
+		a = rtr
+	}
+	if !a.permits(conn.RemoteAddr()) {
+		s.refuse(conn, listener, refusedACL, a.errorReport, protocol.InvalidRequest, "connection refused by access list")
+		return false
+	}
+	if listener != listenerRTR {
+		return true
+	}
+	if reason := s.reserveConn(conn.RemoteAddr()); reason != "" {
+		// Routers retry after their retry interval, so tell them why
+		s.refuse(conn, listener, reason, true, protocol.InternalError, "too many connections")
+		return false
+	}
+	return true
+}
+
+// refuse closes a connection refused on accept. RTR connections are sent an
+// Error Report first if errorReport is set.
+func (s *Server) refuse(conn net.Conn, listener, reason string, errorReport bool, code protocol.ErrorCode, msg string) {
+	s.logger.Warnw("Connection refused", "listener", listener, "reason", reason, "client", conn.RemoteAddr().String())
+	connectionsRefused.WithLabelValues(listener, reason).Inc()
+	if listener == listenerRTR && errorReport {
+		// The router has not sent anything yet, so there is no PDU to quote
+		// and its version is unknown.
+		errorReportsSent.WithLabelValues(errorCodeNames[code]).Inc()
+		_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_ = protocol.NewErrorReportPDU(2, code, nil, msg).Write(conn)
+	}
+	conn.Close()
+}
+
+// aclListener drops connections refused by the access list of its listener
+// before they are handed to the gRPC server or HTTP gateway.
+type aclListener struct {
+	net.Listener
+	s    *Server
+	name string
+}
+
+func (l aclListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || l.s.admit(conn, l.name) {
+			return conn, err
+		}
+	}
+}
+
+// sourceIP returns the IP address of a connection's peer. Unix socket peers
+// have none.
+func sourceIP(addr net.Addr) (netip.Addr, bool) {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
+}
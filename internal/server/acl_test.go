@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"github.com/mellowdrifter/rpkirtr2/internal/protocol"
+	"go.uber.org/zap"
+)
+
+func TestACLPermits(t *testing.T) {
+	a := newACL(config.ACL{
+		Allow: []string{"192.0.2.0/24", "2001:db8::/32"},
+		Deny:  []string{"192.0.2.66"},
+	})
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.66"), Port: 40000}, false},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.66"), Port: 40000}, false},
+		{&net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 40000}, false},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}, true},
+		{&net.UnixAddr{Name: "/run/rpkirtr2/grpc.sock", Net: "unix"}, true},
+	}
+	for _, tt := range tests {
+		if got := a.permits(tt.addr); got != tt.want {
+			t.Errorf("permits(%v) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	open := newACL(config.ACL{Deny: []string{"10.0.0.0/8"}})
+	if !open.permits(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}) {
+		t.Error("an empty allow list should admit addresses that are not denied")
+	}
+}
+
+func TestRTRACLRefusesConnections(t *testing.T) {
+	cfg := &config.Config{RTRACL: config.ACL{Deny: []string{"127.0.0.0/8"}, ErrorReport: true}}
+	srv := New(cfg, zap.NewNop().Sugar())
+	addr := startTestServer(t, srv)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	r := bufio.NewReader(conn)
+	pdu, err := protocol.GetPDU(r)
+	if err != nil {
+		t.Fatalf("failed to read Error Report: %v", err)
+	}
+	report, ok := pdu.(*protocol.ErrorReportPDU)
+	if !ok || report.Code() != protocol.InvalidRequest {
+		t.Fatalf("expected an Invalid Request Error Report, got %v", pdu.Type())
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+
+	srv.clientsMu.RLock()
+	clients := len(srv.clients)
+	srv.clientsMu.RUnlock()
+	if clients != 0 {
+		t.Errorf("refused connection became a client")
+	}
+}
+
+func TestGRPCACLListener(t *testing.T) {
+	srv := New(&config.Config{GRPCACL: config.ACL{Allow: []string{"192.0.2.0/24"}}}, zap.NewNop().Sugar())
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	l := aclListener{Listener: inner, s: srv, name: listenerGRPC}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	refused, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer refused.Close()
+	_ = refused.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := refused.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected the refused connection to be closed")
+	}
+
+	// A reloaded access list applies to the next connection
+	srv.cfgMu.Lock()
+	srv.grpcACL = newACL(config.ACL{Allow: []string{"127.0.0.1"}})
+	srv.cfgMu.Unlock()
+
+	allowed, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer allowed.Close()
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		if conn.RemoteAddr().String() != allowed.LocalAddr().String() {
+			t.Errorf("accepted %v, want %v", conn.RemoteAddr(), allowed.LocalAddr())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("allowed connection was not accepted")
+	}
+}
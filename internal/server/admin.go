@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"time"
+
+	rpkirtripb "github.com/mellowdrifter/rpkirtr2/api/v1"
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"github.com/mellowdrifter/rpkirtr2/internal/logging"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type adminServer struct {
+	rpkirtripb.UnimplementedRPKIRTRAdminServiceServer
+	srv *Server
+}
+
+// Refresh fetches from the upstreams now rather than waiting for the next
+// cycle. An HTTP refresh applies even while updates are paused, together with
+// the RTR upstream data held back so far. What RTR upstreams send in answer
+// is held back like any other change, so naming one fails while paused.
+func (a *adminServer) Refresh(ctx context.Context, req *rpkirtripb.RefreshRequest) (*rpkirtripb.RefreshResponse, error) {
+	name := req.GetUpstream()
+	if name != "" {
+		for _, u := range a.srv.rtrUpstreams {
+			if u.addr == name {
+				if a.srv.UpdatesPaused() {
+					return nil, status.Errorf(codes.FailedPrecondition, "updates are paused, so changes from %s would be held back", name)
+				}
+				u.refreshNow()
+				return &rpkirtripb.RefreshResponse{Serial: a.srv.CacheSerial()}, nil
+			}
+		}
+		if !a.srv.isHTTPSource(name) {
+			return nil, status.Errorf(codes.NotFound, "unknown upstream %q", name)
+		}
+	}
+
+	a.srv.logger.Infow("Refresh requested over gRPC", "upstream", name)
+	var err error
+	if name == "" {
+		err = a.srv.TriggerRefresh(ctx)
+		for _, u := range a.srv.rtrUpstreams {
+			u.refreshNow()
+		}
+	} else {
+		// The other HTTP upstreams contribute their last good data
+		err = a.srv.refreshSources(ctx, func(url string) bool { return url == name })
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "refresh failed: %v", err)
+	}
+
+	resp := &rpkirtripb.RefreshResponse{Serial: a.srv.CacheSerial()}
+	if name != "" {
+		a.srv.upstreamsMu.RLock()
+		if stats, ok := a.srv.upstreams[name]; ok {
+			resp.Upstream = toUpstreamStatus(name, stats)
+		}
+		a.srv.upstreamsMu.RUnlock()
+	}
+	return resp, nil
+}
+
+func (s *Server) isHTTPSource(name string) bool {
+	urls, aspaURLs, upstreams := s.httpSources()
+	if slices.Contains(urls, name) || slices.Contains(aspaURLs, name) {
+		return true
+	}
+	return slices.ContainsFunc(upstreams, func(u config.Upstream) bool { return u.URL == name })
+}
+
+func (a *adminServer) ReloadConfig(ctx context.Context, req *rpkirtripb.ReloadConfigRequest) (*rpkirtripb.ReloadConfigResponse, error) {
+	applied, restart, err := a.srv.Reload()
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &rpkirtripb.ReloadConfigResponse{
+		Applied:         applied,
+		RequiresRestart: restart,
+	}, nil
+}
+
+// SetLogLevel changes the log level until the next reload or restart.
+func (a *adminServer) SetLogLevel(ctx context.Context, req *rpkirtripb.SetLogLevelRequest) (*rpkirtripb.SetLogLevelResponse, error) {
+	level, ok := logging.ParseLevel(req.GetLevel())
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown log level %q", req.GetLevel())
+	}
+	if a.srv.logLevel == nil {
+		return nil, status.Error(codes.FailedPrecondition, "log level cannot be changed at runtime")
+	}
+	prev := a.srv.logLevel.Level()
+	a.srv.logLevel.SetLevel(level)
+	a.srv.logger.Infow("Log level changed", "from", prev, "to", level)
+	return &rpkirtripb.SetLogLevelResponse{PreviousLevel: prev.String()}, nil
+}
+
+func (a *adminServer) PauseUpdates(ctx context.Context, req *rpkirtripb.PauseUpdatesRequest) (*rpkirtripb.PauseUpdatesResponse, error) {
+	a.srv.PauseUpdates()
+	return &rpkirtripb.PauseUpdatesResponse{Paused: a.srv.UpdatesPaused()}, nil
+}
+
+func (a *adminServer) ResumeUpdates(ctx context.Context, req *rpkirtripb.ResumeUpdatesRequest) (*rpkirtripb.ResumeUpdatesResponse, error) {
+	a.srv.ResumeUpdates()
+	return &rpkirtripb.ResumeUpdatesResponse{Paused: a.srv.UpdatesPaused()}, nil
+}
+
+// expiry converts the expires field of a new override. Zero never expires.
+func expiry(ts int64, now time.Time) (time.Time, error) {
+	if ts == 0 {
+		return time.Time{}, nil
+	}
+	t := time.Unix(ts, 0)
+	if !t.After(now) {
+		return time.Time{}, status.Errorf(codes.InvalidArgument, "expires %d is in the past", ts)
+	}
+	return t, nil
+}
+
+func parseOverridePrefix(s string) (netip.Prefix, error) {
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, status.Errorf(codes.InvalidArgument, "invalid prefix %q: %v", s, err)
+	}
+	if p != p.Masked() {
+		return netip.Prefix{}, status.Errorf(codes.InvalidArgument, "prefix %s has host bits set", s)
+	}
+	return p, nil
+}
+
+// overrideError maps errors from changing the overrides to gRPC status codes.
+func overrideError(err error) error {
+	switch {
+	case errors.Is(err, errOverrideNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case status.Code(err) != codes.Unknown:
+		return err
+	default:
+		return status.Errorf(codes.Internal, "failed to save overrides: %v", err)
+	}
+}
+
+// AddPrefixFilter drops matching VRPs from the data served to routers.
+func (a *adminServer) AddPrefixFilter(ctx context.Context, req *rpkirtripb.AddPrefixFilterRequest) (*rpkirtripb.AddPrefixFilterResponse, error) {
+	pb := req.GetFilter()
+	now := time.Now()
+	f := prefixFilter{
+		ID:      newOverrideID(),
+		ASN:     pb.Asn,
+		Comment: pb.GetComment(),
+		Created: now,
+	}
+	if pb.GetPrefix() != "" {
+		p, err := parseOverridePrefix(pb.GetPrefix())
+		if err != nil {
+			return nil, err
+		}
+		f.Prefix = p
+	}
+	if !f.Prefix.IsValid() && f.ASN == nil {
+		return nil, status.Error(codes.InvalidArgument, "a prefix filter needs a prefix, an ASN or both")
+	}
+	var err error
+	if f.Expires, err = expiry(pb.GetExpires(), now); err != nil {
+		return nil, err
+	}
+
+	if err := a.srv.updateOverrides(ctx, func(set *overrideSet) error {
+		set.Filters = append(set.Filters, f)
+		return nil
+	}); err != nil {
+		return nil, overrideError(err)
+	}
+	a.srv.logger.Infow("Prefix filter added", "id", f.ID, "prefix", f.Prefix, "asn", pb.Asn, "comment", f.Comment)
+	return &rpkirtripb.AddPrefixFilterResponse{Filter: toPrefixFilter(f), Serial: a.srv.CacheSerial()}, nil
+}
+
+// AddPrefixAssertion adds a VRP to the data served to routers.
+func (a *adminServer) AddPrefixAssertion(ctx context.Context, req *rpkirtripb.AddPrefixAssertionRequest) (*rpkirtripb.AddPrefixAssertionResponse, error) {
+	pb := req.GetAssertion()
+	now := time.Now()
+	p, err := parseOverridePrefix(pb.GetPrefix())
+	if err != nil {
+		return nil, err
+	}
+	maxLength := pb.GetMaxLength()
+	if maxLength == 0 {
+		maxLength = uint32(p.Bits())
+	}
+	if maxLength < uint32(p.Bits()) || maxLength > uint32(p.Addr().BitLen()) {
+		return nil, status.Errorf(codes.InvalidArgument, "max_length %d is out of range for %s", maxLength, p)
+	}
+	as := prefixAssertion{
+		ID:        newOverrideID(),
+		Prefix:    p,
+		ASN:       pb.GetAsn(),
+		MaxLength: uint8(maxLength),
+		Comment:   pb.GetComment(),
+		Created:   now,
+	}
+	if as.Expires, err = expiry(pb.GetExpires(), now); err != nil {
+		return nil, err
+	}
+
+	if err := a.srv.updateOverrides(ctx, func(set *overrideSet) error {
+		set.Assertions = append(set.Assertions, as)
+		return nil
+	}); err != nil {
+		return nil, overrideError(err)
+	}
+	a.srv.logger.Infow("Prefix assertion added", "id", as.ID, "prefix", as.Prefix, "max_length", as.MaxLength, "asn", as.ASN, "comment", as.Comment)
+	return &rpkirtripb.AddPrefixAssertionResponse{Assertion: toPrefixAssertion(as), Serial: a.srv.CacheSerial()}, nil
+}
+
+// AddASPAOverride replaces or withdraws the ASPA of a customer AS.
+func (a *adminServer) AddASPAOverride(ctx context.Context, req *rpkirtripb.AddASPAOverrideRequest) (*rpkirtripb.AddASPAOverrideResponse, error) {
+	pb := req.GetOverride()
+	now := time.Now()
+	if pb.GetCustomerAsn() == 0 {
+		return nil, status.Error(codes.InvalidArgument, "customer_asn must be set")
+	}
+	providers := slices.Clone(pb.GetProviderAsns())
+	slices.Sort(providers)
+	o := aspaOverride{
+		ID:           newOverrideID(),
+		CustomerASN:  pb.GetCustomerAsn(),
+		ProviderASNs: slices.Compact(providers),
+		Comment:      pb.GetComment(),
+		Created:      now,
+	}
+	var err error
+	if o.Expires, err = expiry(pb.GetExpires(), now); err != nil {
+		return nil, err
+	}
+
+	if err := a.srv.updateOverrides(ctx, func(set *overrideSet) error {
+		if i := slices.IndexFunc(set.ASPAs, func(x aspaOverride) bool { return x.CustomerASN == o.CustomerASN }); i >= 0 {
+			return status.Errorf(codes.AlreadyExists, "AS%d already has ASPA override %s", o.CustomerASN, set.ASPAs[i].ID)
+		}
+		set.ASPAs = append(set.ASPAs, o)
+		return nil
+	}); err != nil {
+		return nil, overrideError(err)
+	}
+	a.srv.logger.Infow("ASPA override added", "id", o.ID, "customer_asn", o.CustomerASN, "provider_asns", o.ProviderASNs, "comment", o.Comment)
+	return &rpkirtripb.AddASPAOverrideResponse{Override: toASPAOverride(o), Serial: a.srv.CacheSerial()}, nil
+}
+
+func (a *adminServer) ListOverrides(ctx context.Context, req *rpkirtripb.ListOverridesRequest) (*rpkirtripb.ListOverridesResponse, error) {
+	set := a.srv.overrides.list()
+	resp := &rpkirtripb.ListOverridesResponse{}
+	for _, f := range set.Filters {
+		resp.Filters = append(resp.Filters, toPrefixFilter(f))
+	}
+	for _, as := range set.Assertions {
+		resp.Assertions = append(resp.Assertions, toPrefixAssertion(as))
+	}
+	for _, o := range set.ASPAs {
+		resp.AspaOverrides = append(resp.AspaOverrides, toASPAOverride(o))
+	}
+	return resp, nil
+}
+
+func (a *adminServer) RemoveOverride(ctx context.Context, req *rpkirtripb.RemoveOverrideRequest) (*rpkirtripb.RemoveOverrideResponse, error) {
+	if err := a.srv.updateOverrides(ctx, func(set *overrideSet) error {
+		return set.remove(req.GetId())
+	}); err != nil {
+		return nil, overrideError(err)
+	}
+	a.srv.logger.Infow("Override removed", "id", req.GetId())
+	return &rpkirtripb.RemoveOverrideResponse{Serial: a.srv.CacheSerial()}, nil
+}
+
+func toPrefixFilter(f prefixFilter) *rpkirtripb.PrefixFilter {
+	pb := &rpkirtripb.PrefixFilter{
+		Id:      f.ID,
+		Asn:     f.ASN,
+		Comment: f.Comment,
+		Created: f.Created.Unix(),
+		Expires: unixTime(f.Expires),
+	}
+	if f.Prefix.IsValid() {
+		pb.Prefix = f.Prefix.String()
+	}
+	return pb
+}
+
+func toPrefixAssertion(a prefixAssertion) *rpkirtripb.PrefixAssertion {
+	return &rpkirtripb.PrefixAssertion{
+		Id:        a.ID,
+		Prefix:    a.Prefix.String(),
+		Asn:       a.ASN,
+		MaxLength: uint32(a.MaxLength),
+		Comment:   a.Comment,
+		Created:   a.Created.Unix(),
+		Expires:   unixTime(a.Expires),
+	}
+}
+
+func toASPAOverride(o aspaOverride) *rpkirtripb.ASPAOverride {
+	return &rpkirtripb.ASPAOverride{
+		Id:           o.ID,
+		CustomerAsn:  o.CustomerASN,
+		ProviderAsns: o.ProviderASNs,
+		Comment:      o.Comment,
+		Created:      o.Created.Unix(),
+		Expires:      unixTime(o.Expires),
+	}
+}
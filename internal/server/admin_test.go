@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"flag"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	rpkirtripb "github.com/mellowdrifter/rpkirtr2/api/v1"
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// startAdminGRPC serves srv the way Start does and returns a connection to it.
+func startAdminGRPC(t *testing.T, srv *Server) *grpc.ClientConn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	gs, err := srv.newGRPCServer()
+	require.NoError(t, err)
+	go func() {
+		_ = gs.Serve(l)
+	}()
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func withToken(token string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func TestAdminAuth(t *testing.T) {
+	srv := New(&config.Config{AdminToken: "s3cr3t"}, zaptest.NewLogger(t).Sugar())
+	conn := startAdminGRPC(t, srv)
+	admin := rpkirtripb.NewRPKIRTRAdminServiceClient(conn)
+
+	_, err := admin.PauseUpdates(context.Background(), &rpkirtripb.PauseUpdatesRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = admin.PauseUpdates(withToken("wrong"), &rpkirtripb.PauseUpdatesRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.False(t, srv.UpdatesPaused())
+
+	resp, err := admin.PauseUpdates(withToken("s3cr3t"), &rpkirtripb.PauseUpdatesRequest{})
+	require.NoError(t, err)
+	assert.True(t, resp.Paused)
+
+	// The read-only service needs no token
+	stats, err := rpkirtripb.NewRPKIRTRServiceClient(conn).GetStats(context.Background(), &rpkirtripb.GetStatsRequest{})
+	require.NoError(t, err)
+	assert.True(t, stats.UpdatesPaused)
+
+	t.Run("Disabled", func(t *testing.T) {
+		srv := New(&config.Config{}, zaptest.NewLogger(t).Sugar())
+		admin := rpkirtripb.NewRPKIRTRAdminServiceClient(startAdminGRPC(t, srv))
+		_, err := admin.PauseUpdates(withToken(""), &rpkirtripb.PauseUpdatesRequest{})
+		assert.Equal(t, codes.Unimplemented, status.Code(err))
+	})
+}
+
+func TestAdminRefresh(t *testing.T) {
+	var empty atomic.Bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if empty.Load() {
+			w.Write([]byte(`{"roas": []}`))
+			return
+		}
+		w.Write([]byte(testRPKIClientJSON))
+	}))
+	defer ts.Close()
+	var otherHits atomic.Int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		otherHits.Add(1)
+		w.Write([]byte(`{"roas": [{"asn": 64510, "prefix": "198.51.100.0/24", "maxLength": 24}]}`))
+	}))
+	defer other.Close()
+
+	srv := New(&config.Config{
+		Upstreams:       []config.Upstream{{URL: ts.URL}, {URL: other.URL}},
+		RefreshInterval: 3600,
+	}, zaptest.NewLogger(t).Sugar())
+	a := &adminServer{srv: srv}
+	ctx := context.Background()
+
+	_, err := a.Refresh(ctx, &rpkirtripb.RefreshRequest{Upstream: "http://unknown.example/"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = a.Refresh(ctx, &rpkirtripb.RefreshRequest{})
+	require.NoError(t, err)
+	assert.Len(t, srv.cache.getState().roas, 3)
+
+	// Naming an upstream fetches only that one and keeps the other's data
+	resp, err := a.Refresh(ctx, &rpkirtripb.RefreshRequest{Upstream: ts.URL})
+	require.NoError(t, err)
+	assert.Equal(t, srv.CacheSerial(), resp.Serial)
+	require.NotNil(t, resp.Upstream)
+	assert.True(t, resp.Upstream.LastFetchSuccess)
+	assert.Equal(t, uint32(2), resp.Upstream.RoaCount)
+	assert.Len(t, srv.cache.getState().roas, 3)
+	assert.Equal(t, int32(1), otherHits.Load(), "other upstream fetched again")
+
+	bg, cancel := context.WithCancel(ctx)
+	srv.wg.Add(1)
+	go srv.periodicROAUpdater(bg)
+	defer func() {
+		cancel()
+		srv.wg.Wait()
+	}()
+
+	// Refreshes requested of the updater are skipped while paused
+	_, err = a.PauseUpdates(ctx, &rpkirtripb.PauseUpdatesRequest{})
+	require.NoError(t, err)
+	empty.Store(true)
+	srv.requestRefresh()
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, srv.cache.getState().roas, 3)
+
+	// Resuming catches up immediately
+	r, err := a.ResumeUpdates(ctx, &rpkirtripb.ResumeUpdatesRequest{})
+	require.NoError(t, err)
+	assert.False(t, r.Paused)
+	require.Eventually(t, func() bool {
+		return len(srv.cache.getState().roas) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestAdminRefreshRTRWhilePaused(t *testing.T) {
+	addr := "127.0.0.1:1"
+	srv := New(&config.Config{
+		Upstreams: []config.Upstream{{Type: config.UpstreamTypeRTR, URL: addr}},
+	}, zaptest.NewLogger(t).Sugar())
+	a := &adminServer{srv: srv}
+	ctx := context.Background()
+
+	srv.PauseUpdates()
+	_, err := a.Refresh(ctx, &rpkirtripb.RefreshRequest{Upstream: addr})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "the answer would be held back")
+
+	srv.ResumeUpdates()
+	_, err = a.Refresh(ctx, &rpkirtripb.RefreshRequest{Upstream: addr})
+	assert.NoError(t, err)
+}
+
+func TestAdminSetLogLevel(t *testing.T) {
+	srv := New(&config.Config{}, zap.NewNop().Sugar())
+	a := &adminServer{srv: srv}
+	ctx := context.Background()
+
+	_, err := a.SetLogLevel(ctx, &rpkirtripb.SetLogLevelRequest{Level: "debug"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	level := zap.NewAtomicLevelAt(zap.InfoLevel)
+	srv.SetAtomicLevel(level)
+	_, err = a.SetLogLevel(ctx, &rpkirtripb.SetLogLevelRequest{Level: "verbose"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	resp, err := a.SetLogLevel(ctx, &rpkirtripb.SetLogLevelRequest{Level: "debug"})
+	require.NoError(t, err)
+	assert.Equal(t, "info", resp.PreviousLevel)
+	assert.Equal(t, zap.DebugLevel, level.Level())
+}
+
+func TestServerReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+listen_addr: ":8282"
+log_level: info
+rpki_urls: ["http://a.example/roas.json"]
+`), 0o600))
+	cfg, err := config.LoadWithArgs(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", path})
+	require.NoError(t, err)
+
+	srv := New(cfg, zap.NewNop().Sugar())
+	level := zap.NewAtomicLevelAt(zap.InfoLevel)
+	srv.SetAtomicLevel(level)
+	srv.recordFetch("http://a.example/roas.json", fetchROAs, &UpstreamStatus{LastFetchTime: time.Now()}, nil)
+
+	require.NoError(t, os.WriteFile(path, []byte(`
+listen_addr: ":9292"
+log_level: debug
+rpki_urls: ["http://b.example/roas.json"]
+`), 0o600))
+	resp, err := (&adminServer{srv: srv}).ReloadConfig(context.Background(), &rpkirtripb.ReloadConfigRequest{})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"log_level", "rpki_urls"}, resp.Applied)
+	assert.Equal(t, []string{"listen_addr"}, resp.RequiresRestart)
+
+	urls, _, _ := srv.httpSources()
+	assert.Equal(t, []string{"http://b.example/roas.json"}, urls)
+	assert.Equal(t, zap.DebugLevel, level.Level())
+	assert.Equal(t, ":8282", srv.cfg.ListenAddr, "settings needing a restart keep their running value")
+	assert.NotContains(t, srv.upstreams, "http://a.example/roas.json", "removed upstreams are forgotten")
+
+	require.NoError(t, os.WriteFile(path, []byte("log_level: [\n"), 0o600))
+	_, _, err = srv.Reload()
+	assert.Error(t, err)
+}
+
+func TestAdminOverrides(t *testing.T) {
+	srv := New(&config.Config{OverridesFile: filepath.Join(t.TempDir(), "overrides.json")}, zaptest.NewLogger(t).Sugar())
+	srv.UpdateROAs([]ROA{
+		{Prefix: netip.MustParsePrefix("192.0.2.0/24"), ASN: 64496, MaxMask: 24},
+		{Prefix: netip.MustParsePrefix("198.51.100.0/24"), ASN: 64497, MaxMask: 24},
+	})
+	srv.UpdateASPAs([]ASPA{{CustomerASN: 64496, ProviderASNs: []uint32{64500}}})
+	a := &adminServer{srv: srv}
+	ctx := context.Background()
+	serial := srv.CacheSerial()
+
+	_, err := a.AddPrefixFilter(ctx, &rpkirtripb.AddPrefixFilterRequest{Filter: &rpkirtripb.PrefixFilter{}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = a.AddPrefixAssertion(ctx, &rpkirtripb.AddPrefixAssertionRequest{Assertion: &rpkirtripb.PrefixAssertion{Prefix: "203.0.113.1/24"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "host bits set")
+	_, err = a.AddPrefixAssertion(ctx, &rpkirtripb.AddPrefixAssertionRequest{Assertion: &rpkirtripb.PrefixAssertion{Prefix: "203.0.113.0/24", MaxLength: 33}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = a.AddPrefixFilter(ctx, &rpkirtripb.AddPrefixFilterRequest{Filter: &rpkirtripb.PrefixFilter{Prefix: "192.0.2.0/24", Expires: time.Now().Add(-time.Hour).Unix()}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "expiry in the past")
+	assert.Equal(t, serial, srv.CacheSerial())
+
+	filter, err := a.AddPrefixFilter(ctx, &rpkirtripb.AddPrefixFilterRequest{Filter: &rpkirtripb.PrefixFilter{Prefix: "192.0.2.0/23", Comment: "emergency"}})
+	require.NoError(t, err)
+	assert.NotEmpty(t, filter.Filter.Id)
+	assert.Equal(t, serial+1, filter.Serial)
+
+	assertion, err := a.AddPrefixAssertion(ctx, &rpkirtripb.AddPrefixAssertionRequest{Assertion: &rpkirtripb.PrefixAssertion{Prefix: "203.0.113.0/24", Asn: 64499}})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(24), assertion.Assertion.MaxLength)
+	assert.Equal(t, serial+2, assertion.Serial)
+
+	override, err := a.AddASPAOverride(ctx, &rpkirtripb.AddASPAOverrideRequest{Override: &rpkirtripb.ASPAOverride{CustomerAsn: 64496, ProviderAsns: []uint32{64502, 64501, 64502}}})
+	require.NoError(t, err)
+	assert.Equal(t, []uint32{64501, 64502}, override.Override.ProviderAsns)
+	_, err = a.AddASPAOverride(ctx, &rpkirtripb.AddASPAOverrideRequest{Override: &rpkirtripb.ASPAOverride{CustomerAsn: 64496}})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	state := srv.cache.getState()
+	assert.Equal(t, []ROA{
+		{Prefix: netip.MustParsePrefix("198.51.100.0/24"), ASN: 64497, MaxMask: 24},
+		{Prefix: netip.MustParsePrefix("203.0.113.0/24"), ASN: 64499, MaxMask: 24},
+	}, state.roas)
+	assert.Equal(t, []ASPA{{CustomerASN: 64496, ProviderASNs: []uint32{64501, 64502}}}, state.aspas)
+	assert.Equal(t, sourceOverride, srv.cache.getHistory()[len(srv.cache.getHistory())-1].source)
+
+	// Overrides keep applying to new upstream data
+	srv.UpdateROAs([]ROA{{Prefix: netip.MustParsePrefix("192.0.2.0/24"), ASN: 64498, MaxMask: 24}})
+	assert.Equal(t, []ROA{{Prefix: netip.MustParsePrefix("203.0.113.0/24"), ASN: 64499, MaxMask: 24}}, srv.cache.getState().roas)
+
+	list, err := a.ListOverrides(ctx, &rpkirtripb.ListOverridesRequest{})
+	require.NoError(t, err)
+	assert.Len(t, list.Filters, 1)
+	assert.Equal(t, "emergency", list.Filters[0].Comment)
+	assert.Len(t, list.Assertions, 1)
+	assert.Len(t, list.AspaOverrides, 1)
+
+	// Overrides survive a restart
+	restarted := New(srv.cfg, zaptest.NewLogger(t).Sugar())
+	require.NoError(t, restarted.overrides.load())
+	reloaded, err := (&adminServer{srv: restarted}).ListOverrides(ctx, &rpkirtripb.ListOverridesRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, list.String(), reloaded.String())
+
+	_, err = a.RemoveOverride(ctx, &rpkirtripb.RemoveOverrideRequest{Id: "missing"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	for _, id := range []string{filter.Filter.Id, assertion.Assertion.Id, override.Override.Id} {
+		_, err := a.RemoveOverride(ctx, &rpkirtripb.RemoveOverrideRequest{Id: id})
+		require.NoError(t, err)
+	}
+	state = srv.cache.getState()
+	assert.Equal(t, []ROA{{Prefix: netip.MustParsePrefix("192.0.2.0/24"), ASN: 64498, MaxMask: 24}}, state.roas)
+	assert.Equal(t, []ASPA{{CustomerASN: 64496, ProviderASNs: []uint32{64500}}}, state.aspas)
+}
+
+func TestOverrideExpiryUpdatesCache(t *testing.T) {
+	srv := New(&config.Config{}, zaptest.NewLogger(t).Sugar())
+	srv.UpdateROAs([]ROA{{Prefix: netip.MustParsePrefix("192.0.2.0/24"), ASN: 64496, MaxMask: 24}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	srv.wg.Add(1)
+	go srv.expireOverrides(ctx)
+	defer func() {
+		cancel()
+		srv.wg.Wait()
+	}()
+
+	_, err := (&adminServer{srv: srv}).AddPrefixFilter(context.Background(), &rpkirtripb.AddPrefixFilterRequest{
+		Filter: &rpkirtripb.PrefixFilter{Prefix: "192.0.2.0/24", Expires: time.Now().Add(time.Second).Unix() + 1},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, srv.cache.getState().roas)
+
+	require.Eventually(t, func() bool {
+		return len(srv.cache.getState().roas) == 1
+	}, 5*time.Second, 20*time.Millisecond)
+	assert.Empty(t, srv.overrides.list().Filters, "expired overrides are removed")
+}
@@ -6,9 +6,12 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"sort"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // ASPA represents an Autonomous System Provider Authorization object.
@@ -19,16 +22,56 @@ type ASPA struct {
 }
 
 // JSONASPA represents the JSON structure of an ASPA object as provided by collectors like rpki-client.
+// Both the "customer" and rpki-client's "customer_asid" field names are accepted.
 type JSONASPA struct {
-	Customer  uint32         `json:"customer"`
-	Providers []JSONProvider `json:"providers"`
-	Expires   int64          `json:"expires"`
+	Customer     jsonASN        `json:"customer"`
+	CustomerASID jsonASN        `json:"customer_asid"`
+	Providers    []JSONProvider `json:"providers"`
+	Expires      int64          `json:"expires"`
+	Source       []JSONSource   `json:"source"` // Routinator jsonext only
 }
 
+// JSONProvider is a provider entry, encoded either as {"asn": N} or as a bare number.
 type JSONProvider struct {
 	ASN uint32 `json:"asn"`
 }
 
+func (p *JSONProvider) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] != '{' {
+		var asn jsonASN
+		if err := json.Unmarshal(b, &asn); err != nil {
+			return err
+		}
+		p.ASN = uint32(asn)
+		return nil
+	}
+	type provider JSONProvider
+	return json.Unmarshal(b, (*provider)(p))
+}
+
+func (a JSONASPA) toASPA() ASPA {
+	customer := uint32(a.Customer)
+	if customer == 0 {
+		customer = uint32(a.CustomerASID)
+	}
+	expires := a.Expires
+	if expires == 0 {
+		expires = sourceExpiry(a.Source)
+	}
+	providers := make([]uint32, len(a.Providers))
+	for i, p := range a.Providers {
+		providers[i] = p.ASN
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i] < providers[j]
+	})
+	return ASPA{
+		CustomerASN:  customer,
+		ProviderASNs: providers,
+		Expires:      expires,
+	}
+}
+
 // Less reports whether this ASPA should sort before the other.
 func (a ASPA) Less(other ASPA) bool {
 	if a.CustomerASN != other.CustomerASN {
@@ -105,17 +148,7 @@ func (s *Server) fetchASPAsFromURL(ctx context.Context, url string) ([]ASPA, err
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	resp, err := s.httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("http request error: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected HTTP status: %s", resp.Status)
-	}
-
-	return decodeASPAsJSON(resp.Body)
+	return fetchDocument(s.defaultClient(), req, url, decodeASPAsJSON)
 }
 
 func decodeASPAsJSON(r io.Reader) ([]ASPA, error) {
@@ -164,72 +197,87 @@ func decodeASPAsJSON(r io.Reader) ([]ASPA, error) {
 			return nil, fmt.Errorf("failed to decode aspa: %w", err)
 		}
 
-		providers := make([]uint32, len(a.Providers))
-		for i, p := range a.Providers {
-			providers[i] = p.ASN
-		}
-		sort.Slice(providers, func(i, j int) bool {
-			return providers[i] < providers[j]
-		})
-		aspas = append(aspas, ASPA{
-			CustomerASN:  a.Customer,
-			ProviderASNs: providers,
-			Expires:      a.Expires,
-		})
+		aspas = append(aspas, a.toASPA())
 	}
 
 	return aspas, nil
 }
 
-func (s *Server) loadASPAs(ctx context.Context) ([]ASPA, error) {
-	if len(s.aspaURLs) == 0 {
+// loadASPAs fetches the ASPA URLs selected by round, or all of them if round is
+// nil, concurrently. A URL that fails or is not fetched contributes the ASPAs
+// from its last successful fetch. If every fetch fails, an error is returned
+// along with the ASPAs the URLs last provided.
+func (s *Server) loadASPAs(ctx context.Context, round *fetchRound) ([]ASPA, error) {
+	_, urls, _ := s.httpSources()
+	if len(urls) == 0 {
 		return nil, nil
 	}
 
 	var wg sync.WaitGroup
-	aspaCh := make(chan []ASPA, len(s.aspaURLs))
-	errsCh := make(chan error, len(s.aspaURLs))
+	aspaCh := make(chan []ASPA, len(urls))
+	prevCh := make(chan []ASPA, len(urls))
 
 	fetch := func(url string) {
 		defer wg.Done()
-		s.logger.Debugf("Fetching ASPAs from %s", url)
+		s.logger.Debugw("Fetching ASPAs", "upstream", url)
+		ctx, span := startSpan(ctx, "upstream.fetch", attribute.String("upstream.url", url))
+		start := time.Now()
 		aspas, err := s.fetchASPAsFromURL(ctx, url)
+		span.SetAttributes(attribute.Int("rpki.aspas", len(aspas)))
+		endSpan(span, err)
 
 		s.upstreamsMu.Lock()
-		stats, ok := s.upstreams[url]
-		if !ok {
-			stats = &UpstreamStatus{}
+		stats := &UpstreamStatus{
+			LastFetchTime: time.Now(),
+			FetchDuration: time.Since(start),
 		}
-		stats.LastFetchTime = time.Now()
-		if err != nil {
-			stats.LastFetchSuccess = false
-			stats.ErrorMessage = err.Error()
-			errsCh <- err
-		} else {
-			stats.LastFetchSuccess = true
+		if err == nil {
+			stats.ASPACount = len(aspas)
+			aspas = DeduplicateASPAsInPlace(aspas)
+			prev := s.lastGood[url]
+			if !slices.EqualFunc(prev.aspas, aspas, aspasEqual) {
+				round.record(url)
+			}
+			prev.aspas = aspas
+			s.lastGood[url] = prev
 			aspaCh <- aspas
+		} else if prev, ok := s.lastGood[url]; ok {
+			prevCh <- prev.aspas
 		}
-		s.upstreams[url] = stats
+		s.recordFetch(url, fetchASPAs, stats, err)
 		s.upstreamsMu.Unlock()
+
+		if err != nil {
+			s.logger.Errorw("Failed to fetch ASPAs from upstream", "upstream", url, "error", err)
+		}
 	}
 
-	wg.Add(len(s.aspaURLs))
-	for _, url := range s.aspaURLs {
+	attempted := 0
+	for _, url := range urls {
+		if !round.fetches(url) {
+			if prev, ok := s.previous(url); ok {
+				prevCh <- prev.aspas
+			}
+			continue
+		}
+		attempted++
+		wg.Add(1)
 		go fetch(url)
 	}
 	wg.Wait()
 	close(aspaCh)
-	close(errsCh)
-
-	for err := range errsCh {
-		s.logger.Errorf("failed to fetch ASPAs from upstream: %v", err)
-	}
+	close(prevCh)
 
 	var allASPASlices [][]ASPA
-	totalASPA := 0
+	totalASPA, fetched := 0, 0
 	for a := range aspaCh {
 		allASPASlices = append(allASPASlices, a)
 		totalASPA += len(a)
+		fetched++
+	}
+	for a := range prevCh {
+		allASPASlices = append(allASPASlices, a)
+		totalASPA += len(a)
 	}
 	combined := make([]ASPA, 0, totalASPA)
 	for _, a := range allASPASlices {
@@ -237,5 +285,8 @@ func (s *Server) loadASPAs(ctx context.Context) ([]ASPA, error) {
 	}
 
 	validASPAs := DeduplicateASPAsInPlace(combined)
+	if fetched == 0 && attempted > 0 {
+		return validASPAs, fmt.Errorf("failed to fetch ASPAs from any configured URL")
+	}
 	return validASPAs, nil
 }
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"slices"
+	"sort"
+)
+
+// hopResult is the provider authorization of a single hop, as defined in the
+// ASPA verification draft (draft-ietf-sidrops-aspa-verification).
+type hopResult int
+
+const (
+	hopNoAttestation hopResult = iota
+	hopProvider
+	hopNotProvider
+)
+
+func (h hopResult) String() string {
+	switch h {
+	case hopProvider:
+		return "provider+"
+	case hopNotProvider:
+		return "not-provider+"
+	default:
+		return "no-attestation"
+	}
+}
+
+// pathState is the outcome of AS_PATH verification.
+type pathState int
+
+const (
+	pathValid pathState = iota
+	pathInvalid
+	pathUnknown
+)
+
+func (p pathState) String() string {
+	switch p {
+	case pathValid:
+		return "valid"
+	case pathInvalid:
+		return "invalid"
+	default:
+		return "unknown"
+	}
+}
+
+// pathDirection selects the verification procedure. Routes received from
+// customers, lateral peers and route server clients use upstream verification;
+// routes received from providers use downstream verification.
+type pathDirection int
+
+const (
+	pathUpstream pathDirection = iota
+	pathDownstream
+)
+
+type aspaHop struct {
+	customer uint32
+	provider uint32
+	result   hopResult
+}
+
+type aspaVerification struct {
+	state       pathState
+	hops        []aspaHop
+	maxUpRamp   int
+	minUpRamp   int
+	maxDownRamp int // downstream only
+	minDownRamp int // downstream only
+}
+
+// providerAuthorized returns the authorization of provider by customer.
+// aspas must be sorted by customer ASN, as stored in the cache.
+func providerAuthorized(aspas []ASPA, customer, provider uint32) hopResult {
+	i := sort.Search(len(aspas), func(i int) bool {
+		return aspas[i].CustomerASN >= customer
+	})
+	if i == len(aspas) || aspas[i].CustomerASN != customer {
+		return hopNoAttestation
+	}
+	if _, ok := slices.BinarySearch(aspas[i].ProviderASNs, provider); ok {
+		return hopProvider
+	}
+	return hopNotProvider
+}
+
+// verifyASPath verifies an AS_PATH as received in BGP, most recent AS first and
+// origin last. Prepends are collapsed before verification. An empty path is Invalid.
+func verifyASPath(aspas []ASPA, asPath []uint32, dir pathDirection) aspaVerification {
+	// Collapse prepends and reverse so that path[0] is the origin, AS(1) in the draft
+	path := make([]uint32, 0, len(asPath))
+	for i := len(asPath) - 1; i >= 0; i-- {
+		if len(path) == 0 || path[len(path)-1] != asPath[i] {
+			path = append(path, asPath[i])
+		}
+	}
+	n := len(path)
+	if n == 0 {
+		return aspaVerification{state: pathInvalid}
+	}
+
+	v := aspaVerification{maxUpRamp: n, minUpRamp: n}
+
+	// Up-ramp: each AS must authorise the next AS towards the receiver as its provider
+	for i := 0; i < n-1; i++ {
+		h := aspaHop{customer: path[i], provider: path[i+1]}
+		h.result = providerAuthorized(aspas, h.customer, h.provider)
+		v.hops = append(v.hops, h)
+		if h.result != hopProvider && v.minUpRamp == n {
+			v.minUpRamp = i + 1
+		}
+		if h.result == hopNotProvider && v.maxUpRamp == n {
+			v.maxUpRamp = i + 1
+		}
+	}
+
+	if dir == pathUpstream {
+		switch {
+		case v.maxUpRamp < n:
+			v.state = pathInvalid
+		case v.minUpRamp < n:
+			v.state = pathUnknown
+		default:
+			v.state = pathValid
+		}
+		return v
+	}
+
+	// Down-ramp: walking back from the receiver, each AS must be authorised as
+	// a provider by the AS that precedes it towards the origin.
+	v.maxDownRamp, v.minDownRamp = n, n
+	for j := n - 2; j >= 0; j-- {
+		h := aspaHop{customer: path[j+1], provider: path[j]}
+		h.result = providerAuthorized(aspas, h.customer, h.provider)
+		v.hops = append(v.hops, h)
+		if h.result != hopProvider && v.minDownRamp == n {
+			v.minDownRamp = n - j - 1
+		}
+		if h.result == hopNotProvider && v.maxDownRamp == n {
+			v.maxDownRamp = n - j - 1
+		}
+	}
+
+	switch {
+	case v.maxUpRamp+v.maxDownRamp < n:
+		v.state = pathInvalid
+	case v.minUpRamp+v.minDownRamp < n:
+		v.state = pathUnknown
+	default:
+		v.state = pathValid
+	}
+	return v
+}
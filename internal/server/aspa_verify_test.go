@@ -0,0 +1,67 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestVerifyASPath(t *testing.T) {
+	aspas := []ASPA{
+		{CustomerASN: 10, ProviderASNs: []uint32{20}},
+		{CustomerASN: 20, ProviderASNs: []uint32{30}},
+		{CustomerASN: 30, ProviderASNs: []uint32{40}},
+		{CustomerASN: 35, ProviderASNs: []uint32{30}},
+	}
+
+	tests := []struct {
+		name string
+		path []uint32 // neighbor first
+		dir  pathDirection
+		want pathState
+	}{
+		{"upstream empty", nil, pathUpstream, pathInvalid},
+		{"upstream single AS", []uint32{5}, pathUpstream, pathValid},
+		{"upstream provider chain", []uint32{30, 20, 10}, pathUpstream, pathValid},
+		{"upstream prepends collapsed", []uint32{20, 20, 10, 10}, pathUpstream, pathValid},
+		{"upstream not provider", []uint32{50, 10}, pathUpstream, pathInvalid},
+		{"upstream leak mid path", []uint32{30, 50, 20, 10}, pathUpstream, pathInvalid},
+		{"upstream no attestation", []uint32{10, 50}, pathUpstream, pathUnknown},
+		{"downstream two hops", []uint32{50, 10}, pathDownstream, pathValid},
+		{"downstream up then down", []uint32{35, 30, 20, 10}, pathDownstream, pathValid},
+		{"downstream valley", []uint32{35, 30, 50, 20, 10}, pathDownstream, pathInvalid},
+		{"downstream unattested up-ramp", []uint32{35, 30, 70, 60}, pathDownstream, pathUnknown},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyASPath(aspas, tt.path, tt.dir); got.state != tt.want {
+				t.Errorf("verifyASPath(%v) = %s, want %s (up %d/%d, down %d/%d)",
+					tt.path, got.state, tt.want, got.maxUpRamp, got.minUpRamp, got.maxDownRamp, got.minDownRamp)
+			}
+		})
+	}
+}
+
+func TestVerifyASPathHops(t *testing.T) {
+	aspas := []ASPA{
+		{CustomerASN: 10, ProviderASNs: []uint32{20}},
+		{CustomerASN: 20, ProviderASNs: []uint32{30}},
+	}
+	v := verifyASPath(aspas, []uint32{40, 30, 20, 20, 10}, pathUpstream)
+
+	want := []aspaHop{
+		{customer: 10, provider: 20, result: hopProvider},
+		{customer: 20, provider: 30, result: hopProvider},
+		{customer: 30, provider: 40, result: hopNoAttestation},
+	}
+	if len(v.hops) != len(want) {
+		t.Fatalf("Expected %d hops, got %v", len(want), v.hops)
+	}
+	for i := range want {
+		if v.hops[i] != want[i] {
+			t.Errorf("hop %d = %+v, want %+v", i, v.hops[i], want[i])
+		}
+	}
+	if v.state != pathUnknown || v.maxUpRamp != 4 || v.minUpRamp != 3 {
+		t.Errorf("Expected unknown with up-ramp 4/3, got %s with %d/%d", v.state, v.maxUpRamp, v.minUpRamp)
+	}
+}
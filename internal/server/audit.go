@@ -0,0 +1,424 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+)
+
+// The audit log is a durable record of what was served to routers. Every
+// change to the cache appends a record with each announced and withdrawn
+// object, and the data loaded at startup is recorded in full, so that the
+// history of any VRP or ASPA can be followed across restarts. Records are
+// JSON Lines in one file per UTC day, named audit-YYYY-MM-DD.jsonl.
+
+const (
+	auditDiff     = "diff"     // a change to the cache
+	auditSnapshot = "snapshot" // the data loaded at startup
+
+	// auditStartup is the source of snapshot records.
+	auditStartup = "startup"
+
+	auditDayLayout = "2006-01-02"
+)
+
+type auditRecord struct {
+	auditHeader
+	Announced auditObjects `json:"announced"`
+	Withdrawn auditObjects `json:"withdrawn"`
+}
+
+// auditHeader describes a record. Queries decode only the header of records
+// that cannot contain a match.
+type auditHeader struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Session    uint16    `json:"session"`
+	FromSerial uint32    `json:"from_serial"`
+	Serial     uint32    `json:"serial"`
+	Source     string    `json:"source"`
+	Upstreams  []string  `json:"upstreams,omitempty"` // HTTP upstreams whose data changed, or that provided a snapshot
+	Principal  string    `json:"principal,omitempty"` // caller of the admin RPC that made the change
+}
+
+type auditObjects struct {
+	VRPs       []auditVRP       `json:"vrps,omitempty"`
+	ASPAs      []auditASPA      `json:"aspas,omitempty"`
+	RouterKeys []auditRouterKey `json:"router_keys,omitempty"`
+}
+
+type auditVRP struct {
+	Prefix    netip.Prefix `json:"prefix"`
+	MaxLength uint8        `json:"max_length"`
+	ASN       uint32       `json:"asn"`
+}
+
+type auditASPA struct {
+	CustomerASN  uint32   `json:"customer_asn"`
+	ProviderASNs []uint32 `json:"provider_asns"`
+}
+
+type auditRouterKey struct {
+	SKI  string `json:"ski"`
+	ASN  uint32 `json:"asn"`
+	SPKI []byte `json:"spki"`
+}
+
+func newAuditObjects(roas []ROA, aspas []ASPA, keys []RouterKey) auditObjects {
+	var o auditObjects
+	for _, r := range roas {
+		o.VRPs = append(o.VRPs, auditVRP{Prefix: r.Prefix, MaxLength: r.MaxMask, ASN: r.ASN})
+	}
+	for _, a := range aspas {
+		o.ASPAs = append(o.ASPAs, auditASPA{CustomerASN: a.CustomerASN, ProviderASNs: a.ProviderASNs})
+	}
+	for _, k := range keys {
+		o.RouterKeys = append(o.RouterKeys, auditRouterKey{SKI: hex.EncodeToString(k.SKI[:]), ASN: k.ASN, SPKI: k.SPKI})
+	}
+	return o
+}
+
+// recordAudit appends rec to the audit log, if enabled, adding the upstreams
+// behind a startup snapshot and the admin caller found in ctx. A failure is
+// logged rather than holding back the update.
+func (s *Server) recordAudit(ctx context.Context, rec auditRecord) {
+	if s.audit == nil {
+		return
+	}
+	if rec.Source == auditStartup {
+		rec.Upstreams = s.fetchedUpstreams()
+	}
+	if p, ok := principalFrom(ctx); ok {
+		rec.Principal = p.name
+	}
+	if err := s.audit.write(rec); err != nil {
+		s.logger.Errorw("Failed to write audit record", "serial", rec.Serial, "error", err)
+	}
+}
+
+// fetchedUpstreams returns the HTTP upstreams whose last fetch succeeded.
+func (s *Server) fetchedUpstreams() []string {
+	s.upstreamsMu.RLock()
+	var urls []string
+	for url, st := range s.upstreams {
+		if st.LastFetchSuccess {
+			urls = append(urls, url)
+		}
+	}
+	s.upstreamsMu.RUnlock()
+	urls = slices.DeleteFunc(urls, func(url string) bool { return !s.isHTTPSource(url) })
+	slices.Sort(urls)
+	return urls
+}
+
+// auditLog appends records to the daily files in dir and removes files older
+// than maxAge days.
+type auditLog struct {
+	mu     sync.Mutex
+	dir    string
+	maxAge uint32 // zero keeps every file
+	file   *os.File
+	day    string // day of file
+}
+
+func newAuditLog(cfg config.Audit) *auditLog {
+	if cfg.Dir == "" {
+		return nil
+	}
+	return &auditLog{dir: cfg.Dir, maxAge: cfg.MaxAge}
+}
+
+// write appends rec and syncs it to disk, so that a record is never lost once
+// routers may have received the change.
+func (a *auditLog) write(rec auditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.open(rec.Time); err != nil {
+		return err
+	}
+	if _, err := a.file.Write(data); err != nil {
+		return fmt.Errorf("failed to write audit record: %w", err)
+	}
+	return a.file.Sync()
+}
+
+// open makes file the one for the day of t, pruning old files whenever it
+// moves on to a new day. The caller must hold mu.
+func (a *auditLog) open(t time.Time) error {
+	day := t.UTC().Format(auditDayLayout)
+	if a.file != nil && a.day == day {
+		return nil
+	}
+	if err := os.MkdirAll(a.dir, 0o750); err != nil {
+		return fmt.Errorf("failed to create audit directory: %w", err)
+	}
+	f, err := os.OpenFile(a.path(day), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit file: %w", err)
+	}
+	if a.file != nil {
+		a.file.Close()
+	}
+	a.file, a.day = f, day
+	return a.prune(t)
+}
+
+// prune removes the files of days more than maxAge days before t.
+func (a *auditLog) prune(t time.Time) error {
+	if a.maxAge == 0 {
+		return nil
+	}
+	days, err := a.days()
+	if err != nil {
+		return err
+	}
+	oldest := t.UTC().AddDate(0, 0, -int(a.maxAge)).Format(auditDayLayout)
+	var errs []error
+	for _, d := range days {
+		if d < oldest {
+			errs = append(errs, os.Remove(a.path(d)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// days lists the days with an audit file, oldest first.
+func (a *auditLog) days() ([]string, error) {
+	entries, err := os.ReadDir(a.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit directory: %w", err)
+	}
+	var days []string
+	for _, e := range entries {
+		day, ok := strings.CutPrefix(e.Name(), "audit-")
+		if day, ok2 := strings.CutSuffix(day, ".jsonl"); ok && ok2 {
+			if _, err := time.Parse(auditDayLayout, day); err == nil {
+				days = append(days, day)
+			}
+		}
+	}
+	slices.Sort(days)
+	return days, nil
+}
+
+func (a *auditLog) path(day string) string {
+	return filepath.Join(a.dir, "audit-"+day+".jsonl")
+}
+
+func (a *auditLog) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	return err
+}
+
+// auditQuery selects the VRPs and ASPAs to follow through the audit log.
+type auditQuery struct {
+	prefix       netip.Prefix // VRPs for exactly this prefix
+	asn          *uint32      // VRP origin, or ASPA customer or provider
+	since, until time.Time    // unbounded when zero
+}
+
+func (q auditQuery) matchVRP(v auditVRP) bool {
+	if q.prefix.IsValid() && v.Prefix != q.prefix {
+		return false
+	}
+	return q.asn == nil || v.ASN == *q.asn
+}
+
+func (q auditQuery) matchASPA(a auditASPA) bool {
+	if q.prefix.IsValid() || q.asn == nil {
+		return false
+	}
+	return a.CustomerASN == *q.asn || slices.Contains(a.ProviderASNs, *q.asn)
+}
+
+// needle is a string every record mentioning a match contains, used to skip
+// decoding the objects of the other records.
+func (q auditQuery) needle() []byte {
+	if q.prefix.IsValid() {
+		return []byte(strconv.Quote(q.prefix.String()))
+	}
+	return []byte(strconv.FormatUint(uint64(*q.asn), 10))
+}
+
+type auditAction int
+
+const (
+	auditAnnounced auditAction = iota + 1
+	auditWithdrawn
+	auditLoaded
+)
+
+// auditEvent is a change to one matching object.
+type auditEvent struct {
+	record *auditHeader
+	action auditAction
+	vrp    *auditVRP
+	aspa   *auditASPA
+}
+
+// query returns every change to the objects matching q, oldest first. A
+// snapshot only produces events for objects whose state it changed: loaded
+// when they were not already being served and withdrawn when they were but
+// are missing from it.
+func (a *auditLog) query(q auditQuery) ([]auditEvent, error) {
+	days, err := a.days()
+	if err != nil {
+		return nil, err
+	}
+	needle := q.needle()
+	present := make(map[string]auditEvent) // objects being served, by key
+
+	var events []auditEvent
+	for _, day := range days {
+		if !q.since.IsZero() && day < q.since.UTC().Format(auditDayLayout) {
+			continue
+		}
+		if !q.until.IsZero() && day > q.until.UTC().Format(auditDayLayout) {
+			break
+		}
+		err := readAuditFile(a.path(day), func(line []byte) error {
+			var h auditHeader
+			if err := json.Unmarshal(line, &h); err != nil {
+				return err
+			}
+			if !q.since.IsZero() && h.Time.Before(q.since) || !q.until.IsZero() && h.Time.After(q.until) {
+				return nil
+			}
+			rec := &h
+
+			var full auditRecord
+			if bytes.Contains(line, needle) {
+				if err := json.Unmarshal(line, &full); err != nil {
+					return err
+				}
+			}
+			matched := matchingEvents(q, rec, full)
+
+			if h.Type == auditSnapshot {
+				loaded := make(map[string]bool)
+				for _, e := range matched {
+					k := e.key()
+					loaded[k] = true
+					if _, ok := present[k]; !ok {
+						events = append(events, e)
+						present[k] = e
+					}
+				}
+				var gone []string
+				for k := range present {
+					if !loaded[k] {
+						gone = append(gone, k)
+					}
+				}
+				slices.Sort(gone)
+				for _, k := range gone {
+					e := present[k]
+					events = append(events, auditEvent{record: rec, action: auditWithdrawn, vrp: e.vrp, aspa: e.aspa})
+					delete(present, k)
+				}
+				return nil
+			}
+
+			for _, e := range matched {
+				if e.action == auditWithdrawn {
+					delete(present, e.key())
+				} else {
+					present[e.key()] = e
+				}
+				events = append(events, e)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read audit file for %s: %w", day, err)
+		}
+	}
+	return events, nil
+}
+
+// matchingEvents returns the events of full for objects matching q, with
+// withdrawals first so that a replaced ASPA reads in order. Objects of a
+// snapshot are loaded.
+func matchingEvents(q auditQuery, rec *auditHeader, full auditRecord) []auditEvent {
+	var events []auditEvent
+	add := func(objs auditObjects, action auditAction) {
+		for _, v := range objs.VRPs {
+			if q.matchVRP(v) {
+				events = append(events, auditEvent{record: rec, action: action, vrp: &v})
+			}
+		}
+		for _, as := range objs.ASPAs {
+			if q.matchASPA(as) {
+				events = append(events, auditEvent{record: rec, action: action, aspa: &as})
+			}
+		}
+	}
+	if rec.Type == auditSnapshot {
+		add(full.Announced, auditLoaded)
+		return events
+	}
+	add(full.Withdrawn, auditWithdrawn)
+	add(full.Announced, auditAnnounced)
+	return events
+}
+
+// key identifies the object of an event.
+func (e auditEvent) key() string {
+	if e.vrp != nil {
+		return fmt.Sprintf("vrp %s-%d AS%d", e.vrp.Prefix, e.vrp.MaxLength, e.vrp.ASN)
+	}
+	return fmt.Sprintf("aspa AS%d %v", e.aspa.CustomerASN, e.aspa.ProviderASNs)
+}
+
+// readAuditFile calls fn with each complete line of an audit file. A final
+// line without a newline is still being written and is skipped.
+func readAuditFile(path string, fn func([]byte) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	rpkirtripb "github.com/mellowdrifter/rpkirtr2/api/v1"
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// auditRecords decodes every record in the audit files of dir.
+func auditRecords(t *testing.T, dir string) []auditRecord {
+	t.Helper()
+	a := &auditLog{dir: dir}
+	days, err := a.days()
+	require.NoError(t, err)
+	var recs []auditRecord
+	for _, day := range days {
+		require.NoError(t, readAuditFile(a.path(day), func(line []byte) error {
+			var rec auditRecord
+			require.NoError(t, json.Unmarshal(line, &rec))
+			recs = append(recs, rec)
+			return nil
+		}))
+	}
+	return recs
+}
+
+// auditSummary describes events as "action prefix-maxlen ASn serial" or
+// "action ASn [providers] serial", for comparing timelines.
+func auditSummary(resp *rpkirtripb.QueryAuditResponse) []string {
+	var out []string
+	for _, e := range resp.Events {
+		action := strings.ToLower(strings.TrimPrefix(e.Action.String(), "AUDIT_ACTION_"))
+		if e.Vrp != nil {
+			out = append(out, fmt.Sprintf("%s %s-%d AS%d %d", action, e.Vrp.Prefix, e.Vrp.MaxLength, e.Vrp.Asn, e.ToSerial))
+		} else {
+			out = append(out, fmt.Sprintf("%s AS%d %v %d", action, e.Aspa.CustomerAsn, e.Aspa.ProviderAsns, e.ToSerial))
+		}
+	}
+	return out
+}
+
+func TestAuditLog(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &config.Config{Audit: config.Audit{Dir: dir}, AdminToken: "s3cr3t"}
+	bg := context.Background()
+
+	a := netip.MustParsePrefix("192.0.2.0/24")
+	b := netip.MustParsePrefix("198.51.100.0/24")
+
+	// First run: startup snapshot, then changes
+	srv := New(cfg, zaptest.NewLogger(t).Sugar())
+	srv.loadInitial(bg, []ROA{{Prefix: a, ASN: 64496, MaxMask: 24}}, nil, nil)
+	srv.UpdateROAs([]ROA{{Prefix: a, ASN: 64496, MaxMask: 24}, {Prefix: b, ASN: 64497, MaxMask: 24}})
+	srv.UpdateASPAs([]ASPA{{CustomerASN: 64496, ProviderASNs: []uint32{64500}}})
+	srv.UpdateASPAs([]ASPA{{CustomerASN: 64496, ProviderASNs: []uint32{64500, 64501}}})
+	srv.UpdateROAs([]ROA{{Prefix: b, ASN: 64497, MaxMask: 24}})
+	srv.UpdateROAs([]ROA{{Prefix: b, ASN: 64497, MaxMask: 24}}) // no diff, no record
+
+	// An override made over the admin service records its caller
+	admin := rpkirtripb.NewRPKIRTRAdminServiceClient(startAdminGRPC(t, srv))
+	_, err := admin.AddPrefixFilter(withToken("s3cr3t"), &rpkirtripb.AddPrefixFilterRequest{Filter: &rpkirtripb.PrefixFilter{Prefix: b.String()}})
+	require.NoError(t, err)
+	require.NoError(t, srv.audit.close())
+
+	recs := auditRecords(t, dir)
+	require.Len(t, recs, 6)
+	assert.Equal(t, auditSnapshot, recs[0].Type)
+	diff := recs[1]
+	assert.Equal(t, auditDiff, diff.Type)
+	assert.Equal(t, sourceManual, diff.Source)
+	assert.Equal(t, diff.FromSerial+1, diff.Serial)
+	assert.Equal(t, []auditVRP{{Prefix: b, MaxLength: 24, ASN: 64497}}, diff.Announced.VRPs)
+	assert.Empty(t, diff.Withdrawn.VRPs)
+	assert.Equal(t, recs[4].Serial, recs[5].FromSerial, "records chain")
+	assert.Equal(t, sourceOverride, recs[5].Source)
+	assert.Equal(t, "admin_token", recs[5].Principal)
+	assert.Empty(t, recs[4].Principal)
+
+	// Second run: a is back in the data loaded at startup
+	srv2 := New(cfg, zaptest.NewLogger(t).Sugar())
+	srv2.loadInitial(bg, []ROA{{Prefix: a, ASN: 64496, MaxMask: 24}}, []ASPA{{CustomerASN: 64496, ProviderASNs: []uint32{64500, 64501}}}, nil)
+	g := &grpcServer{srv: srv2}
+
+	resp, err := g.QueryAudit(bg, &rpkirtripb.QueryAuditRequest{Prefix: "192.0.2.0/24"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		fmt.Sprint("loaded 192.0.2.0/24-24 AS64496 ", recs[0].Serial),
+		fmt.Sprint("withdrawn 192.0.2.0/24-24 AS64496 ", recs[4].Serial),
+		fmt.Sprint("loaded 192.0.2.0/24-24 AS64496 ", srv2.getSerial()),
+	}, auditSummary(resp))
+
+	resp, err = g.QueryAudit(bg, &rpkirtripb.QueryAuditRequest{Prefix: "198.51.100.0/24"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		fmt.Sprint("announced 198.51.100.0/24-24 AS64497 ", recs[1].Serial),
+		fmt.Sprint("withdrawn 198.51.100.0/24-24 AS64497 ", recs[5].Serial),
+	}, auditSummary(resp))
+	assert.Equal(t, "admin_token", resp.Events[1].Principal)
+
+	// An AS matches VRP origins and ASPA customers. The ASPA loaded at startup
+	// was already being served, so it adds no event
+	asn := uint32(64496)
+	resp, err = g.QueryAudit(bg, &rpkirtripb.QueryAuditRequest{Asn: &asn})
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		fmt.Sprint("loaded 192.0.2.0/24-24 AS64496 ", recs[0].Serial),
+		fmt.Sprint("announced AS64496 [64500] ", recs[2].Serial),
+		fmt.Sprint("withdrawn AS64496 [64500] ", recs[3].Serial),
+		fmt.Sprint("announced AS64496 [64500 64501] ", recs[3].Serial),
+		fmt.Sprint("withdrawn 192.0.2.0/24-24 AS64496 ", recs[4].Serial),
+		fmt.Sprint("loaded 192.0.2.0/24-24 AS64496 ", srv2.getSerial()),
+	}, auditSummary(resp))
+
+	provider := uint32(64501)
+	resp, err = g.QueryAudit(bg, &rpkirtripb.QueryAuditRequest{Asn: &provider})
+	require.NoError(t, err)
+	assert.Len(t, resp.Events, 1, "providers match ASPAs")
+
+	resp, err = g.QueryAudit(bg, &rpkirtripb.QueryAuditRequest{Prefix: "198.51.100.0/24", Since: time.Now().Add(time.Hour).Unix()})
+	require.NoError(t, err)
+	assert.Empty(t, resp.Events)
+
+	_, err = g.QueryAudit(bg, &rpkirtripb.QueryAuditRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = (&grpcServer{srv: New(&config.Config{}, zaptest.NewLogger(t).Sugar())}).QueryAudit(bg, &rpkirtripb.QueryAuditRequest{Prefix: "192.0.2.0/24"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestAuditRetention(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	for _, day := range []string{"2026-10-01", "2026-10-10", "2026-10-11"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "audit-"+day+".jsonl"), nil, 0o600))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0o600))
+
+	a := newAuditLog(config.Audit{Dir: dir, MaxAge: 7})
+	require.NoError(t, a.write(auditRecord{auditHeader: auditHeader{Time: now, Type: auditDiff}}))
+	require.NoError(t, a.close())
+
+	days, err := a.days()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2026-10-11", "2026-10-18"}, days)
+	_, err = os.Stat(filepath.Join(dir, "notes.txt"))
+	assert.NoError(t, err, "other files are left alone")
+
+	assert.Nil(t, newAuditLog(config.Audit{}))
+}
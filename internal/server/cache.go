@@ -2,8 +2,12 @@ package server
 
 import (
 	"context"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const maxHistory = 10
@@ -13,19 +17,70 @@ type cache struct {
 	// TODO(perf): ROAs are re-marshalled into PDUs on every client send. Pre-building PDU bytes at load time would reduce per-client CPU at scale.
 	roas       []ROA
 	aspas      []ASPA
+	routerKeys []RouterKey
 	history    []diffRecord
 	serial     uint32
 	session    uint16
 	lastUpdate time.Time
+
+	// input is what the cache was last built from, before local overrides
+	input upstreamData
+
+	compressed int // VRPs left out of roas by compression
+
+	// loading is set until the first sync of the RTR upstreams, see
+	// Server.checkLoaded. Queries are answered with No Data Available.
+	loading atomic.Bool
+
+	// roaGen changes whenever roas is replaced and invalidates trie
+	roaGen uint64
+	trieMu sync.Mutex // serialises trie builds
+	trie   *roaTrie
 }
 
 type diffRecord struct {
 	from    uint32
 	to      uint32
+	time    time.Time
+	source  string   // what produced the change, see diffSet
+	changed []string // HTTP upstreams whose data changed, see diffSet
 	add     []ROA
 	del     []ROA
 	addAspa []ASPA
 	delAspa []ASPA
+	addKeys []RouterKey
+	delKeys []RouterKey
+}
+
+// diffSet is the net set of changes a client needs to move between two serials.
+type diffSet struct {
+	addRoa  []ROA
+	delRoa  []ROA
+	addAspa []ASPA
+	delAspa []ASPA
+	addKeys []RouterKey
+	delKeys []RouterKey
+
+	// source records what produced the change in the history: sourceRefresh,
+	// the address of an RTR upstream, sourceOverride, sourceResume or
+	// sourceManual.
+	source string
+	// changed lists, for sourceRefresh, the HTTP upstreams whose data
+	// changed since their previous fetch.
+	changed []string
+}
+
+const (
+	sourceRefresh  = "refresh"
+	sourceOverride = "override"
+	sourceResume   = "resume" // changes held back while updates were paused
+	sourceManual   = "manual"
+)
+
+func (d diffSet) empty() bool {
+	return len(d.addRoa) == 0 && len(d.delRoa) == 0 &&
+		len(d.addAspa) == 0 && len(d.delAspa) == 0 &&
+		len(d.addKeys) == 0 && len(d.delKeys) == 0
 }
 
 func newCache() *cache {
@@ -38,22 +93,43 @@ func newCache() *cache {
 
 func (c *cache) replaceRoas(roas []ROA) {
 	c.roas = roas
+	c.roaGen++
 }
 
 func (c *cache) replaceAspas(aspas []ASPA) {
 	c.aspas = aspas
 }
 
+func (c *cache) replaceRouterKeys(keys []RouterKey) {
+	c.routerKeys = keys
+}
+
 func (c *cache) updateDiffs(roas []ROA, addRoa, delRoa []ROA, aspas []ASPA, addAspa, delAspa []ASPA) {
-	c.roas = roas
+	c.updateDiffSet(roas, aspas, c.routerKeys, diffSet{
+		addRoa:  addRoa,
+		delRoa:  delRoa,
+		addAspa: addAspa,
+		delAspa: delAspa,
+	})
+}
+
+// updateDiffSet replaces the cached data and appends the diff to the history ring.
+func (c *cache) updateDiffSet(roas []ROA, aspas []ASPA, keys []RouterKey, d diffSet) {
+	c.replaceRoas(roas)
 	c.aspas = aspas
+	c.routerKeys = keys
 	newDiff := diffRecord{
 		from:    c.serial,
 		to:      c.serial + 1,
-		add:     addRoa,
-		del:     delRoa,
-		addAspa: addAspa,
-		delAspa: delAspa,
+		time:    time.Now(),
+		source:  d.source,
+		changed: d.changed,
+		add:     d.addRoa,
+		del:     d.delRoa,
+		addAspa: d.addAspa,
+		delAspa: d.delAspa,
+		addKeys: d.addKeys,
+		delKeys: d.delKeys,
 	}
 	c.history = append(c.history, newDiff)
 	if len(c.history) > maxHistory {
@@ -73,11 +149,18 @@ func (c *cache) incrementSerial() {
 }
 
 func (c *cache) getDiffsFrom(serial uint32) ([]ROA, []ROA, []ASPA, []ASPA, bool) {
+	d, ok := c.getDiffSetFrom(serial)
+	return d.addRoa, d.delRoa, d.addAspa, d.delAspa, ok
+}
+
+// getDiffSetFrom returns the net changes from serial to the current serial.
+// The boolean is false if serial is no longer covered by the history ring.
+func (c *cache) getDiffSetFrom(serial uint32) (diffSet, bool) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
 	if serial == c.serial {
-		return nil, nil, nil, nil, true
+		return diffSet{}, true
 	}
 
 	// Find the sequence of diffs starting from 'serial'
@@ -90,54 +173,107 @@ func (c *cache) getDiffsFrom(serial uint32) ([]ROA, []ROA, []ASPA, []ASPA, bool)
 	}
 
 	if startIdx == -1 {
-		return nil, nil, nil, nil, false
+		return diffSet{}, false
+	}
+
+	return aggregateDiffs(c.history[startIdx:]), true
+}
+
+// getDiffSetBetween returns the net changes between two retained serials.
+// The boolean is false unless from and to bound a run of the history ring.
+func (c *cache) getDiffSetBetween(from, to uint32) (diffSet, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if from == to {
+		return diffSet{}, from == c.serial || slices.ContainsFunc(c.history, func(d diffRecord) bool {
+			return d.from == from || d.to == from
+		})
 	}
 
-	// Aggregate all diffs from startIdx to the end, cancelling opposing operations
+	start := slices.IndexFunc(c.history, func(d diffRecord) bool { return d.from == from })
+	if start == -1 {
+		return diffSet{}, false
+	}
+	for i := start; i < len(c.history); i++ {
+		if c.history[i].to == to {
+			return aggregateDiffs(c.history[start : i+1]), true
+		}
+	}
+	return diffSet{}, false
+}
+
+// getHistory returns a copy of the history ring, oldest first.
+func (c *cache) getHistory() []diffRecord {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Clone(c.history)
+}
+
+// aggregateDiffs merges consecutive diff records, cancelling opposing operations.
+func aggregateDiffs(records []diffRecord) diffSet {
 	roaNet := make(map[roaKey]int)
 	roaData := make(map[roaKey]ROA)
 	aspaNet := make(map[uint32]int)
 	aspaData := make(map[uint32]ASPA)
-	var allAdd, allDel []ROA
-	var allAddAspa, allDelAspa []ASPA
+	keyNet := make(map[routerKeyID]int)
+	keyData := make(map[routerKeyID]RouterKey)
+	var out diffSet
 
-	for i := startIdx; i < len(c.history); i++ {
-		for _, r := range c.history[i].add {
+	for _, rec := range records {
+		for _, r := range rec.add {
 			rk := r.key()
 			roaNet[rk]++
 			roaData[rk] = r
 		}
-		for _, r := range c.history[i].del {
+		for _, r := range rec.del {
 			rk := r.key()
 			roaNet[rk]--
 			roaData[rk] = r
 		}
-		for _, a := range c.history[i].addAspa {
+		for _, a := range rec.addAspa {
 			aspaNet[a.CustomerASN]++
 			aspaData[a.CustomerASN] = a
 		}
-		for _, a := range c.history[i].delAspa {
+		for _, a := range rec.delAspa {
 			aspaNet[a.CustomerASN]--
 			aspaData[a.CustomerASN] = a
 		}
+		for _, k := range rec.addKeys {
+			id := k.id()
+			keyNet[id]++
+			keyData[id] = k
+		}
+		for _, k := range rec.delKeys {
+			id := k.id()
+			keyNet[id]--
+			keyData[id] = k
+		}
 	}
 
 	for rk, net := range roaNet {
 		if net > 0 {
-			allAdd = append(allAdd, roaData[rk])
+			out.addRoa = append(out.addRoa, roaData[rk])
 		} else if net < 0 {
-			allDel = append(allDel, roaData[rk])
+			out.delRoa = append(out.delRoa, roaData[rk])
 		}
 	}
 	for asn, net := range aspaNet {
 		if net > 0 {
-			allAddAspa = append(allAddAspa, aspaData[asn])
+			out.addAspa = append(out.addAspa, aspaData[asn])
+		} else if net < 0 {
+			out.delAspa = append(out.delAspa, aspaData[asn])
+		}
+	}
+	for id, net := range keyNet {
+		if net > 0 {
+			out.addKeys = append(out.addKeys, keyData[id])
 		} else if net < 0 {
-			allDelAspa = append(allDelAspa, aspaData[asn])
+			out.delKeys = append(out.delKeys, keyData[id])
 		}
 	}
 
-	return allAdd, allDel, allAddAspa, allDelAspa, true
+	return out
 }
 
 type cacheState struct {
@@ -145,7 +281,9 @@ type cacheState struct {
 	session    uint16
 	roas       []ROA
 	aspas      []ASPA
+	routerKeys []RouterKey
 	lastUpdate time.Time
+	compressed int
 }
 
 func (c *cache) getState() cacheState {
@@ -156,72 +294,269 @@ func (c *cache) getState() cacheState {
 		session:    c.session,
 		roas:       c.roas,
 		aspas:      c.aspas,
+		routerKeys: c.routerKeys,
 		lastUpdate: c.lastUpdate,
+		compressed: c.compressed,
 	}
 }
 
 func (s *Server) periodicROAUpdater(ctx context.Context) {
 	defer s.wg.Done()
-	if s.cfg.RefreshInterval == 0 {
+	interval := s.refreshInterval()
+	if interval == 0 {
 		<-ctx.Done()
 		return
 	}
-	ticker := time.NewTicker(time.Duration(s.cfg.RefreshInterval) * time.Second)
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	refresh := func(reason string, run func(context.Context) error) {
+		if s.paused.Load() {
+			s.logger.Debugw("Updates paused, skipping refresh", "reason", reason)
+			return
+		}
+		s.logger.Infow("Refreshing", "reason", reason)
+		if err := run(ctx); err != nil {
+			s.logger.Errorw("Refresh failed", "reason", reason, "error", err)
+		}
+	}
+
 	for {
+		// Failed upstreams are retried with backoff between regular cycles
+		var retry <-chan time.Time
+		var retryTimer *time.Timer
+		if next, ok := s.nextRetry(); ok {
+			retryTimer = time.NewTimer(max(time.Until(next), time.Second))
+			retry = retryTimer.C
+		}
+
 		select {
 		case <-ctx.Done():
+			if retryTimer != nil {
+				retryTimer.Stop()
+			}
 			return
 		case <-ticker.C:
-			s.logger.Info("Checking for ROA updates...")
-			if err := s.TriggerRefresh(ctx); err != nil {
-				s.logger.Errorf("failed to update ROAs: %v", err)
+			refresh("scheduled", s.TriggerRefresh)
+		case <-retry:
+			refresh("retry", s.retryFailed)
+		case <-s.refreshNow:
+			// The interval may have been changed by a reload
+			if interval = s.refreshInterval(); interval > 0 {
+				ticker.Reset(interval)
 			}
+			refresh("requested", s.TriggerRefresh)
+		}
+		if retryTimer != nil {
+			retryTimer.Stop()
 		}
 	}
 }
 
-// TriggerRefresh forces a reload of ROAs from all configured URLs.
+// TriggerRefresh forces a reload of ROAs, ASPAs and router keys from all configured upstreams.
 func (s *Server) TriggerRefresh(ctx context.Context) error {
-	newROAs, err := s.loadROAs(ctx)
-	if err != nil {
-		return err
+	return s.refreshSources(ctx, nil)
+}
+
+// retryFailed fetches only the HTTP upstreams whose retry is due, and rebuilds
+// the cache with the last good data of the others.
+func (s *Server) retryFailed(ctx context.Context) error {
+	now := time.Now()
+	s.upstreamsMu.RLock()
+	due := make(map[string]bool)
+	for url, stats := range s.upstreams {
+		if !stats.LastFetchSuccess && !stats.NextAttempt.IsZero() && !stats.NextAttempt.After(now) {
+			due[url] = true
+		}
 	}
-	newASPAs, err := s.loadASPAs(ctx)
+	s.upstreamsMu.RUnlock()
+	return s.refreshSources(ctx, func(url string) bool { return due[url] })
+}
+
+// refreshSources fetches the HTTP upstreams selected by due, or all of them if
+// due is nil, and rebuilds the cache. The upstreams whose data changed are
+// recorded with the diff.
+func (s *Server) refreshSources(ctx context.Context, due func(url string) bool) (err error) {
+	ctx, span := startSpan(ctx, "refresh", attribute.Bool("refresh.all", due == nil))
+	defer func() { endSpan(span, err) }()
+
+	round := &fetchRound{due: due}
+	newROAs, newASPAs, newKeys, err := s.loadAll(ctx, round)
 	if err != nil {
-		s.logger.Warnf("failed to refresh ASPAs, keeping previous: %v", err)
-		s.rlock()
-		newASPAs = s.cache.aspas
-		s.runlock()
+		return err
 	}
-	s.updateCache(newROAs, newASPAs)
+
+	s.sourcesMu.Lock()
+	defer s.sourcesMu.Unlock()
+	s.fetched = upstreamData{roas: newROAs, aspas: newASPAs, routerKeys: newKeys}
+	s.heldBack = false // applied along with the fetched data
+	roas, aspas, keys := s.mergeSources(ctx)
+	s.updateCacheFrom(ctx, sourceRefresh, round.changedUpstreams(), roas, aspas, keys)
 	return nil
 }
 
-func (s *Server) updateCache(newROAs []ROA, newASPAs []ASPA) {
+// rebuildCache merges the most recent HTTP data with every mirrored RTR cache
+// and applies the result. It is called whenever an RTR upstream changes, and
+// source names that upstream in the history. Nothing is applied while updates
+// are paused; ResumeUpdates applies what was held back.
+func (s *Server) rebuildCache(source string) {
+	s.sourcesMu.Lock()
+	defer s.sourcesMu.Unlock()
+	if s.paused.Load() {
+		s.logger.Debugw("Updates paused, holding back changes", "source", source)
+		s.heldBack = true
+		return
+	}
+	s.rebuildLocked(source)
+}
+
+// applyHeldBack rebuilds the cache if changes were held back while updates
+// were paused.
+func (s *Server) applyHeldBack() {
+	s.sourcesMu.Lock()
+	defer s.sourcesMu.Unlock()
+	if s.heldBack {
+		s.heldBack = false
+		s.rebuildLocked(sourceResume)
+	}
+}
+
+// rebuildLocked merges and applies the sources. The caller must hold
+// sourcesMu.
+func (s *Server) rebuildLocked(source string) {
+	ctx, span := startSpan(context.Background(), "rebuild", attribute.String("rpki.source", source))
+	defer span.End()
+
+	roas, aspas, keys := s.mergeSources(ctx)
+	s.updateCacheFrom(ctx, source, nil, roas, aspas, keys)
+}
+
+// mergeSources combines the fetched HTTP data with a snapshot of each RTR
+// upstream into new validated, sorted sets. The caller must hold sourcesMu.
+func (s *Server) mergeSources(ctx context.Context) ([]ROA, []ASPA, []RouterKey) {
+	_, span := startSpan(ctx, "refresh.merge", attribute.Int("rpki.rtr_upstreams", len(s.rtrUpstreams)))
+	defer span.End()
+
+	roas := append([]ROA(nil), s.fetched.roas...)
+	aspas := append([]ASPA(nil), s.fetched.aspas...)
+	keys := append([]RouterKey(nil), s.fetched.routerKeys...)
+	for _, u := range s.rtrUpstreams {
+		d := u.snapshot()
+		roas = append(roas, d.roas...)
+		aspas = append(aspas, d.aspas...)
+		keys = append(keys, d.routerKeys...)
+	}
+	roas, aspas, keys = GetSetOfValidatedROAs(roas), DeduplicateASPAsInPlace(aspas), DeduplicateRouterKeysInPlace(keys)
+	span.SetAttributes(dataAttributes(roas, aspas, keys)...)
+	return roas, aspas, keys
+}
+
+// loadAll fetches the legacy ROA and ASPA URLs as well as the unified HTTP
+// upstreams selected by round, or all of them if round is nil, and merges the
+// results with the last good data of the others into validated, sorted sets.
+func (s *Server) loadAll(ctx context.Context, round *fetchRound) ([]ROA, []ASPA, []RouterKey, error) {
+	urls, _, upstreams := s.httpSources()
+	loadCtx, span := startSpan(ctx, "refresh.load")
+	roas, roaErr := s.loadROAs(loadCtx, round)
+	feed, feedErr := s.loadUpstreams(loadCtx, round)
+	aspas, aspaErr := s.loadASPAs(loadCtx, round)
+	span.End()
+
+	// Each failed source contributes what it last provided
+	switch {
+	case roaErr != nil && (len(upstreams) == 0 || feedErr != nil):
+		return nil, nil, nil, roaErr
+	case feedErr != nil && len(urls) == 0:
+		return nil, nil, nil, feedErr
+	case roaErr != nil:
+		s.logger.Warnw("Failed to refresh ROA URLs, keeping previous", "error", roaErr)
+	case feedErr != nil:
+		s.logger.Warnw("Failed to refresh unified upstreams, keeping previous", "error", feedErr)
+	}
+	if aspaErr != nil {
+		s.logger.Warnw("Failed to refresh ASPAs, keeping previous", "error", aspaErr)
+	}
+
+	_, span = startSpan(ctx, "refresh.validate")
+	keys := feed.routerKeys
+	aspas = append(aspas, feed.aspas...)
+	roas = GetSetOfValidatedROAs(append(roas, feed.roas...))
+	aspas = DeduplicateASPAsInPlace(aspas)
+	keys = DeduplicateRouterKeysInPlace(keys)
+	span.SetAttributes(dataAttributes(roas, aspas, keys)...)
+	span.End()
+	return roas, aspas, keys, nil
+}
+
+// updateCacheFrom applies new data to the cache, after local overrides,
+// recording source and the changed HTTP upstreams in the history if anything
+// changed.
+func (s *Server) updateCacheFrom(ctx context.Context, source string, changed []string, newROAs []ROA, newASPAs []ASPA, newKeys []RouterKey) {
+	ctx, span := startSpan(ctx, "cache.update", attribute.String("rpki.source", source))
+	defer span.End()
+
 	newROAs = filterExpired(newROAs, time.Now())
 	newASPAs = filterExpiredASPAs(newASPAs, time.Now())
+	newKeys = filterExpiredRouterKeys(newKeys, time.Now())
+	input := upstreamData{roas: newROAs, aspas: newASPAs, routerKeys: newKeys}
+	newROAs, newASPAs = s.overrides.active(time.Now()).apply(newROAs, newASPAs)
+	newROAs, compressed := s.compress(newROAs)
+	span.SetAttributes(attribute.Int("rpki.vrps_compressed", compressed))
 
+	_, diffSpan := startSpan(ctx, "cache.diff")
 	s.lock()
+	s.cache.input = input
+	s.cache.compressed = compressed
 	roaDiff := makeDiff(newROAs, s.cache.roas)
 	aspaDiff := makeASPADiff(newASPAs, s.cache.aspas)
+	keyDiff := makeRouterKeyDiff(newKeys, s.cache.routerKeys)
+
+	diff := diffSet{
+		addRoa:  roaDiff.addRoa,
+		delRoa:  roaDiff.delRoa,
+		addAspa: aspaDiff.addAspa,
+		delAspa: aspaDiff.delAspa,
+		addKeys: keyDiff.addKeys,
+		delKeys: keyDiff.delKeys,
+		source:  source,
+		changed: changed,
+	}
+	hasDiff := !diff.empty()
 
-	hasDiff := len(roaDiff.addRoa) > 0 || len(roaDiff.delRoa) > 0 || len(aspaDiff.addAspa) > 0 || len(aspaDiff.delAspa) > 0
-
+	from, session := s.cache.serial, s.cache.session
 	if hasDiff {
-		s.cache.updateDiffs(newROAs, roaDiff.addRoa, roaDiff.delRoa, newASPAs, aspaDiff.addAspa, aspaDiff.delAspa)
+		s.cache.updateDiffSet(newROAs, newASPAs, newKeys, diff)
 		s.cache.incrementSerial()
 		s.cache.lastUpdate = time.Now()
 	}
+	serial := s.cache.serial
 	s.unlock()
+	diffSpan.SetAttributes(diffAttributes(diff)...)
+	diffSpan.End()
+	span.SetAttributes(attribute.Int64("rtr.serial", int64(serial)))
 
+	// Before notifying, so that routers are not told there is still no data
+	loaded := s.checkLoaded()
 	if hasDiff {
-		s.logger.Debugf("ROA diff: %d added, %d deleted", len(roaDiff.addRoa), len(roaDiff.delRoa))
-		s.logger.Debugf("ASPA diff: %d added, %d deleted", len(aspaDiff.addAspa), len(aspaDiff.delAspa))
+		observeDiff(diff)
+		s.recordAudit(ctx, auditRecord{
+			auditHeader: auditHeader{Time: time.Now(), Type: auditDiff, Session: session, FromSerial: from, Serial: serial, Source: source, Upstreams: changed},
+			Announced:   newAuditObjects(diff.addRoa, diff.addAspa, diff.addKeys),
+			Withdrawn:   newAuditObjects(diff.delRoa, diff.delAspa, diff.delKeys),
+		})
+		s.logger.Debugw("Computed diffs",
+			"roas_added", len(roaDiff.addRoa), "roas_deleted", len(roaDiff.delRoa), "vrps_compressed", compressed,
+			"aspas_added", len(aspaDiff.addAspa), "aspas_deleted", len(aspaDiff.delAspa),
+			"router_keys_added", len(keyDiff.addKeys), "router_keys_deleted", len(keyDiff.delKeys))
+		_, notifySpan := startSpan(ctx, "cache.notify")
 		s.notifyClients()
+		s.notifyWatchers()
+		notifySpan.End()
 	} else {
-		s.logger.Debugf("no diffs in ROAs or ASPAs.")
+		s.logger.Debug("No diffs in ROAs, ASPAs or router keys")
+		if loaded {
+			s.notifyClients()
+		}
 	}
 }
 
@@ -271,17 +606,28 @@ func makeASPADiff(new, old []ASPA) aspaDiffResult {
 // generating diffs and incrementing the serial number. This is primarily for testing.
 func (s *Server) UpdateROAs(roas []ROA) {
 	s.rlock()
-	aspas := s.cache.aspas
+	aspas := s.cache.input.aspas
+	keys := s.cache.input.routerKeys
 	s.runlock()
-	s.updateCache(roas, aspas)
+	s.updateCacheFrom(context.Background(), sourceManual, nil, roas, aspas, keys)
 }
 
 // UpdateASPAs manually triggers a cache update with the provided ASPAs.
 func (s *Server) UpdateASPAs(aspas []ASPA) {
 	s.rlock()
-	roas := s.cache.roas
+	roas := s.cache.input.roas
+	keys := s.cache.input.routerKeys
+	s.runlock()
+	s.updateCacheFrom(context.Background(), sourceManual, nil, roas, aspas, keys)
+}
+
+// UpdateRouterKeys manually triggers a cache update with the provided router keys.
+func (s *Server) UpdateRouterKeys(keys []RouterKey) {
+	s.rlock()
+	roas := s.cache.input.roas
+	aspas := s.cache.input.aspas
 	s.runlock()
-	s.updateCache(roas, aspas)
+	s.updateCacheFrom(context.Background(), sourceManual, nil, roas, aspas, DeduplicateRouterKeysInPlace(keys))
 }
 
 func (s *Server) notifyClients() {
@@ -300,7 +646,7 @@ func (s *Server) notifyClients() {
 	// if a client is slow or dead.
 	go func() {
 		for _, client := range clients {
-			s.logger.Infof("Notifying client %s of new serial %d", client.ID(), s.getSerial())
+			s.logger.Infow("Notifying client of new serial", "client", client.ID(), "serial", s.getSerial())
 			client.notify()
 		}
 	}()
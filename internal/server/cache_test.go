@@ -199,3 +199,41 @@ func TestGetDiffsFromInvariants(t *testing.T) {
 		t.Errorf("expected 0 deletions, got %d", len(del))
 	}
 }
+
+func TestDiffSetBetween(t *testing.T) {
+	c := newCache()
+	c.serial = 10
+
+	roa1 := ROA{Prefix: netip.MustParsePrefix("1.1.1.0/24"), ASN: 1, MaxMask: 24}
+	roa2 := ROA{Prefix: netip.MustParsePrefix("2.2.2.0/24"), ASN: 2, MaxMask: 24}
+
+	// 10 -> 11 add roa1, 11 -> 12 add roa2, 12 -> 13 del roa1
+	c.updateDiffs([]ROA{roa1}, []ROA{roa1}, nil, nil, nil, nil)
+	c.incrementSerial()
+	c.updateDiffs([]ROA{roa1, roa2}, []ROA{roa2}, nil, nil, nil, nil)
+	c.incrementSerial()
+	c.updateDiffs([]ROA{roa2}, nil, []ROA{roa1}, nil, nil, nil)
+	c.incrementSerial()
+
+	d, ok := c.getDiffSetBetween(10, 12)
+	if !ok || len(d.addRoa) != 2 || len(d.delRoa) != 0 {
+		t.Errorf("Expected 10->12 to add 2 ROAs, got %v (%v)", d, ok)
+	}
+	d, ok = c.getDiffSetBetween(11, 13)
+	if !ok || len(d.addRoa) != 1 || d.addRoa[0] != roa2 || len(d.delRoa) != 1 || d.delRoa[0] != roa1 {
+		t.Errorf("Expected 11->13 to add roa2 and delete roa1, got %v (%v)", d, ok)
+	}
+	d, ok = c.getDiffSetBetween(10, 13)
+	if !ok || len(d.addRoa) != 1 || len(d.delRoa) != 0 {
+		t.Errorf("Expected roa1 to cancel out over 10->13, got %v (%v)", d, ok)
+	}
+	if d, ok := c.getDiffSetBetween(12, 12); !ok || !d.empty() {
+		t.Errorf("Expected an empty diff for a retained serial, got %v (%v)", d, ok)
+	}
+
+	for _, r := range [][2]uint32{{9, 12}, {10, 14}, {12, 11}, {5, 5}} {
+		if _, ok := c.getDiffSetBetween(r[0], r[1]); ok {
+			t.Errorf("Expected %d->%d to be rejected", r[0], r[1])
+		}
+	}
+}
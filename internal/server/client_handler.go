@@ -2,15 +2,19 @@ package server
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"io"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/mellowdrifter/rpkirtr2/internal/protocol"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -34,6 +38,11 @@ type Client struct {
 	version   protocol.Version
 	cache     *cache
 	intervals rtrIntervals
+	limiter   *queryLimiter // nil when queries are not rate limited
+	view      *view         // filters what is sent; nil for all data
+	done      chan struct{} // closed by Close
+	stats     clientStats
+	out       map[protocol.PDUType]io.Writer // writer per PDU type, counting what is sent
 }
 
 type rtrIntervals struct {
@@ -41,6 +50,7 @@ type rtrIntervals struct {
 	retryInterval   uint32
 	expireInterval  uint32
 	readTimeout     time.Duration
+	idleTimeout     time.Duration // until the first query
 }
 
 // NewClient wraps a new connection into a Client instance.
@@ -48,15 +58,19 @@ func NewClient(conn net.Conn, baseLogger *zap.SugaredLogger, c *cache) *Client {
 	remote := conn.RemoteAddr().String()
 	logger := baseLogger.With("client", remote)
 
-	return &Client{
+	client := &Client{
 		conn:      conn,
 		reader:    bufio.NewReader(conn),
-		writer:    bufio.NewWriter(conn),
 		logger:    logger,
 		id:        remote,
 		cache:     c,
 		intervals: *newRTRIntervals(),
+		done:      make(chan struct{}),
 	}
+	client.stats.connectedAt = time.Now()
+	client.writer = bufio.NewWriter(countingWriter{w: conn, n: &client.stats.bytesSent})
+	client.out = newPDUWriters(client.writer)
+	return client
 }
 
 // ID returns the unique identifier for the client (IP:Port).
@@ -70,6 +84,7 @@ func newRTRIntervals() *rtrIntervals {
 		retryInterval:   DefaultRetryInterval,
 		expireInterval:  DefaultExpireInterval,
 		readTimeout:     DefaultReadTimeout,
+		idleTimeout:     DefaultReadTimeout,
 	}
 }
 
@@ -79,28 +94,40 @@ func (c *Client) Handle() error {
 
 	c.logger.Info("Client session started")
 
-	// Step 1: Version negotiation
-	c.conn.SetReadDeadline(time.Now().Add(c.intervals.readTimeout))
+	// Step 1: Version negotiation. The first query must arrive within the
+	// idle timeout
+	c.conn.SetReadDeadline(time.Now().Add(c.intervals.idleTimeout))
+	_, span := startSpan(context.Background(), "rtr.negotiate", attribute.String("rtr.client", c.id))
 	ver, err := protocol.Negotiate(c.reader)
 	if err != nil {
-		c.logger.Warnf("Negotiation failed: %v", err)
+		endSpan(span, err)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			c.closeIdle()
+			return nil
+		}
+		c.logger.Warnw("Negotiation failed", "error", err)
 		c.sendAndCloseError("NEGOTIATION_FAILED", protocol.UnsupportedVersion)
 		return err
 	}
+	span.SetAttributes(attribute.Int("rtr.version", int(ver)))
+	span.End()
 
-	c.logger.Infof("Negotiated version: %d", ver)
-	c.version = ver
+	c.logger.Infow("Negotiated version", "version", ver)
+	c.setVersion(ver)
 
 	// Step 2: Client MUST send either a Reset Query or a Serial Query PDU
-	c.conn.SetReadDeadline(time.Now().Add(c.intervals.readTimeout))
 	pdu, err := protocol.GetPDU(c.reader)
 	if err != nil {
-		c.logger.Warnf("Failed to read initial PDU: %v", err)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			c.closeIdle()
+			return nil
+		}
+		c.logger.Warnw("Failed to read initial PDU", "error", err)
 		c.sendAndCloseError("INVALID_REQUEST", protocol.InvalidRequest)
 		return err
 	}
 	if err := c.dispatchPDU(pdu); err != nil {
-		c.logger.Warnf("Failed to dispatch initial PDU: %v", err)
+		c.logger.Warnw("Failed to dispatch initial PDU", "error", err)
 		return err
 	}
 
@@ -113,7 +140,7 @@ func (c *Client) Handle() error {
 				c.logger.Info("Client disconnected")
 				return nil
 			}
-			c.logger.Warnf("Read error: %v", err)
+			c.logger.Warnw("Read error", "error", err)
 			c.sendAndCloseError("READ_ERROR", protocol.CorruptData)
 			return err
 		}
@@ -125,75 +152,169 @@ func (c *Client) Handle() error {
 
 func (c *Client) dispatchPDU(pdu protocol.PDU) error {
 	if c.version != pdu.Version() {
-		c.logger.Warnf("Version mismatch: expected %d, got %d", c.version, pdu.Version())
+		c.logger.Warnw("Version mismatch", "version", c.version, "pdu_version", pdu.Version())
 		c.sendAndCloseError("VERSION_MISMATCH", protocol.UnexpectedVersion)
 		return errors.New("version mismatch")
 	}
 
 	switch pdu.Type() {
 	case protocol.ResetQuery:
-		c.logger.Info("Received Reset Query PDU")
+		c.logger.Infow("Received Reset Query PDU", "version", c.version)
+		c.recordQuery(protocol.ResetQuery, 0)
+		if !c.throttle(protocol.ResetQuery) {
+			return nil
+		}
+		ctx, span := c.startQuerySpan("rtr.reset_query")
+		defer span.End()
+		if c.cache.loading.Load() {
+			c.reply(ctx, "no_data", c.sendNoData)
+			return nil
+		}
 		state := c.cache.getState()
-		c.sendAllData(state.roas, state.aspas, state.session, state.serial)
+		c.reply(ctx, "full", func() {
+			c.sendAllData(c.view.filterROAs(state.roas), c.view.filterASPAs(state.aspas), state.routerKeys, state.session, state.serial)
+		})
 	case protocol.SerialQuery:
-		c.logger.Info("Received Serial Query PDU")
+		c.logger.Infow("Received Serial Query PDU", "version", c.version)
 		sqPDU, ok := pdu.(*protocol.SerialQueryPDU)
 		if !ok {
-			c.logger.Warnf("Failed to cast PDU to *SerialQueryPDU")
+			c.logger.Warn("Failed to cast PDU to *SerialQueryPDU")
 			c.sendAndCloseError("SERIAL_QUERY_CAST_ERROR", protocol.InternalError)
 			return errors.New("failed to cast PDU to *SerialQueryPDU")
 		}
-		if err := c.handleSerialQuery(sqPDU); err != nil {
-			c.logger.Warnf("Failed to handle Serial Query PDU: %v", err)
+		c.recordQuery(protocol.SerialQuery, sqPDU.Serial())
+		if !c.throttle(protocol.SerialQuery) {
+			return nil
+		}
+		ctx, span := c.startQuerySpan("rtr.serial_query",
+			attribute.Int64("rtr.serial", int64(sqPDU.Serial())),
+			attribute.Int("rtr.session", int(sqPDU.Session())))
+		defer span.End()
+		if err := c.handleSerialQuery(ctx, sqPDU); err != nil {
+			failSpan(span, err)
+			c.logger.Warnw("Failed to handle Serial Query PDU", "error", err)
 			c.sendAndCloseError("SERIAL_QUERY_ERROR", protocol.InternalError)
 			return err
 		}
 	default:
-		c.logger.Warnf("Unexpected PDU type: %d", pdu.Type())
+		c.logger.Warnw("Unexpected PDU type", "type", pdu.Type())
 		c.Close()
 		return nil
 	}
 	return nil
 }
 
-func (c *Client) handleSerialQuery(pdu *protocol.SerialQueryPDU) error {
-	c.logger.Info("Handling Serial Query PDU")
+// closeIdle closes a session that sent no query within the idle timeout.
+func (c *Client) closeIdle() {
+	c.logger.Infow("Closing idle session without a query", "idle_timeout", c.intervals.idleTimeout)
+	idleSessionsClosed.Inc()
+	c.Close()
+}
+
+// throttle delays the reply to a query beyond the session's query rate. As
+// the next PDU is only read after the reply, a router querying in a loop is
+// slowed to the rate. It returns false if the connection was closed while
+// waiting.
+func (c *Client) throttle(t protocol.PDUType) bool {
+	if c.limiter == nil {
+		return true
+	}
+	wait := c.limiter.take(time.Now())
+	if wait == 0 {
+		return true
+	}
+	queriesThrottled.WithLabelValues(queryTypeNames[t]).Inc()
+	c.logger.Warnw("Query rate exceeded, delaying reply", "delay", wait)
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+func (c *Client) handleSerialQuery(ctx context.Context, pdu *protocol.SerialQueryPDU) error {
+	if c.cache.loading.Load() {
+		c.reply(ctx, "no_data", c.sendNoData)
+		return nil
+	}
 	serial := pdu.Serial()
 	state := c.cache.getState()
 
 	if pdu.Session() != state.session {
-		c.logger.Infof("Client session ID %d does not match server session ID %d. Sending cache reset.", pdu.Session(), state.session)
-		c.sendCacheReset()
+		c.logger.Infow("Client session does not match, sending cache reset", "session", pdu.Session(), "cache_session", state.session)
+		c.reply(ctx, "cache_reset", c.sendCacheReset)
 		return nil
 	}
 
 	if serial == 0 {
-		c.logger.Infof("Client requested serial 0, so sending cache reset PDU")
-		c.sendCacheReset()
+		c.logger.Infow("Client requested serial 0, sending cache reset", "serial", serial)
+		c.reply(ctx, "cache_reset", c.sendCacheReset)
 		return nil
 	}
 
-	addRoa, delRoa, addAspa, delAspa, found := c.cache.getDiffsFrom(serial)
+	_, span := startSpan(ctx, "rtr.diff", attribute.Int64("rtr.cache_serial", int64(state.serial)))
+	diff, found := c.cache.getDiffSetFrom(serial)
+	if found {
+		diff = c.view.filterDiff(diff)
+		span.SetAttributes(diffAttributes(diff)...)
+	}
+	span.End()
 	if !found {
-		c.logger.Infof("Client requested serial %d, current serial is %d. Serial too old or unknown. Sending cache reset.", serial, state.serial)
-		c.sendCacheReset()
+		c.logger.Infow("Serial too old or unknown, sending cache reset", "serial", serial, "cache_serial", state.serial)
+		c.reply(ctx, "cache_reset", c.sendCacheReset)
 		return nil
 	}
 
-	c.logger.Infof("Client requested serial %d, current serial is %d. Sending %d ROA additions, %d ROA deletions, %d ASPA additions, %d ASPA deletions.", serial, state.serial, len(addRoa), len(delRoa), len(addAspa), len(delAspa))
-	c.sendDiffs(addRoa, delRoa, addAspa, delAspa, state.session, state.serial)
+	c.logger.Infow("Sending diff",
+		"serial", serial, "cache_serial", state.serial,
+		"roas_added", len(diff.addRoa), "roas_deleted", len(diff.delRoa),
+		"aspas_added", len(diff.addAspa), "aspas_deleted", len(diff.delAspa),
+		"router_keys_added", len(diff.addKeys), "router_keys_deleted", len(diff.delKeys))
+	c.reply(ctx, "diff", func() {
+		c.sendDiffs(diff, state.session, state.serial)
+	})
 
 	return nil
 }
 
+// startQuerySpan starts the root span of a query from the router. Each query
+// is its own trace, as sessions last for days.
+func (c *Client) startQuerySpan(name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(attrs, attribute.String("rtr.client", c.id), attribute.Int("rtr.version", int(c.version)))
+	if c.view != nil {
+		attrs = append(attrs, attribute.String("rtr.view", c.view.name))
+	}
+	return startSpan(context.Background(), name, attrs...)
+}
+
+// reply sends the response to a query, traced as rtr.write. The send
+// functions close the connection when a write fails.
+func (c *Client) reply(ctx context.Context, response string, send func()) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("rtr.response", response))
+	_, span := startSpan(ctx, "rtr.write")
+	send()
+	if c.closed.Load() {
+		endSpan(span, errors.New("connection closed while writing"))
+		return
+	}
+	span.End()
+}
+
 func (c *Client) writePDUUnsafe(pdu protocol.PDU) error {
-	if err := pdu.Write(c.writer); err != nil {
+	if err := pdu.Write(c.out[pdu.Type()]); err != nil {
+		return err
+	}
+	if err := c.writer.Flush(); err != nil {
 		return err
 	}
-	return c.writer.Flush()
+	c.recordSent(1, false, 0)
+	return nil
 }
 
-func (c *Client) sendDiffs(add, del []ROA, addAspa, delAspa []ASPA, session uint16, serial uint32) {
+func (c *Client) sendDiffs(d diffSet, session uint16, serial uint32) {
 	c.logger.Info("Sending diffs to client")
 
 	c.writeMu.Lock()
@@ -201,22 +322,22 @@ func (c *Client) sendDiffs(add, del []ROA, addAspa, delAspa []ASPA, session uint
 
 	// 1. Send Cache Response
 	cpdu := protocol.NewCacheResponsePDU(c.version, session)
-	if err := cpdu.Write(c.writer); err != nil {
-		c.logger.Errorf("Failed to write Cache Response PDU: %v", err)
+	if err := cpdu.Write(c.out[protocol.CacheResponse]); err != nil {
+		c.logger.Errorw("Failed to write Cache Response PDU", "error", err)
 		c.Close()
 		return
 	}
 
 	// 2. Send all ROA additions
-	for _, ROA := range add {
+	for _, ROA := range d.addRoa {
 		var err error
 		if ROA.Prefix.Addr().Is4() {
-			err = protocol.WriteIpv4Prefix(c.writer, c.version, protocol.Announce, uint8(ROA.Prefix.Bits()), ROA.MaxMask, ROA.Prefix.Addr().As4(), ROA.ASN)
+			err = protocol.WriteIpv4Prefix(c.out[protocol.Ipv4Prefix], c.version, protocol.Announce, uint8(ROA.Prefix.Bits()), ROA.MaxMask, ROA.Prefix.Addr().As4(), ROA.ASN)
 		} else {
-			err = protocol.WriteIpv6Prefix(c.writer, c.version, protocol.Announce, uint8(ROA.Prefix.Bits()), ROA.MaxMask, ROA.Prefix.Addr().As16(), ROA.ASN)
+			err = protocol.WriteIpv6Prefix(c.out[protocol.Ipv6Prefix], c.version, protocol.Announce, uint8(ROA.Prefix.Bits()), ROA.MaxMask, ROA.Prefix.Addr().As16(), ROA.ASN)
 		}
 		if err != nil {
-			c.logger.Errorf("Failed to write prefix PDU: %v", err)
+			c.logger.Errorw("Failed to write prefix PDU", "error", err)
 			c.Close()
 			return
 		}
@@ -224,69 +345,98 @@ func (c *Client) sendDiffs(add, del []ROA, addAspa, delAspa []ASPA, session uint
 
 	// 3. Send all ASPA additions
 	if c.version >= 2 {
-		for _, aspa := range addAspa {
-			if err := protocol.WriteAspa(c.writer, c.version, protocol.Announce, aspa.CustomerASN, aspa.ProviderASNs); err != nil {
-				c.logger.Errorf("Failed to write ASPA PDU: %v", err)
+		for _, aspa := range d.addAspa {
+			if err := protocol.WriteAspa(c.out[protocol.Aspa], c.version, protocol.Announce, aspa.CustomerASN, aspa.ProviderASNs); err != nil {
+				c.logger.Errorw("Failed to write ASPA PDU", "error", err)
 				c.Close()
 				return
 			}
 		}
 	}
 
-	// 4. Send all ROA deletions
-	for _, ROA := range del {
+	// 4. Send all router key additions
+	if !c.writeRouterKeys(d.addKeys, protocol.Announce) {
+		return
+	}
+
+	// 5. Send all ROA deletions
+	for _, ROA := range d.delRoa {
 		var err error
 		if ROA.Prefix.Addr().Is4() {
-			err = protocol.WriteIpv4Prefix(c.writer, c.version, protocol.Withdraw, uint8(ROA.Prefix.Bits()), ROA.MaxMask, ROA.Prefix.Addr().As4(), ROA.ASN)
+			err = protocol.WriteIpv4Prefix(c.out[protocol.Ipv4Prefix], c.version, protocol.Withdraw, uint8(ROA.Prefix.Bits()), ROA.MaxMask, ROA.Prefix.Addr().As4(), ROA.ASN)
 		} else {
-			err = protocol.WriteIpv6Prefix(c.writer, c.version, protocol.Withdraw, uint8(ROA.Prefix.Bits()), ROA.MaxMask, ROA.Prefix.Addr().As16(), ROA.ASN)
+			err = protocol.WriteIpv6Prefix(c.out[protocol.Ipv6Prefix], c.version, protocol.Withdraw, uint8(ROA.Prefix.Bits()), ROA.MaxMask, ROA.Prefix.Addr().As16(), ROA.ASN)
 		}
 		if err != nil {
-			c.logger.Errorf("Failed to write prefix PDU: %v", err)
+			c.logger.Errorw("Failed to write prefix PDU", "error", err)
 			c.Close()
 			return
 		}
 	}
 
-	// 5. Send all ASPA deletions
+	// 6. Send all ASPA deletions
 	if c.version >= 2 {
-		for _, aspa := range delAspa {
-			if err := protocol.WriteAspa(c.writer, c.version, protocol.Withdraw, aspa.CustomerASN, aspa.ProviderASNs); err != nil {
-				c.logger.Errorf("Failed to write ASPA PDU: %v", err)
+		for _, aspa := range d.delAspa {
+			if err := protocol.WriteAspa(c.out[protocol.Aspa], c.version, protocol.Withdraw, aspa.CustomerASN, aspa.ProviderASNs); err != nil {
+				c.logger.Errorw("Failed to write ASPA PDU", "error", err)
 				c.Close()
 				return
 			}
 		}
 	}
 
-	// 6. Send End of Data
+	// 7. Send all router key deletions
+	if !c.writeRouterKeys(d.delKeys, protocol.Withdraw) {
+		return
+	}
+
+	// 8. Send End of Data
 	epdu := protocol.NewEndOfDataPDU(c.version, session, serial, c.intervals.refreshInterval, c.intervals.retryInterval, c.intervals.expireInterval)
-	if err := epdu.Write(c.writer); err != nil {
-		c.logger.Errorf("Failed to write End of Data PDU: %v", err)
+	if err := epdu.Write(c.out[protocol.EndOfData]); err != nil {
+		c.logger.Errorw("Failed to write End of Data PDU", "error", err)
 		c.Close()
 		return
 	}
 
 	if err := c.writer.Flush(); err != nil {
-		c.logger.Errorf("Failed to flush writer: %v", err)
+		c.logger.Errorw("Failed to flush writer", "error", err)
 		c.Close()
 		return
 	}
+	c.recordSent(2+len(d.addRoa)+len(d.delRoa)+c.aspaPDUs(len(d.addAspa)+len(d.delAspa))+len(d.addKeys)+len(d.delKeys), true, serial)
 }
 
 func (c *Client) sendCacheReset() {
 	c.logger.Info("Sending Cache Reset PDU to client")
+	cacheResetsSent.Inc()
 	rpdu := protocol.NewCacheResetPDU(c.version)
 
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
 
 	if err := c.writePDUUnsafe(rpdu); err != nil {
-		c.logger.Errorf("Failed to write Cache Reset PDU: %v", err)
+		c.logger.Errorw("Failed to write Cache Reset PDU", "error", err)
 	}
 }
 
-func (c *Client) sendAllData(roas []ROA, aspas []ASPA, session uint16, serial uint32) {
+// sendNoData tells the router the cache has no data yet. Unlike other errors
+// No Data Available does not end the session (RFC 8210, section 12), and the
+// router retries after its retry interval.
+func (c *Client) sendNoData() {
+	c.logger.Info("Cache not loaded yet, sending No Data Available")
+	errorReportsSent.WithLabelValues(errorCodeNames[protocol.NoData]).Inc()
+	pdu := protocol.NewErrorReportPDU(c.version, protocol.NoData, nil, "cache not loaded yet")
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if err := c.writePDUUnsafe(pdu); err != nil {
+		c.logger.Errorw("Failed to write Error Report PDU", "error", err)
+		c.Close()
+	}
+}
+
+func (c *Client) sendAllData(roas []ROA, aspas []ASPA, keys []RouterKey, session uint16, serial uint32) {
 	c.logger.Info("Sending all ROAs and ASPAs to client")
 
 	c.writeMu.Lock()
@@ -294,8 +444,8 @@ func (c *Client) sendAllData(roas []ROA, aspas []ASPA, session uint16, serial ui
 
 	// 1. Cache Response
 	cpdu := protocol.NewCacheResponsePDU(c.version, session)
-	if err := cpdu.Write(c.writer); err != nil {
-		c.logger.Errorf("Failed to write Cache Response PDU: %v", err)
+	if err := cpdu.Write(c.out[protocol.CacheResponse]); err != nil {
+		c.logger.Errorw("Failed to write Cache Response PDU", "error", err)
 		c.Close()
 		return
 	}
@@ -304,12 +454,12 @@ func (c *Client) sendAllData(roas []ROA, aspas []ASPA, session uint16, serial ui
 	for _, ROA := range roas {
 		var err error
 		if ROA.Prefix.Addr().Is4() {
-			err = protocol.WriteIpv4Prefix(c.writer, c.version, protocol.Announce, uint8(ROA.Prefix.Bits()), ROA.MaxMask, ROA.Prefix.Addr().As4(), ROA.ASN)
+			err = protocol.WriteIpv4Prefix(c.out[protocol.Ipv4Prefix], c.version, protocol.Announce, uint8(ROA.Prefix.Bits()), ROA.MaxMask, ROA.Prefix.Addr().As4(), ROA.ASN)
 		} else {
-			err = protocol.WriteIpv6Prefix(c.writer, c.version, protocol.Announce, uint8(ROA.Prefix.Bits()), ROA.MaxMask, ROA.Prefix.Addr().As16(), ROA.ASN)
+			err = protocol.WriteIpv6Prefix(c.out[protocol.Ipv6Prefix], c.version, protocol.Announce, uint8(ROA.Prefix.Bits()), ROA.MaxMask, ROA.Prefix.Addr().As16(), ROA.ASN)
 		}
 		if err != nil {
-			c.logger.Errorf("Failed to write prefix PDU: %v", err)
+			c.logger.Errorw("Failed to write prefix PDU", "error", err)
 			c.Close()
 			return
 		}
@@ -318,27 +468,54 @@ func (c *Client) sendAllData(roas []ROA, aspas []ASPA, session uint16, serial ui
 	// 3. ASPA PDUs
 	if c.version >= 2 {
 		for _, aspa := range aspas {
-			if err := protocol.WriteAspa(c.writer, c.version, protocol.Announce, aspa.CustomerASN, aspa.ProviderASNs); err != nil {
-				c.logger.Errorf("Failed to write ASPA PDU: %v", err)
+			if err := protocol.WriteAspa(c.out[protocol.Aspa], c.version, protocol.Announce, aspa.CustomerASN, aspa.ProviderASNs); err != nil {
+				c.logger.Errorw("Failed to write ASPA PDU", "error", err)
 				c.Close()
 				return
 			}
 		}
 	}
 
-	// 4. End of Data
+	// 4. Router Key PDUs
+	if !c.writeRouterKeys(keys, protocol.Announce) {
+		return
+	}
+
+	// 5. End of Data
 	epdu := protocol.NewEndOfDataPDU(c.version, session, serial, c.intervals.refreshInterval, c.intervals.retryInterval, c.intervals.expireInterval)
-	if err := epdu.Write(c.writer); err != nil {
-		c.logger.Errorf("Failed to write End of Data PDU: %v", err)
+	if err := epdu.Write(c.out[protocol.EndOfData]); err != nil {
+		c.logger.Errorw("Failed to write End of Data PDU", "error", err)
 		c.Close()
 		return
 	}
 
 	if err := c.writer.Flush(); err != nil {
-		c.logger.Errorf("Failed to flush writer: %v", err)
+		c.logger.Errorw("Failed to flush writer", "error", err)
 		c.Close()
 		return
 	}
+	c.recordSent(2+len(roas)+c.aspaPDUs(len(aspas))+len(keys), true, serial)
+}
+
+// aspaPDUs returns how many of n ASPAs are sent, as they are only sent from version 2.
+func (c *Client) aspaPDUs(n int) int {
+	if c.version >= 2 {
+		return n
+	}
+	return 0
+}
+
+// writeRouterKeys writes Router Key PDUs without flushing. The caller must hold writeMu.
+// It reports false, after closing the connection, if a write failed.
+func (c *Client) writeRouterKeys(keys []RouterKey, flags uint8) bool {
+	for _, k := range keys {
+		if err := protocol.WriteRouterKey(c.out[protocol.RouterKey], c.version, flags, k.SKI, k.ASN, k.SPKI); err != nil {
+			c.logger.Errorw("Failed to write Router Key PDU", "error", err)
+			c.Close()
+			return false
+		}
+	}
+	return true
 }
 
 func (c *Client) sendAndCloseError(msg string, code protocol.ErrorCode) {
@@ -347,6 +524,7 @@ func (c *Client) sendAndCloseError(msg string, code protocol.ErrorCode) {
 		version = 2
 	}
 	pdu := protocol.NewErrorReportPDU(version, code, []byte(msg), msg)
+	errorReportsSent.WithLabelValues(errorCodeNames[code]).Inc()
 
 	c.writeMu.Lock()
 	// No defer unlock because we might close the connection
@@ -370,7 +548,8 @@ func isDisconnectError(err error) bool {
 func (c *Client) Close() {
 	c.closeOnce.Do(func() {
 		c.closed.Store(true)
-		c.logger.Infof("Closing connection to client: %s", c.id)
+		close(c.done)
+		c.logger.Info("Closing connection to client")
 		if c.conn != nil {
 			_ = c.conn.Close()
 		}
@@ -392,7 +571,7 @@ func (c *Client) notify() {
 	defer c.writeMu.Unlock()
 
 	if err := c.writePDUUnsafe(pdu); err != nil {
-		c.logger.Errorf("Failed to write Serial Notify PDU: %v", err)
+		c.logger.Errorw("Failed to write Serial Notify PDU", "error", err)
 		c.Close()
 	}
 }
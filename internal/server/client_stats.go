@@ -0,0 +1,104 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/protocol"
+)
+
+// clientStats tracks a router session for inspection over gRPC.
+type clientStats struct {
+	connectedAt time.Time
+	bytesSent   atomic.Uint64
+	pdusSent    atomic.Uint64
+
+	mu          sync.Mutex
+	lastQuery   protocol.PDUType
+	lastQueryAt time.Time // zero until the first query
+	ackSerial   uint32    // serial from the last Serial Query
+	sentSerial  uint32    // serial of the last End of Data sent
+	synced      bool      // an End of Data has been sent
+}
+
+// clientInfo is a point in time view of a client session.
+type clientInfo struct {
+	id          string
+	view        string
+	version     protocol.Version
+	connectedAt time.Time
+	lastQuery   protocol.PDUType
+	lastQueryAt time.Time
+	ackSerial   uint32
+	sentSerial  uint32
+	synced      bool
+	bytesSent   uint64
+	pdusSent    uint64
+}
+
+var queryTypeNames = map[protocol.PDUType]string{
+	protocol.ResetQuery:  "reset",
+	protocol.SerialQuery: "serial",
+}
+
+// countingWriter counts the bytes written to the connection.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Uint64
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n.Add(uint64(n))
+	return n, err
+}
+
+func (c *Client) setVersion(v protocol.Version) {
+	c.stats.mu.Lock()
+	c.version = v
+	c.stats.mu.Unlock()
+}
+
+func (c *Client) recordQuery(t protocol.PDUType, serial uint32) {
+	queriesReceived.WithLabelValues(queryTypeNames[t]).Inc()
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+	c.stats.lastQuery = t
+	c.stats.lastQueryAt = time.Now()
+	if t == protocol.SerialQuery {
+		c.stats.ackSerial = serial
+	}
+}
+
+// recordSent counts PDUs written and, for responses ending in End of Data, the
+// serial the router now holds.
+func (c *Client) recordSent(pdus int, endOfData bool, serial uint32) {
+	c.stats.pdusSent.Add(uint64(pdus))
+	if !endOfData {
+		return
+	}
+	c.stats.mu.Lock()
+	c.stats.sentSerial = serial
+	c.stats.synced = true
+	c.stats.mu.Unlock()
+}
+
+func (c *Client) info() clientInfo {
+	c.stats.mu.Lock()
+	defer c.stats.mu.Unlock()
+	return clientInfo{
+		id:          c.id,
+		view:        c.view.label(),
+		version:     c.version,
+		connectedAt: c.stats.connectedAt,
+		lastQuery:   c.stats.lastQuery,
+		lastQueryAt: c.stats.lastQueryAt,
+		ackSerial:   c.stats.ackSerial,
+		sentSerial:  c.stats.sentSerial,
+		synced:      c.stats.synced,
+		bytesSent:   c.stats.bytesSent.Load(),
+		pdusSent:    c.stats.pdusSent.Load(),
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+)
+
+// compressROAs removes the VRPs that another VRP for the same origin makes
+// redundant: one whose prefix covers theirs with a max length at least as
+// long. Every route a removed VRP matches is matched by the one covering it,
+// and every route it covers is covered by that one too, so route origin
+// validation gives the same result for every route. The order of the
+// remaining VRPs is kept. It returns them and the number removed.
+//
+// A removed VRP comes back on the next update if the one covering it is
+// withdrawn or expires, as compression is applied to the full data each time.
+func compressROAs(roas []ROA) ([]ROA, int) {
+	// Walk each origin's prefixes depth first, parents before children and
+	// equal prefixes by decreasing max length, keeping the chain of prefixes
+	// covering the current one
+	order := make([]int, len(roas))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(i, j int) int {
+		a, b := roas[i], roas[j]
+		if c := cmp.Compare(a.ASN, b.ASN); c != 0 {
+			return c
+		}
+		if c := a.Prefix.Addr().Compare(b.Prefix.Addr()); c != 0 {
+			return c
+		}
+		if c := cmp.Compare(a.Prefix.Bits(), b.Prefix.Bits()); c != 0 {
+			return c
+		}
+		return cmp.Compare(b.MaxMask, a.MaxMask)
+	})
+
+	type covering struct {
+		prefix  netip.Prefix
+		asn     uint32
+		maxMask uint8 // longest max length of this prefix and those covering it
+	}
+	var chain []covering
+	redundant := make([]bool, len(roas))
+	removed := 0
+	for _, i := range order {
+		r := roas[i]
+		for len(chain) > 0 {
+			top := chain[len(chain)-1]
+			if top.asn == r.ASN && top.prefix.Bits() <= r.Prefix.Bits() && top.prefix.Contains(r.Prefix.Addr()) {
+				break
+			}
+			chain = chain[:len(chain)-1]
+		}
+		maxMask := r.MaxMask
+		if len(chain) > 0 {
+			best := chain[len(chain)-1].maxMask
+			if best >= r.MaxMask {
+				redundant[i] = true
+				removed++
+			}
+			maxMask = max(maxMask, best)
+		}
+		chain = append(chain, covering{prefix: r.Prefix, asn: r.ASN, maxMask: maxMask})
+	}
+	if removed == 0 {
+		return roas, 0
+	}
+
+	out := make([]ROA, 0, len(roas)-removed)
+	for i, r := range roas {
+		if !redundant[i] {
+			out = append(out, r)
+		}
+	}
+	return out, removed
+}
+
+// compress applies compressROAs if compress_vrps is set.
+func (s *Server) compress(roas []ROA) ([]ROA, int) {
+	s.cfgMu.RLock()
+	on := s.cfg.CompressVRPs
+	s.cfgMu.RUnlock()
+	if !on {
+		return roas, 0
+	}
+	return compressROAs(roas)
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"go.uber.org/zap"
+)
+
+func TestCompressROAs(t *testing.T) {
+	vrp := func(prefix string, asn uint32, maxMask uint8) ROA {
+		return ROA{Prefix: netip.MustParsePrefix(prefix), ASN: asn, MaxMask: maxMask}
+	}
+	roas := GetSetOfValidatedROAs([]ROA{
+		vrp("10.0.0.0/16", 64496, 24),
+		vrp("10.0.1.0/24", 64496, 24),   // covered with a long enough max length
+		vrp("10.0.2.0/24", 64496, 28),   // longer max length than its cover
+		vrp("10.0.2.128/25", 64496, 26), // covered by 10.0.2.0/24-28
+		vrp("10.0.3.0/24", 64497, 24),   // other origin
+		vrp("10.0.0.0/16", 64496, 16),   // same prefix, shorter max length
+		vrp("10.1.0.0/16", 64496, 24),   // not covered
+		vrp("2001:db8::/32", 64496, 48),
+		vrp("2001:db8:1::/48", 64496, 48), // covered
+		vrp("10.0.0.0/8", 0, 8),           // AS0 does not cover other origins
+	})
+
+	got, removed := compressROAs(roas)
+	want := GetSetOfValidatedROAs([]ROA{
+		vrp("10.0.0.0/16", 64496, 24),
+		vrp("10.0.2.0/24", 64496, 28),
+		vrp("10.0.3.0/24", 64497, 24),
+		vrp("10.1.0.0/16", 64496, 24),
+		vrp("2001:db8::/32", 64496, 48),
+		vrp("10.0.0.0/8", 0, 8),
+	})
+	if !slices.Equal(got, want) {
+		t.Errorf("compressROAs() = %v, want %v", got, want)
+	}
+	if removed != len(roas)-len(want) {
+		t.Errorf("removed %d, want %d", removed, len(roas)-len(want))
+	}
+
+	if out, n := compressROAs(nil); out != nil || n != 0 {
+		t.Errorf("compressROAs(nil) = %v, %d", out, n)
+	}
+}
+
+func TestCacheUpdateCompresses(t *testing.T) {
+	cfg := &config.Config{CompressVRPs: true}
+	srv := New(cfg, zap.NewNop().Sugar())
+	cover := ROA{Prefix: netip.MustParsePrefix("10.0.0.0/16"), ASN: 64496, MaxMask: 24}
+	covered := ROA{Prefix: netip.MustParsePrefix("10.0.1.0/24"), ASN: 64496, MaxMask: 24}
+
+	srv.UpdateROAs([]ROA{cover, covered})
+	state := srv.cache.getState()
+	if !slices.Equal(state.roas, []ROA{cover}) || state.compressed != 1 {
+		t.Fatalf("cache holds %v with %d compressed, want only %v", state.roas, state.compressed, cover)
+	}
+
+	// Withdrawing the cover brings back the VRP it made redundant
+	srv.UpdateROAs([]ROA{covered})
+	diff, ok := srv.cache.getDiffSetFrom(state.serial)
+	if !ok || !slices.Equal(diff.addRoa, []ROA{covered}) || !slices.Equal(diff.delRoa, []ROA{cover}) {
+		t.Errorf("diff announces %v and withdraws %v", diff.addRoa, diff.delRoa)
+	}
+	if n := srv.cache.getState().compressed; n != 0 {
+		t.Errorf("compressed = %d after the cover was withdrawn", n)
+	}
+}
+
+// oracleValidate is RFC 6811 route origin validation by a linear scan.
+func oracleValidate(roas []ROA, route netip.Prefix, origin uint32) rovState {
+	state := rovNotFound
+	for _, r := range roas {
+		if r.Prefix.Bits() > route.Bits() || !r.Prefix.Contains(route.Addr()) {
+			continue
+		}
+		if r.ASN != 0 && r.ASN == origin && route.Bits() <= int(r.MaxMask) {
+			return rovValid
+		}
+		state = rovInvalid
+	}
+	return state
+}
+
+// TestCompressROAsPreservesValidation checks on random data, dense enough for
+// many VRPs to cover one another, that every route validates the same against
+// the compressed VRPs as against all of them, and that routes within a view's
+// prefixes also do against the view of the compressed VRPs.
+func TestCompressROAsPreservesValidation(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	randPrefix := func(v6 bool, minBits, maxBits int) netip.Prefix {
+		bits := minBits + rng.IntN(maxBits-minBits+1)
+		if v6 {
+			var b [16]byte
+			b[0], b[1], b[2], b[3] = 0x20, 0x01, 0x0d, 0xb8
+			b[4], b[5] = byte(rng.IntN(4)), byte(rng.IntN(256))
+			return netip.PrefixFrom(netip.AddrFrom16(b), 32+bits).Masked()
+		}
+		b := [4]byte{10, byte(rng.IntN(4)), byte(rng.IntN(256)), byte(rng.IntN(256))}
+		return netip.PrefixFrom(netip.AddrFrom4(b), 8+bits).Masked()
+	}
+
+	lab := newViews([]config.View{{Name: "lab", Clients: []string{"::/0"}, Prefixes: []string{"10.1.0.0/16", "2001:db8:100::/40"}}})[0]
+
+	for round := range 50 {
+		var roas []ROA
+		for range 50 + rng.IntN(400) {
+			p := randPrefix(rng.IntN(4) == 0, 0, 12)
+			maxMask := p.Bits() + rng.IntN(6)
+			roas = append(roas, ROA{Prefix: p, ASN: uint32(rng.IntN(4)), MaxMask: uint8(maxMask)})
+		}
+		roas = GetSetOfValidatedROAs(roas)
+
+		compressed, removed := compressROAs(roas)
+		if removed != len(roas)-len(compressed) {
+			t.Fatalf("round %d: reported %d removed, but %d of %d are left", round, removed, len(compressed), len(roas))
+		}
+		if again, n := compressROAs(compressed); n != 0 || !slices.Equal(again, compressed) {
+			t.Fatalf("round %d: compressing again removed %d more", round, n)
+		}
+		for _, r := range compressed {
+			if !slices.Contains(roas, r) {
+				t.Fatalf("round %d: compressed set has new VRP %v", round, r)
+			}
+		}
+
+		trie := newROATrie(compressed)
+		viewed := lab.filterROAs(compressed)
+		for range 2000 {
+			route := randPrefix(rng.IntN(4) == 0, 0, 20)
+			origin := uint32(rng.IntN(5))
+			want := oracleValidate(roas, route, origin)
+			if got := oracleValidate(compressed, route, origin); got != want {
+				t.Fatalf("round %d: %s from AS%d is %s with compression, %s without", round, route, origin, got, want)
+			}
+			if got, _, _ := trie.validate(route, origin); got != want {
+				t.Fatalf("round %d: trie says %s from AS%d is %s, want %s", round, route, origin, got, want)
+			}
+			if !slices.ContainsFunc(lab.prefixes, func(p netip.Prefix) bool { return p.Bits() <= route.Bits() && p.Contains(route.Addr()) }) {
+				continue
+			}
+			if got := oracleValidate(viewed, route, origin); got != want {
+				t.Fatalf("round %d: %s from AS%d is %s in the view, %s without", round, route, origin, got, want)
+			}
+		}
+		if round == 0 && removed == 0 {
+			t.Fatal("random data should include redundant VRPs")
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+)
+
+// upstreamDecoder extracts every object type it understands from an upstream document.
+type upstreamDecoder func(io.Reader) (upstreamData, error)
+
+// upstreamDecoders maps each configurable format to its decoder. The JSON
+// dialects share one streaming decoder as they only differ in optional fields.
+var upstreamDecoders = map[string]upstreamDecoder{
+	config.FormatAuto:              decodeAuto,
+	config.FormatRPKIClient:        decodeRPKIJSON,
+	config.FormatRoutinatorJSONExt: decodeRPKIJSON,
+	config.FormatGoRTR:             decodeRPKIJSON,
+	config.FormatCSV:               decodeCSV,
+	config.FormatOpenBGPD:          decodeOpenBGPD,
+}
+
+// decoderFor returns the decoder for the given format, defaulting to auto-detection.
+func decoderFor(format string) (upstreamDecoder, error) {
+	if format == "" {
+		format = config.FormatAuto
+	}
+	dec, ok := upstreamDecoders[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown upstream format %q", format)
+	}
+	return dec, nil
+}
+
+// decodeAuto peeks at the start of the document to pick a decoder:
+// JSON objects, OpenBGPD set blocks, or CSV otherwise.
+func decodeAuto(r io.Reader) (upstreamData, error) {
+	br := bufio.NewReader(r)
+	b, err := br.Peek(1)
+	for err == nil && (b[0] == ' ' || b[0] == '\t' || b[0] == '\r' || b[0] == '\n') {
+		_, _ = br.ReadByte()
+		b, err = br.Peek(1)
+	}
+	if err != nil {
+		return upstreamData{}, fmt.Errorf("failed to detect upstream format: %w", err)
+	}
+
+	switch b[0] {
+	case '{':
+		return decodeRPKIJSON(br)
+	case '#':
+		return decodeOpenBGPD(br)
+	}
+
+	head, _ := br.Peek(8)
+	if bytes.HasPrefix(head, []byte("roa-set")) || bytes.HasPrefix(head, []byte("aspa-set")) {
+		return decodeOpenBGPD(br)
+	}
+	return decodeCSV(br)
+}
+
+// decodeCSV parses the csv output of rpki-client and Routinator:
+//
+//	ASN,IP Prefix,Max Length,Trust Anchor[,Expires]
+//	AS13335,1.1.1.0/24,24,apnic,1750000000
+//
+// A header row is skipped. Only ROAs are carried in this format.
+func decodeCSV(r io.Reader) (upstreamData, error) {
+	var data upstreamData
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	cr.TrimLeadingSpace = true
+
+	line := 0
+	for {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		line++
+		if err != nil {
+			return data, fmt.Errorf("failed to read csv line %d: %w", line, err)
+		}
+		if len(rec) < 3 {
+			return data, fmt.Errorf("csv line %d: expected at least 3 fields, got %d", line, len(rec))
+		}
+		if line == 1 && strings.EqualFold(strings.TrimSpace(rec[0]), "ASN") {
+			continue
+		}
+
+		roa, err := parseCSVROA(rec)
+		if err != nil {
+			return data, fmt.Errorf("csv line %d: %w", line, err)
+		}
+		data.roas = append(data.roas, roa)
+	}
+
+	return data, nil
+}
+
+func parseCSVROA(rec []string) (ROA, error) {
+	asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(rec[0])), "AS"), 10, 32)
+	if err != nil {
+		return ROA{}, fmt.Errorf("invalid asn %q: %w", rec[0], err)
+	}
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(rec[1]))
+	if err != nil {
+		return ROA{}, fmt.Errorf("invalid prefix %q: %w", rec[1], err)
+	}
+	maxLen, err := strconv.ParseUint(strings.TrimSpace(rec[2]), 10, 8)
+	if err != nil {
+		return ROA{}, fmt.Errorf("invalid max length %q: %w", rec[2], err)
+	}
+
+	var expires int64
+	if len(rec) >= 5 && rec[4] != "" {
+		expires, err = strconv.ParseInt(strings.TrimSpace(rec[4]), 10, 64)
+		if err != nil {
+			return ROA{}, fmt.Errorf("invalid expires %q: %w", rec[4], err)
+		}
+	}
+
+	return ROA{
+		Prefix:  prefix,
+		ASN:     uint32(asn),
+		MaxMask: uint8(maxLen),
+		Expires: expires,
+	}, nil
+}
+
+// decodeOpenBGPD parses the OpenBGPD configuration output of rpki-client:
+//
+//	roa-set {
+//		1.1.1.0/24 maxlen 24 source-as 13335 expires 1750000000
+//	}
+//	aspa-set {
+//		customer-as 64496 expires 1750000000 provider-as { 64497, 64498 }
+//	}
+//
+// Comments starting with '#' are ignored. Any other top level block is an error.
+func decodeOpenBGPD(r io.Reader) (upstreamData, error) {
+	var data upstreamData
+	toks := newBGPDTokenizer(r)
+
+	for {
+		tok, err := toks.next()
+		if errors.Is(err, io.EOF) {
+			return data, nil
+		}
+		if err != nil {
+			return data, err
+		}
+
+		switch tok {
+		case "roa-set":
+			err = toks.block(func(first string) error {
+				roa, err := parseBGPDROA(first, toks)
+				if err != nil {
+					return err
+				}
+				data.roas = append(data.roas, roa)
+				return nil
+			})
+		case "aspa-set":
+			err = toks.block(func(first string) error {
+				aspa, err := parseBGPDASPA(first, toks)
+				if err != nil {
+					return err
+				}
+				data.aspas = append(data.aspas, aspa)
+				return nil
+			})
+		default:
+			return data, fmt.Errorf("line %d: unexpected token %q", toks.line, tok)
+		}
+		if err != nil {
+			return data, err
+		}
+	}
+}
+
+// parseBGPDROA parses "<prefix> [maxlen N] source-as N [expires N]".
+func parseBGPDROA(first string, toks *bgpdTokenizer) (ROA, error) {
+	prefix, err := netip.ParsePrefix(first)
+	if err != nil {
+		return ROA{}, fmt.Errorf("line %d: invalid prefix %q: %w", toks.line, first, err)
+	}
+	roa := ROA{Prefix: prefix, MaxMask: uint8(prefix.Bits())}
+	line := toks.line
+
+	for toks.sameLine(line) {
+		kw, err := toks.next()
+		if err != nil {
+			return ROA{}, err
+		}
+		val, err := toks.uint(32)
+		if err != nil {
+			return ROA{}, err
+		}
+		switch kw {
+		case "maxlen":
+			if val > 128 {
+				return ROA{}, fmt.Errorf("line %d: invalid maxlen %d", toks.line, val)
+			}
+			roa.MaxMask = uint8(val)
+		case "source-as":
+			roa.ASN = uint32(val)
+		case "expires":
+			roa.Expires = int64(val)
+		default:
+			return ROA{}, fmt.Errorf("line %d: unexpected token %q", toks.line, kw)
+		}
+	}
+
+	return roa, nil
+}
+
+// parseBGPDASPA parses "customer-as N [expires N] provider-as { N [allow inet|inet6], ... }".
+func parseBGPDASPA(first string, toks *bgpdTokenizer) (ASPA, error) {
+	if first != "customer-as" {
+		return ASPA{}, fmt.Errorf("line %d: expected customer-as, got %q", toks.line, first)
+	}
+	customer, err := toks.uint(32)
+	if err != nil {
+		return ASPA{}, err
+	}
+	aspa := ASPA{CustomerASN: uint32(customer)}
+	line := toks.line
+
+	for toks.sameLine(line) {
+		kw, err := toks.next()
+		if err != nil {
+			return ASPA{}, err
+		}
+		switch kw {
+		case "expires":
+			val, err := toks.uint(32)
+			if err != nil {
+				return ASPA{}, err
+			}
+			aspa.Expires = int64(val)
+		case "provider-as":
+			if err := toks.block(func(tok string) error {
+				switch tok {
+				case ",", "allow", "inet", "inet6":
+					return nil
+				}
+				asn, err := strconv.ParseUint(tok, 10, 32)
+				if err != nil {
+					return fmt.Errorf("line %d: invalid provider %q", toks.line, tok)
+				}
+				aspa.ProviderASNs = append(aspa.ProviderASNs, uint32(asn))
+				return nil
+			}); err != nil {
+				return ASPA{}, err
+			}
+		default:
+			return ASPA{}, fmt.Errorf("line %d: unexpected token %q", toks.line, kw)
+		}
+	}
+
+	sort.Slice(aspa.ProviderASNs, func(i, j int) bool {
+		return aspa.ProviderASNs[i] < aspa.ProviderASNs[j]
+	})
+	return aspa, nil
+}
+
+// bgpdTokenizer splits OpenBGPD configuration into words, treating braces and
+// commas as separate tokens and dropping comments.
+type bgpdTokenizer struct {
+	sc      *bufio.Scanner
+	pending []string
+	line    int
+}
+
+func newBGPDTokenizer(r io.Reader) *bgpdTokenizer {
+	return &bgpdTokenizer{sc: bufio.NewScanner(r)}
+}
+
+var bgpdPunct = strings.NewReplacer("{", " { ", "}", " } ", ",", " , ")
+
+func (t *bgpdTokenizer) fill() error {
+	for len(t.pending) == 0 {
+		if !t.sc.Scan() {
+			if err := t.sc.Err(); err != nil {
+				return fmt.Errorf("failed to read line %d: %w", t.line+1, err)
+			}
+			return io.EOF
+		}
+		t.line++
+		text := t.sc.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		t.pending = strings.Fields(bgpdPunct.Replace(text))
+	}
+	return nil
+}
+
+func (t *bgpdTokenizer) next() (string, error) {
+	if err := t.fill(); err != nil {
+		return "", err
+	}
+	tok := t.pending[0]
+	t.pending = t.pending[1:]
+	return tok, nil
+}
+
+// sameLine reports whether more tokens remain on the given line, ignoring a
+// closing brace which always terminates the current entry.
+func (t *bgpdTokenizer) sameLine(line int) bool {
+	return t.line == line && len(t.pending) > 0 && t.pending[0] != "}"
+}
+
+func (t *bgpdTokenizer) uint(bits int) (uint64, error) {
+	tok, err := t.next()
+	if err != nil {
+		return 0, fmt.Errorf("line %d: unexpected end of input", t.line)
+	}
+	v, err := strconv.ParseUint(tok, 10, bits)
+	if err != nil {
+		return 0, fmt.Errorf("line %d: invalid number %q", t.line, tok)
+	}
+	return v, nil
+}
+
+// block consumes "{ ... }", calling entry with the first token of each entry.
+func (t *bgpdTokenizer) block(entry func(first string) error) error {
+	open, err := t.next()
+	if err != nil {
+		return fmt.Errorf("line %d: unexpected end of input", t.line)
+	}
+	if open != "{" {
+		return fmt.Errorf("line %d: expected '{', got %q", t.line, open)
+	}
+	for {
+		tok, err := t.next()
+		if err != nil {
+			return fmt.Errorf("line %d: unterminated block", t.line)
+		}
+		if tok == "}" {
+			return nil
+		}
+		if err := entry(tok); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func addFixtureSeeds(f *testing.F, names ...string) {
+	for _, name := range names {
+		b, err := os.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+}
+
+func FuzzDecodeCSV(f *testing.F) {
+	// Seed corpus
+	addFixtureSeeds(f, "rpki-client.csv", "routinator.csv")
+	f.Add([]byte("AS1,1.1.1.0/24,24"))
+	f.Add([]byte(`"unterminated`))
+	f.Add([]byte(""))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = decodeCSV(bytes.NewReader(data))
+	})
+}
+
+func FuzzDecodeOpenBGPD(f *testing.F) {
+	// Seed corpus
+	addFixtureSeeds(f, "openbgpd.conf")
+	f.Add([]byte("roa-set { 10.0.0.0/8 source-as 1 }"))
+	f.Add([]byte("aspa-set { customer-as 1 provider-as { 2 allow inet, 3 } }"))
+	f.Add([]byte("roa-set {"))
+	f.Add([]byte("}"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = decodeOpenBGPD(bytes.NewReader(data))
+	})
+}
+
+func FuzzDecodeAuto(f *testing.F) {
+	// Seed corpus
+	addFixtureSeeds(f, "rpki-client.json", "routinator-jsonext.json", "gortr.json", "rpki-client.csv", "openbgpd.conf")
+	f.Add([]byte("   "))
+	f.Add([]byte("#"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_, _ = decodeAuto(bytes.NewReader(data))
+	})
+}
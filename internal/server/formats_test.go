@@ -0,0 +1,145 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+)
+
+func TestUpstreamFormatFixtures(t *testing.T) {
+	wantROAs := []ROA{
+		{Prefix: mustPrefix("1.1.1.0/24"), ASN: 13335, MaxMask: 24},
+		{Prefix: mustPrefix("192.0.2.0/24"), ASN: 64496, MaxMask: 28},
+		{Prefix: mustPrefix("2001:db8::/32"), ASN: 64497, MaxMask: 48},
+	}
+
+	tests := []struct {
+		file        string
+		format      string
+		wantExpires []int64 // per ROA in wantROAs order
+		wantASPAs   int
+		wantKeys    int
+	}{
+		{file: "rpki-client.json", format: config.FormatRPKIClient, wantExpires: []int64{1750000000, 1750000000, 1750000000}, wantASPAs: 1, wantKeys: 1},
+		{file: "routinator-jsonext.json", format: config.FormatRoutinatorJSONExt, wantExpires: []int64{1750000000, 0, 1750000000}, wantASPAs: 1, wantKeys: 1},
+		{file: "gortr.json", format: config.FormatGoRTR, wantExpires: []int64{0, 0, 0}},
+		{file: "rpki-client.csv", format: config.FormatCSV, wantExpires: []int64{1750000000, 1750000000, 1750000000}},
+		{file: "routinator.csv", format: config.FormatCSV, wantExpires: []int64{0, 0, 0}},
+		{file: "openbgpd.conf", format: config.FormatOpenBGPD, wantExpires: []int64{1750000000, 1750000000, 1750000000}, wantASPAs: 1},
+	}
+
+	for _, tt := range tests {
+		for _, format := range []string{tt.format, config.FormatAuto} {
+			t.Run(tt.file+"/"+format, func(t *testing.T) {
+				f, err := os.Open(filepath.Join("testdata", tt.file))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+
+				decode, err := decoderFor(format)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := decode(f)
+				if err != nil {
+					t.Fatalf("decode failed: %v", err)
+				}
+
+				roas := GetSetOfValidatedROAs(data.roas)
+				if len(roas) != len(wantROAs) {
+					t.Fatalf("Expected %d ROAs, got %d: %+v", len(wantROAs), len(roas), roas)
+				}
+				for i, want := range wantROAs {
+					if roas[i].key() != want.key() {
+						t.Errorf("ROA %d = %+v, want %+v", i, roas[i], want)
+					}
+					if roas[i].Expires != tt.wantExpires[i] {
+						t.Errorf("ROA %d expires = %d, want %d", i, roas[i].Expires, tt.wantExpires[i])
+					}
+				}
+
+				if len(data.aspas) != tt.wantASPAs {
+					t.Fatalf("Expected %d ASPAs, got %d", tt.wantASPAs, len(data.aspas))
+				}
+				for _, a := range data.aspas {
+					if a.CustomerASN != 64496 || len(a.ProviderASNs) != 2 || a.ProviderASNs[0] != 64497 || a.ProviderASNs[1] != 64498 {
+						t.Errorf("Unexpected ASPA: %+v", a)
+					}
+					if a.Expires != 1750000000 {
+						t.Errorf("ASPA expires = %d, want 1750000000", a.Expires)
+					}
+				}
+
+				if len(data.routerKeys) != tt.wantKeys {
+					t.Fatalf("Expected %d router keys, got %d", tt.wantKeys, len(data.routerKeys))
+				}
+				for _, k := range data.routerKeys {
+					if k.ASN != 64496 || k.SKI[0] != 0x01 || len(k.SPKI) == 0 || k.Expires != 1750000000 {
+						t.Errorf("Unexpected router key: %+v", k)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestDecoderForUnknownFormat(t *testing.T) {
+	if _, err := decoderFor("bogus"); err == nil {
+		t.Error("Expected error for unknown format")
+	}
+	if _, err := decoderFor(""); err != nil {
+		t.Errorf("Expected empty format to auto-detect, got %v", err)
+	}
+}
+
+func TestDecodeCSVErrors(t *testing.T) {
+	tests := []string{
+		"AS1,1.1.1.0/24",
+		"ASx,1.1.1.0/24,24,ta",
+		"AS1,nope,24,ta",
+		"AS1,1.1.1.0/24,300,ta",
+		"AS1,1.1.1.0/24,24,ta,soon",
+		"sAAs64496,1.1.1.0/24,24,ta",
+		"SSSA1,1.1.1.0/24,24,ta",
+		"ASAS1,1.1.1.0/24,24,ta",
+	}
+	for _, in := range tests {
+		if _, err := decodeCSV(strings.NewReader(in)); err == nil {
+			t.Errorf("Expected error for %q", in)
+		}
+	}
+}
+
+func TestDecodeOpenBGPDErrors(t *testing.T) {
+	tests := []string{
+		"roa-set 1.1.1.0/24",
+		"roa-set {\n1.1.1.0/24 source-as\n}",
+		"roa-set {\n1.1.1.0/24 source-as 1 colour blue\n}",
+		"roa-set {\n1.1.1.0/24 source-as 1\n",
+		"aspa-set {\nprovider-as { 1 }\n}",
+		"aspa-set {\ncustomer-as 1 provider-as { x }\n}",
+		"as-set foo { 1 }",
+	}
+	for _, in := range tests {
+		if _, err := decodeOpenBGPD(strings.NewReader(in)); err == nil {
+			t.Errorf("Expected error for %q", in)
+		}
+	}
+}
+
+func TestDecodeOpenBGPDDefaults(t *testing.T) {
+	data, err := decodeOpenBGPD(strings.NewReader("roa-set { 10.0.0.0/8 source-as 1 }\naspa-set {\n\tcustomer-as 5 provider-as { 7 allow inet6, 6 allow inet }\n}"))
+	if err != nil {
+		t.Fatalf("decodeOpenBGPD failed: %v", err)
+	}
+	if len(data.roas) != 1 || data.roas[0].MaxMask != 8 || data.roas[0].Expires != 0 {
+		t.Errorf("Expected maxlen to default to the prefix length, got %+v", data.roas)
+	}
+	if len(data.aspas) != 1 || len(data.aspas[0].ProviderASNs) != 2 || data.aspas[0].ProviderASNs[0] != 6 {
+		t.Errorf("Unexpected ASPAs: %+v", data.aspas)
+	}
+}
@@ -0,0 +1,445 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	rpkirtripb "github.com/mellowdrifter/rpkirtr2/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// gatewayJSON renders responses with the field names used in the proto file
+// and README, including zero values so that dashboards see every field.
+var gatewayJSON = protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true}
+
+// gateway serves the read-only RPCs of RPKIRTRService as JSON over HTTP, with
+// the same principals and roles as the gRPC listener.
+type gateway struct {
+	g    *grpcServer
+	auth *grpcAuth
+}
+
+// newGatewayHandler returns the HTTP/JSON gateway, the Prometheus metrics
+// and the health probes. Query parameters map to request fields by name.
+// Probes are answered without credentials.
+func (s *Server) newGatewayHandler() http.Handler {
+	gw := &gateway{g: &grpcServer{srv: s}, auth: newGRPCAuth(s.cfg)}
+	g := gw.g
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /v1/stats", unaryHandler(g.GetStats))
+	mux.Handle("GET /v1/upstreams", http.HandlerFunc(gw.upstreams))
+	mux.Handle("GET /v1/clients", unaryHandler(g.ListClients))
+	mux.Handle("GET /v1/roas", streamHandler(g.ListROAs))
+	mux.Handle("GET /v1/aspas", streamHandler(g.ListASPAs))
+	mux.Handle("GET /v1/validate", unaryHandler(g.ValidateRoute))
+	mux.Handle("GET /v1/verify-aspath", unaryHandler(g.VerifyASPath))
+	mux.Handle("GET /v1/diffs", unaryHandler(g.ListDiffs))
+	mux.Handle("GET /v1/diffs/{from_serial}", unaryHandler(g.GetDiff))
+	mux.Handle("GET /v1/audit", unaryHandler(g.QueryAudit))
+	mux.Handle("GET /vrps.json", http.HandlerFunc(gw.export))
+	mux.Handle("GET /metrics", s.metricsHandler())
+
+	probes := http.NewServeMux()
+	probes.HandleFunc("GET /livez", s.livez)
+	probes.HandleFunc("GET /readyz", s.readyz)
+	probes.Handle("/", gw.authorize(mux))
+	return probes
+}
+
+// authorize requires the read role for every request and passes the
+// principal on to the RPCs.
+func (gw *gateway) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := gw.auth.identify(r.Header.Values("Authorization"), verifiedLeaf(r.TLS))
+		if err != nil {
+			writeStatus(w, err)
+			return
+		}
+		ctx, err := permit(r.Context(), p, roleRead, r.URL.Path)
+		if err != nil {
+			writeStatus(w, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// unaryHandler serves a unary RPC, decoding its request from the path
+// wildcards and query parameters.
+func unaryHandler[Req, Resp any, PReq interface {
+	*Req
+	proto.Message
+}, PResp interface {
+	*Resp
+	proto.Message
+}](rpc func(context.Context, PReq) (PResp, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := PReq(new(Req))
+		if err := decodeRequest(r, req); err != nil {
+			writeStatus(w, status.Error(codes.InvalidArgument, err.Error()))
+			return
+		}
+		resp, err := rpc(r.Context(), req)
+		if err != nil {
+			writeStatus(w, err)
+			return
+		}
+		writeProto(w, resp)
+	})
+}
+
+// streamHandler serves a server-streaming RPC as a single response with the
+// messages merged, so repeated fields hold every result.
+func streamHandler[Req, Resp any, PReq interface {
+	*Req
+	proto.Message
+}, PResp interface {
+	*Resp
+	proto.Message
+}](rpc func(PReq, grpc.ServerStreamingServer[Resp]) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := PReq(new(Req))
+		if err := decodeRequest(r, req); err != nil {
+			writeStatus(w, status.Error(codes.InvalidArgument, err.Error()))
+			return
+		}
+		c := &collector[Resp]{ctx: r.Context()}
+		if err := rpc(req, c); err != nil {
+			writeStatus(w, err)
+			return
+		}
+		resp := PResp(new(Resp))
+		for _, m := range c.msgs {
+			proto.Merge(resp, PResp(m))
+		}
+		writeProto(w, resp)
+	})
+}
+
+// collector gathers the messages of a server-streaming RPC.
+type collector[T any] struct {
+	grpc.ServerStream
+	ctx  context.Context
+	msgs []*T
+}
+
+func (c *collector[T]) Context() context.Context {
+	return c.ctx
+}
+
+func (c *collector[T]) Send(m *T) error {
+	c.msgs = append(c.msgs, m)
+	return nil
+}
+
+// upstreams reports the status of every upstream, sorted by URL.
+func (gw *gateway) upstreams(w http.ResponseWriter, r *http.Request) {
+	stats, err := gw.g.GetStats(r.Context(), &rpkirtripb.GetStatsRequest{})
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+	slices.SortFunc(stats.Upstreams, func(a, b *rpkirtripb.UpstreamStatus) int {
+		return strings.Compare(a.Url, b.Url)
+	})
+	list := make([]json.RawMessage, 0, len(stats.Upstreams))
+	for _, u := range stats.Upstreams {
+		b, err := gatewayJSON.Marshal(u)
+		if err != nil {
+			writeStatus(w, err)
+			return
+		}
+		list = append(list, b)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string][]json.RawMessage{"upstreams": list})
+}
+
+// decodeRequest sets the fields of req from the path wildcards and query
+// parameters of r.
+func decodeRequest(r *http.Request, req proto.Message) error {
+	params := r.URL.Query()
+	if from := r.PathValue("from_serial"); from != "" {
+		params.Set("from_serial", from)
+	}
+	return decodeQuery(params, req)
+}
+
+// decodeQuery sets the fields of req from parameters named after their proto
+// or JSON field names. Repeated fields take several parameters or a comma
+// separated list; enums take their name, with or without the type prefix, or
+// their number.
+func decodeQuery(params url.Values, req proto.Message) error {
+	m := req.ProtoReflect()
+	fields := m.Descriptor().Fields()
+	for key, values := range params {
+		fd := fields.ByName(protoreflect.Name(key))
+		if fd == nil {
+			fd = fields.ByJSONName(key)
+		}
+		if fd == nil {
+			return fmt.Errorf("unknown parameter %q", key)
+		}
+
+		if fd.IsList() {
+			list := m.Mutable(fd).List()
+			for _, v := range values {
+				for part := range strings.SplitSeq(v, ",") {
+					val, err := parseField(fd, part)
+					if err != nil {
+						return err
+					}
+					list.Append(val)
+				}
+			}
+			continue
+		}
+		val, err := parseField(fd, values[len(values)-1])
+		if err != nil {
+			return err
+		}
+		m.Set(fd, val)
+	}
+	return nil
+}
+
+func parseField(fd protoreflect.FieldDescriptor, s string) (protoreflect.Value, error) {
+	s = strings.TrimSpace(s)
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(s), nil
+	case protoreflect.BoolKind:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return protoreflect.Value{}, fmt.Errorf("invalid %s %q", fd.Name(), s)
+		}
+		return protoreflect.ValueOfBool(b), nil
+	case protoreflect.Uint32Kind:
+		n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(s), "AS"), 10, 32)
+		if err != nil {
+			return protoreflect.Value{}, fmt.Errorf("invalid %s %q", fd.Name(), s)
+		}
+		return protoreflect.ValueOfUint32(uint32(n)), nil
+	case protoreflect.Int64Kind:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return protoreflect.Value{}, fmt.Errorf("invalid %s %q", fd.Name(), s)
+		}
+		return protoreflect.ValueOfInt64(n), nil
+	case protoreflect.EnumKind:
+		values := fd.Enum().Values()
+		if n, err := strconv.Atoi(s); err == nil && values.ByNumber(protoreflect.EnumNumber(n)) != nil {
+			return protoreflect.ValueOfEnum(protoreflect.EnumNumber(n)), nil
+		}
+		upper := strings.ToUpper(s)
+		for i := range values.Len() {
+			v := values.Get(i)
+			if name := string(v.Name()); name == upper || strings.HasSuffix(name, "_"+upper) {
+				return protoreflect.ValueOfEnum(v.Number()), nil
+			}
+		}
+		return protoreflect.Value{}, fmt.Errorf("invalid %s %q", fd.Name(), s)
+	}
+	return protoreflect.Value{}, fmt.Errorf("parameter %s is not supported", fd.Name())
+}
+
+func writeProto(w http.ResponseWriter, m proto.Message) {
+	b, err := gatewayJSON.Marshal(m)
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(b)
+}
+
+// httpStatuses maps the gRPC codes returned by the RPCs to HTTP statuses.
+var httpStatuses = map[codes.Code]int{
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.FailedPrecondition: http.StatusPreconditionFailed,
+	codes.NotFound:           http.StatusNotFound,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.Canceled:           499, // client closed request
+}
+
+// writeStatus writes err as a google.rpc.Status, like grpc-gateway.
+func writeStatus(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	code, ok := httpStatuses[st.Code()]
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+	b, _ := protojson.Marshal(st.Proto())
+	w.Header().Set("Content-Type", "application/json")
+	if st.Code() == codes.Unauthenticated {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	w.WriteHeader(code)
+	_, _ = w.Write(b)
+}
+
+// Export formats of /vrps.json
+const (
+	exportRPKIClient = "rpki-client"
+	exportGoRTR      = "gortr"
+)
+
+// exportDocument is the layout of rpki-client's json output, which
+// decodeRPKIJSON reads back, so one instance can feed another.
+type exportDocument struct {
+	Metadata   exportMetadata    `json:"metadata"`
+	ROAs       []exportROA       `json:"roas"`
+	ASPAs      []exportASPA      `json:"aspas"`
+	RouterKeys []exportRouterKey `json:"bgpsec_keys"`
+}
+
+type exportMetadata struct {
+	BuildTime  string `json:"buildtime"`
+	Generated  int64  `json:"generated"`
+	Serial     uint32 `json:"serial"`
+	SessionID  uint16 `json:"session_id"`
+	ROAs       int    `json:"roas"`
+	ASPAs      int    `json:"aspas"`
+	RouterKeys int    `json:"bgpsec_pubkeys"`
+}
+
+type exportROA struct {
+	ASN       uint32 `json:"asn"`
+	Prefix    string `json:"prefix"`
+	MaxLength uint8  `json:"maxLength"`
+	Expires   int64  `json:"expires,omitempty"`
+}
+
+type exportASPA struct {
+	CustomerASID uint32   `json:"customer_asid"`
+	Providers    []uint32 `json:"providers"`
+	Expires      int64    `json:"expires,omitempty"`
+}
+
+type exportRouterKey struct {
+	ASN     uint32 `json:"asn"`
+	SKI     string `json:"ski"`
+	Pubkey  string `json:"pubkey"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+// export serves the cache as a feed. The default rpki-client layout carries
+// ROAs, ASPAs and router keys; format=gortr produces the GoRTR / StayRTR
+// layout, which only has ROAs. The ETag changes with the serial.
+func (gw *gateway) export(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = exportRPKIClient
+	}
+	if format != exportRPKIClient && format != exportGoRTR {
+		writeStatus(w, status.Errorf(codes.InvalidArgument, "unknown format %q, want %s or %s", format, exportRPKIClient, exportGoRTR))
+		return
+	}
+
+	state := gw.g.srv.cache.getState()
+	etag := fmt.Sprintf(`"%s-%d-%d"`, format, state.session, state.serial)
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	now := time.Now()
+	var doc any
+	switch format {
+	case exportGoRTR:
+		list := gortrList{
+			Metadata: gortrMetadata{Counts: len(state.roas), Generated: int(now.Unix())},
+			Data:     make([]gortrROA, 0, len(state.roas)),
+		}
+		for _, roa := range state.roas {
+			list.Data = append(list.Data, gortrROA{Prefix: roa.Prefix.String(), Length: roa.MaxMask, ASN: fmt.Sprintf("AS%d", roa.ASN)})
+		}
+		doc = list
+	default:
+		d := exportDocument{
+			Metadata: exportMetadata{
+				BuildTime:  now.UTC().Format(time.RFC3339),
+				Generated:  now.Unix(),
+				Serial:     state.serial,
+				SessionID:  state.session,
+				ROAs:       len(state.roas),
+				ASPAs:      len(state.aspas),
+				RouterKeys: len(state.routerKeys),
+			},
+			ROAs:       make([]exportROA, 0, len(state.roas)),
+			ASPAs:      make([]exportASPA, 0, len(state.aspas)),
+			RouterKeys: make([]exportRouterKey, 0, len(state.routerKeys)),
+		}
+		for _, roa := range state.roas {
+			d.ROAs = append(d.ROAs, exportROA{ASN: roa.ASN, Prefix: roa.Prefix.String(), MaxLength: roa.MaxMask, Expires: roa.Expires})
+		}
+		for _, a := range state.aspas {
+			d.ASPAs = append(d.ASPAs, exportASPA{CustomerASID: a.CustomerASN, Providers: a.ProviderASNs, Expires: a.Expires})
+		}
+		for _, k := range state.routerKeys {
+			d.RouterKeys = append(d.RouterKeys, exportRouterKey{
+				ASN:     k.ASN,
+				SKI:     strings.ToUpper(hex.EncodeToString(k.SKI[:])),
+				Pubkey:  base64.StdEncoding.EncodeToString(k.SPKI),
+				Expires: k.Expires,
+			})
+		}
+		doc = d
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(doc)
+}
+
+// startGateway serves the HTTP/JSON gateway on the configured address, over
+// TLS with the gRPC certificate when grpc_tls is set.
+func (s *Server) startGateway() error {
+	l, err := listenGRPC(s.cfg.HTTPAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on HTTP address %s: %w", s.cfg.HTTPAddr, err)
+	}
+	l = aclListener{Listener: l, s: s, name: listenerHTTP}
+	s.httpServer = &http.Server{
+		Handler:           s.newGatewayHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if s.cfg.GRPCTLS.Enabled() {
+		if s.httpServer.TLSConfig, err = grpcTLSConfig(s.cfg.GRPCTLS); err != nil {
+			l.Close()
+			return err
+		}
+	}
+
+	go func() {
+		s.logger.Infow("HTTP gateway listening", "addr", s.cfg.HTTPAddr)
+		var err error
+		if s.httpServer.TLSConfig != nil {
+			err = s.httpServer.ServeTLS(l, "", "")
+		} else {
+			err = s.httpServer.Serve(l)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			s.logger.Errorw("HTTP gateway error", "error", err)
+		}
+	}()
+	return nil
+}
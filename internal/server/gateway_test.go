@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+)
+
+// getJSON fetches path from the gateway and decodes the response into a map.
+func getJSON(t *testing.T, ts *httptest.Server, path string, header ...string) (int, map[string]any) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+	require.NoError(t, err)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var body map[string]any
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+	return resp.StatusCode, body
+}
+
+func newGatewayTestServer(t *testing.T, cfg *config.Config) (*Server, *httptest.Server) {
+	srv := New(cfg, zaptest.NewLogger(t).Sugar())
+	srv.UpdateROAs([]ROA{
+		{Prefix: netip.MustParsePrefix("1.1.1.0/24"), ASN: 13335, MaxMask: 24},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), ASN: 64496, MaxMask: 48, Expires: 1900000000},
+	})
+	srv.UpdateASPAs([]ASPA{{CustomerASN: 64496, ProviderASNs: []uint32{64500, 64501}}})
+	srv.UpdateRouterKeys([]RouterKey{{ASN: 64496, SKI: [20]byte{0xab}, SPKI: []byte{1, 2, 3}}})
+
+	ts := httptest.NewServer(srv.newGatewayHandler())
+	t.Cleanup(ts.Close)
+	return srv, ts
+}
+
+func TestGatewayQueries(t *testing.T) {
+	srv, ts := newGatewayTestServer(t, &config.Config{})
+
+	code, body := getJSON(t, ts, "/v1/stats")
+	require.Equal(t, http.StatusOK, code)
+	assert.EqualValues(t, 2, body["roa_count"])
+	assert.EqualValues(t, 0, body["client_count"], "zero values are included")
+	assert.EqualValues(t, srv.CacheSerial(), body["serial"])
+
+	code, body = getJSON(t, ts, "/v1/roas?prefix=1.1.1.128/25&prefix_match=covering")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, body["roas"], 1)
+	assert.Equal(t, "1.1.1.0/24", body["roas"].([]any)[0].(map[string]any)["prefix"])
+
+	// Pages are merged into one response
+	code, body = getJSON(t, ts, "/v1/roas?page_size=1")
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, body["roas"], 1)
+	assert.NotEmpty(t, body["next_page_token"])
+	code, body = getJSON(t, ts, "/v1/roas?address_family=ipv6")
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, body["roas"], 1)
+
+	code, body = getJSON(t, ts, "/v1/aspas?customer_asn=AS64496")
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, body["aspas"], 1)
+
+	code, body = getJSON(t, ts, "/v1/validate?prefix=1.1.1.0/24&origin_asn=13335")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "VALIDATION_STATE_VALID", body["state"])
+
+	code, body = getJSON(t, ts, "/v1/verify-aspath?as_path=64500,64496&direction=upstream")
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, body["hops"], 1)
+
+	code, body = getJSON(t, ts, "/v1/diffs")
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, body["diffs"], 3)
+	serial := srv.CacheSerial()
+	code, body = getJSON(t, ts, fmt.Sprintf("/v1/diffs/%d?to_serial=%d", serial-2, serial-1))
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, body["announced_aspas"], 1)
+
+	code, body = getJSON(t, ts, "/v1/upstreams")
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, body["upstreams"])
+	code, body = getJSON(t, ts, "/v1/clients")
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, body["clients"])
+}
+
+func TestGatewayErrors(t *testing.T) {
+	_, ts := newGatewayTestServer(t, &config.Config{})
+
+	for path, want := range map[string]int{
+		"/v1/validate?prefix=bogus":         http.StatusBadRequest,
+		"/v1/roas?color=blue":               http.StatusBadRequest,
+		"/v1/roas?address_family=ipv5":      http.StatusBadRequest,
+		"/v1/diffs/1000":                    http.StatusBadRequest,
+		"/v1/verify-aspath?as_path=1,x":     http.StatusBadRequest,
+		"/vrps.json?format=bird":            http.StatusBadRequest,
+		"/v1/roas?serial=4000000000":        http.StatusPreconditionFailed,
+		"/v1/verify-aspath?direction=bogus": http.StatusBadRequest,
+	} {
+		code, body := getJSON(t, ts, path)
+		assert.Equal(t, want, code, path)
+		assert.NotEmpty(t, body["message"], path)
+	}
+
+	resp, err := ts.Client().Get(ts.URL + "/v1/nothing")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestGatewayAuth(t *testing.T) {
+	_, ts := newGatewayTestServer(t, &config.Config{GRPCAuth: config.GRPCAuth{
+		AnonymousRole: config.RoleNone,
+		Tokens:        []config.GRPCToken{{Name: "dashboards", Token: "ro", Role: config.RoleRead}},
+	}})
+
+	code, _ := getJSON(t, ts, "/v1/stats")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = getJSON(t, ts, "/v1/stats", "Authorization", "Bearer bogus")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = getJSON(t, ts, "/vrps.json")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = getJSON(t, ts, "/v1/stats", "Authorization", "Bearer ro")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestGatewayExport(t *testing.T) {
+	srv, ts := newGatewayTestServer(t, &config.Config{})
+	state := srv.cache.getState()
+
+	resp, err := ts.Client().Get(ts.URL + "/vrps.json")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The export reads back as an upstream document
+	data, err := decodeRPKIJSON(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, state.roas, data.roas)
+	assert.Equal(t, state.aspas, data.aspas)
+	assert.Equal(t, state.routerKeys, data.routerKeys)
+
+	resp, err = ts.Client().Get(ts.URL + "/vrps.json?format=gortr")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	var list gortrList
+	require.NoError(t, json.Unmarshal(b, &list))
+	assert.Equal(t, 2, list.Metadata.Counts)
+	require.Len(t, list.Data, 2)
+	assert.Equal(t, "AS13335", list.Data[0].ASN)
+	roa, err := list.Data[1].toROA()
+	require.NoError(t, err)
+	assert.Equal(t, ROA{Prefix: netip.MustParsePrefix("2001:db8::/32"), ASN: 64496, MaxMask: 48}, roa)
+
+	// Unchanged content is not sent again
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/vrps.json", nil)
+	require.NoError(t, err)
+	req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+	other, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	other.Body.Close()
+	assert.Equal(t, http.StatusOK, other.StatusCode, "the ETag differs per format")
+
+	first, err := ts.Client().Get(ts.URL + "/vrps.json")
+	require.NoError(t, err)
+	first.Body.Close()
+	req.Header.Set("If-None-Match", first.Header.Get("ETag"))
+	notModified, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	notModified.Body.Close()
+	assert.Equal(t, http.StatusNotModified, notModified.StatusCode)
+
+	srv.UpdateROAs(state.roas[:1])
+	changed, err := ts.Client().Do(req)
+	require.NoError(t, err)
+	changed.Body.Close()
+	assert.Equal(t, http.StatusOK, changed.StatusCode)
+}
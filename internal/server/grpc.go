@@ -2,8 +2,16 @@ package server
 
 import (
 	"context"
+	"encoding/hex"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
 
 	rpkirtripb "github.com/mellowdrifter/rpkirtr2/api/v1"
+	"github.com/mellowdrifter/rpkirtr2/internal/protocol"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type grpcServer struct {
@@ -21,20 +29,531 @@ func (g *grpcServer) GetStats(ctx context.Context, req *rpkirtripb.GetStatsReque
 	g.srv.upstreamsMu.RLock()
 	upstreams := make([]*rpkirtripb.UpstreamStatus, 0, len(g.srv.upstreams))
 	for url, stats := range g.srv.upstreams {
-		upstreams = append(upstreams, &rpkirtripb.UpstreamStatus{
-			Url:              url,
-			LastFetchSuccess: stats.LastFetchSuccess,
-			LastFetchTime:    stats.LastFetchTime.Unix(),
-			ErrorMessage:     stats.ErrorMessage,
-		})
+		upstreams = append(upstreams, toUpstreamStatus(url, stats))
 	}
 	g.srv.upstreamsMu.RUnlock()
 
 	return &rpkirtripb.GetStatsResponse{
-		RoaCount:    uint32(len(state.roas)),
-		ClientCount: clientCount,
-		Serial:      state.serial,
-		LastUpdate:  state.lastUpdate.Unix(),
-		Upstreams:   upstreams,
+		RoaCount:       uint32(len(state.roas)),
+		ClientCount:    clientCount,
+		Serial:         state.serial,
+		LastUpdate:     state.lastUpdate.Unix(),
+		Upstreams:      upstreams,
+		AspaCount:      uint32(len(state.aspas)),
+		RouterKeyCount: uint32(len(state.routerKeys)),
+		UpdatesPaused:  g.srv.UpdatesPaused(),
+		VrpsCompressed: uint32(state.compressed),
+	}, nil
+}
+
+func toUpstreamStatus(url string, stats *UpstreamStatus) *rpkirtripb.UpstreamStatus {
+	return &rpkirtripb.UpstreamStatus{
+		Url:              url,
+		LastFetchSuccess: stats.LastFetchSuccess,
+		LastFetchTime:    stats.LastFetchTime.Unix(),
+		ErrorMessage:     stats.ErrorMessage,
+		RoaCount:         uint32(stats.ROACount),
+		AspaCount:        uint32(stats.ASPACount),
+		RouterKeyCount:   uint32(stats.RouterKeyCount),
+		SessionId:        uint32(stats.SessionID),
+		Serial:           stats.Serial,
+		RetryCount:       uint32(stats.RetryCount),
+		NextAttempt:      unixTime(stats.NextAttempt),
+	}
+}
+
+// unixTime converts t to a Unix timestamp, keeping zero for unset times such as
+// the retry time of a healthy upstream.
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// ValidateRoute performs RFC 6811 route origin validation against the cache
+// served to routers.
+func (g *grpcServer) ValidateRoute(ctx context.Context, req *rpkirtripb.ValidateRouteRequest) (*rpkirtripb.ValidateRouteResponse, error) {
+	prefix, err := netip.ParsePrefix(req.GetPrefix())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid prefix %q: %v", req.GetPrefix(), err)
+	}
+
+	trie := g.srv.cache.roaIndex()
+	state, matched, unmatched := trie.validate(prefix, req.GetOriginAsn())
+
+	return &rpkirtripb.ValidateRouteResponse{
+		State:     validationStates[state],
+		Matched:   toVRPs(matched),
+		Unmatched: toVRPs(unmatched),
+		Serial:    trie.serial,
+	}, nil
+}
+
+// VerifyASPath verifies an AS_PATH against the cached ASPAs following the ASPA
+// verification draft and reports the authorization of every hop.
+func (g *grpcServer) VerifyASPath(ctx context.Context, req *rpkirtripb.VerifyASPathRequest) (*rpkirtripb.VerifyASPathResponse, error) {
+	var dir pathDirection
+	switch req.GetDirection() {
+	case rpkirtripb.PathDirection_PATH_DIRECTION_UPSTREAM:
+		dir = pathUpstream
+	case rpkirtripb.PathDirection_PATH_DIRECTION_DOWNSTREAM:
+		dir = pathDownstream
+	default:
+		return nil, status.Error(codes.InvalidArgument, "direction must be upstream or downstream")
+	}
+
+	g.srv.rlock()
+	aspas, serial := g.srv.cache.aspas, g.srv.cache.serial
+	g.srv.runlock()
+
+	v := verifyASPath(aspas, req.GetAsPath(), dir)
+	hops := make([]*rpkirtripb.ASPAHop, 0, len(v.hops))
+	for _, h := range v.hops {
+		hops = append(hops, &rpkirtripb.ASPAHop{
+			CustomerAsn:   h.customer,
+			ProviderAsn:   h.provider,
+			Authorization: hopAuthorizations[h.result],
+		})
+	}
+
+	return &rpkirtripb.VerifyASPathResponse{
+		State:       pathStates[v.state],
+		Hops:        hops,
+		Serial:      serial,
+		MaxUpRamp:   uint32(v.maxUpRamp),
+		MinUpRamp:   uint32(v.minUpRamp),
+		MaxDownRamp: uint32(v.maxDownRamp),
+		MinDownRamp: uint32(v.minDownRamp),
+	}, nil
+}
+
+var pathStates = map[pathState]rpkirtripb.ASPathState{
+	pathValid:   rpkirtripb.ASPathState_AS_PATH_STATE_VALID,
+	pathInvalid: rpkirtripb.ASPathState_AS_PATH_STATE_INVALID,
+	pathUnknown: rpkirtripb.ASPathState_AS_PATH_STATE_UNKNOWN,
+}
+
+var hopAuthorizations = map[hopResult]rpkirtripb.HopAuthorization{
+	hopNoAttestation: rpkirtripb.HopAuthorization_HOP_AUTHORIZATION_NO_ATTESTATION,
+	hopProvider:      rpkirtripb.HopAuthorization_HOP_AUTHORIZATION_PROVIDER,
+	hopNotProvider:   rpkirtripb.HopAuthorization_HOP_AUTHORIZATION_NOT_PROVIDER,
+}
+
+// ListROAs streams the cached VRPs matching the request filters.
+func (g *grpcServer) ListROAs(req *rpkirtripb.ListROAsRequest, stream rpkirtripb.RPKIRTRService_ListROAsServer) error {
+	f := roaFilter{
+		origin:        req.OriginAsn,
+		maxLength:     req.MaxLength,
+		expiresBefore: req.GetExpiresBefore(),
+		expiresAfter:  req.GetExpiresAfter(),
+	}
+	if req.GetPrefix() != "" {
+		p, err := netip.ParsePrefix(req.GetPrefix())
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid prefix %q: %v", req.GetPrefix(), err)
+		}
+		f.prefix = p.Masked()
+	}
+	switch req.GetPrefixMatch() {
+	case rpkirtripb.PrefixMatch_PREFIX_MATCH_COVERING:
+		f.match = matchCovering
+	case rpkirtripb.PrefixMatch_PREFIX_MATCH_COVERED:
+		f.match = matchCovered
+	}
+	switch req.GetAddressFamily() {
+	case rpkirtripb.AddressFamily_ADDRESS_FAMILY_IPV4:
+		f.family = 4
+	case rpkirtripb.AddressFamily_ADDRESS_FAMILY_IPV6:
+		f.family = 6
+	}
+
+	state := g.srv.cache.getState()
+	start, err := listStart(state.session, state.serial, req.Serial, req.GetPageToken())
+	if err != nil {
+		return err
+	}
+
+	send := func(roas []ROA) error {
+		return stream.Send(&rpkirtripb.ListROAsResponse{Serial: state.serial, Roas: toVRPs(roas)})
+	}
+	last, next, err := listPage(state.roas, start, int(req.GetPageSize()), f.keep, send)
+	if err != nil {
+		return err
+	}
+	resp := &rpkirtripb.ListROAsResponse{Serial: state.serial, Roas: toVRPs(last)}
+	if next >= 0 {
+		resp.NextPageToken = encodePageToken(state.session, state.serial, next)
+	}
+	return stream.Send(resp)
+}
+
+// ListASPAs streams the cached ASPAs matching the request filters.
+func (g *grpcServer) ListASPAs(req *rpkirtripb.ListASPAsRequest, stream rpkirtripb.RPKIRTRService_ListASPAsServer) error {
+	f := aspaFilter{
+		customer:      req.CustomerAsn,
+		provider:      req.ProviderAsn,
+		expiresBefore: req.GetExpiresBefore(),
+		expiresAfter:  req.GetExpiresAfter(),
+	}
+
+	state := g.srv.cache.getState()
+	start, err := listStart(state.session, state.serial, req.Serial, req.GetPageToken())
+	if err != nil {
+		return err
+	}
+
+	send := func(aspas []ASPA) error {
+		return stream.Send(&rpkirtripb.ListASPAsResponse{Serial: state.serial, Aspas: toASPAs(aspas)})
+	}
+	last, next, err := listPage(state.aspas, start, int(req.GetPageSize()), f.keep, send)
+	if err != nil {
+		return err
+	}
+	resp := &rpkirtripb.ListASPAsResponse{Serial: state.serial, Aspas: toASPAs(last)}
+	if next >= 0 {
+		resp.NextPageToken = encodePageToken(state.session, state.serial, next)
+	}
+	return stream.Send(resp)
+}
+
+// WatchUpdates streams an update for every serial bump. A consumer that
+// passes the serial it last saw is brought up to date from the history ring,
+// like an RTR Serial Query; otherwise it starts with a snapshot, like a Reset
+// Query.
+func (g *grpcServer) WatchUpdates(req *rpkirtripb.WatchUpdatesRequest, stream rpkirtripb.RPKIRTRService_WatchUpdatesServer) error {
+	wake, ok := g.srv.watchUpdates()
+	if !ok {
+		return status.Error(codes.Unavailable, "server is shutting down")
+	}
+	defer g.srv.unwatchUpdates(wake)
+
+	serial, synced := req.GetSerial(), req.Serial != nil
+	if synced && req.SessionId != nil && *req.SessionId != uint32(g.srv.getSession()) {
+		synced = false
+	}
+
+	for {
+		records, state, ok := g.srv.cache.updatesFrom(serial)
+		var err error
+		if !synced || !ok {
+			err = sendCacheUpdate(stream, state.session, 0, state.serial, true, state.roas, nil, state.aspas, nil)
+		} else {
+			for _, r := range records {
+				if err = sendCacheUpdate(stream, state.session, r.from, r.to, false, r.add, r.del, r.addAspa, r.delAspa); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+		serial, synced = state.serial, true
+
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case _, open := <-wake:
+			if !open {
+				return status.Error(codes.Unavailable, "server is shutting down")
+			}
+		}
+	}
+}
+
+// sendCacheUpdate sends one serial's changes, split across messages of at
+// most listChunkSize entries per list.
+func sendCacheUpdate(stream rpkirtripb.RPKIRTRService_WatchUpdatesServer, session uint16, from, to uint32, snapshot bool,
+	addRoa, delRoa []ROA, addAspa, delAspa []ASPA) error {
+	n := max(len(addRoa), len(delRoa), len(addAspa), len(delAspa))
+	for off := 0; off == 0 || off < n; off += listChunkSize {
+		end := off + listChunkSize
+		if err := stream.Send(&rpkirtripb.CacheUpdate{
+			Serial:         to,
+			SessionId:      uint32(session),
+			Snapshot:       snapshot,
+			FromSerial:     from,
+			AnnouncedRoas:  toVRPs(chunkOf(addRoa, off, end)),
+			WithdrawnRoas:  toVRPs(chunkOf(delRoa, off, end)),
+			AnnouncedAspas: toASPAs(chunkOf(addAspa, off, end)),
+			WithdrawnAspas: toASPAs(chunkOf(delAspa, off, end)),
+			More:           end < n,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkOf returns items[from:to], clamped to the slice.
+func chunkOf[T any](items []T, from, to int) []T {
+	return items[min(from, len(items)):min(to, len(items))]
+}
+
+// ListDiffs summarises the diffs retained in the history ring.
+func (g *grpcServer) ListDiffs(ctx context.Context, req *rpkirtripb.ListDiffsRequest) (*rpkirtripb.ListDiffsResponse, error) {
+	state := g.srv.cache.getState()
+	history := g.srv.cache.getHistory()
+
+	diffs := make([]*rpkirtripb.DiffSummary, 0, len(history))
+	for _, d := range history {
+		diffs = append(diffs, &rpkirtripb.DiffSummary{
+			FromSerial: d.from,
+			ToSerial:   d.to,
+			Timestamp:  d.time.Unix(),
+			Source:     d.source,
+			Upstreams:  d.changed,
+			Announced:  diffCounts(d.add, d.addAspa, d.addKeys),
+			Withdrawn:  diffCounts(d.del, d.delAspa, d.delKeys),
+		})
+	}
+
+	return &rpkirtripb.ListDiffsResponse{
+		Serial:    state.serial,
+		SessionId: uint32(state.session),
+		Diffs:     diffs,
+	}, nil
+}
+
+// GetDiff returns the net changes between two retained serials, with
+// opposing changes cancelled out as for an RTR Serial Query.
+func (g *grpcServer) GetDiff(ctx context.Context, req *rpkirtripb.GetDiffRequest) (*rpkirtripb.GetDiffResponse, error) {
+	from, to := req.GetFromSerial(), req.GetToSerial()
+	if to == 0 {
+		to = g.srv.getSerial()
+	}
+	d, ok := g.srv.cache.getDiffSetBetween(from, to)
+	if !ok {
+		return nil, status.Errorf(codes.OutOfRange, "no retained diffs lead from serial %d to %d", from, to)
+	}
+
+	return &rpkirtripb.GetDiffResponse{
+		FromSerial:          from,
+		ToSerial:            to,
+		AnnouncedRoas:       toVRPs(d.addRoa),
+		WithdrawnRoas:       toVRPs(d.delRoa),
+		AnnouncedAspas:      toASPAs(d.addAspa),
+		WithdrawnAspas:      toASPAs(d.delAspa),
+		AnnouncedRouterKeys: toRouterKeys(d.addKeys),
+		WithdrawnRouterKeys: toRouterKeys(d.delKeys),
+	}, nil
+}
+
+func diffCounts(roas []ROA, aspas []ASPA, keys []RouterKey) *rpkirtripb.DiffCounts {
+	c := &rpkirtripb.DiffCounts{
+		Aspas:      uint32(len(aspas)),
+		RouterKeys: uint32(len(keys)),
+	}
+	for _, r := range roas {
+		if r.Prefix.Addr().Is4() {
+			c.Ipv4Roas++
+		} else {
+			c.Ipv6Roas++
+		}
+	}
+	return c
+}
+
+// ListClients reports every connected router session.
+func (g *grpcServer) ListClients(ctx context.Context, req *rpkirtripb.ListClientsRequest) (*rpkirtripb.ListClientsResponse, error) {
+	serial := g.srv.getSerial()
+
+	g.srv.clientsMu.RLock()
+	infos := make([]clientInfo, 0, len(g.srv.clients))
+	for _, c := range g.srv.clients {
+		infos = append(infos, c.info())
+	}
+	g.srv.clientsMu.RUnlock()
+	slices.SortFunc(infos, func(a, b clientInfo) int { return strings.Compare(a.id, b.id) })
+
+	clients := make([]*rpkirtripb.ClientInfo, 0, len(infos))
+	for _, i := range infos {
+		c := &rpkirtripb.ClientInfo{
+			Id:                 i.id,
+			Version:            uint32(i.version),
+			ConnectedAt:        i.connectedAt.Unix(),
+			AcknowledgedSerial: i.ackSerial,
+			LastSerial:         i.sentSerial,
+			BytesSent:          i.bytesSent,
+			PdusSent:           i.pdusSent,
+			Behind:             !i.synced || i.sentSerial != serial,
+			View:               i.view,
+		}
+		if !i.lastQueryAt.IsZero() {
+			c.LastQuery = queryTypes[i.lastQuery]
+			c.LastQueryTime = i.lastQueryAt.Unix()
+		}
+		clients = append(clients, c)
+	}
+
+	return &rpkirtripb.ListClientsResponse{
+		Serial:  serial,
+		Clients: clients,
 	}, nil
 }
+
+var queryTypes = map[protocol.PDUType]rpkirtripb.QueryType{
+	protocol.ResetQuery:  rpkirtripb.QueryType_QUERY_TYPE_RESET,
+	protocol.SerialQuery: rpkirtripb.QueryType_QUERY_TYPE_SERIAL,
+}
+
+// DisconnectClient closes a router session.
+func (g *grpcServer) DisconnectClient(ctx context.Context, req *rpkirtripb.DisconnectClientRequest) (*rpkirtripb.DisconnectClientResponse, error) {
+	c, err := g.client(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	g.srv.logger.Infow("Disconnecting client on request", "client", c.ID())
+	c.Close()
+	return &rpkirtripb.DisconnectClientResponse{}, nil
+}
+
+// ResetClient sends a Cache Reset to a router, which makes it resynchronise
+// with a Reset Query.
+func (g *grpcServer) ResetClient(ctx context.Context, req *rpkirtripb.ResetClientRequest) (*rpkirtripb.ResetClientResponse, error) {
+	c, err := g.client(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if c.info().version == 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "client %s has not negotiated a version yet", c.ID())
+	}
+	g.srv.logger.Infow("Sending Cache Reset to client on request", "client", c.ID())
+	c.sendCacheReset()
+	return &rpkirtripb.ResetClientResponse{}, nil
+}
+
+// QueryAudit follows the VRPs for a prefix, or the VRPs and ASPAs of an AS,
+// through the audit log.
+func (g *grpcServer) QueryAudit(ctx context.Context, req *rpkirtripb.QueryAuditRequest) (*rpkirtripb.QueryAuditResponse, error) {
+	if g.srv.audit == nil {
+		return nil, status.Error(codes.FailedPrecondition, "audit log is not enabled")
+	}
+	q := auditQuery{asn: req.Asn}
+	if req.GetPrefix() != "" {
+		p, err := netip.ParsePrefix(req.GetPrefix())
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid prefix: %v", err)
+		}
+		q.prefix = p.Masked()
+	}
+	if !q.prefix.IsValid() && q.asn == nil {
+		return nil, status.Error(codes.InvalidArgument, "prefix or asn is required")
+	}
+	if req.GetSince() != 0 {
+		q.since = time.Unix(req.GetSince(), 0)
+	}
+	if req.GetUntil() != 0 {
+		q.until = time.Unix(req.GetUntil(), 0)
+	}
+
+	events, err := g.srv.audit.query(q)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to query audit log: %v", err)
+	}
+	resp := &rpkirtripb.QueryAuditResponse{Events: make([]*rpkirtripb.AuditEvent, 0, len(events))}
+	for _, e := range events {
+		ev := &rpkirtripb.AuditEvent{
+			Timestamp:  e.record.Time.Unix(),
+			SessionId:  uint32(e.record.Session),
+			FromSerial: e.record.FromSerial,
+			ToSerial:   e.record.Serial,
+			Source:     e.record.Source,
+			Upstreams:  e.record.Upstreams,
+			Principal:  e.record.Principal,
+			Action:     auditActions[e.action],
+		}
+		if e.vrp != nil {
+			ev.Vrp = &rpkirtripb.VRP{Prefix: e.vrp.Prefix.String(), MaxLength: uint32(e.vrp.MaxLength), Asn: e.vrp.ASN}
+		}
+		if e.aspa != nil {
+			ev.Aspa = &rpkirtripb.ASPA{CustomerAsn: e.aspa.CustomerASN, ProviderAsns: e.aspa.ProviderASNs}
+		}
+		resp.Events = append(resp.Events, ev)
+	}
+	return resp, nil
+}
+
+var auditActions = map[auditAction]rpkirtripb.AuditAction{
+	auditAnnounced: rpkirtripb.AuditAction_AUDIT_ACTION_ANNOUNCED,
+	auditWithdrawn: rpkirtripb.AuditAction_AUDIT_ACTION_WITHDRAWN,
+	auditLoaded:    rpkirtripb.AuditAction_AUDIT_ACTION_LOADED,
+}
+
+func (g *grpcServer) client(id string) (*Client, error) {
+	g.srv.clientsMu.RLock()
+	defer g.srv.clientsMu.RUnlock()
+	c, ok := g.srv.clients[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no client %q", id)
+	}
+	return c, nil
+}
+
+// listStart returns the offset to resume a listing from. Pages are only
+// consistent within one cache session and serial, so a request pinned to
+// another serial, either explicitly or through its page token, or with a page
+// token from another session fails with FailedPrecondition.
+func listStart(session uint16, serial uint32, want *uint32, token string) (int, error) {
+	if want != nil && *want != serial {
+		return 0, status.Errorf(codes.FailedPrecondition, "cache is at serial %d, not %d", serial, *want)
+	}
+	if token == "" {
+		return 0, nil
+	}
+	tokenSession, tokenSerial, offset, err := decodePageToken(token)
+	if err != nil {
+		return 0, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if tokenSession != session {
+		return 0, status.Errorf(codes.FailedPrecondition, "cache session changed from %d to %d, restart the listing", tokenSession, session)
+	}
+	if tokenSerial != serial {
+		return 0, status.Errorf(codes.FailedPrecondition, "cache changed from serial %d to %d, restart the listing", tokenSerial, serial)
+	}
+	return offset, nil
+}
+
+var validationStates = map[rovState]rpkirtripb.ValidationState{
+	rovNotFound: rpkirtripb.ValidationState_VALIDATION_STATE_NOT_FOUND,
+	rovValid:    rpkirtripb.ValidationState_VALIDATION_STATE_VALID,
+	rovInvalid:  rpkirtripb.ValidationState_VALIDATION_STATE_INVALID,
+}
+
+func toVRPs(roas []ROA) []*rpkirtripb.VRP {
+	vrps := make([]*rpkirtripb.VRP, 0, len(roas))
+	for _, r := range roas {
+		vrps = append(vrps, &rpkirtripb.VRP{
+			Prefix:    r.Prefix.String(),
+			MaxLength: uint32(r.MaxMask),
+			Asn:       r.ASN,
+			Expires:   r.Expires,
+		})
+	}
+	return vrps
+}
+
+func toASPAs(aspas []ASPA) []*rpkirtripb.ASPA {
+	out := make([]*rpkirtripb.ASPA, 0, len(aspas))
+	for _, a := range aspas {
+		out = append(out, &rpkirtripb.ASPA{
+			CustomerAsn:  a.CustomerASN,
+			ProviderAsns: a.ProviderASNs,
+			Expires:      a.Expires,
+		})
+	}
+	return out
+}
+
+func toRouterKeys(keys []RouterKey) []*rpkirtripb.RouterKey {
+	out := make([]*rpkirtripb.RouterKey, 0, len(keys))
+	for _, k := range keys {
+		out = append(out, &rpkirtripb.RouterKey{
+			Ski:     hex.EncodeToString(k.SKI[:]),
+			Asn:     k.ASN,
+			Spki:    k.SPKI,
+			Expires: k.Expires,
+		})
+	}
+	return out
+}
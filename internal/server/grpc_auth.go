@@ -0,0 +1,295 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	rpkirtripb "github.com/mellowdrifter/rpkirtr2/api/v1"
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	adminServicePrefix  = "/rpkirtr.v1.RPKIRTRAdminService/"
+	healthServicePrefix = "/grpc.health.v1.Health/"
+)
+
+// role is the access level of a gRPC caller. Each role includes the ones below it.
+type role int
+
+const (
+	roleNone role = iota
+	roleRead
+	roleAdmin
+)
+
+var roles = map[string]role{
+	config.RoleNone:  roleNone,
+	config.RoleRead:  roleRead,
+	config.RoleAdmin: roleAdmin,
+}
+
+// principal is an authenticated gRPC caller.
+type principal struct {
+	name string // token name, certificate name or "anonymous"
+	role role
+}
+
+type principalKey struct{}
+
+// principalFrom returns the caller of an RPC that passed the auth interceptors.
+func principalFrom(ctx context.Context) (principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(principal)
+	return p, ok
+}
+
+// grpcAuth authenticates gRPC callers and enforces the role each method needs.
+type grpcAuth struct {
+	tokens    []config.GRPCToken
+	certs     []config.GRPCClientCert
+	anonymous role
+}
+
+func newGRPCAuth(cfg *config.Config) *grpcAuth {
+	a := &grpcAuth{
+		tokens:    slices.Clone(cfg.GRPCAuth.Tokens),
+		certs:     cfg.GRPCAuth.ClientCerts,
+		anonymous: roleRead,
+	}
+	if cfg.GRPCAuth.AnonymousRole != "" {
+		a.anonymous = roles[cfg.GRPCAuth.AnonymousRole]
+	}
+	if cfg.AdminToken != "" {
+		a.tokens = append(a.tokens, config.GRPCToken{Name: "admin_token", Token: cfg.AdminToken, Role: config.RoleAdmin})
+	}
+	return a
+}
+
+// hasAdmin reports whether any caller can reach the admin service.
+func (a *grpcAuth) hasAdmin() bool {
+	return a.anonymous == roleAdmin ||
+		slices.ContainsFunc(a.tokens, func(t config.GRPCToken) bool { return t.Role == config.RoleAdmin }) ||
+		slices.ContainsFunc(a.certs, func(c config.GRPCClientCert) bool { return c.Role == config.RoleAdmin })
+}
+
+// required returns the role needed to call a method. Health checks are open
+// to probes without credentials. Anything but the admin service, including
+// reflection, only reads.
+func required(method string) role {
+	switch {
+	case strings.HasPrefix(method, healthServicePrefix):
+		return roleNone
+	case strings.HasPrefix(method, adminServicePrefix):
+		return roleAdmin
+	}
+	return roleRead
+}
+
+// authenticate identifies the caller of an RPC.
+func (a *grpcAuth) authenticate(ctx context.Context) (principal, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return a.identify(md.Get("authorization"), peerCertificate(ctx))
+}
+
+// identify maps the authorization values and verified client certificate of a
+// caller to a principal. A bearer token takes precedence over a client
+// certificate; a token that does not match is refused rather than treated as
+// anonymous.
+func (a *grpcAuth) identify(authorization []string, cert *x509.Certificate) (principal, error) {
+	if len(authorization) > 0 {
+		token, ok := strings.CutPrefix(authorization[0], "Bearer ")
+		if !ok {
+			return principal{}, status.Error(codes.Unauthenticated, "authorization must be a bearer token")
+		}
+		for _, t := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+				return principal{name: t.Name, role: roles[t.Role]}, nil
+			}
+		}
+		return principal{}, status.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	if cert != nil {
+		for _, c := range a.certs {
+			if cert.Subject.CommonName == c.Name || slices.Contains(cert.DNSNames, c.Name) {
+				return principal{name: c.Name, role: roles[c.Role]}, nil
+			}
+		}
+	}
+	return principal{name: "anonymous", role: a.anonymous}, nil
+}
+
+// peerCertificate returns the verified client certificate of the caller, if any.
+func peerCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return nil
+	}
+	return verifiedLeaf(&info.State)
+}
+
+// verifiedLeaf returns the client certificate of a connection if it was
+// verified against the client CA.
+func verifiedLeaf(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
+
+func (a *grpcAuth) authorize(ctx context.Context, method string) (context.Context, error) {
+	want := required(method)
+	if want == roleNone {
+		return ctx, nil
+	}
+	p, err := a.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return permit(ctx, p, want, method)
+}
+
+// permit checks that p may call method, which needs role want, and returns
+// ctx carrying p.
+func permit(ctx context.Context, p principal, want role, method string) (context.Context, error) {
+	if p.role < want {
+		if p.role == roleNone {
+			return nil, status.Error(codes.Unauthenticated, "authentication required")
+		}
+		return nil, status.Errorf(codes.PermissionDenied, "%s may not call %s", p.name, method)
+	}
+	return context.WithValue(ctx, principalKey{}, p), nil
+}
+
+func (a *grpcAuth) unary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ctx, err := a.authorize(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *grpcAuth) stream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.authorize(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authedStream{ServerStream: ss, ctx: ctx})
+}
+
+// authedStream carries the principal to stream handlers.
+type authedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authedStream) Context() context.Context {
+	return s.ctx
+}
+
+// grpcTLSConfig builds the TLS settings of the gRPC listener. The server
+// certificate is loaded again on every handshake so that renewals apply
+// without a restart.
+func grpcTLSConfig(t config.GRPCTLS) (*tls.Config, error) {
+	if _, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile); err != nil {
+		return nil, fmt.Errorf("failed to load gRPC certificate: %w", err)
+	}
+	certFile, keyFile := t.CertFile, t.KeyFile
+	tlsCfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load gRPC certificate: %w", err)
+			}
+			return &cert, nil
+		},
+	}
+
+	if t.ClientCAFile != "" {
+		pem, err := os.ReadFile(t.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA file %s", t.ClientCAFile)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if t.RequireClientCert {
+			tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tlsCfg, nil
+}
+
+// newGRPCServer builds the gRPC server with TLS and auth as configured. The
+// admin service is only registered when some caller may use it.
+func (s *Server) newGRPCServer() (*grpc.Server, error) {
+	auth := newGRPCAuth(s.cfg)
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(auth.unary),
+		grpc.ChainStreamInterceptor(auth.stream),
+	}
+	if s.cfg.GRPCTLS.Enabled() {
+		tlsCfg, err := grpcTLSConfig(s.cfg.GRPCTLS)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+	} else if len(auth.tokens) > 0 && !isUnixAddr(s.cfg.GRPCAddr) {
+		s.logger.Warn("gRPC tokens are sent in plaintext; configure grpc_tls or a Unix socket")
+	}
+
+	gs := grpc.NewServer(opts...)
+	rpkirtripb.RegisterRPKIRTRServiceServer(gs, &grpcServer{srv: s})
+	healthpb.RegisterHealthServer(gs, s.health)
+	if auth.hasAdmin() {
+		rpkirtripb.RegisterRPKIRTRAdminServiceServer(gs, &adminServer{srv: s})
+	}
+	return gs, nil
+}
+
+func isUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, "unix:")
+}
+
+// listenGRPC listens on a TCP address or, for "unix:" addresses, on a Unix
+// socket. A socket left behind by an earlier run is replaced.
+func listenGRPC(addr string) (net.Listener, error) {
+	if !isUnixAddr(addr) {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(addr, "unix://"), "unix:")
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("socket %s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	} else if err == nil {
+		return nil, errors.New(path + " exists and is not a socket")
+	}
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	rpkirtripb "github.com/mellowdrifter/rpkirtr2/api/v1"
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// newTestServerCert creates a self-signed certificate for 127.0.0.1 and
+// returns its pool and the paths to the certificate and key files.
+func newTestServerCert(t *testing.T) (*x509.CertPool, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "rpkirtr2-server"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return pool, writePEM(t, "server.pem", "CERTIFICATE", der), writePEM(t, "server.key", "PRIVATE KEY", keyDER)
+}
+
+// serveGRPC serves srv on l the way Start does and returns a connection to it.
+func serveGRPC(t *testing.T, srv *Server, l net.Listener, target string, opts ...grpc.DialOption) *grpc.ClientConn {
+	t.Helper()
+	gs, err := srv.newGRPCServer()
+	require.NoError(t, err)
+	go func() {
+		_ = gs.Serve(l)
+	}()
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.NewClient(target, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestGRPCRoles(t *testing.T) {
+	srv := New(&config.Config{GRPCAuth: config.GRPCAuth{
+		Tokens: []config.GRPCToken{
+			{Name: "monitoring", Token: "ro", Role: config.RoleRead},
+			{Name: "noc", Token: "rw", Role: config.RoleAdmin},
+		},
+		AnonymousRole: config.RoleNone,
+	}}, zaptest.NewLogger(t).Sugar())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	conn := serveGRPC(t, srv, l, l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	client := rpkirtripb.NewRPKIRTRServiceClient(conn)
+	admin := rpkirtripb.NewRPKIRTRAdminServiceClient(conn)
+	bg := context.Background()
+
+	_, err = client.GetStats(bg, &rpkirtripb.GetStatsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "anonymous callers have no access")
+	_, err = client.GetStats(withToken("bogus"), &rpkirtripb.GetStatsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = client.GetStats(withToken("ro"), &rpkirtripb.GetStatsRequest{})
+	assert.NoError(t, err)
+	_, err = admin.PauseUpdates(withToken("ro"), &rpkirtripb.PauseUpdatesRequest{})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+	assert.False(t, srv.UpdatesPaused())
+
+	_, err = admin.PauseUpdates(withToken("rw"), &rpkirtripb.PauseUpdatesRequest{})
+	assert.NoError(t, err)
+	_, err = client.GetStats(withToken("rw"), &rpkirtripb.GetStatsRequest{})
+	assert.NoError(t, err, "admin includes read")
+
+	// Streams are checked too
+	stream, err := client.ListROAs(bg, &rpkirtripb.ListROAsRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	stream, err = client.ListROAs(withToken("ro"), &rpkirtripb.ListROAsRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.NoError(t, err)
+}
+
+func TestGRPCClientCertAuth(t *testing.T) {
+	serverPool, serverCert, serverKey := newTestServerCert(t)
+	_, clientCert, clientKey := newTestClientCert(t)
+
+	srv := New(&config.Config{
+		GRPCTLS: config.GRPCTLS{
+			CertFile:          serverCert,
+			KeyFile:           serverKey,
+			ClientCAFile:      clientCert, // self-signed
+			RequireClientCert: true,
+		},
+		GRPCAuth: config.GRPCAuth{
+			ClientCerts: []config.GRPCClientCert{{Name: "rpkirtr2-test", Role: config.RoleAdmin}},
+		},
+	}, zaptest.NewLogger(t).Sugar())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	require.NoError(t, err)
+	creds := credentials.NewTLS(&tls.Config{RootCAs: serverPool, Certificates: []tls.Certificate{cert}})
+	conn := serveGRPC(t, srv, l, l.Addr().String(), grpc.WithTransportCredentials(creds))
+
+	resp, err := rpkirtripb.NewRPKIRTRAdminServiceClient(conn).PauseUpdates(context.Background(), &rpkirtripb.PauseUpdatesRequest{})
+	require.NoError(t, err)
+	assert.True(t, resp.Paused)
+
+	// Without a client certificate the handshake fails
+	noCert, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: serverPool})))
+	require.NoError(t, err)
+	defer noCert.Close()
+	_, err = rpkirtripb.NewRPKIRTRServiceClient(noCert).GetStats(context.Background(), &rpkirtripb.GetStatsRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	// Plaintext is refused
+	plain, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer plain.Close()
+	_, err = rpkirtripb.NewRPKIRTRServiceClient(plain).GetStats(context.Background(), &rpkirtripb.GetStatsRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestGRPCUnixSocket(t *testing.T) {
+	// Socket paths are limited to about 100 bytes, which t.TempDir can exceed
+	dir, err := os.MkdirTemp("", "rpkirtr2")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "grpc.sock")
+
+	l, err := listenGRPC("unix://" + path)
+	require.NoError(t, err)
+	srv := New(&config.Config{GRPCAddr: "unix://" + path}, zaptest.NewLogger(t).Sugar())
+	conn := serveGRPC(t, srv, l, "unix://"+path, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	_, err = rpkirtripb.NewRPKIRTRServiceClient(conn).GetStats(context.Background(), &rpkirtripb.GetStatsRequest{})
+	require.NoError(t, err)
+
+	_, err = listenGRPC("unix:" + path)
+	assert.ErrorContains(t, err, "in use")
+
+	// A stale socket from a crashed process is replaced
+	stale := filepath.Join(dir, "stale.sock")
+	sl, err := net.Listen("unix", stale)
+	require.NoError(t, err)
+	sl.(*net.UnixListener).SetUnlinkOnClose(false)
+	sl.Close()
+	l2, err := listenGRPC("unix:" + stale)
+	require.NoError(t, err)
+	l2.Close()
+
+	notSocket := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(notSocket, nil, 0o600))
+	_, err = listenGRPC("unix:" + notSocket)
+	assert.Error(t, err)
+}
+
+func TestGRPCTLSConfigErrors(t *testing.T) {
+	_, cert, key := newTestServerCert(t)
+	_, err := grpcTLSConfig(config.GRPCTLS{CertFile: cert, KeyFile: filepath.Join(t.TempDir(), "missing.key")})
+	assert.Error(t, err)
+	_, err = grpcTLSConfig(config.GRPCTLS{CertFile: cert, KeyFile: key, ClientCAFile: key})
+	assert.ErrorContains(t, err, "no certificates")
+}
@@ -1,19 +1,29 @@
 package server
 
 import (
+	"bufio"
 	"context"
+	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	rpkirtripb "github.com/mellowdrifter/rpkirtr2/api/v1"
 	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"github.com/mellowdrifter/rpkirtr2/internal/protocol"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap/zaptest"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
 func TestGRPCStats(t *testing.T) {
@@ -60,3 +70,443 @@ func TestGRPCStats(t *testing.T) {
 	assert.Equal(t, uint32(0), resp.ClientCount)
 	assert.Equal(t, srv.cache.serial, resp.Serial)
 }
+
+func TestGRPCValidateRoute(t *testing.T) {
+	srv := New(&config.Config{}, zaptest.NewLogger(t).Sugar())
+	srv.LoadROAs([]ROA{
+		{Prefix: netip.MustParsePrefix("1.1.1.0/24"), ASN: 13335, MaxMask: 24},
+	})
+	g := &grpcServer{srv: srv}
+	ctx := context.Background()
+
+	resp, err := g.ValidateRoute(ctx, &rpkirtripb.ValidateRouteRequest{Prefix: "1.1.1.0/24", OriginAsn: 13335})
+	require.NoError(t, err)
+	assert.Equal(t, rpkirtripb.ValidationState_VALIDATION_STATE_VALID, resp.State)
+	require.Len(t, resp.Matched, 1)
+	assert.Equal(t, "1.1.1.0/24", resp.Matched[0].Prefix)
+	assert.Equal(t, uint32(24), resp.Matched[0].MaxLength)
+	assert.Equal(t, srv.CacheSerial(), resp.Serial)
+
+	resp, err = g.ValidateRoute(ctx, &rpkirtripb.ValidateRouteRequest{Prefix: "1.1.1.0/25", OriginAsn: 13335})
+	require.NoError(t, err)
+	assert.Equal(t, rpkirtripb.ValidationState_VALIDATION_STATE_INVALID, resp.State)
+	assert.Len(t, resp.Unmatched, 1)
+
+	resp, err = g.ValidateRoute(ctx, &rpkirtripb.ValidateRouteRequest{Prefix: "8.8.8.0/24", OriginAsn: 15169})
+	require.NoError(t, err)
+	assert.Equal(t, rpkirtripb.ValidationState_VALIDATION_STATE_NOT_FOUND, resp.State)
+
+	_, err = g.ValidateRoute(ctx, &rpkirtripb.ValidateRouteRequest{Prefix: "not-a-prefix"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestGRPCVerifyASPath(t *testing.T) {
+	srv := New(&config.Config{}, zaptest.NewLogger(t).Sugar())
+	srv.UpdateASPAs([]ASPA{
+		{CustomerASN: 64500, ProviderASNs: []uint32{64501}},
+		{CustomerASN: 64501, ProviderASNs: []uint32{64502}},
+	})
+	g := &grpcServer{srv: srv}
+	ctx := context.Background()
+
+	resp, err := g.VerifyASPath(ctx, &rpkirtripb.VerifyASPathRequest{
+		AsPath:    []uint32{64502, 64501, 64501, 64500},
+		Direction: rpkirtripb.PathDirection_PATH_DIRECTION_UPSTREAM,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, rpkirtripb.ASPathState_AS_PATH_STATE_VALID, resp.State)
+	require.Len(t, resp.Hops, 2)
+	assert.Equal(t, uint32(64500), resp.Hops[0].CustomerAsn)
+	assert.Equal(t, uint32(64501), resp.Hops[0].ProviderAsn)
+	assert.Equal(t, rpkirtripb.HopAuthorization_HOP_AUTHORIZATION_PROVIDER, resp.Hops[0].Authorization)
+	assert.Equal(t, uint32(3), resp.MaxUpRamp)
+	assert.Equal(t, srv.CacheSerial(), resp.Serial)
+
+	resp, err = g.VerifyASPath(ctx, &rpkirtripb.VerifyASPathRequest{
+		AsPath:    []uint32{64503, 64500},
+		Direction: rpkirtripb.PathDirection_PATH_DIRECTION_UPSTREAM,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, rpkirtripb.ASPathState_AS_PATH_STATE_INVALID, resp.State)
+	assert.Equal(t, rpkirtripb.HopAuthorization_HOP_AUTHORIZATION_NOT_PROVIDER, resp.Hops[0].Authorization)
+
+	_, err = g.VerifyASPath(ctx, &rpkirtripb.VerifyASPathRequest{AsPath: []uint32{64500}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+// startTestGRPC serves the gRPC API for srv on a loopback port and returns a client.
+func startTestGRPC(t *testing.T, srv *Server) rpkirtripb.RPKIRTRServiceClient {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	gs := grpc.NewServer()
+	rpkirtripb.RegisterRPKIRTRServiceServer(gs, &grpcServer{srv: srv})
+	go func() {
+		_ = gs.Serve(l)
+	}()
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return rpkirtripb.NewRPKIRTRServiceClient(conn)
+}
+
+// listROAs reads a whole ListROAs stream and returns the VRPs and the final message.
+func listROAs(t *testing.T, client rpkirtripb.RPKIRTRServiceClient, req *rpkirtripb.ListROAsRequest) ([]*rpkirtripb.VRP, *rpkirtripb.ListROAsResponse, error) {
+	t.Helper()
+	stream, err := client.ListROAs(context.Background(), req)
+	require.NoError(t, err)
+	var vrps []*rpkirtripb.VRP
+	var last *rpkirtripb.ListROAsResponse
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return vrps, last, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		vrps = append(vrps, resp.Roas...)
+		last = resp
+	}
+}
+
+func TestGRPCListROAs(t *testing.T) {
+	srv := New(&config.Config{}, zaptest.NewLogger(t).Sugar())
+	now := time.Now().Unix()
+	srv.UpdateROAs([]ROA{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), ASN: 64496, MaxMask: 16, Expires: now + 1000},
+		{Prefix: netip.MustParsePrefix("10.1.0.0/16"), ASN: 64497, MaxMask: 24, Expires: now + 2000},
+		{Prefix: netip.MustParsePrefix("10.1.2.0/24"), ASN: 64496, MaxMask: 24},
+		{Prefix: netip.MustParsePrefix("192.0.2.0/24"), ASN: 64498, MaxMask: 24},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), ASN: 64496, MaxMask: 48},
+	})
+	client := startTestGRPC(t, srv)
+
+	vrps, last, err := listROAs(t, client, &rpkirtripb.ListROAsRequest{})
+	require.NoError(t, err)
+	assert.Len(t, vrps, 5)
+	assert.Equal(t, srv.CacheSerial(), last.Serial)
+	assert.Empty(t, last.NextPageToken)
+
+	asn := uint32(64496)
+	vrps, _, err = listROAs(t, client, &rpkirtripb.ListROAsRequest{
+		Prefix:        "10.1.0.0/16",
+		PrefixMatch:   rpkirtripb.PrefixMatch_PREFIX_MATCH_COVERING,
+		OriginAsn:     &asn,
+		AddressFamily: rpkirtripb.AddressFamily_ADDRESS_FAMILY_IPV4,
+	})
+	require.NoError(t, err)
+	require.Len(t, vrps, 1)
+	assert.Equal(t, "10.0.0.0/8", vrps[0].Prefix)
+	assert.Equal(t, now+1000, vrps[0].Expires)
+
+	vrps, _, err = listROAs(t, client, &rpkirtripb.ListROAsRequest{ExpiresBefore: now + 1500})
+	require.NoError(t, err)
+	require.Len(t, vrps, 1)
+	assert.Equal(t, "10.0.0.0/8", vrps[0].Prefix)
+
+	// Page through everything two at a time
+	var all []string
+	token := ""
+	for {
+		vrps, last, err := listROAs(t, client, &rpkirtripb.ListROAsRequest{PageSize: 2, PageToken: token})
+		require.NoError(t, err)
+		for _, v := range vrps {
+			all = append(all, v.Prefix)
+		}
+		token = last.NextPageToken
+		if token == "" {
+			break
+		}
+		assert.Len(t, vrps, 2)
+	}
+	assert.Len(t, all, 5)
+
+	_, last, err = listROAs(t, client, &rpkirtripb.ListROAsRequest{PageSize: 2})
+	require.NoError(t, err)
+	require.NotEmpty(t, last.NextPageToken)
+
+	srv.UpdateROAs([]ROA{{Prefix: netip.MustParsePrefix("10.0.0.0/8"), ASN: 64496, MaxMask: 8}})
+	_, _, err = listROAs(t, client, &rpkirtripb.ListROAsRequest{PageSize: 2, PageToken: last.NextPageToken})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	stale := last.Serial
+	_, _, err = listROAs(t, client, &rpkirtripb.ListROAsRequest{Serial: &stale})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	_, _, err = listROAs(t, client, &rpkirtripb.ListROAsRequest{PageToken: "garbage"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// A token from another session is refused at the same serial, as after a restart
+	other := encodePageToken(srv.getSession()+1, srv.getSerial(), 0)
+	_, _, err = listROAs(t, client, &rpkirtripb.ListROAsRequest{PageToken: other})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestGRPCListASPAs(t *testing.T) {
+	srv := New(&config.Config{}, zaptest.NewLogger(t).Sugar())
+	srv.UpdateASPAs([]ASPA{
+		{CustomerASN: 64500, ProviderASNs: []uint32{64501, 64502}},
+		{CustomerASN: 64501, ProviderASNs: []uint32{64502}},
+		{CustomerASN: 64503, ProviderASNs: []uint32{64504}},
+	})
+	client := startTestGRPC(t, srv)
+
+	provider := uint32(64502)
+	stream, err := client.ListASPAs(context.Background(), &rpkirtripb.ListASPAsRequest{ProviderAsn: &provider})
+	require.NoError(t, err)
+	resp, err := stream.Recv()
+	require.NoError(t, err)
+	require.Len(t, resp.Aspas, 2)
+	assert.Equal(t, uint32(64500), resp.Aspas[0].CustomerAsn)
+	assert.Equal(t, []uint32{64501, 64502}, resp.Aspas[0].ProviderAsns)
+	assert.Equal(t, uint32(64501), resp.Aspas[1].CustomerAsn)
+	assert.Equal(t, srv.CacheSerial(), resp.Serial)
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestGRPCWatchUpdates(t *testing.T) {
+	srv := New(&config.Config{}, zaptest.NewLogger(t).Sugar())
+	a := ROA{Prefix: netip.MustParsePrefix("10.0.0.0/8"), ASN: 64496, MaxMask: 8}
+	b := ROA{Prefix: netip.MustParsePrefix("10.1.0.0/16"), ASN: 64497, MaxMask: 16}
+	srv.UpdateROAs([]ROA{a})
+	client := startTestGRPC(t, srv)
+	session := uint32(srv.getSession())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.WatchUpdates(ctx, &rpkirtripb.WatchUpdatesRequest{})
+	require.NoError(t, err)
+	first, err := stream.Recv()
+	require.NoError(t, err)
+	assert.True(t, first.Snapshot)
+	assert.Equal(t, session, first.SessionId)
+	assert.Equal(t, srv.CacheSerial(), first.Serial)
+	require.Len(t, first.AnnouncedRoas, 1)
+
+	srv.UpdateROAs([]ROA{b})
+	update, err := stream.Recv()
+	require.NoError(t, err)
+	assert.False(t, update.Snapshot)
+	assert.Equal(t, first.Serial, update.FromSerial)
+	assert.Equal(t, first.Serial+1, update.Serial)
+	require.Len(t, update.AnnouncedRoas, 1)
+	assert.Equal(t, "10.1.0.0/16", update.AnnouncedRoas[0].Prefix)
+	require.Len(t, update.WithdrawnRoas, 1)
+	assert.Equal(t, "10.0.0.0/8", update.WithdrawnRoas[0].Prefix)
+
+	// Resuming replays every serial since the one given
+	srv.UpdateROAs([]ROA{a, b})
+	resumed, err := client.WatchUpdates(ctx, &rpkirtripb.WatchUpdatesRequest{Serial: &first.Serial, SessionId: &session})
+	require.NoError(t, err)
+	for _, want := range []uint32{first.Serial + 1, first.Serial + 2} {
+		u, err := resumed.Recv()
+		require.NoError(t, err)
+		assert.False(t, u.Snapshot)
+		assert.Equal(t, want, u.Serial)
+	}
+
+	// A different session or a serial outside the history gets a snapshot
+	otherSession := session + 1
+	tooOld := uint32(0)
+	for _, req := range []*rpkirtripb.WatchUpdatesRequest{
+		{Serial: &first.Serial, SessionId: &otherSession},
+		{Serial: &tooOld},
+	} {
+		s, err := client.WatchUpdates(ctx, req)
+		require.NoError(t, err)
+		u, err := s.Recv()
+		require.NoError(t, err)
+		assert.True(t, u.Snapshot)
+		assert.Len(t, u.AnnouncedRoas, 2)
+	}
+
+	update, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, first.Serial+2, update.Serial)
+
+	srv.closeWatchers()
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
+
+func TestGRPCWatchUpdatesChunked(t *testing.T) {
+	srv := New(&config.Config{}, zaptest.NewLogger(t).Sugar())
+	roas := make([]ROA, 0, listChunkSize+10)
+	for i := range listChunkSize + 10 {
+		roas = append(roas, ROA{Prefix: netip.PrefixFrom(netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 0}), 24), ASN: 64496, MaxMask: 24})
+	}
+	srv.UpdateROAs(roas)
+	client := startTestGRPC(t, srv)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.WatchUpdates(ctx, &rpkirtripb.WatchUpdatesRequest{})
+	require.NoError(t, err)
+
+	first, err := stream.Recv()
+	require.NoError(t, err)
+	assert.True(t, first.More)
+	assert.Len(t, first.AnnouncedRoas, listChunkSize)
+	second, err := stream.Recv()
+	require.NoError(t, err)
+	assert.False(t, second.More)
+	assert.True(t, second.Snapshot)
+	assert.Len(t, second.AnnouncedRoas, 10)
+}
+
+func TestGRPCDiffHistory(t *testing.T) {
+	srv := New(&config.Config{}, zaptest.NewLogger(t).Sugar())
+	v4 := ROA{Prefix: netip.MustParsePrefix("10.0.0.0/8"), ASN: 64496, MaxMask: 8}
+	v6 := ROA{Prefix: netip.MustParsePrefix("2001:db8::/32"), ASN: 64496, MaxMask: 32}
+	start := srv.CacheSerial()
+	srv.UpdateROAs([]ROA{v4, v6})
+	srv.UpdateROAs([]ROA{v6})
+	srv.UpdateASPAs([]ASPA{{CustomerASN: 64496, ProviderASNs: []uint32{64497}}})
+	g := &grpcServer{srv: srv}
+	ctx := context.Background()
+
+	list, err := g.ListDiffs(ctx, &rpkirtripb.ListDiffsRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, srv.CacheSerial(), list.Serial)
+	require.Len(t, list.Diffs, 3)
+	first := list.Diffs[0]
+	assert.Equal(t, start, first.FromSerial)
+	assert.Equal(t, start+1, first.ToSerial)
+	assert.Equal(t, sourceManual, first.Source)
+	assert.NotZero(t, first.Timestamp)
+	assert.Equal(t, uint32(1), first.Announced.Ipv4Roas)
+	assert.Equal(t, uint32(1), first.Announced.Ipv6Roas)
+	assert.Equal(t, uint32(1), list.Diffs[1].Withdrawn.Ipv4Roas)
+	assert.Equal(t, uint32(1), list.Diffs[2].Announced.Aspas)
+
+	diff, err := g.GetDiff(ctx, &rpkirtripb.GetDiffRequest{FromSerial: start})
+	require.NoError(t, err)
+	assert.Equal(t, srv.CacheSerial(), diff.ToSerial)
+	require.Len(t, diff.AnnouncedRoas, 1)
+	assert.Equal(t, "2001:db8::/32", diff.AnnouncedRoas[0].Prefix)
+	assert.Empty(t, diff.WithdrawnRoas)
+	assert.Len(t, diff.AnnouncedAspas, 1)
+
+	diff, err = g.GetDiff(ctx, &rpkirtripb.GetDiffRequest{FromSerial: start + 1, ToSerial: start + 2})
+	require.NoError(t, err)
+	require.Len(t, diff.WithdrawnRoas, 1)
+	assert.Equal(t, "10.0.0.0/8", diff.WithdrawnRoas[0].Prefix)
+
+	_, err = g.GetDiff(ctx, &rpkirtripb.GetDiffRequest{FromSerial: start + 10})
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
+func TestGRPCDiffUpstreams(t *testing.T) {
+	serve := func(doc *atomic.Value) *httptest.Server {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(doc.Load().(string)))
+		}))
+		t.Cleanup(ts.Close)
+		return ts
+	}
+	var docA, docB atomic.Value
+	docA.Store(testRPKIClientJSON)
+	docB.Store(`{"roas": [{"asn": 64511, "prefix": "203.0.113.0/24", "maxLength": 24}, {"asn": 64510, "prefix": "198.51.100.0/24", "maxLength": 24}]}`)
+	a, b := serve(&docA), serve(&docB)
+
+	dir := t.TempDir()
+	cfg := &config.Config{Upstreams: []config.Upstream{{URL: a.URL}, {URL: b.URL}}, Audit: config.Audit{Dir: dir}}
+	srv := New(cfg, zaptest.NewLogger(t).Sugar())
+	g := &grpcServer{srv: srv}
+	ctx := context.Background()
+
+	require.NoError(t, srv.TriggerRefresh(ctx))
+	// a announces one more VRP, b only reorders its document
+	docA.Store(strings.Replace(testRPKIClientJSON, `"roas": [`, `"roas": [{"asn": 64499, "prefix": "192.0.2.0/24", "maxLength": 24},`, 1))
+	docB.Store(`{"roas": [{"asn": 64510, "prefix": "198.51.100.0/24", "maxLength": 24}, {"asn": 64511, "prefix": "203.0.113.0/24", "maxLength": 24}]}`)
+	require.NoError(t, srv.TriggerRefresh(ctx))
+	// Nothing changed, so nothing is recorded
+	require.NoError(t, srv.TriggerRefresh(ctx))
+
+	list, err := g.ListDiffs(ctx, &rpkirtripb.ListDiffsRequest{})
+	require.NoError(t, err)
+	require.Len(t, list.Diffs, 2)
+	want := []string{a.URL, b.URL}
+	slices.Sort(want)
+	assert.Equal(t, sourceRefresh, list.Diffs[0].Source)
+	assert.Equal(t, want, list.Diffs[0].Upstreams, "first fetch of both")
+	assert.Equal(t, sourceRefresh, list.Diffs[1].Source)
+	assert.Equal(t, []string{a.URL}, list.Diffs[1].Upstreams)
+	assert.Equal(t, uint32(1), list.Diffs[1].Announced.Ipv4Roas)
+
+	require.NoError(t, srv.audit.close())
+	recs := auditRecords(t, dir)
+	require.Len(t, recs, 2)
+	assert.Equal(t, want, recs[0].Upstreams)
+	assert.Equal(t, []string{a.URL}, recs[1].Upstreams)
+}
+
+func TestGRPCClients(t *testing.T) {
+	srv := New(&config.Config{}, zaptest.NewLogger(t).Sugar())
+	srv.UpdateROAs([]ROA{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), ASN: 64496, MaxMask: 8},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), ASN: 64496, MaxMask: 32},
+	})
+	addr := startTestServer(t, srv)
+	g := &grpcServer{srv: srv}
+	ctx := context.Background()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	require.NoError(t, protocol.NewResetQueryPDU(1).Write(conn))
+	for {
+		pdu, err := protocol.GetPDU(r)
+		require.NoError(t, err)
+		if pdu.Type() == protocol.EndOfData {
+			break
+		}
+	}
+
+	var info *rpkirtripb.ClientInfo
+	require.Eventually(t, func() bool {
+		resp, err := g.ListClients(ctx, &rpkirtripb.ListClientsRequest{})
+		if err != nil || len(resp.Clients) != 1 || resp.Clients[0].PdusSent == 0 {
+			return false
+		}
+		info = resp.Clients[0]
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, conn.LocalAddr().String(), info.Id)
+	assert.Equal(t, uint32(1), info.Version)
+	assert.Equal(t, rpkirtripb.QueryType_QUERY_TYPE_RESET, info.LastQuery)
+	assert.NotZero(t, info.LastQueryTime)
+	assert.Equal(t, srv.CacheSerial(), info.LastSerial)
+	assert.Equal(t, uint64(4), info.PdusSent) // Cache Response, 2 prefixes, End of Data
+	assert.Equal(t, uint64(8+20+32+24), info.BytesSent)
+	assert.False(t, info.Behind)
+
+	srv.UpdateROAs(nil)
+	resp, err := g.ListClients(ctx, &rpkirtripb.ListClientsRequest{})
+	require.NoError(t, err)
+	assert.True(t, resp.Clients[0].Behind)
+	pdu, err := protocol.GetPDU(r)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.SerialNotify, pdu.Type())
+
+	_, err = g.ResetClient(ctx, &rpkirtripb.ResetClientRequest{Id: info.Id})
+	require.NoError(t, err)
+	pdu, err = protocol.GetPDU(r)
+	require.NoError(t, err)
+	assert.Equal(t, protocol.CacheReset, pdu.Type())
+
+	_, err = g.DisconnectClient(ctx, &rpkirtripb.DisconnectClientRequest{Id: info.Id})
+	require.NoError(t, err)
+	_, err = protocol.GetPDU(r)
+	assert.Error(t, err)
+
+	_, err = g.ResetClient(ctx, &rpkirtripb.ResetClientRequest{Id: "192.0.2.1:1"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
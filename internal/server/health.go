@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// readinessService is the gRPC health service name reporting readiness. The
+// empty service name reports liveness.
+const readinessService = "rpkirtr.v1.RPKIRTRService"
+
+// healthInterval is how often the gRPC health status is re-evaluated.
+const healthInterval = 5 * time.Second
+
+// healthCheck is one of the conditions for readiness.
+type healthCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+}
+
+type healthReport struct {
+	Status string        `json:"status"`
+	Checks []healthCheck `json:"checks,omitempty"`
+}
+
+// readyMaxAge returns how recently some upstream must have succeeded for the
+// server to be ready.
+func (s *Server) readyMaxAge() time.Duration {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	if s.cfg.ReadyMaxAge != 0 {
+		return time.Duration(s.cfg.ReadyMaxAge) * time.Second
+	}
+	return 2 * seconds(s.cfg.RefreshInterval, config.DefaultRefreshInterval)
+}
+
+// readiness reports whether routers should be sent to this instance: it is
+// not shutting down, the cache holds data, at least one upstream was fetched
+// or synced within readyMaxAge and updates are not held back.
+func (s *Server) readiness(now time.Time) (bool, []healthCheck) {
+	var checks []healthCheck
+	add := func(name string, ok bool, format string, args ...any) {
+		checks = append(checks, healthCheck{Name: name, OK: ok, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if s.shuttingDown.Load() {
+		add("server", false, "shutting down")
+	} else {
+		add("server", true, "running")
+	}
+
+	state := s.cache.getState()
+	if s.cache.loading.Load() {
+		add("cache", false, "waiting for the first sync of the RTR upstreams")
+	} else if len(state.roas) == 0 && len(state.aspas) == 0 && len(state.routerKeys) == 0 {
+		add("cache", false, "cache is empty")
+	} else {
+		add("cache", true, "serial %d with %d VRPs, %d ASPAs and %d router keys", state.serial, len(state.roas), len(state.aspas), len(state.routerKeys))
+	}
+
+	maxAge := s.readyMaxAge()
+	var freshest string
+	var last time.Time
+	s.upstreamsMu.RLock()
+	for url, st := range s.upstreams {
+		if st.LastSuccessTime.After(last) {
+			freshest, last = url, st.LastSuccessTime
+		}
+	}
+	s.upstreamsMu.RUnlock()
+	switch {
+	case last.IsZero():
+		add("upstreams", false, "no upstream has been fetched successfully")
+	case now.Sub(last) > maxAge:
+		add("upstreams", false, "freshest upstream %s was last fetched %s ago, more than %s", freshest, now.Sub(last).Round(time.Second), maxAge)
+	default:
+		add("upstreams", true, "%s fetched %s ago", freshest, now.Sub(last).Round(time.Second))
+	}
+
+	// A pause is the only way changes are held back; there are no sanity
+	// checks that hold back a change by themselves
+	if s.UpdatesPaused() {
+		add("updates", false, "updates are paused and upstream changes are held back")
+	} else {
+		add("updates", true, "applied as fetched")
+	}
+
+	for _, c := range checks {
+		if !c.OK {
+			return false, checks
+		}
+	}
+	return true, checks
+}
+
+// updateHealth sets the gRPC readiness status from the current state.
+func (s *Server) updateHealth() {
+	status := healthpb.HealthCheckResponse_SERVING
+	if ready, _ := s.readiness(time.Now()); !ready {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	s.health.SetServingStatus(readinessService, status)
+}
+
+// watchHealth keeps the gRPC readiness status current until ctx is done.
+func (s *Server) watchHealth(ctx context.Context) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		s.updateHealth()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// livez answers liveness probes. The process is alive as long as it serves
+// HTTP; a failed readiness check is no reason to restart it.
+func (s *Server) livez(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, healthReport{Status: "ok"})
+}
+
+// readyz answers readiness probes with 503 and the failed checks while the
+// server should not receive routers.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	ready, checks := s.readiness(time.Now())
+	if !ready {
+		writeHealth(w, http.StatusServiceUnavailable, healthReport{Status: "not ready", Checks: checks})
+		return
+	}
+	writeHealth(w, http.StatusOK, healthReport{Status: "ready", Checks: checks})
+}
+
+func writeHealth(w http.ResponseWriter, code int, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(report)
+}
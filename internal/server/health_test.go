@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// failedChecks returns the names of the readiness checks that failed.
+func failedChecks(checks []healthCheck) []string {
+	var failed []string
+	for _, c := range checks {
+		if !c.OK {
+			failed = append(failed, c.Name)
+		}
+	}
+	return failed
+}
+
+// makeReady loads data into srv and records a successful fetch of an upstream.
+func makeReady(srv *Server, fetched time.Time) {
+	srv.UpdateROAs([]ROA{{Prefix: netip.MustParsePrefix("192.0.2.0/24"), ASN: 64496, MaxMask: 24}})
+	srv.upstreamsMu.Lock()
+	srv.recordFetch("https://rpki.example.net/rpki.json", fetchUnified, &UpstreamStatus{LastFetchTime: fetched}, nil)
+	srv.upstreamsMu.Unlock()
+}
+
+func TestReadiness(t *testing.T) {
+	srv := New(&config.Config{RefreshInterval: 600}, zaptest.NewLogger(t).Sugar())
+	now := time.Now()
+
+	ready, checks := srv.readiness(now)
+	assert.False(t, ready)
+	assert.Equal(t, []string{"cache", "upstreams"}, failedChecks(checks))
+
+	makeReady(srv, now.Add(-15*time.Minute))
+	ready, checks = srv.readiness(now)
+	assert.True(t, ready, checks)
+
+	// Twice the refresh interval by default
+	ready, checks = srv.readiness(now.Add(10 * time.Minute))
+	assert.False(t, ready)
+	assert.Equal(t, []string{"upstreams"}, failedChecks(checks))
+
+	srv.cfg.ReadyMaxAge = 3600
+	ready, _ = srv.readiness(now.Add(10 * time.Minute))
+	assert.True(t, ready, "ready_max_age overrides the default")
+
+	// A failed fetch does not make the last success stale
+	srv.upstreamsMu.Lock()
+	srv.recordFetch("https://rpki.example.net/rpki.json", fetchUnified, &UpstreamStatus{LastFetchTime: now}, assert.AnError)
+	srv.upstreamsMu.Unlock()
+	ready, _ = srv.readiness(now)
+	assert.True(t, ready)
+
+	srv.PauseUpdates()
+	ready, checks = srv.readiness(now)
+	assert.False(t, ready)
+	assert.Equal(t, []string{"updates"}, failedChecks(checks))
+	srv.ResumeUpdates()
+
+	srv.shuttingDown.Store(true)
+	ready, checks = srv.readiness(now)
+	assert.False(t, ready)
+	assert.Equal(t, []string{"server"}, failedChecks(checks))
+}
+
+func TestHealthProbes(t *testing.T) {
+	srv := New(&config.Config{GRPCAuth: config.GRPCAuth{AnonymousRole: config.RoleNone}}, zaptest.NewLogger(t).Sugar())
+	ts := httptest.NewServer(srv.newGatewayHandler())
+	defer ts.Close()
+
+	// Probes need no credentials, unlike the gateway
+	code, body := getJSON(t, ts, "/livez")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", body["status"])
+	code, _ = getJSON(t, ts, "/v1/stats")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, body = getJSON(t, ts, "/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "not ready", body["status"])
+	assert.Len(t, body["checks"], 4)
+
+	makeReady(srv, time.Now())
+	code, body = getJSON(t, ts, "/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ready", body["status"])
+}
+
+func TestGRPCHealth(t *testing.T) {
+	srv := New(&config.Config{GRPCAuth: config.GRPCAuth{AnonymousRole: config.RoleNone}}, zaptest.NewLogger(t).Sugar())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	conn := serveGRPC(t, srv, l, l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	client := healthpb.NewHealthClient(conn)
+	bg := context.Background()
+
+	check := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		t.Helper()
+		resp, err := client.Check(bg, &healthpb.HealthCheckRequest{Service: service})
+		require.NoError(t, err, "health checks need no credentials")
+		return resp.Status
+	}
+
+	srv.updateHealth()
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, check(""))
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check(readinessService))
+
+	makeReady(srv, time.Now())
+	srv.updateHealth()
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, check(readinessService))
+
+	require.NoError(t, srv.Stop(time.Second))
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check(""))
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check(readinessService))
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+)
+
+// upstreamClient returns the HTTP client for an upstream. Upstreams without
+// client settings share the default client; the others get their own client
+// which is built on first use and reused for connection pooling. A client that
+// fails to build is not cached, so fixing e.g. a missing CA file takes effect
+// on the next attempt.
+func (s *Server) upstreamClient(u config.Upstream) (*http.Client, error) {
+	if !u.HasClientOptions() {
+		return s.defaultClient(), nil
+	}
+
+	s.upstreamClientsMu.Lock()
+	defer s.upstreamClientsMu.Unlock()
+	if c, ok := s.upstreamClients[u.URL]; ok {
+		return c, nil
+	}
+	c, err := s.newUpstreamClient(u)
+	if err != nil {
+		return nil, err
+	}
+	s.upstreamClients[u.URL] = c
+	return c, nil
+}
+
+func (s *Server) newUpstreamClient(u config.Upstream) (*http.Client, error) {
+	tlsCfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if u.TLSMinVersion != "" {
+		v, ok := config.TLSVersions[u.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls_min_version %q", u.TLSMinVersion)
+		}
+		tlsCfg.MinVersion = v
+	}
+
+	if u.CAFile != "" {
+		pem, err := os.ReadFile(u.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", u.CAFile)
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if u.ClientCert != "" {
+		// Fail early on a broken key pair, but load it again on every handshake
+		// so that renewed certificates are picked up without a restart.
+		if _, err := tls.LoadX509KeyPair(u.ClientCert, u.ClientKey); err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		certFile, keyFile := u.ClientCert, u.ClientKey
+		tlsCfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client certificate: %w", err)
+			}
+			return &cert, nil
+		}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsCfg
+	if u.Proxy != "" {
+		proxy, err := url.Parse(u.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %w", u.Proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	return &http.Client{
+		Timeout:   s.defaultClient().Timeout,
+		Transport: transport,
+	}, nil
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"go.uber.org/zap"
+)
+
+func writePEM(t *testing.T, name, typ string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// newTestClientCert creates a self-signed client certificate and returns its
+// pool and the paths to the certificate and key files.
+func newTestClientCert(t *testing.T) (*x509.CertPool, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "rpkirtr2-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	return pool, writePEM(t, "client.pem", "CERTIFICATE", der), writePEM(t, "client.key", "PRIVATE KEY", keyDER)
+}
+
+func fetchWith(t *testing.T, u config.Upstream) error {
+	t.Helper()
+	srv := New(&config.Config{}, zap.NewNop().Sugar())
+	_, err := srv.fetchUpstream(context.Background(), u)
+	return err
+}
+
+func TestUpstreamClientCA(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testRPKIClientJSON))
+	}))
+	defer ts.Close()
+
+	if err := fetchWith(t, config.Upstream{URL: ts.URL}); err == nil {
+		t.Error("Expected the test server's certificate to be rejected without a CA file")
+	}
+
+	ca := writePEM(t, "ca.pem", "CERTIFICATE", ts.Certificate().Raw)
+	if err := fetchWith(t, config.Upstream{URL: ts.URL, CAFile: ca}); err != nil {
+		t.Errorf("Expected fetch with CA file to succeed, got %v", err)
+	}
+
+	if err := fetchWith(t, config.Upstream{URL: ts.URL, CAFile: filepath.Join(t.TempDir(), "missing.pem")}); err == nil {
+		t.Error("Expected missing CA file to fail")
+	}
+}
+
+func TestUpstreamClientMTLS(t *testing.T) {
+	pool, certFile, keyFile := newTestClientCert(t)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testRPKIClientJSON))
+	}))
+	ts.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  pool,
+	}
+	ts.StartTLS()
+	defer ts.Close()
+	ca := writePEM(t, "ca.pem", "CERTIFICATE", ts.Certificate().Raw)
+
+	if err := fetchWith(t, config.Upstream{URL: ts.URL, CAFile: ca}); err == nil {
+		t.Error("Expected fetch without a client certificate to fail")
+	}
+	if err := fetchWith(t, config.Upstream{URL: ts.URL, CAFile: ca, ClientCert: certFile, ClientKey: keyFile}); err != nil {
+		t.Errorf("Expected mTLS fetch to succeed, got %v", err)
+	}
+}
+
+func TestUpstreamClientHeaders(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cr3t" || r.Header.Get("X-Site") != "ams" {
+			http.Error(w, "unauthorised", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(testRPKIClientJSON))
+	}))
+	defer ts.Close()
+	ca := writePEM(t, "ca.pem", "CERTIFICATE", ts.Certificate().Raw)
+
+	err := fetchWith(t, config.Upstream{URL: ts.URL, CAFile: ca})
+	if err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected 401 without headers, got %v", err)
+	}
+	headers := map[string]string{"Authorization": "Bearer s3cr3t", "X-Site": "ams"}
+	if err := fetchWith(t, config.Upstream{URL: ts.URL, CAFile: ca, Headers: headers}); err != nil {
+		t.Errorf("Expected fetch with headers to succeed, got %v", err)
+	}
+}
+
+func TestUpstreamClientProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte(testRPKIClientJSON))
+	}))
+	defer proxy.Close()
+
+	target := "http://validator.invalid/rpki.json"
+	if err := fetchWith(t, config.Upstream{URL: target, Proxy: proxy.URL}); err != nil {
+		t.Fatalf("Expected fetch through proxy to succeed, got %v", err)
+	}
+	if proxied != target {
+		t.Errorf("Expected proxy to receive %s, got %q", target, proxied)
+	}
+}
+
+func TestUpstreamClientTLSMinVersion(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testRPKIClientJSON))
+	}))
+	ts.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	ts.StartTLS()
+	defer ts.Close()
+	ca := writePEM(t, "ca.pem", "CERTIFICATE", ts.Certificate().Raw)
+
+	if err := fetchWith(t, config.Upstream{URL: ts.URL, CAFile: ca, TLSMinVersion: "1.2"}); err != nil {
+		t.Errorf("Expected TLS 1.2 to be accepted, got %v", err)
+	}
+	if err := fetchWith(t, config.Upstream{URL: ts.URL, CAFile: ca, TLSMinVersion: "1.3"}); err == nil {
+		t.Error("Expected a TLS 1.2 only server to be rejected with tls_min_version 1.3")
+	}
+}
+
+func TestUpstreamClientReuse(t *testing.T) {
+	srv := New(&config.Config{}, zap.NewNop().Sugar())
+	plain, err := srv.upstreamClient(config.Upstream{URL: "https://a.example"})
+	if err != nil || plain != srv.httpClient {
+		t.Errorf("Expected upstream without settings to share the default client")
+	}
+
+	u := config.Upstream{URL: "https://b.example", Headers: map[string]string{"X": "y"}}
+	c1, err := srv.upstreamClient(u)
+	if err != nil {
+		t.Fatalf("upstreamClient failed: %v", err)
+	}
+	c2, _ := srv.upstreamClient(u)
+	if c1 != c2 || c1 == srv.httpClient {
+		t.Error("Expected a dedicated client to be built once and reused")
+	}
+}
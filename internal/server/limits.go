@@ -0,0 +1,89 @@
+package server
+
+import (
+	"net"
+	"time"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+)
+
+// rtrLimits returns the limits for new RTR sessions.
+func (s *Server) rtrLimits() config.RTRLimits {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.cfg.RTRLimits
+}
+
+// reserveConn counts a new RTR connection against the connection limits. It
+// returns the reason if a limit is reached, and otherwise the connection must
+// be given back with releaseConn.
+func (s *Server) reserveConn(addr net.Addr) string {
+	limits := s.rtrLimits()
+	ip, hasIP := sourceIP(addr)
+
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if limits.MaxConnections != 0 && s.conns >= int(limits.MaxConnections) {
+		return refusedMaxConns
+	}
+	if hasIP && limits.MaxConnectionsPerIP != 0 && s.connsPerIP[ip] >= int(limits.MaxConnectionsPerIP) {
+		return refusedMaxConnsIP
+	}
+	s.conns++
+	if hasIP {
+		s.connsPerIP[ip]++
+	}
+	return ""
+}
+
+func (s *Server) releaseConn(addr net.Addr) {
+	ip, hasIP := sourceIP(addr)
+
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	s.conns--
+	if hasIP {
+		s.connsPerIP[ip]--
+		if s.connsPerIP[ip] <= 0 {
+			delete(s.connsPerIP, ip)
+		}
+	}
+}
+
+// applyLimits sets the per-session limits of a new RTR client.
+func (s *Server) applyLimits(c *Client) {
+	limits := s.rtrLimits()
+	c.intervals.idleTimeout = seconds(limits.IdleTimeout, config.DefaultIdleTimeout)
+	if limits.QueriesPerMinute != 0 {
+		burst := limits.QueryBurst
+		if burst == 0 {
+			burst = config.DefaultQueryBurst
+		}
+		c.limiter = newQueryLimiter(float64(limits.QueriesPerMinute)/60, int(burst), time.Now())
+	}
+}
+
+// queryLimiter is a token bucket limiting the queries of one RTR session.
+// It is only used by the session's read loop.
+type queryLimiter struct {
+	rate   float64 // tokens added per second
+	burst  float64 // most tokens held
+	tokens float64
+	last   time.Time
+}
+
+func newQueryLimiter(rate float64, burst int, now time.Time) *queryLimiter {
+	return &queryLimiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// take uses a token for a query received at now and returns how long its
+// reply must wait for the token to be available.
+func (l *queryLimiter) take(now time.Time) time.Duration {
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"github.com/mellowdrifter/rpkirtr2/internal/protocol"
+	"go.uber.org/zap"
+)
+
+func TestQueryLimiter(t *testing.T) {
+	start := time.Unix(1_700_000_000, 0)
+	l := newQueryLimiter(1, 2, start) // one query a second, two at once
+
+	for i, tt := range []struct {
+		after time.Duration
+		want  time.Duration
+	}{
+		{0, 0},
+		{0, 0},
+		{0, time.Second},
+		{time.Second, time.Second}, // the delayed query used this second's token
+		{5 * time.Second, 0},       // refilled to the burst, not beyond
+		{5 * time.Second, 0},
+		{5 * time.Second, time.Second},
+		{5*time.Second + 500*time.Millisecond, 1500 * time.Millisecond},
+	} {
+		if got := l.take(start.Add(tt.after)); got != tt.want {
+			t.Errorf("query %d after %v: delay %v, want %v", i, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestReserveConn(t *testing.T) {
+	srv := New(&config.Config{RTRLimits: config.RTRLimits{MaxConnections: 3, MaxConnectionsPerIP: 2}}, zap.NewNop().Sugar())
+	a := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000}
+	aMapped := &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 40001}
+	b := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 40000}
+
+	if reason := srv.reserveConn(a); reason != "" {
+		t.Fatalf("first connection refused: %s", reason)
+	}
+	if reason := srv.reserveConn(aMapped); reason != "" {
+		t.Fatalf("second connection refused: %s", reason)
+	}
+	if reason := srv.reserveConn(a); reason != refusedMaxConnsIP {
+		t.Errorf("third connection from one address: got %q, want %q", reason, refusedMaxConnsIP)
+	}
+	if reason := srv.reserveConn(b); reason != "" {
+		t.Fatalf("connection from another address refused: %s", reason)
+	}
+	if reason := srv.reserveConn(&net.TCPAddr{IP: net.ParseIP("2001:db8::2")}); reason != refusedMaxConns {
+		t.Errorf("fourth connection: got %q, want %q", reason, refusedMaxConns)
+	}
+
+	srv.releaseConn(a)
+	srv.releaseConn(aMapped)
+	srv.releaseConn(b)
+	if srv.conns != 0 || len(srv.connsPerIP) != 0 {
+		t.Errorf("after release: %d connections, %v per address", srv.conns, srv.connsPerIP)
+	}
+}
+
+func TestConnectionLimitRefusal(t *testing.T) {
+	srv := New(&config.Config{RTRLimits: config.RTRLimits{MaxConnectionsPerIP: 1}}, zap.NewNop().Sugar())
+	addr := startTestServer(t, srv)
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer first.Close()
+	waitForConns(t, srv, 1)
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer second.Close()
+	_ = second.SetDeadline(time.Now().Add(5 * time.Second))
+	pdu, err := protocol.GetPDU(bufio.NewReader(second))
+	if err != nil {
+		t.Fatalf("failed to read Error Report: %v", err)
+	}
+	if report, ok := pdu.(*protocol.ErrorReportPDU); !ok || report.Code() != protocol.InternalError {
+		t.Fatalf("expected an Internal Error report, got %v", pdu.Type())
+	}
+
+	// Closing the first session frees its slot
+	first.Close()
+	waitForConns(t, srv, 0)
+	third, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer third.Close()
+	waitForConns(t, srv, 1)
+}
+
+func waitForConns(t *testing.T, srv *Server, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		srv.connsMu.Lock()
+		n := srv.conns
+		srv.connsMu.Unlock()
+		if n == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d connections", want)
+}
+
+func TestIdleSessionClosed(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	client := NewClient(serverConn, zap.NewNop().Sugar(), newCache())
+	client.intervals.idleTimeout = 50 * time.Millisecond
+
+	done := make(chan error, 1)
+	go func() { done <- client.Handle() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Handle() = %v, want nil for an idle session", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle session was not closed")
+	}
+	if !client.IsClosed() {
+		t.Error("expected the connection to be closed")
+	}
+}
+
+func TestThrottleStopsOnClose(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+
+	client := NewClient(serverConn, zap.NewNop().Sugar(), newCache())
+	client.limiter = newQueryLimiter(1.0/60, 1, time.Now())
+
+	if !client.throttle(protocol.ResetQuery) {
+		t.Fatal("first query should not wait")
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		client.Close()
+	}()
+	if client.throttle(protocol.ResetQuery) {
+		t.Error("throttle should give up when the connection closes")
+	}
+}
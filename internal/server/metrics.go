@@ -0,0 +1,271 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Counters and histograms are updated as events happen and shared by every
+// Server in the process. Gauges describing the cache, clients and upstreams
+// are read from the Server on each scrape by serverCollector.
+var (
+	pdusSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rpkirtr_pdus_sent_total",
+		Help: "RTR PDUs sent to routers by PDU type.",
+	}, []string{"type"})
+	bytesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rpkirtr_sent_bytes_total",
+		Help: "Bytes sent to routers by PDU type.",
+	}, []string{"type"})
+	queriesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rpkirtr_queries_total",
+		Help: "Reset and Serial Queries received from routers.",
+	}, []string{"type"})
+	cacheResetsSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rpkirtr_cache_resets_total",
+		Help: "Cache Reset PDUs sent to routers whose serial could not be served incrementally.",
+	})
+	errorReportsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rpkirtr_error_reports_sent_total",
+		Help: "Error Report PDUs sent to routers by error code.",
+	}, []string{"code"})
+	connectionsRefused = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rpkirtr_connections_refused_total",
+		Help: "Connections closed on accept by listener and reason.",
+	}, []string{"listener", "reason"})
+	queriesThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rpkirtr_queries_throttled_total",
+		Help: "Queries whose reply was delayed by the per-session query rate limit.",
+	}, []string{"type"})
+	idleSessionsClosed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rpkirtr_idle_sessions_closed_total",
+		Help: "RTR sessions closed for sending no query within the idle timeout.",
+	})
+	diffSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rpkirtr_diff_size",
+		Help:    "Entries announced and withdrawn per cache update by object type.",
+		Buckets: prometheus.ExponentialBuckets(1, 4, 10),
+	}, []string{"type", "action"})
+
+	upstreamFetchDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rpkirtr_upstream_fetch_duration_seconds",
+		Help:    "Time taken to download and decode an HTTP upstream.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+	}, []string{"upstream"})
+	upstreamFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rpkirtr_upstream_fetches_total",
+		Help: "Upstream fetches and RTR upstream syncs by result.",
+	}, []string{"upstream", "result"})
+	upstreamBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rpkirtr_upstream_fetched_bytes_total",
+		Help: "Bytes downloaded from HTTP upstreams.",
+	}, []string{"upstream"})
+
+	sharedMetrics = []prometheus.Collector{
+		pdusSent, bytesSent, queriesReceived, cacheResetsSent, errorReportsSent, diffSize,
+		connectionsRefused, queriesThrottled, idleSessionsClosed,
+		upstreamFetchDuration, upstreamFetches, upstreamBytes,
+	}
+)
+
+var pduTypeNames = map[protocol.PDUType]string{
+	protocol.SerialNotify:  "serial_notify",
+	protocol.CacheResponse: "cache_response",
+	protocol.Ipv4Prefix:    "ipv4_prefix",
+	protocol.Ipv6Prefix:    "ipv6_prefix",
+	protocol.EndOfData:     "end_of_data",
+	protocol.CacheReset:    "cache_reset",
+	protocol.RouterKey:     "router_key",
+	protocol.ErrorReport:   "error_report",
+	protocol.Aspa:          "aspa",
+}
+
+var errorCodeNames = map[protocol.ErrorCode]string{
+	protocol.CorruptData:        "corrupt_data",
+	protocol.InternalError:      "internal_error",
+	protocol.NoData:             "no_data",
+	protocol.InvalidRequest:     "invalid_request",
+	protocol.UnsupportedVersion: "unsupported_version",
+	protocol.UnsupportedPDU:     "unsupported_pdu",
+	protocol.UnknownWithdrawal:  "unknown_withdrawal",
+	protocol.Duplicate:          "duplicate",
+	protocol.UnexpectedVersion:  "unexpected_version",
+	protocol.ASPAListError:      "aspa_list_error",
+	protocol.TransportError:     "transport_error",
+}
+
+// pduWriter counts the PDUs of one type written to a router. Every PDU is
+// written with a single Write call.
+type pduWriter struct {
+	w     io.Writer
+	pdus  prometheus.Counter
+	bytes prometheus.Counter
+}
+
+func newPDUWriters(w io.Writer) map[protocol.PDUType]io.Writer {
+	writers := make(map[protocol.PDUType]io.Writer, len(pduTypeNames))
+	for t, name := range pduTypeNames {
+		writers[t] = &pduWriter{w: w, pdus: pdusSent.WithLabelValues(name), bytes: bytesSent.WithLabelValues(name)}
+	}
+	return writers
+}
+
+func (pw *pduWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.bytes.Add(float64(n))
+	if err == nil {
+		pw.pdus.Inc()
+	}
+	return n, err
+}
+
+// countingBody counts the bytes read from an upstream response.
+type countingBody struct {
+	r io.Reader
+	c prometheus.Counter
+}
+
+func (cb countingBody) Read(p []byte) (int, error) {
+	n, err := cb.r.Read(p)
+	cb.c.Add(float64(n))
+	return n, err
+}
+
+func observeUpstreamBody(url string, body io.Reader) io.Reader {
+	return countingBody{r: body, c: upstreamBytes.WithLabelValues(url)}
+}
+
+// observeFetch records the outcome of an upstream fetch. A zero duration,
+// as for RTR upstreams, is not observed.
+func observeFetch(url string, took time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	upstreamFetches.WithLabelValues(url, result).Inc()
+	if took > 0 {
+		upstreamFetchDuration.WithLabelValues(url).Observe(took.Seconds())
+	}
+}
+
+func observeDiff(d diffSet) {
+	observe := func(typ string, announced, withdrawn int) {
+		diffSize.WithLabelValues(typ, "announce").Observe(float64(announced))
+		diffSize.WithLabelValues(typ, "withdraw").Observe(float64(withdrawn))
+	}
+	observe("vrp", len(d.addRoa), len(d.delRoa))
+	observe("aspa", len(d.addAspa), len(d.delAspa))
+	observe("router_key", len(d.addKeys), len(d.delKeys))
+}
+
+var (
+	descVRPs            = prometheus.NewDesc("rpkirtr_vrps", "VRPs in the cache by address family.", []string{"afi"}, nil)
+	descVRPsCompressed  = prometheus.NewDesc("rpkirtr_vrps_compressed", "VRPs left out of the cache as redundant by compress_vrps.", nil, nil)
+	descASPAs           = prometheus.NewDesc("rpkirtr_aspas", "ASPAs in the cache.", nil, nil)
+	descRouterKeys      = prometheus.NewDesc("rpkirtr_router_keys", "BGPsec router keys in the cache.", nil, nil)
+	descSerial          = prometheus.NewDesc("rpkirtr_serial", "Current cache serial.", nil, nil)
+	descSession         = prometheus.NewDesc("rpkirtr_session_id", "Current RTR session ID.", nil, nil)
+	descLastUpdate      = prometheus.NewDesc("rpkirtr_last_update_timestamp_seconds", "Time of the last cache change.", nil, nil)
+	descLastUpdateAge   = prometheus.NewDesc("rpkirtr_last_update_age_seconds", "Seconds since the last cache change.", nil, nil)
+	descUpdatesPaused   = prometheus.NewDesc("rpkirtr_updates_paused", "Whether automatic updates are paused.", nil, nil)
+	descClients         = prometheus.NewDesc("rpkirtr_clients", "Connected routers by negotiated protocol version.", []string{"version"}, nil)
+	descUpstreamUp      = prometheus.NewDesc("rpkirtr_upstream_up", "Whether the last fetch or session of an upstream succeeded.", []string{"upstream"}, nil)
+	descUpstreamFetched = prometheus.NewDesc("rpkirtr_upstream_last_fetch_timestamp_seconds", "Time of the last fetch attempt.", []string{"upstream"}, nil)
+	descUpstreamObjects = prometheus.NewDesc("rpkirtr_upstream_objects", "Objects from the last successful fetch by type.", []string{"upstream", "type"}, nil)
+	descUpstreamRetries = prometheus.NewDesc("rpkirtr_upstream_consecutive_failures", "Failed attempts since the last success.", []string{"upstream"}, nil)
+)
+
+// serverCollector reports the state of a Server at scrape time.
+type serverCollector struct {
+	s *Server
+}
+
+func (c serverCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{
+		descVRPs, descVRPsCompressed, descASPAs, descRouterKeys, descSerial, descSession, descLastUpdate, descLastUpdateAge,
+		descUpdatesPaused, descClients, descUpstreamUp, descUpstreamFetched, descUpstreamObjects, descUpstreamRetries,
+	} {
+		ch <- d
+	}
+}
+
+func (c serverCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.s
+	state := s.cache.getState()
+	var v4, v6 int
+	for _, r := range state.roas {
+		if r.Prefix.Addr().Is4() {
+			v4++
+		} else {
+			v6++
+		}
+	}
+	gauge := func(d *prometheus.Desc, v float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(d, prometheus.GaugeValue, v, labels...)
+	}
+	gauge(descVRPs, float64(v4), "ipv4")
+	gauge(descVRPs, float64(v6), "ipv6")
+	gauge(descVRPsCompressed, float64(state.compressed))
+	gauge(descASPAs, float64(len(state.aspas)))
+	gauge(descRouterKeys, float64(len(state.routerKeys)))
+	gauge(descSerial, float64(state.serial))
+	gauge(descSession, float64(state.session))
+	if !state.lastUpdate.IsZero() {
+		gauge(descLastUpdate, float64(state.lastUpdate.Unix()))
+		gauge(descLastUpdateAge, time.Since(state.lastUpdate).Seconds())
+	}
+	gauge(descUpdatesPaused, boolGauge(s.UpdatesPaused()))
+
+	versions := make(map[protocol.Version]int)
+	s.clientsMu.RLock()
+	for _, client := range s.clients {
+		versions[client.info().version]++
+	}
+	s.clientsMu.RUnlock()
+	for v, n := range versions {
+		gauge(descClients, float64(n), strconv.Itoa(int(v)))
+	}
+
+	s.upstreamsMu.RLock()
+	defer s.upstreamsMu.RUnlock()
+	for url, st := range s.upstreams {
+		gauge(descUpstreamUp, boolGauge(st.LastFetchSuccess), url)
+		gauge(descUpstreamFetched, float64(st.LastFetchTime.Unix()), url)
+		gauge(descUpstreamObjects, float64(st.ROACount), url, "vrp")
+		gauge(descUpstreamObjects, float64(st.ASPACount), url, "aspa")
+		gauge(descUpstreamObjects, float64(st.RouterKeyCount), url, "router_key")
+		gauge(descUpstreamRetries, float64(st.RetryCount), url)
+	}
+}
+
+func boolGauge(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// newMetricsRegistry returns a registry with the shared metrics, the state
+// of s and the Go runtime and process metrics.
+func newMetricsRegistry(s *Server) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(sharedMetrics...)
+	reg.MustRegister(
+		serverCollector{s: s},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return reg
+}
+
+// metricsHandler serves the metrics of s in the Prometheus exposition format.
+func (s *Server) metricsHandler() http.Handler {
+	return promhttp.HandlerFor(newMetricsRegistry(s), promhttp.HandlerOpts{})
+}
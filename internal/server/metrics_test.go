@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"github.com/mellowdrifter/rpkirtr2/internal/protocol"
+	"go.uber.org/zap"
+)
+
+// scrape returns every sample exposed by the metrics handler of srv, keyed by
+// series as written in the exposition format.
+func scrape(t *testing.T, srv *Server) map[string]float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	srv.metricsHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("metrics returned %d: %s", rec.Code, rec.Body)
+	}
+
+	samples := make(map[string]float64)
+	sc := bufio.NewScanner(rec.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("invalid sample %q: %v", line, err)
+		}
+		samples[line[:i]] = v
+	}
+	return samples
+}
+
+func TestMetricsCacheState(t *testing.T) {
+	srv := New(&config.Config{}, zap.NewNop().Sugar())
+	before := scrape(t, srv)
+	srv.UpdateROAs([]ROA{
+		{Prefix: netip.MustParsePrefix("192.0.2.0/24"), ASN: 64496, MaxMask: 24},
+		{Prefix: netip.MustParsePrefix("198.51.100.0/24"), ASN: 64496, MaxMask: 24},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), ASN: 64496, MaxMask: 48},
+	})
+	srv.UpdateASPAs([]ASPA{{CustomerASN: 64496, ProviderASNs: []uint32{64500}}})
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+	client := NewClient(serverConn, zap.NewNop().Sugar(), srv.cache)
+	client.setVersion(2)
+	srv.clients["192.0.2.1:179"] = client
+
+	got := scrape(t, srv)
+	for series, want := range map[string]float64{
+		`rpkirtr_vrps{afi="ipv4"}`:     2,
+		`rpkirtr_vrps{afi="ipv6"}`:     1,
+		`rpkirtr_aspas`:                1,
+		`rpkirtr_router_keys`:          0,
+		`rpkirtr_serial`:               float64(srv.CacheSerial()),
+		`rpkirtr_session_id`:           float64(srv.getSession()),
+		`rpkirtr_updates_paused`:       0,
+		`rpkirtr_clients{version="2"}`: 1,
+	} {
+		if v, ok := got[series]; !ok || v != want {
+			t.Errorf("%s = %v (present %v), want %v", series, v, ok, want)
+		}
+	}
+	if _, ok := got["rpkirtr_last_update_age_seconds"]; !ok {
+		t.Error("Expected the age of the last update")
+	}
+
+	for series, want := range map[string]float64{
+		`rpkirtr_diff_size_count{action="announce",type="vrp"}`: 2,
+		`rpkirtr_diff_size_sum{action="announce",type="vrp"}`:   3,
+		`rpkirtr_diff_size_sum{action="announce",type="aspa"}`:  1,
+		`rpkirtr_diff_size_sum{action="withdraw",type="vrp"}`:   0,
+	} {
+		if d := got[series] - before[series]; d != want {
+			t.Errorf("%s increased by %v, want %v", series, d, want)
+		}
+	}
+}
+
+func TestMetricsPDUsSent(t *testing.T) {
+	srv := New(&config.Config{}, zap.NewNop().Sugar())
+	srv.UpdateROAs([]ROA{
+		{Prefix: netip.MustParsePrefix("192.0.2.0/24"), ASN: 64496, MaxMask: 24},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), ASN: 64496, MaxMask: 48},
+	})
+	before := scrape(t, srv)
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go io.Copy(io.Discard, clientConn)
+	client := NewClient(serverConn, zap.NewNop().Sugar(), srv.cache)
+	client.setVersion(1)
+
+	client.recordQuery(protocol.ResetQuery, 0)
+	state := srv.cache.getState()
+	client.sendAllData(state.roas, state.aspas, state.routerKeys, state.session, state.serial)
+	client.sendCacheReset()
+	client.sendAndCloseError("test", protocol.InvalidRequest)
+
+	got := scrape(t, srv)
+	for series, want := range map[string]float64{
+		`rpkirtr_pdus_sent_total{type="cache_response"}`:           1,
+		`rpkirtr_pdus_sent_total{type="ipv4_prefix"}`:              1,
+		`rpkirtr_pdus_sent_total{type="ipv6_prefix"}`:              1,
+		`rpkirtr_pdus_sent_total{type="end_of_data"}`:              1,
+		`rpkirtr_pdus_sent_total{type="cache_reset"}`:              1,
+		`rpkirtr_pdus_sent_total{type="error_report"}`:             1,
+		`rpkirtr_sent_bytes_total{type="ipv4_prefix"}`:             20,
+		`rpkirtr_sent_bytes_total{type="ipv6_prefix"}`:             32,
+		`rpkirtr_queries_total{type="reset"}`:                      1,
+		`rpkirtr_cache_resets_total`:                               1,
+		`rpkirtr_error_reports_sent_total{code="invalid_request"}`: 1,
+	} {
+		if d := got[series] - before[series]; d != want {
+			t.Errorf("%s increased by %v, want %v", series, d, want)
+		}
+	}
+}
+
+func TestMetricsUpstreams(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testRPKIClientJSON))
+	}))
+	defer ts.Close()
+
+	srv := New(&config.Config{Upstreams: []config.Upstream{{URL: ts.URL}}}, zap.NewNop().Sugar())
+	if err := srv.TriggerRefresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ts.Close()
+	if err := srv.TriggerRefresh(context.Background()); err == nil {
+		t.Fatal("Expected the refresh to fail once the upstream is gone")
+	}
+
+	got := scrape(t, srv)
+	for series, want := range map[string]float64{
+		`rpkirtr_upstream_fetches_total{result="success",upstream="` + ts.URL + `"}`: 1,
+		`rpkirtr_upstream_fetches_total{result="failure",upstream="` + ts.URL + `"}`: 1,
+		`rpkirtr_upstream_fetched_bytes_total{upstream="` + ts.URL + `"}`:            float64(len(testRPKIClientJSON)),
+		`rpkirtr_upstream_fetch_duration_seconds_count{upstream="` + ts.URL + `"}`:   2,
+		`rpkirtr_upstream_up{upstream="` + ts.URL + `"}`:                             0,
+		`rpkirtr_upstream_consecutive_failures{upstream="` + ts.URL + `"}`:           1,
+		`rpkirtr_upstream_objects{type="vrp",upstream="` + ts.URL + `"}`:             0,
+	} {
+		if v, ok := got[series]; !ok || v != want {
+			t.Errorf("%s = %v (present %v), want %v", series, v, ok, want)
+		}
+	}
+}
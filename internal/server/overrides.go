@@ -0,0 +1,353 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Local overrides let operators adjust the data served to routers without
+// touching the upstreams, in the spirit of SLURM (RFC 8416). Prefix filters
+// drop matching VRPs, prefix assertions add VRPs and ASPA overrides replace
+// the provider set of a customer AS. Filters and ASPA overrides only affect
+// upstream data; assertions are added after filtering.
+
+// prefixFilter drops VRPs whose prefix is equal to or more specific than
+// Prefix and whose origin is ASN. Either may be unset, but not both.
+type prefixFilter struct {
+	ID      string       `json:"id"`
+	Prefix  netip.Prefix `json:"prefix,omitzero"`
+	ASN     *uint32      `json:"asn,omitempty"`
+	Comment string       `json:"comment,omitempty"`
+	Created time.Time    `json:"created"`
+	Expires time.Time    `json:"expires,omitzero"` // zero never expires
+}
+
+type prefixAssertion struct {
+	ID        string       `json:"id"`
+	Prefix    netip.Prefix `json:"prefix"`
+	ASN       uint32       `json:"asn"`
+	MaxLength uint8        `json:"max_length"`
+	Comment   string       `json:"comment,omitempty"`
+	Created   time.Time    `json:"created"`
+	Expires   time.Time    `json:"expires,omitzero"`
+}
+
+// aspaOverride replaces the ASPA of CustomerASN. No providers withdraws it.
+type aspaOverride struct {
+	ID           string    `json:"id"`
+	CustomerASN  uint32    `json:"customer_asn"`
+	ProviderASNs []uint32  `json:"provider_asns"`
+	Comment      string    `json:"comment,omitempty"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires,omitzero"`
+}
+
+type overrideSet struct {
+	Filters    []prefixFilter    `json:"prefix_filters"`
+	Assertions []prefixAssertion `json:"prefix_assertions"`
+	ASPAs      []aspaOverride    `json:"aspa_overrides"`
+}
+
+// overrides holds the local overrides and persists every change to path.
+type overrides struct {
+	mu   sync.Mutex
+	path string // empty keeps the overrides in memory only
+	set  overrideSet
+}
+
+var errOverrideNotFound = errors.New("override not found")
+
+func (f prefixFilter) matches(r ROA) bool {
+	if f.ASN != nil && *f.ASN != r.ASN {
+		return false
+	}
+	return !f.Prefix.IsValid() || (f.Prefix.Bits() <= r.Prefix.Bits() && f.Prefix.Contains(r.Prefix.Addr()))
+}
+
+func (a prefixAssertion) roa() ROA {
+	return ROA{Prefix: a.Prefix, ASN: a.ASN, MaxMask: a.MaxLength}
+}
+
+func live(expires, now time.Time) bool {
+	return expires.IsZero() || expires.After(now)
+}
+
+// load reads the overrides from disk. A missing file is not an error.
+func (o *overrides) load() error {
+	if o.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(o.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read overrides: %w", err)
+	}
+	var set overrideSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("failed to decode overrides %s: %w", o.path, err)
+	}
+	o.mu.Lock()
+	o.set = set
+	o.mu.Unlock()
+	return nil
+}
+
+// save writes set to a temporary file, syncs it and renames it into place,
+// then syncs the directory, so that neither a crash nor a power loss leaves a
+// truncated or empty file behind.
+func (o *overrides) save(set overrideSet) error {
+	if o.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(set, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := o.path + ".tmp"
+	if err := writeSynced(tmp, data); err != nil {
+		return fmt.Errorf("failed to write overrides: %w", err)
+	}
+	if err := os.Rename(tmp, o.path); err != nil {
+		return fmt.Errorf("failed to write overrides: %w", err)
+	}
+	if err := syncDir(filepath.Dir(o.path)); err != nil {
+		return fmt.Errorf("failed to sync overrides directory: %w", err)
+	}
+	return nil
+}
+
+// writeSynced writes data to the file at path, replacing its contents, and
+// syncs it to disk.
+func writeSynced(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir syncs dir, making a rename within it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// update applies fn to a copy of the overrides and keeps the result only if
+// it was saved.
+func (o *overrides) update(fn func(*overrideSet) error) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	set := overrideSet{
+		Filters:    slices.Clone(o.set.Filters),
+		Assertions: slices.Clone(o.set.Assertions),
+		ASPAs:      slices.Clone(o.set.ASPAs),
+	}
+	if err := fn(&set); err != nil {
+		return err
+	}
+	if err := o.save(set); err != nil {
+		return err
+	}
+	o.set = set
+	return nil
+}
+
+func (o *overrides) list() overrideSet {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.set
+}
+
+// active returns the overrides that have not expired.
+func (o *overrides) active(now time.Time) overrideSet {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var set overrideSet
+	for _, f := range o.set.Filters {
+		if live(f.Expires, now) {
+			set.Filters = append(set.Filters, f)
+		}
+	}
+	for _, a := range o.set.Assertions {
+		if live(a.Expires, now) {
+			set.Assertions = append(set.Assertions, a)
+		}
+	}
+	for _, a := range o.set.ASPAs {
+		if live(a.Expires, now) {
+			set.ASPAs = append(set.ASPAs, a)
+		}
+	}
+	return set
+}
+
+// nextExpiry returns the earliest expiry still in the future.
+func (o *overrides) nextExpiry(now time.Time) (time.Time, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var next time.Time
+	consider := func(t time.Time) {
+		if t.After(now) && (next.IsZero() || t.Before(next)) {
+			next = t
+		}
+	}
+	for _, f := range o.set.Filters {
+		consider(f.Expires)
+	}
+	for _, a := range o.set.Assertions {
+		consider(a.Expires)
+	}
+	for _, a := range o.set.ASPAs {
+		consider(a.Expires)
+	}
+	return next, !next.IsZero()
+}
+
+// prune removes expired overrides.
+func (o *overrides) prune(now time.Time) error {
+	return o.update(func(set *overrideSet) error {
+		set.Filters = slices.DeleteFunc(set.Filters, func(f prefixFilter) bool { return !live(f.Expires, now) })
+		set.Assertions = slices.DeleteFunc(set.Assertions, func(a prefixAssertion) bool { return !live(a.Expires, now) })
+		set.ASPAs = slices.DeleteFunc(set.ASPAs, func(a aspaOverride) bool { return !live(a.Expires, now) })
+		return nil
+	})
+}
+
+// remove deletes the override with the given ID, whatever its kind.
+func (set *overrideSet) remove(id string) error {
+	n := len(set.Filters) + len(set.Assertions) + len(set.ASPAs)
+	set.Filters = slices.DeleteFunc(set.Filters, func(f prefixFilter) bool { return f.ID == id })
+	set.Assertions = slices.DeleteFunc(set.Assertions, func(a prefixAssertion) bool { return a.ID == id })
+	set.ASPAs = slices.DeleteFunc(set.ASPAs, func(a aspaOverride) bool { return a.ID == id })
+	if n == len(set.Filters)+len(set.Assertions)+len(set.ASPAs) {
+		return errOverrideNotFound
+	}
+	return nil
+}
+
+func newOverrideID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// apply returns the data with the overrides applied. The inputs are never
+// modified, and returned as they are when there is nothing to apply.
+func (set overrideSet) apply(roas []ROA, aspas []ASPA) ([]ROA, []ASPA) {
+	if len(set.Filters) > 0 || len(set.Assertions) > 0 {
+		out := make([]ROA, 0, len(roas)+len(set.Assertions))
+		for _, r := range roas {
+			if !slices.ContainsFunc(set.Filters, func(f prefixFilter) bool { return f.matches(r) }) {
+				out = append(out, r)
+			}
+		}
+		for _, a := range set.Assertions {
+			out = append(out, a.roa())
+		}
+		roas = GetSetOfValidatedROAs(out)
+	}
+
+	if len(set.ASPAs) > 0 {
+		replaced := make(map[uint32]bool, len(set.ASPAs))
+		out := make([]ASPA, 0, len(aspas)+len(set.ASPAs))
+		for _, o := range set.ASPAs {
+			replaced[o.CustomerASN] = true
+			if len(o.ProviderASNs) > 0 {
+				out = append(out, ASPA{CustomerASN: o.CustomerASN, ProviderASNs: slices.Clone(o.ProviderASNs)})
+			}
+		}
+		for _, a := range aspas {
+			if !replaced[a.CustomerASN] {
+				out = append(out, a)
+			}
+		}
+		aspas = DeduplicateASPAsInPlace(out)
+	}
+	return roas, aspas
+}
+
+// reapplyOverrides rebuilds the cache from its current input after the
+// overrides changed. ctx carries the caller that changed them, if any.
+func (s *Server) reapplyOverrides(ctx context.Context) {
+	s.sourcesMu.Lock()
+	defer s.sourcesMu.Unlock()
+	s.rlock()
+	in := s.cache.input
+	s.runlock()
+	s.updateCacheFrom(ctx, sourceOverride, nil, slices.Clone(in.roas), slices.Clone(in.aspas), slices.Clone(in.routerKeys))
+}
+
+// updateOverrides changes the overrides and applies the result to the cache.
+func (s *Server) updateOverrides(ctx context.Context, fn func(*overrideSet) error) error {
+	if err := s.overrides.update(fn); err != nil {
+		return err
+	}
+	s.reapplyOverrides(ctx)
+	select {
+	case s.overridesChanged <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// expireOverrides lifts overrides when they expire, unless updates are paused,
+// in which case they are lifted when updates resume.
+func (s *Server) expireOverrides(ctx context.Context) {
+	defer s.wg.Done()
+	for {
+		var expiry <-chan time.Time
+		var timer *time.Timer
+		if next, ok := s.overrides.nextExpiry(time.Now()); ok {
+			timer = time.NewTimer(time.Until(next))
+			expiry = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-s.overridesChanged:
+		case <-expiry:
+			if err := s.overrides.prune(time.Now()); err != nil {
+				s.logger.Errorw("Failed to remove expired overrides", "error", err)
+			}
+			if !s.paused.Load() {
+				s.logger.Info("Local overrides expired, updating cache")
+				s.reapplyOverrides(ctx)
+			} else {
+				s.sourcesMu.Lock()
+				s.heldBack = true
+				s.sourcesMu.Unlock()
+			}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
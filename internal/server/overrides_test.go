@@ -0,0 +1,149 @@
+package server
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOverrideSetApply(t *testing.T) {
+	asn := uint32(64497)
+	roas := []ROA{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), ASN: 64496, MaxMask: 8},
+		{Prefix: netip.MustParsePrefix("192.0.2.0/24"), ASN: 64496, MaxMask: 24},
+		{Prefix: netip.MustParsePrefix("192.0.2.128/25"), ASN: 64496, MaxMask: 25},
+		{Prefix: netip.MustParsePrefix("198.51.100.0/24"), ASN: 64497, MaxMask: 24},
+	}
+	aspas := []ASPA{
+		{CustomerASN: 64496, ProviderASNs: []uint32{64500}},
+		{CustomerASN: 64497, ProviderASNs: []uint32{64500}},
+		{CustomerASN: 64498, ProviderASNs: []uint32{64500}},
+	}
+	origROAs := append([]ROA(nil), roas...)
+	origASPAs := append([]ASPA(nil), aspas...)
+
+	set := overrideSet{
+		Filters: []prefixFilter{
+			{Prefix: netip.MustParsePrefix("192.0.2.0/24")}, // covers both 192.0.2.0 VRPs
+			{ASN: &asn},
+		},
+		Assertions: []prefixAssertion{
+			{Prefix: netip.MustParsePrefix("192.0.2.0/24"), ASN: 64499, MaxLength: 24},
+		},
+		ASPAs: []aspaOverride{
+			{CustomerASN: 64496, ProviderASNs: []uint32{64501, 64502}},
+			{CustomerASN: 64498}, // withdrawn
+			{CustomerASN: 64499, ProviderASNs: []uint32{64500}},
+		},
+	}
+	gotROAs, gotASPAs := set.apply(roas, aspas)
+
+	wantROAs := []ROA{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), ASN: 64496, MaxMask: 8},
+		{Prefix: netip.MustParsePrefix("192.0.2.0/24"), ASN: 64499, MaxMask: 24},
+	}
+	if !reflect.DeepEqual(gotROAs, wantROAs) {
+		t.Errorf("ROAs = %v, want %v", gotROAs, wantROAs)
+	}
+	wantASPAs := []ASPA{
+		{CustomerASN: 64496, ProviderASNs: []uint32{64501, 64502}},
+		{CustomerASN: 64497, ProviderASNs: []uint32{64500}},
+		{CustomerASN: 64499, ProviderASNs: []uint32{64500}},
+	}
+	if !reflect.DeepEqual(gotASPAs, wantASPAs) {
+		t.Errorf("ASPAs = %v, want %v", gotASPAs, wantASPAs)
+	}
+
+	if !reflect.DeepEqual(roas, origROAs) || !reflect.DeepEqual(aspas, origASPAs) {
+		t.Error("apply modified its input")
+	}
+	if r, a := (overrideSet{}).apply(roas, aspas); &r[0] != &roas[0] || &a[0] != &aspas[0] {
+		t.Error("Expected the input to be returned as is without overrides")
+	}
+}
+
+func TestOverridesExpiry(t *testing.T) {
+	now := time.Now()
+	o := &overrides{set: overrideSet{
+		Filters: []prefixFilter{
+			{ID: "expired", Prefix: netip.MustParsePrefix("10.0.0.0/8"), Expires: now.Add(-time.Minute)},
+			{ID: "later", Prefix: netip.MustParsePrefix("10.0.0.0/8"), Expires: now.Add(time.Hour)},
+			{ID: "never", Prefix: netip.MustParsePrefix("10.0.0.0/8")},
+		},
+		Assertions: []prefixAssertion{
+			{ID: "soon", Prefix: netip.MustParsePrefix("10.0.0.0/8"), MaxLength: 8, Expires: now.Add(time.Minute)},
+		},
+	}}
+
+	if active := o.active(now); len(active.Filters) != 2 || len(active.Assertions) != 1 {
+		t.Errorf("Expected 2 active filters and 1 assertion, got %+v", active)
+	}
+	if next, ok := o.nextExpiry(now); !ok || !next.Equal(now.Add(time.Minute)) {
+		t.Errorf("nextExpiry = %v, %v; want %v", next, ok, now.Add(time.Minute))
+	}
+
+	if err := o.prune(now.Add(2 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	set := o.list()
+	if len(set.Filters) != 2 || len(set.Assertions) != 0 {
+		t.Errorf("Expected expired overrides to be pruned, got %+v", set)
+	}
+}
+
+func TestOverridesPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "overrides.json")
+	o := &overrides{path: path}
+	if err := o.load(); err != nil {
+		t.Fatalf("Expected a missing file to be ignored, got %v", err)
+	}
+
+	asn := uint32(64496)
+	err := o.update(func(set *overrideSet) error {
+		set.Filters = append(set.Filters, prefixFilter{ID: "f1", ASN: &asn, Comment: "hijack", Created: time.Unix(1700000000, 0)})
+		set.Assertions = append(set.Assertions, prefixAssertion{ID: "a1", Prefix: netip.MustParsePrefix("2001:db8::/32"), ASN: 64496, MaxLength: 48})
+		set.ASPAs = append(set.ASPAs, aspaOverride{ID: "o1", CustomerASN: 64496, ProviderASNs: []uint32{64500}, Expires: time.Unix(1900000000, 0)})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &overrides{path: path}
+	if err := loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	got, want := loaded.list(), o.list()
+	if len(got.Filters) != 1 || *got.Filters[0].ASN != asn || got.Filters[0].Comment != "hijack" || !got.Filters[0].Created.Equal(want.Filters[0].Created) {
+		t.Errorf("Filters = %+v, want %+v", got.Filters, want.Filters)
+	}
+	if len(got.Assertions) != 1 || got.Assertions[0].roa() != want.Assertions[0].roa() {
+		t.Errorf("Assertions = %+v, want %+v", got.Assertions, want.Assertions)
+	}
+	if len(got.ASPAs) != 1 || !got.ASPAs[0].Expires.Equal(want.ASPAs[0].Expires) {
+		t.Errorf("ASPAs = %+v, want %+v", got.ASPAs, want.ASPAs)
+	}
+
+	if err := loaded.update(func(set *overrideSet) error { return set.remove("missing") }); err != errOverrideNotFound {
+		t.Errorf("Expected errOverrideNotFound, got %v", err)
+	}
+
+	// A change that cannot be saved is not kept
+	o.path = filepath.Join(path, "not-a-dir", "overrides.json")
+	if err := o.update(func(set *overrideSet) error { return set.remove("f1") }); err == nil {
+		t.Error("Expected the save to fail")
+	}
+	if len(o.list().Filters) != 1 {
+		t.Error("Expected the failed change to be discarded")
+	}
+
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&overrides{path: path}).load(); err == nil {
+		t.Error("Expected an error for a corrupt file")
+	}
+}
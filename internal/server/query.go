@@ -0,0 +1,154 @@
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// listChunkSize bounds the number of entries per streamed list message.
+const listChunkSize = 1000
+
+type prefixMatch int
+
+const (
+	matchExact prefixMatch = iota
+	matchCovering
+	matchCovered
+)
+
+// roaFilter selects ROAs for listing. Zero values match everything.
+type roaFilter struct {
+	prefix        netip.Prefix
+	match         prefixMatch
+	origin        *uint32
+	family        int // 4, 6 or 0 for both
+	maxLength     *uint32
+	expiresBefore int64
+	expiresAfter  int64
+}
+
+func (f roaFilter) keep(r ROA) bool {
+	if f.prefix.IsValid() {
+		switch f.match {
+		case matchCovering:
+			if r.Prefix.Bits() > f.prefix.Bits() || !r.Prefix.Contains(f.prefix.Addr()) {
+				return false
+			}
+		case matchCovered:
+			if f.prefix.Bits() > r.Prefix.Bits() || !f.prefix.Contains(r.Prefix.Addr()) {
+				return false
+			}
+		default:
+			if r.Prefix.Masked() != f.prefix {
+				return false
+			}
+		}
+	}
+	if f.origin != nil && r.ASN != *f.origin {
+		return false
+	}
+	if f.family == 4 && !r.Prefix.Addr().Is4() || f.family == 6 && !r.Prefix.Addr().Is6() {
+		return false
+	}
+	if f.maxLength != nil && uint32(r.MaxMask) != *f.maxLength {
+		return false
+	}
+	return keepExpiry(r.Expires, f.expiresBefore, f.expiresAfter)
+}
+
+// aspaFilter selects ASPAs for listing. Zero values match everything.
+type aspaFilter struct {
+	customer      *uint32
+	provider      *uint32
+	expiresBefore int64
+	expiresAfter  int64
+}
+
+func (f aspaFilter) keep(a ASPA) bool {
+	if f.customer != nil && a.CustomerASN != *f.customer {
+		return false
+	}
+	if f.provider != nil {
+		if _, ok := slices.BinarySearch(a.ProviderASNs, *f.provider); !ok {
+			return false
+		}
+	}
+	return keepExpiry(a.Expires, f.expiresBefore, f.expiresAfter)
+}
+
+// keepExpiry applies the expiry bounds. Entries without expiry information
+// never match a bound.
+func keepExpiry(expires, before, after int64) bool {
+	if before != 0 && (expires == 0 || expires >= before) {
+		return false
+	}
+	if after != 0 && (expires == 0 || expires <= after) {
+		return false
+	}
+	return true
+}
+
+var errPageToken = errors.New("invalid page token")
+
+// encodePageToken returns an opaque token to resume a listing at offset into
+// the cache snapshot with the given session and serial. The session tells
+// snapshots apart whose serials match, such as after a restart.
+func encodePageToken(session uint16, serial uint32, offset int) string {
+	return base64.RawURLEncoding.EncodeToString(fmt.Appendf(nil, "%d:%d:%d", session, serial, offset))
+}
+
+func decodePageToken(token string) (uint16, uint32, int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return 0, 0, 0, errPageToken
+	}
+	parts := strings.Split(string(b), ":")
+	if len(parts) != 3 {
+		return 0, 0, 0, errPageToken
+	}
+	session, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, 0, 0, errPageToken
+	}
+	serial, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return 0, 0, 0, errPageToken
+	}
+	offset, err := strconv.Atoi(parts[2])
+	if err != nil || offset < 0 {
+		return 0, 0, 0, errPageToken
+	}
+	return uint16(session), uint32(serial), offset, nil
+}
+
+// listPage walks items from start and collects the entries kept by the filter,
+// stopping after pageSize entries (zero means no limit). Full chunks of
+// listChunkSize are passed to send as they fill, except the last one which is
+// returned so the caller can attach the page token to it. The returned offset
+// is that of the next match, or -1 if there are no more.
+func listPage[T any](items []T, start, pageSize int, keep func(T) bool, send func([]T) error) ([]T, int, error) {
+	chunk := make([]T, 0, listChunkSize)
+	sent := 0
+	for i := start; i < len(items); i++ {
+		if !keep(items[i]) {
+			continue
+		}
+		if pageSize > 0 && sent == pageSize {
+			return chunk, i, nil
+		}
+		if len(chunk) == listChunkSize {
+			if err := send(chunk); err != nil {
+				return nil, -1, err
+			}
+			chunk = chunk[:0]
+		}
+		chunk = append(chunk, items[i])
+		sent++
+	}
+	return chunk, -1, nil
+}
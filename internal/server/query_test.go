@@ -0,0 +1,96 @@
+package server
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestROAFilter(t *testing.T) {
+	roa := ROA{Prefix: netip.MustParsePrefix("10.1.0.0/16"), ASN: 64496, MaxMask: 24, Expires: 1000}
+	asn, other := uint32(64496), uint32(64497)
+	maxLen := uint32(24)
+
+	tests := []struct {
+		name   string
+		filter roaFilter
+		want   bool
+	}{
+		{"empty", roaFilter{}, true},
+		{"exact", roaFilter{prefix: netip.MustParsePrefix("10.1.0.0/16")}, true},
+		{"exact mismatch", roaFilter{prefix: netip.MustParsePrefix("10.1.0.0/17")}, false},
+		{"covering", roaFilter{prefix: netip.MustParsePrefix("10.1.2.0/24"), match: matchCovering}, true},
+		{"not covering", roaFilter{prefix: netip.MustParsePrefix("10.0.0.0/8"), match: matchCovering}, false},
+		{"covered", roaFilter{prefix: netip.MustParsePrefix("10.0.0.0/8"), match: matchCovered}, true},
+		{"not covered", roaFilter{prefix: netip.MustParsePrefix("10.1.2.0/24"), match: matchCovered}, false},
+		{"other family", roaFilter{prefix: netip.MustParsePrefix("::/0"), match: matchCovered}, false},
+		{"origin", roaFilter{origin: &asn}, true},
+		{"other origin", roaFilter{origin: &other}, false},
+		{"ipv4", roaFilter{family: 4}, true},
+		{"ipv6", roaFilter{family: 6}, false},
+		{"max length", roaFilter{maxLength: &maxLen}, true},
+		{"expires before", roaFilter{expiresBefore: 1001}, true},
+		{"expires before boundary", roaFilter{expiresBefore: 1000}, false},
+		{"expires after", roaFilter{expiresAfter: 999}, true},
+		{"expires after boundary", roaFilter{expiresAfter: 1000}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.keep(roa); got != tt.want {
+				t.Errorf("keep() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if (roaFilter{expiresAfter: 1}).keep(ROA{Prefix: roa.Prefix}) {
+		t.Error("Expected a ROA without expiry information not to match an expiry filter")
+	}
+}
+
+func TestListPage(t *testing.T) {
+	items := make([]int, 2500)
+	for i := range items {
+		items[i] = i
+	}
+	even := func(i int) bool { return i%2 == 0 }
+
+	var chunks []int
+	send := func(c []int) error {
+		chunks = append(chunks, len(c))
+		return nil
+	}
+
+	last, next, err := listPage(items, 0, 0, even, send)
+	if err != nil || next != -1 || len(last) != 250 || len(chunks) != 1 || chunks[0] != listChunkSize {
+		t.Errorf("Expected one full chunk and 250 trailing entries, got chunks %v, last %d, next %d", chunks, len(last), next)
+	}
+
+	chunks = nil
+	last, next, _ = listPage(items, 0, 3, even, send)
+	if len(chunks) != 0 || len(last) != 3 || last[2] != 4 || next != 6 {
+		t.Errorf("Expected a page of 3 ending at 4 with next offset 6, got %v and %d", last, next)
+	}
+	last, next, _ = listPage(items, 2496, 3, even, send)
+	if len(last) != 2 || next != -1 {
+		t.Errorf("Expected the final page to hold 2 entries and no next offset, got %v and %d", last, next)
+	}
+
+	boom := errors.New("boom")
+	if _, _, err := listPage(items, 0, 0, even, func([]int) error { return boom }); err != boom {
+		t.Errorf("Expected send error to be returned, got %v", err)
+	}
+}
+
+func TestPageToken(t *testing.T) {
+	session, serial, offset, err := decodePageToken(encodePageToken(7, 42, 1234))
+	if err != nil || session != 7 || serial != 42 || offset != 1234 {
+		t.Errorf("Expected 7/42/1234 to round trip, got %d/%d/%d %v", session, serial, offset, err)
+	}
+	// Including one without a session, "42:1234", and one with a session out of range
+	for _, tok := range []string{"!!", "bm9jb2xvbg", "YTpi", "MTotMQ", "NDI6MTIzNA", "NzAwMDA6MToy"} {
+		if _, _, _, err := decodePageToken(tok); err == nil {
+			t.Errorf("Expected token %q to be rejected", tok)
+		}
+	}
+}
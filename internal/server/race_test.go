@@ -37,10 +37,12 @@ func TestCacheRace(t *testing.T) {
 			defer serverConn.Close()
 			defer clientConn.Close()
 
+			writer := bufio.NewWriter(serverConn)
 			client := &Client{
 				conn:    serverConn,
 				reader:  bufio.NewReader(serverConn),
-				writer:  bufio.NewWriter(serverConn),
+				writer:  writer,
+				out:     newPDUWriters(writer),
 				logger:  logger,
 				id:      fmt.Sprintf("client-%d", id),
 				cache:   c,
@@ -55,7 +57,7 @@ func TestCacheRace(t *testing.T) {
 						return
 					default:
 						state := client.cache.getState()
-						client.sendAllData(state.roas, state.aspas, state.session, state.serial)
+						client.sendAllData(state.roas, state.aspas, state.routerKeys, state.session, state.serial)
 						time.Sleep(time.Millisecond * 2)
 					}
 				}
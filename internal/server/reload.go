@@ -0,0 +1,219 @@
+package server
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"github.com/mellowdrifter/rpkirtr2/internal/logging"
+	"go.uber.org/zap"
+)
+
+// SetAtomicLevel hands the server the level of its logger so that it can be
+// changed at runtime, by the SetLogLevel admin RPC or a config reload.
+func (s *Server) SetAtomicLevel(level zap.AtomicLevel) {
+	s.logLevel = &level
+}
+
+// httpSources returns the HTTP sources to fetch.
+func (s *Server) httpSources() (urls, aspaURLs []string, upstreams []config.Upstream) {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.urls, s.aspaURLs, s.upstreamCfgs
+}
+
+// defaultClient returns the HTTP client shared by upstreams without custom settings.
+func (s *Server) defaultClient() *http.Client {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.httpClient
+}
+
+func (s *Server) refreshInterval() time.Duration {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return time.Duration(s.cfg.RefreshInterval) * time.Second
+}
+
+// Reload loads the configuration again and applies the settings that can
+// change at runtime: the log level, the HTTP upstreams, the refresh, fetch
+// and retry intervals, the access lists and the RTR limits. It returns the names of the settings applied and of
+// changed settings that need a restart. A refresh is started so that new
+// upstreams take effect immediately.
+func (s *Server) Reload() (applied, restart []string, err error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.cfgMu.RLock()
+	cur := s.cfg
+	s.cfgMu.RUnlock()
+
+	next, err := cur.Reload()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to reload config: %w", err)
+	}
+
+	var httpUpstreams []config.Upstream
+	var rtrAddrs []string
+	for _, u := range next.Upstreams {
+		if u.IsRTR() {
+			rtrAddrs = append(rtrAddrs, u.URL)
+		} else {
+			httpUpstreams = append(httpUpstreams, u)
+		}
+	}
+	var curRTR []string
+	for _, u := range s.rtrUpstreams {
+		curRTR = append(curRTR, u.addr)
+	}
+
+	restartIf := func(name string, changed bool) {
+		if changed {
+			restart = append(restart, name)
+		}
+	}
+	restartIf("listen_addr", next.ListenAddr != cur.ListenAddr)
+	restartIf("grpc_addr", next.GRPCAddr != cur.GRPCAddr)
+	restartIf("http_addr", next.HTTPAddr != cur.HTTPAddr)
+	restartIf("admin_token", next.AdminToken != cur.AdminToken)
+	restartIf("overrides_file", next.OverridesFile != cur.OverridesFile)
+	restartIf("grpc_tls", next.GRPCTLS != cur.GRPCTLS)
+	restartIf("grpc_auth", !reflect.DeepEqual(next.GRPCAuth, cur.GRPCAuth))
+	restartIf("views", !reflect.DeepEqual(next.Views, cur.Views))
+	restartIf("audit", next.Audit != cur.Audit)
+	restartIf("logging", !reflect.DeepEqual(next.Logging, cur.Logging))
+	restartIf("tracing", next.Tracing != cur.Tracing)
+	restartIf("test_mode", next.TestMode != cur.TestMode)
+	restartIf("rtr upstreams", !slices.Equal(rtrAddrs, curRTR))
+
+	// Settings that need a restart keep their running values
+	updated := *cur
+	updated.LogLevel = next.LogLevel
+	updated.RPKIURLs = next.RPKIURLs
+	updated.ASPAURLs = next.ASPAURLs
+	updated.Upstreams = next.Upstreams
+	updated.RefreshInterval = next.RefreshInterval
+	updated.FetchTimeout = next.FetchTimeout
+	updated.RetryMinInterval = next.RetryMinInterval
+	updated.RetryMaxInterval = next.RetryMaxInterval
+	updated.ReadyMaxAge = next.ReadyMaxAge
+	updated.CompressVRPs = next.CompressVRPs
+	updated.RTRACL = next.RTRACL
+	updated.GRPCACL = next.GRPCACL
+	updated.RTRLimits = next.RTRLimits
+	if updated.RefreshInterval == 0 || cur.RefreshInterval == 0 {
+		// The updater only runs if it was started with an interval
+		restartIf("refresh_interval", updated.RefreshInterval != cur.RefreshInterval)
+		updated.RefreshInterval = cur.RefreshInterval
+	}
+
+	applyIf := func(name string, changed bool) {
+		if changed {
+			applied = append(applied, name)
+		}
+	}
+	applyIf("log_level", updated.LogLevel != cur.LogLevel)
+	applyIf("rpki_urls", !slices.Equal(updated.RPKIURLs, cur.RPKIURLs))
+	applyIf("aspa_urls", !slices.Equal(updated.ASPAURLs, cur.ASPAURLs))
+	_, _, curHTTP := s.httpSources()
+	applyIf("upstreams", !reflect.DeepEqual(httpUpstreams, curHTTP))
+	applyIf("refresh_interval", updated.RefreshInterval != cur.RefreshInterval)
+	applyIf("fetch_timeout", updated.FetchTimeout != cur.FetchTimeout)
+	applyIf("retry_min_interval", updated.RetryMinInterval != cur.RetryMinInterval)
+	applyIf("retry_max_interval", updated.RetryMaxInterval != cur.RetryMaxInterval)
+	applyIf("ready_max_age", updated.ReadyMaxAge != cur.ReadyMaxAge)
+	applyIf("compress_vrps", updated.CompressVRPs != cur.CompressVRPs)
+	applyIf("rtr_acl", !reflect.DeepEqual(updated.RTRACL, cur.RTRACL))
+	applyIf("grpc_acl", !reflect.DeepEqual(updated.GRPCACL, cur.GRPCACL))
+	applyIf("rtr_limits", updated.RTRLimits != cur.RTRLimits)
+
+	s.cfgMu.Lock()
+	s.cfg = &updated
+	s.urls = updated.RPKIURLs
+	s.aspaURLs = updated.ASPAURLs
+	s.upstreamCfgs = httpUpstreams
+	s.httpClient = &http.Client{
+		Timeout: seconds(updated.FetchTimeout, config.DefaultFetchTimeout),
+	}
+	s.rtrACL = newACL(updated.RTRACL)
+	s.grpcACL = newACL(updated.GRPCACL)
+	s.cfgMu.Unlock()
+
+	// Clients with custom settings are rebuilt on their next use
+	s.upstreamClientsMu.Lock()
+	clear(s.upstreamClients)
+	s.upstreamClientsMu.Unlock()
+
+	// Forget the status and data of upstreams that were removed
+	configured := make(map[string]bool)
+	for _, url := range slices.Concat(updated.RPKIURLs, updated.ASPAURLs, curRTR) {
+		configured[url] = true
+	}
+	for _, u := range httpUpstreams {
+		configured[u.URL] = true
+	}
+	s.upstreamsMu.Lock()
+	maps.DeleteFunc(s.upstreams, func(url string, _ *UpstreamStatus) bool { return !configured[url] })
+	maps.DeleteFunc(s.fetches, func(key fetchKey, _ *UpstreamStatus) bool { return !configured[key.url] })
+	maps.DeleteFunc(s.lastGood, func(url string, _ upstreamData) bool { return !configured[url] })
+	s.upstreamsMu.Unlock()
+
+	if s.logLevel != nil {
+		level, _ := logging.ParseLevel(updated.LogLevel)
+		s.logLevel.SetLevel(level)
+	}
+
+	s.logger.Infow("Configuration reloaded", "applied", applied, "restart_needed", restart)
+	s.requestRefresh()
+	return applied, restart, nil
+}
+
+// requestRefresh refreshes from every upstream now rather than at the next
+// tick. Without a refresh cycle there is no updater to wake, so the refresh
+// runs in the background here.
+func (s *Server) requestRefresh() {
+	if s.refreshInterval() > 0 {
+		select {
+		case s.refreshNow <- struct{}{}:
+		default:
+		}
+		return
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.logger.Infow("Refreshing", "reason", "requested")
+		if err := s.TriggerRefresh(s.background); err != nil {
+			s.logger.Errorw("Refresh failed", "reason", "requested", "error", err)
+		}
+	}()
+}
+
+// PauseUpdates stops the cache from changing: scheduled refreshes and retries
+// are skipped and changes from RTR upstreams are held back. An explicit
+// refresh of the HTTP upstreams still applies, together with the RTR data
+// held back so far.
+func (s *Server) PauseUpdates() {
+	if !s.paused.Swap(true) {
+		s.logger.Warn("Automatic updates paused")
+	}
+}
+
+// ResumeUpdates undoes PauseUpdates. It applies the changes held back at once
+// and refreshes from the HTTP upstreams to catch up.
+func (s *Server) ResumeUpdates() {
+	if s.paused.Swap(false) {
+		s.logger.Info("Automatic updates resumed")
+		s.applyHeldBack()
+		s.requestRefresh()
+	}
+}
+
+// UpdatesPaused reports whether automatic updates are paused.
+func (s *Server) UpdatesPaused() bool {
+	return s.paused.Load()
+}
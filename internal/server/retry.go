@@ -0,0 +1,171 @@
+package server
+
+import (
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+)
+
+// seconds converts a configured interval to a duration, using def when unset.
+func seconds(v, def uint32) time.Duration {
+	if v == 0 {
+		v = def
+	}
+	return time.Duration(v) * time.Second
+}
+
+// retryDelay returns how long to wait before retrying an upstream that has
+// failed the given number of consecutive times. The delay doubles with every
+// failure up to the configured maximum and carries up to 20% jitter either way
+// so that many instances do not retry a struggling upstream in lockstep.
+func (s *Server) retryDelay(failures int) time.Duration {
+	s.cfgMu.RLock()
+	lo := seconds(s.cfg.RetryMinInterval, config.DefaultRetryMinInterval)
+	hi := seconds(s.cfg.RetryMaxInterval, config.DefaultRetryMaxInterval)
+	s.cfgMu.RUnlock()
+
+	d := lo
+	for i := 1; i < failures && d < hi; i++ {
+		d *= 2
+	}
+	d = min(d, hi)
+
+	spread := d / 5
+	if spread <= 0 {
+		return d
+	}
+	return d - spread + rand.N(2*spread+1)
+}
+
+// fetchKind is what a fetch of an HTTP upstream retrieves. A URL listed under
+// both rpki_urls and aspa_urls is fetched once for each kind.
+type fetchKind uint8
+
+const (
+	fetchROAs fetchKind = iota
+	fetchASPAs
+	fetchUnified
+)
+
+var fetchKinds = []fetchKind{fetchROAs, fetchASPAs, fetchUnified}
+
+func (k fetchKind) String() string {
+	switch k {
+	case fetchROAs:
+		return "roas"
+	case fetchASPAs:
+		return "aspas"
+	default:
+		return "upstream"
+	}
+}
+
+// fetchKey identifies the fetches of one kind from one URL.
+type fetchKey struct {
+	url  string
+	kind fetchKind
+}
+
+// recordFetch stores the outcome of fetching kind from url. Consecutive
+// failures are counted and schedule the next retry; a success resets them.
+// The status of url combines the last fetch of every kind, see
+// combinedStatus. The caller must hold upstreamsMu.
+func (s *Server) recordFetch(url string, kind fetchKind, stats *UpstreamStatus, err error) {
+	key := fetchKey{url, kind}
+	failures := 0
+	if prev, ok := s.fetches[key]; ok {
+		failures = prev.RetryCount
+		stats.LastSuccessTime = prev.LastSuccessTime
+	}
+
+	if err != nil {
+		stats.LastFetchSuccess = false
+		stats.ErrorMessage = err.Error()
+		stats.RetryCount = failures + 1
+		stats.NextAttempt = stats.LastFetchTime.Add(s.retryDelay(stats.RetryCount))
+	} else {
+		stats.LastFetchSuccess = true
+		stats.LastSuccessTime = stats.LastFetchTime
+		stats.ErrorMessage = ""
+		stats.RetryCount = 0
+		stats.NextAttempt = time.Time{}
+	}
+	s.fetches[key] = stats
+	s.upstreams[url] = s.combinedStatus(url)
+	observeFetch(url, stats.FetchDuration, err)
+}
+
+// combinedStatus returns the status of url from the last fetch of each kind.
+// It has failed if any kind failed, with the error of each, and is retried at
+// the earliest retry of a failed kind. Its last success is the oldest of the
+// kinds'. The caller must hold upstreamsMu.
+func (s *Server) combinedStatus(url string) *UpstreamStatus {
+	var kinds []fetchKind
+	for _, kind := range fetchKinds {
+		if _, ok := s.fetches[fetchKey{url, kind}]; ok {
+			kinds = append(kinds, kind)
+		}
+	}
+	if len(kinds) == 1 {
+		stats := *s.fetches[fetchKey{url, kinds[0]}]
+		return &stats
+	}
+
+	out := &UpstreamStatus{LastFetchSuccess: true}
+	var errs []string
+	for i, kind := range kinds {
+		st := s.fetches[fetchKey{url, kind}]
+		if st.LastFetchTime.After(out.LastFetchTime) {
+			out.LastFetchTime = st.LastFetchTime
+		}
+		if i == 0 || st.LastSuccessTime.Before(out.LastSuccessTime) {
+			out.LastSuccessTime = st.LastSuccessTime
+		}
+		out.FetchDuration = max(out.FetchDuration, st.FetchDuration)
+		out.ROACount += st.ROACount
+		out.ASPACount += st.ASPACount
+		out.RouterKeyCount += st.RouterKeyCount
+		if st.LastFetchSuccess {
+			continue
+		}
+		out.LastFetchSuccess = false
+		errs = append(errs, kind.String()+": "+st.ErrorMessage)
+		out.RetryCount = max(out.RetryCount, st.RetryCount)
+		if out.NextAttempt.IsZero() || st.NextAttempt.Before(out.NextAttempt) {
+			out.NextAttempt = st.NextAttempt
+		}
+	}
+	out.ErrorMessage = strings.Join(errs, "; ")
+	return out
+}
+
+// nextRetry returns the earliest scheduled retry of any failed HTTP upstream.
+func (s *Server) nextRetry() (time.Time, bool) {
+	urls, aspaURLs, upstreams := s.httpSources()
+
+	s.upstreamsMu.RLock()
+	defer s.upstreamsMu.RUnlock()
+
+	var next time.Time
+	check := func(url string) {
+		stats, ok := s.upstreams[url]
+		if !ok || stats.LastFetchSuccess || stats.NextAttempt.IsZero() {
+			return
+		}
+		if next.IsZero() || stats.NextAttempt.Before(next) {
+			next = stats.NextAttempt
+		}
+	}
+	for _, url := range urls {
+		check(url)
+	}
+	for _, url := range aspaURLs {
+		check(url)
+	}
+	for _, u := range upstreams {
+		check(u.URL)
+	}
+	return next, !next.IsZero()
+}
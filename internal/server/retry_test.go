@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"go.uber.org/zap"
+)
+
+func TestRetryDelay(t *testing.T) {
+	srv := New(&config.Config{RetryMinInterval: 10, RetryMaxInterval: 100}, zap.NewNop().Sugar())
+
+	tests := []struct {
+		failures int
+		base     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{4, 80 * time.Second},
+		{5, 100 * time.Second},
+		{50, 100 * time.Second},
+	}
+	for _, tt := range tests {
+		for range 20 {
+			d := srv.retryDelay(tt.failures)
+			if d < tt.base*4/5 || d > tt.base*6/5 {
+				t.Errorf("retryDelay(%d) = %v, want %v ±20%%", tt.failures, d, tt.base)
+			}
+		}
+	}
+}
+
+func TestRecordFetch(t *testing.T) {
+	srv := New(&config.Config{RetryMinInterval: 10, RetryMaxInterval: 100}, zap.NewNop().Sugar())
+	srv.urls = []string{"u"}
+
+	srv.upstreamsMu.Lock()
+	for i := 1; i <= 3; i++ {
+		srv.recordFetch("u", fetchROAs, &UpstreamStatus{LastFetchTime: time.Now()}, errors.New("boom"))
+		if got := srv.upstreams["u"].RetryCount; got != i {
+			t.Errorf("Expected retry count %d, got %d", i, got)
+		}
+	}
+	srv.upstreamsMu.Unlock()
+
+	next, ok := srv.nextRetry()
+	if !ok || time.Until(next) < 30*time.Second {
+		t.Errorf("Expected a retry at least 30s out after 3 failures, got %v (%v)", time.Until(next), ok)
+	}
+
+	srv.upstreamsMu.Lock()
+	srv.recordFetch("u", fetchROAs, &UpstreamStatus{LastFetchTime: time.Now()}, nil)
+	stats := *srv.upstreams["u"]
+	srv.upstreamsMu.Unlock()
+	if stats.RetryCount != 0 || !stats.NextAttempt.IsZero() || stats.ErrorMessage != "" {
+		t.Errorf("Expected success to reset retry state, got %+v", stats)
+	}
+	if _, ok := srv.nextRetry(); ok {
+		t.Error("Expected no retry to be scheduled after success")
+	}
+
+	srv.upstreamsMu.Lock()
+	srv.recordFetch("u", fetchROAs, &UpstreamStatus{LastFetchTime: time.Now()}, errors.New("boom"))
+	failed := *srv.upstreams["u"]
+	srv.upstreamsMu.Unlock()
+	if !failed.LastSuccessTime.Equal(stats.LastFetchTime) {
+		t.Errorf("Expected the last success %v to be kept after a failure, got %v", stats.LastFetchTime, failed.LastSuccessTime)
+	}
+}
+
+func TestRecordFetchPerKind(t *testing.T) {
+	srv := New(&config.Config{RetryMinInterval: 10, RetryMaxInterval: 100}, zap.NewNop().Sugar())
+	boom := errors.New("boom")
+	status := func() UpstreamStatus {
+		return *srv.upstreams["u"]
+	}
+
+	// The same URL under rpki_urls and aspa_urls
+	srv.upstreamsMu.Lock()
+	defer srv.upstreamsMu.Unlock()
+	srv.recordFetch("u", fetchROAs, &UpstreamStatus{LastFetchTime: time.Now(), ROACount: 5}, nil)
+	srv.recordFetch("u", fetchASPAs, &UpstreamStatus{LastFetchTime: time.Now()}, boom)
+	if st := status(); st.LastFetchSuccess || st.ErrorMessage != "aspas: boom" || st.ROACount != 5 || st.NextAttempt.IsZero() {
+		t.Errorf("Expected the ASPA failure alongside the ROA count, got %+v", st)
+	}
+
+	srv.recordFetch("u", fetchASPAs, &UpstreamStatus{LastFetchTime: time.Now(), ASPACount: 2}, nil)
+	if st := status(); !st.LastFetchSuccess || st.ErrorMessage != "" || st.ROACount != 5 || st.ASPACount != 2 || st.RetryCount != 0 {
+		t.Errorf("Expected a healthy upstream once both kinds succeed, got %+v", st)
+	}
+
+	// An ASPA success must not mask a ROA failure, nor reset its backoff
+	srv.recordFetch("u", fetchROAs, &UpstreamStatus{LastFetchTime: time.Now()}, boom)
+	srv.recordFetch("u", fetchROAs, &UpstreamStatus{LastFetchTime: time.Now()}, boom)
+	srv.recordFetch("u", fetchASPAs, &UpstreamStatus{LastFetchTime: time.Now(), ASPACount: 2}, nil)
+	if st := status(); st.LastFetchSuccess || st.ErrorMessage != "roas: boom" || st.RetryCount != 2 || st.NextAttempt.IsZero() {
+		t.Errorf("Expected the ROA failure to be kept, got %+v", st)
+	}
+}
+
+func TestPeriodicUpdaterRetriesFailedUpstream(t *testing.T) {
+	var fail atomic.Bool
+	fail.Store(true)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "boom", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(testRPKIClientJSON))
+	}))
+	defer ts.Close()
+
+	cfg := &config.Config{
+		Upstreams:        []config.Upstream{{URL: ts.URL}},
+		RefreshInterval:  3600,
+		RetryMinInterval: 1,
+		RetryMaxInterval: 1,
+		FetchTimeout:     5,
+	}
+	srv := New(cfg, zap.NewNop().Sugar())
+	if srv.httpClient.Timeout != 5*time.Second {
+		t.Errorf("Expected fetch timeout of 5s, got %v", srv.httpClient.Timeout)
+	}
+
+	if err := srv.TriggerRefresh(context.Background()); err == nil {
+		t.Fatal("Expected initial refresh to fail")
+	}
+	fail.Store(false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	srv.wg.Add(1)
+	go srv.periodicROAUpdater(ctx)
+	defer func() {
+		cancel()
+		srv.wg.Wait()
+	}()
+
+	// The retry must happen long before the hourly refresh.
+	waitForState(t, srv, "retry after backoff", func(s cacheState) bool {
+		return len(s.roas) == 2
+	})
+
+	srv.upstreamsMu.RLock()
+	stats := *srv.upstreams[ts.URL]
+	srv.upstreamsMu.RUnlock()
+	if !stats.LastFetchSuccess || stats.RetryCount != 0 {
+		t.Errorf("Expected healthy upstream after retry, got %+v", stats)
+	}
+}
+
+func TestRetryFetchesOnlyFailedUpstreams(t *testing.T) {
+	var healthyHits, failingHits atomic.Int32
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		healthyHits.Add(1)
+		w.Write([]byte(testRPKIClientJSON))
+	}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failingHits.Add(1)
+		http.Error(w, "boom", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	cfg := &config.Config{
+		RPKIURLs:         []string{failing.URL},
+		Upstreams:        []config.Upstream{{URL: healthy.URL}},
+		RefreshInterval:  3600,
+		RetryMinInterval: 1,
+		RetryMaxInterval: 1,
+	}
+	srv := New(cfg, zap.NewNop().Sugar())
+	if err := srv.TriggerRefresh(context.Background()); err != nil {
+		t.Fatalf("TriggerRefresh failed: %v", err)
+	}
+	serial := srv.getSerial()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	srv.wg.Add(1)
+	go srv.periodicROAUpdater(ctx)
+	defer func() {
+		cancel()
+		srv.wg.Wait()
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for failingHits.Load() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for retries, failing upstream fetched %d times", failingHits.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := healthyHits.Load(); got != 1 {
+		t.Errorf("Expected the healthy upstream to be fetched once, got %d", got)
+	}
+	if got := srv.getSerial(); got != serial {
+		t.Errorf("Expected retries with the healthy upstream's last good data to change nothing, serial %d became %d", serial, got)
+	}
+
+	srv.upstreamsMu.RLock()
+	stats := *srv.upstreams[healthy.URL]
+	srv.upstreamsMu.RUnlock()
+	if !stats.LastFetchSuccess || stats.RetryCount != 0 {
+		t.Errorf("Expected the healthy upstream's status to be untouched, got %+v", stats)
+	}
+}
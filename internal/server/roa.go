@@ -7,11 +7,14 @@ import (
 	"io"
 	"net/http"
 	"net/netip"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type ROA struct {
@@ -26,6 +29,48 @@ type JSONROA struct {
 	Mask    uint8        `json:"maxLength"`
 	ASN     jsonASN      `json:"asn"`
 	Expires int64        `json:"expires"`
+	Source  []JSONSource `json:"source"` // Routinator jsonext only
+}
+
+// JSONSource is the per-object source information emitted by Routinator's jsonext format.
+type JSONSource struct {
+	Type          string       `json:"type"`
+	URI           string       `json:"uri"`
+	TAL           string       `json:"tal"`
+	ChainValidity JSONValidity `json:"chainValidity"`
+}
+
+type JSONValidity struct {
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
+// sourceExpiry returns the latest chain expiry of any source, as the object
+// stays valid for as long as one of its sources does. Zero means unknown.
+func sourceExpiry(sources []JSONSource) int64 {
+	var expires int64
+	for _, src := range sources {
+		if src.ChainValidity.NotAfter.IsZero() {
+			continue
+		}
+		if t := src.ChainValidity.NotAfter.Unix(); t > expires {
+			expires = t
+		}
+	}
+	return expires
+}
+
+func (r JSONROA) toROA() ROA {
+	expires := r.Expires
+	if expires == 0 {
+		expires = sourceExpiry(r.Source)
+	}
+	return ROA{
+		Prefix:  r.Prefix,
+		MaxMask: r.Mask,
+		ASN:     uint32(r.ASN),
+		Expires: expires,
+	}
 }
 
 type jsonASN uint32
@@ -135,7 +180,7 @@ type diffResult struct {
 }
 
 func makeDiff(new, old []ROA) diffResult {
-	// Slices are already sorted by loadROAs and previous updateCache
+	// Slices are already sorted by loadROAs and previous updateCacheFrom
 
 	var addROA, delROA []ROA
 	i, j := 0, 0
@@ -180,17 +225,7 @@ func (s *Server) fetchROAsFromURL(ctx context.Context, url string) ([]ROA, error
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	resp, err := s.httpClient.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("http request error: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected HTTP status: %s", resp.Status)
-	}
-
-	return decodeROAsJSON(resp.Body)
+	return fetchDocument(s.defaultClient(), req, url, decodeROAsJSON)
 }
 
 func decodeROAsJSON(r io.Reader) ([]ROA, error) {
@@ -241,12 +276,7 @@ func decodeROAsJSON(r io.Reader) ([]ROA, error) {
 			return nil, fmt.Errorf("failed to decode roa: %w", err)
 		}
 
-		roas = append(roas, ROA{
-			Prefix:  r.Prefix,
-			MaxMask: r.Mask,
-			ASN:     uint32(r.ASN),
-			Expires: r.Expires,
-		})
+		roas = append(roas, r.toROA())
 	}
 
 	return roas, nil
@@ -265,7 +295,7 @@ func filterExpired(roas []ROA, now time.Time) []ROA {
 
 // Some json VRPs contain ASXXX instead of just XXX as the ASN
 func asnToUint32(a string) uint32 {
-	n, err := strconv.ParseUint(strings.TrimLeft(a, "ASas"), 10, 32)
+	n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(a), "AS"), 10, 32)
 	if err != nil {
 		return 0
 	}
@@ -273,66 +303,89 @@ func asnToUint32(a string) uint32 {
 	return uint32(n)
 }
 
-func (s *Server) loadROAs(ctx context.Context) ([]ROA, error) {
+// loadROAs fetches the legacy ROA URLs selected by round, or all of them if
+// round is nil, concurrently. A URL that fails or is not fetched contributes
+// the ROAs from its last successful fetch. If every fetch fails, an error is
+// returned along with the ROAs the URLs last provided.
+func (s *Server) loadROAs(ctx context.Context, round *fetchRound) ([]ROA, error) {
+	urls, _, _ := s.httpSources()
 	var wg sync.WaitGroup
-	roasCh := make(chan []ROA, len(s.urls))
-	errsCh := make(chan error, len(s.urls))
+	roasCh := make(chan []ROA, len(urls))
+	prevCh := make(chan []ROA, len(urls))
 
 	fetch := func(url string) {
 		defer wg.Done()
-		s.logger.Debugf("Fetching ROAs from %s", url)
+		s.logger.Debugw("Fetching ROAs", "upstream", url)
+		ctx, span := startSpan(ctx, "upstream.fetch", attribute.String("upstream.url", url))
+		start := time.Now()
 		roas, err := s.fetchROAsFromURL(ctx, url)
+		span.SetAttributes(attribute.Int("rpki.vrps", len(roas)))
+		endSpan(span, err)
 
 		s.upstreamsMu.Lock()
 		stats := &UpstreamStatus{
 			LastFetchTime: time.Now(),
+			FetchDuration: time.Since(start),
 		}
-		if err != nil {
-			stats.LastFetchSuccess = false
-			stats.ErrorMessage = err.Error()
-			errsCh <- err
-		} else {
-			stats.LastFetchSuccess = true
+		if err == nil {
+			stats.ROACount = len(roas)
+			roas = GetSetOfValidatedROAs(roas)
+			prev := s.lastGood[url]
+			if !slices.Equal(prev.roas, roas) {
+				round.record(url)
+			}
+			prev.roas = roas
+			s.lastGood[url] = prev
 			roasCh <- roas
+		} else if prev, ok := s.lastGood[url]; ok {
+			prevCh <- prev.roas
 		}
-		s.upstreams[url] = stats
+		s.recordFetch(url, fetchROAs, stats, err)
 		s.upstreamsMu.Unlock()
 
-		if err == nil {
-			s.logger.Debugf("Roas retrieved from %s", url)
+		if err != nil {
+			s.logger.Errorw("Failed to fetch ROAs from upstream", "upstream", url, "error", err)
+		} else {
+			s.logger.Debugw("ROAs retrieved", "upstream", url, "roas", len(roas))
 		}
 	}
 
-	wg.Add(len(s.urls))
-	for _, url := range s.urls {
+	attempted := 0
+	for _, url := range urls {
+		if !round.fetches(url) {
+			if prev, ok := s.previous(url); ok {
+				prevCh <- prev.roas
+			}
+			continue
+		}
+		attempted++
+		wg.Add(1)
 		go fetch(url)
 	}
 	wg.Wait()
 	close(roasCh)
-	close(errsCh)
-
-	// Log any errors that occurred
-	for err := range errsCh {
-		s.logger.Errorf("failed to fetch ROAs from upstream: %v", err)
-	}
+	close(prevCh)
 
 	var allSlices [][]ROA
-	total := 0
+	total, fetched := 0, 0
 	for r := range roasCh {
 		allSlices = append(allSlices, r)
 		total += len(r)
+		fetched++
+	}
+	for r := range prevCh {
+		allSlices = append(allSlices, r)
+		total += len(r)
 	}
 
 	combined := make([]ROA, 0, total)
 	for _, r := range allSlices {
 		combined = append(combined, r...)
 	}
+	validRoas := GetSetOfValidatedROAs(combined)
 
-	// If we have no ROAs but we did have URLs configured, something went wrong.
-	if len(combined) == 0 && len(s.urls) > 0 {
-		return nil, fmt.Errorf("failed to fetch ROAs from any configured URL")
+	if fetched == 0 && attempted > 0 {
+		return validRoas, fmt.Errorf("failed to fetch ROAs from any configured URL")
 	}
-
-	validRoas := GetSetOfValidatedROAs(combined)
 	return validRoas, nil
 }
@@ -176,6 +176,9 @@ func TestAsnToUint32(t *testing.T) {
 		{"garbage", "ASabc", 0},
 		{"just AS", "AS", 0},
 		{"AS0", "AS0", 0},
+		{"scrambled prefix", "sAAs64496", 0},
+		{"no AS prefix", "SSSA1", 0},
+		{"repeated prefix", "ASAS1", 0},
 		{"overflow uint32", "4294967296", 0},
 		{"large value", "5000000000", 0},
 	}
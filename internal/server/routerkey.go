@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RouterKey represents a BGPsec router key (RFC 8210 section 5.10).
+type RouterKey struct {
+	SKI     [20]byte
+	ASN     uint32
+	SPKI    []byte // DER encoded Subject Public Key Info
+	Expires int64  // Unix timestamp; 0 means no expiry information
+}
+
+// JSONRouterKey represents the JSON structure of a BGPsec router key as provided by
+// rpki-client ("pubkey") or Routinator's jsonext ("routerPublicKey").
+type JSONRouterKey struct {
+	ASN             jsonASN      `json:"asn"`
+	SKI             string       `json:"ski"`
+	Pubkey          string       `json:"pubkey"`
+	RouterPublicKey string       `json:"routerPublicKey"`
+	Expires         int64        `json:"expires"`
+	Source          []JSONSource `json:"source"`
+}
+
+func (k JSONRouterKey) toRouterKey() (RouterKey, error) {
+	ski, err := hex.DecodeString(strings.ReplaceAll(k.SKI, ":", ""))
+	if err != nil {
+		return RouterKey{}, fmt.Errorf("invalid ski %q: %w", k.SKI, err)
+	}
+	if len(ski) != 20 {
+		return RouterKey{}, fmt.Errorf("invalid ski %q: expected 20 bytes, got %d", k.SKI, len(ski))
+	}
+	pubkey := k.Pubkey
+	if pubkey == "" {
+		pubkey = k.RouterPublicKey
+	}
+	spki, err := base64.StdEncoding.DecodeString(pubkey)
+	if err != nil {
+		return RouterKey{}, fmt.Errorf("invalid pubkey: %w", err)
+	}
+	expires := k.Expires
+	if expires == 0 {
+		expires = sourceExpiry(k.Source)
+	}
+	return RouterKey{
+		SKI:     [20]byte(ski),
+		ASN:     uint32(k.ASN),
+		SPKI:    spki,
+		Expires: expires,
+	}, nil
+}
+
+// Less reports whether this router key should sort before the other.
+func (k RouterKey) Less(other RouterKey) bool {
+	if k.ASN != other.ASN {
+		return k.ASN < other.ASN
+	}
+	if c := bytes.Compare(k.SKI[:], other.SKI[:]); c != 0 {
+		return c < 0
+	}
+	return bytes.Compare(k.SPKI, other.SPKI) < 0
+}
+
+func routerKeysEqual(a, b RouterKey) bool {
+	return a.ASN == b.ASN && a.SKI == b.SKI && bytes.Equal(a.SPKI, b.SPKI)
+}
+
+func (k RouterKey) isValid() bool {
+	return k.ASN != 0 && len(k.SPKI) > 0
+}
+
+// DeduplicateRouterKeysInPlace sorts and deduplicates the provided slice in-place.
+func DeduplicateRouterKeysInPlace(keys []RouterKey) []RouterKey {
+	if len(keys) == 0 {
+		return keys
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Less(keys[j])
+	})
+
+	i := 0
+	for j := 0; j < len(keys); j++ {
+		if !keys[j].isValid() {
+			continue
+		}
+		if i == 0 || !routerKeysEqual(keys[j], keys[i-1]) {
+			keys[i] = keys[j]
+			i++
+		}
+	}
+	return keys[:i]
+}
+
+// filterExpiredRouterKeys removes router keys that have already expired, in-place.
+func filterExpiredRouterKeys(keys []RouterKey, now time.Time) []RouterKey {
+	i := 0
+	for _, k := range keys {
+		if k.Expires == 0 || time.Unix(k.Expires, 0).After(now) {
+			keys[i] = k
+			i++
+		}
+	}
+	return keys[:i]
+}
+
+type routerKeyDiffResult struct {
+	addKeys []RouterKey
+	delKeys []RouterKey
+}
+
+func makeRouterKeyDiff(new, old []RouterKey) routerKeyDiffResult {
+	// Both slices are sorted by DeduplicateRouterKeysInPlace
+	var addKeys, delKeys []RouterKey
+	i, j := 0, 0
+	for i < len(new) && j < len(old) {
+		switch {
+		case routerKeysEqual(new[i], old[j]):
+			i++
+			j++
+		case new[i].Less(old[j]):
+			addKeys = append(addKeys, new[i])
+			i++
+		default:
+			delKeys = append(delKeys, old[j])
+			j++
+		}
+	}
+
+	addKeys = append(addKeys, new[i:]...)
+	delKeys = append(delKeys, old[j:]...)
+
+	return routerKeyDiffResult{
+		addKeys: addKeys,
+		delKeys: delKeys,
+	}
+}
+
+// routerKeyID identifies a router key for diff aggregation.
+type routerKeyID struct {
+	SKI  [20]byte
+	ASN  uint32
+	SPKI string
+}
+
+func (k RouterKey) id() routerKeyID {
+	return routerKeyID{SKI: k.SKI, ASN: k.ASN, SPKI: string(k.SPKI)}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDeduplicateRouterKeysInPlace(t *testing.T) {
+	k1 := RouterKey{ASN: 1, SKI: [20]byte{1}, SPKI: []byte{1}}
+	k2 := RouterKey{ASN: 1, SKI: [20]byte{2}, SPKI: []byte{1}}
+	k3 := RouterKey{ASN: 2, SKI: [20]byte{1}, SPKI: []byte{1}}
+	invalid := RouterKey{ASN: 3, SKI: [20]byte{1}}
+
+	got := DeduplicateRouterKeysInPlace([]RouterKey{k3, k1, invalid, k2, k1})
+	want := []RouterKey{k1, k2, k3}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("DeduplicateRouterKeysInPlace() = %+v, want %+v", got, want)
+	}
+}
+
+func TestFilterExpiredRouterKeys(t *testing.T) {
+	now := time.Unix(1000, 0)
+	keys := []RouterKey{
+		{ASN: 1, SPKI: []byte{1}, Expires: 0},
+		{ASN: 2, SPKI: []byte{1}, Expires: 999},
+		{ASN: 3, SPKI: []byte{1}, Expires: 1001},
+	}
+	got := filterExpiredRouterKeys(keys, now)
+	if len(got) != 2 || got[0].ASN != 1 || got[1].ASN != 3 {
+		t.Errorf("filterExpiredRouterKeys() = %+v", got)
+	}
+}
+
+func TestMakeRouterKeyDiff(t *testing.T) {
+	k1 := RouterKey{ASN: 1, SKI: [20]byte{1}, SPKI: []byte{1}}
+	k2 := RouterKey{ASN: 2, SKI: [20]byte{1}, SPKI: []byte{1}}
+	k3 := RouterKey{ASN: 3, SKI: [20]byte{1}, SPKI: []byte{1}}
+
+	d := makeRouterKeyDiff([]RouterKey{k1, k3}, []RouterKey{k1, k2})
+	if !reflect.DeepEqual(d.addKeys, []RouterKey{k3}) {
+		t.Errorf("addKeys = %+v, want [k3]", d.addKeys)
+	}
+	if !reflect.DeepEqual(d.delKeys, []RouterKey{k2}) {
+		t.Errorf("delKeys = %+v, want [k2]", d.delKeys)
+	}
+
+	d = makeRouterKeyDiff([]RouterKey{k1}, []RouterKey{k1})
+	if d.addKeys != nil || d.delKeys != nil {
+		t.Errorf("Expected no diff, got %+v", d)
+	}
+}
+
+func TestRouterKeyDiffCancellation(t *testing.T) {
+	c := newCache()
+	c.serial = 10
+	k := RouterKey{ASN: 1, SKI: [20]byte{1}, SPKI: []byte{1}}
+
+	c.updateDiffSet(nil, nil, []RouterKey{k}, diffSet{addKeys: []RouterKey{k}})
+	c.incrementSerial()
+	c.updateDiffSet(nil, nil, nil, diffSet{delKeys: []RouterKey{k}})
+	c.incrementSerial()
+
+	d, ok := c.getDiffSetFrom(10)
+	if !ok {
+		t.Fatal("Expected serial 10 to be in history")
+	}
+	if !d.empty() {
+		t.Errorf("Expected add and delete to cancel, got %+v", d)
+	}
+
+	d, ok = c.getDiffSetFrom(11)
+	if !ok || len(d.delKeys) != 1 {
+		t.Errorf("Expected one router key deletion from serial 11, got %+v", d)
+	}
+}
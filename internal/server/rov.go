@@ -0,0 +1,193 @@
+package server
+
+import (
+	"net/netip"
+)
+
+// rovState is a route origin validation state as defined in RFC 6811.
+type rovState int
+
+const (
+	rovNotFound rovState = iota
+	rovValid
+	rovInvalid
+)
+
+func (s rovState) String() string {
+	switch s {
+	case rovValid:
+		return "valid"
+	case rovInvalid:
+		return "invalid"
+	default:
+		return "not-found"
+	}
+}
+
+// roaTrie is a path-compressed binary trie of ROAs, one per address family.
+// Each node holds the ROAs for exactly its prefix, so the VRPs covering a
+// route are collected by walking a single path from the root.
+type roaTrie struct {
+	v4, v6 *trieNode
+	gen    uint64 // cache ROA generation the trie was built from
+	serial uint32 // cache serial the trie was built from
+}
+
+type trieNode struct {
+	prefix   netip.Prefix // always masked
+	children [2]*trieNode
+	roas     []ROA
+}
+
+func newROATrie(roas []ROA) *roaTrie {
+	t := &roaTrie{}
+	for _, r := range roas {
+		t.insert(r)
+	}
+	return t
+}
+
+func (t *roaTrie) root(addr netip.Addr) **trieNode {
+	if addr.Is4() {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+func (t *roaTrie) insert(r ROA) {
+	p := r.Prefix.Masked()
+	np := t.root(p.Addr())
+	for {
+		n := *np
+		if n == nil {
+			*np = &trieNode{prefix: p, roas: []ROA{r}}
+			return
+		}
+
+		common := commonBits(n.prefix, p)
+		switch {
+		case common == n.prefix.Bits() && common == p.Bits():
+			n.roas = append(n.roas, r)
+			return
+		case common == n.prefix.Bits():
+			// n covers p, continue below it
+			np = &n.children[addrBit(p.Addr(), common)]
+		case common == p.Bits():
+			// p covers n, insert above it
+			parent := &trieNode{prefix: p, roas: []ROA{r}}
+			parent.children[addrBit(n.prefix.Addr(), common)] = n
+			*np = parent
+			return
+		default:
+			// p and n diverge, join them under their common prefix
+			split := &trieNode{prefix: netip.PrefixFrom(p.Addr(), common).Masked()}
+			split.children[addrBit(n.prefix.Addr(), common)] = n
+			split.children[addrBit(p.Addr(), common)] = &trieNode{prefix: p, roas: []ROA{r}}
+			*np = split
+			return
+		}
+	}
+}
+
+// covering returns every ROA whose prefix covers the route, shortest prefix first.
+func (t *roaTrie) covering(route netip.Prefix) []ROA {
+	route = route.Masked()
+	var out []ROA
+	n := *t.root(route.Addr())
+	for n != nil && n.prefix.Bits() <= route.Bits() && n.prefix.Contains(route.Addr()) {
+		out = append(out, n.roas...)
+		if n.prefix.Bits() == route.Bits() {
+			break
+		}
+		n = n.children[addrBit(route.Addr(), n.prefix.Bits())]
+	}
+	return out
+}
+
+// validate performs route origin validation as described in RFC 6811. It
+// returns the state along with the covering VRPs that matched and those that
+// did not. VRPs for AS0 (RFC 7607) never match.
+func (t *roaTrie) validate(route netip.Prefix, origin uint32) (rovState, []ROA, []ROA) {
+	var matched, unmatched []ROA
+	for _, r := range t.covering(route) {
+		if r.ASN != 0 && r.ASN == origin && route.Bits() <= int(r.MaxMask) {
+			matched = append(matched, r)
+		} else {
+			unmatched = append(unmatched, r)
+		}
+	}
+
+	switch {
+	case len(matched) > 0:
+		return rovValid, matched, unmatched
+	case len(unmatched) > 0:
+		return rovInvalid, matched, unmatched
+	default:
+		return rovNotFound, nil, nil
+	}
+}
+
+// addrBytes returns the address as big-endian bytes, 4 for IPv4 and 16 for IPv6.
+func addrBytes(a netip.Addr) []byte {
+	if a.Is4() {
+		b := a.As4()
+		return b[:]
+	}
+	b := a.As16()
+	return b[:]
+}
+
+// addrBit returns bit i of the address, counting from the most significant bit.
+func addrBit(a netip.Addr, i int) int {
+	b := addrBytes(a)
+	return int(b[i/8]>>(7-i%8)) & 1
+}
+
+// commonBits returns the length of the longest prefix shared by a and b.
+func commonBits(a, b netip.Prefix) int {
+	limit := min(a.Bits(), b.Bits())
+	ab, bb := addrBytes(a.Addr()), addrBytes(b.Addr())
+	n := 0
+	for i := range ab {
+		if n >= limit {
+			break
+		}
+		x := ab[i] ^ bb[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	return min(n, limit)
+}
+
+// roaIndex returns a trie of the cached ROAs. It is built on first use and
+// rebuilt lazily after the ROAs change, so refreshes do not pay for it unless
+// lookups are made.
+func (c *cache) roaIndex() *roaTrie {
+	c.trieMu.Lock()
+	defer c.trieMu.Unlock()
+
+	c.mu.RLock()
+	t, gen, roas, serial := c.trie, c.roaGen, c.roas, c.serial
+	c.mu.RUnlock()
+	if t != nil && t.gen == gen {
+		return t
+	}
+
+	t = newROATrie(roas)
+	t.gen = gen
+	t.serial = serial
+
+	c.mu.Lock()
+	if c.roaGen == gen {
+		c.trie = t
+	}
+	c.mu.Unlock()
+	return t
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestROVValidate(t *testing.T) {
+	roas := []ROA{
+		{Prefix: netip.MustParsePrefix("10.0.0.0/8"), ASN: 64496, MaxMask: 16},
+		{Prefix: netip.MustParsePrefix("10.1.0.0/16"), ASN: 64497, MaxMask: 24},
+		{Prefix: netip.MustParsePrefix("192.0.2.0/24"), ASN: 0, MaxMask: 24},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), ASN: 64498, MaxMask: 48},
+	}
+	trie := newROATrie(roas)
+
+	tests := []struct {
+		name      string
+		route     string
+		origin    uint32
+		want      rovState
+		matched   int
+		unmatched int
+	}{
+		{"exact match", "10.0.0.0/8", 64496, rovValid, 1, 0},
+		{"within max length", "10.2.0.0/16", 64496, rovValid, 1, 0},
+		{"too specific", "10.2.3.0/24", 64496, rovInvalid, 0, 1},
+		{"wrong origin", "10.2.0.0/16", 64511, rovInvalid, 0, 1},
+		{"more specific ROA matches", "10.1.2.0/24", 64497, rovValid, 1, 1},
+		{"both covering fail", "10.1.2.0/24", 64511, rovInvalid, 0, 2},
+		{"less specific than any ROA", "10.0.0.0/7", 64496, rovNotFound, 0, 0},
+		{"uncovered", "198.51.100.0/24", 64496, rovNotFound, 0, 0},
+		{"AS0 never matches", "192.0.2.0/24", 0, rovInvalid, 0, 1},
+		{"ipv6 valid", "2001:db8:1::/48", 64498, rovValid, 1, 0},
+		{"ipv6 invalid", "2001:db8:1:2::/64", 64498, rovInvalid, 0, 1},
+		{"ipv4 does not match ipv6", "32.1.13.184/29", 64498, rovNotFound, 0, 0},
+		{"unmasked route", "10.2.0.1/16", 64496, rovValid, 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, matched, unmatched := trie.validate(netip.MustParsePrefix(tt.route), tt.origin)
+			if state != tt.want || len(matched) != tt.matched || len(unmatched) != tt.unmatched {
+				t.Errorf("validate(%s, AS%d) = %s, %d matched, %d unmatched; want %s, %d, %d",
+					tt.route, tt.origin, state, len(matched), len(unmatched), tt.want, tt.matched, tt.unmatched)
+			}
+		})
+	}
+}
+
+// TestROATrieMatchesLinearScan checks the trie against a brute force scan over random data.
+func TestROATrieMatchesLinearScan(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	randPrefix := func(v6 bool) netip.Prefix {
+		if v6 {
+			var b [16]byte
+			b[0], b[1], b[2] = 0x20, 0x01, byte(rng.IntN(4))
+			b[3] = byte(rng.IntN(256))
+			return netip.PrefixFrom(netip.AddrFrom16(b), 16+rng.IntN(49)).Masked()
+		}
+		var b [4]byte
+		b[0], b[1], b[2] = byte(10+rng.IntN(2)), byte(rng.IntN(4)), byte(rng.IntN(256))
+		return netip.PrefixFrom(netip.AddrFrom4(b), 8+rng.IntN(17)).Masked()
+	}
+
+	var roas []ROA
+	for range 2000 {
+		p := randPrefix(rng.IntN(2) == 0)
+		roas = append(roas, ROA{Prefix: p, ASN: uint32(1 + rng.IntN(5)), MaxMask: uint8(p.Bits() + rng.IntN(8))})
+	}
+	trie := newROATrie(roas)
+
+	for range 2000 {
+		route := randPrefix(rng.IntN(2) == 0)
+		var want []ROA
+		for _, r := range roas {
+			if r.Prefix.Bits() <= route.Bits() && r.Prefix.Contains(route.Addr()) {
+				want = append(want, r)
+			}
+		}
+		got := trie.covering(route)
+
+		key := func(a, b ROA) int {
+			if a.key().Less(b.key()) {
+				return -1
+			}
+			if b.key().Less(a.key()) {
+				return 1
+			}
+			return 0
+		}
+		slices.SortFunc(want, key)
+		slices.SortFunc(got, key)
+		if !slices.Equal(got, want) {
+			t.Fatalf("covering(%s) = %v, want %v", route, got, want)
+		}
+	}
+}
+
+func TestROAIndexRebuiltOnChange(t *testing.T) {
+	c := newCache()
+	c.replaceRoas([]ROA{{Prefix: netip.MustParsePrefix("10.0.0.0/8"), ASN: 1, MaxMask: 8}})
+
+	first := c.roaIndex()
+	if c.roaIndex() != first {
+		t.Error("Expected the trie to be reused while the ROAs are unchanged")
+	}
+
+	c.mu.Lock()
+	c.updateDiffSet([]ROA{{Prefix: netip.MustParsePrefix("10.0.0.0/8"), ASN: 2, MaxMask: 8}}, nil, nil, diffSet{})
+	c.mu.Unlock()
+
+	second := c.roaIndex()
+	if second == first {
+		t.Fatal("Expected the trie to be rebuilt after the ROAs changed")
+	}
+	if state, _, _ := second.validate(netip.MustParsePrefix("10.0.0.0/8"), 2); state != rovValid {
+		t.Errorf("Expected rebuilt trie to reflect new ROAs, got %s", state)
+	}
+}
@@ -0,0 +1,540 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/protocol"
+	"go.uber.org/zap"
+)
+
+const (
+	rtrDialTimeout = 30 * time.Second
+
+	// rtrStartupWait bounds how long routers are answered with No Data
+	// Available while an RTR upstream has not synced since startup.
+	rtrStartupWait = time.Minute
+)
+
+// errRTRReconnect ends an upstream session that should be re-established immediately,
+// e.g. after a version downgrade or a session ID change.
+var errRTRReconnect = errors.New("reconnect required")
+
+// errRTRExpired ends a session that has not completed an update within the
+// expire interval, such as one to an upstream that stopped answering but
+// keeps the connection open.
+var errRTRExpired = errors.New("no update within the expire interval")
+
+// rtrUpstream mirrors another RTR cache. It keeps a persistent connection,
+// follows Serial Notify and the upstream's refresh interval, and rebuilds the
+// local cache after every completed response.
+type rtrUpstream struct {
+	srv    *Server
+	addr   string
+	logger *zap.SugaredLogger
+	kick   chan struct{} // query now instead of waiting for the refresh timer
+
+	// Only used by the session goroutine
+	version  protocol.Version
+	querying bool // a query is outstanding
+	txn      *rtrTxn
+
+	mu        sync.Mutex
+	roas      map[roaKey]ROA
+	aspas     map[uint32]ASPA
+	keys      map[routerKeyID]RouterKey
+	session   uint16
+	serial    uint32
+	synced    bool
+	lastSync  time.Time
+	intervals rtrIntervals
+}
+
+// rtrTxn collects the payload of a single Cache Response until End of Data.
+// A nil value withdraws the entry.
+type rtrTxn struct {
+	reset   bool
+	session uint16
+	roas    map[roaKey]*ROA
+	aspas   map[uint32]*ASPA
+	keys    map[routerKeyID]*RouterKey
+}
+
+func newRTRUpstream(s *Server, addr string) *rtrUpstream {
+	return &rtrUpstream{
+		srv:       s,
+		addr:      addr,
+		logger:    s.logger.With("upstream", addr),
+		kick:      make(chan struct{}, 1),
+		version:   2,
+		roas:      make(map[roaKey]ROA),
+		aspas:     make(map[uint32]ASPA),
+		keys:      make(map[routerKeyID]RouterKey),
+		intervals: *newRTRIntervals(),
+	}
+}
+
+// run keeps a session to the upstream cache open until ctx is cancelled.
+func (u *rtrUpstream) run(ctx context.Context) {
+	defer u.srv.wg.Done()
+
+	for {
+		err := u.runSession(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, errRTRReconnect) {
+			continue
+		}
+
+		u.logger.Warnw("RTR upstream session failed", "error", err)
+		u.setError(err)
+		u.expireIfStale()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(u.retryInterval()):
+		case <-u.kick:
+		}
+	}
+}
+
+// runSession connects to the upstream cache and processes PDUs until an error occurs.
+func (u *rtrUpstream) runSession(ctx context.Context) error {
+	d := net.Dialer{Timeout: rtrDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	u.logger.Infow("Connected to RTR upstream", "version", u.version)
+
+	pdus := make(chan protocol.PDU)
+	errc := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		r := bufio.NewReader(conn)
+		for {
+			pdu, err := protocol.GetPDU(r)
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case pdus <- pdu:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	u.txn = nil
+	u.querying = false
+	if err := u.query(conn); err != nil {
+		return err
+	}
+
+	refresh := time.NewTimer(u.refreshInterval())
+	defer refresh.Stop()
+	expire := time.NewTimer(u.untilExpiry())
+	defer expire.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errc:
+			return fmt.Errorf("failed to read PDU: %w", err)
+		case <-expire.C:
+			return errRTRExpired
+		case <-refresh.C:
+			if !u.querying {
+				if err := u.query(conn); err != nil {
+					return err
+				}
+			}
+			refresh.Reset(u.refreshInterval())
+		case <-u.kick:
+			if !u.querying {
+				if err := u.query(conn); err != nil {
+					return err
+				}
+			}
+			refresh.Reset(u.refreshInterval())
+		case pdu := <-pdus:
+			if err := u.handlePDU(conn, pdu); err != nil {
+				return err
+			}
+			if pdu.Type() == protocol.EndOfData {
+				refresh.Reset(u.refreshInterval())
+				expire.Reset(u.untilExpiry())
+			}
+		}
+	}
+}
+
+// query sends a Serial Query if the upstream has been synced before, otherwise a Reset Query.
+func (u *rtrUpstream) query(conn net.Conn) error {
+	u.mu.Lock()
+	synced, session, serial := u.synced, u.session, u.serial
+	u.mu.Unlock()
+
+	var err error
+	if synced {
+		u.logger.Debugw("Sending Serial Query", "serial", serial)
+		err = protocol.NewSerialQueryPDU(u.version, session, serial).Write(conn)
+	} else {
+		u.logger.Debug("Sending Reset Query")
+		err = protocol.NewResetQueryPDU(u.version).Write(conn)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to send query: %w", err)
+	}
+	u.querying = true
+	return nil
+}
+
+//nolint:gocyclo
+func (u *rtrUpstream) handlePDU(conn net.Conn, pdu protocol.PDU) error {
+	if pdu.Version() != u.version && pdu.Type() != protocol.ErrorReport {
+		return fmt.Errorf("unexpected version %d in %T, expected %d", pdu.Version(), pdu, u.version)
+	}
+
+	switch p := pdu.(type) {
+	case *protocol.SerialNotifyPDU:
+		if u.querying {
+			return nil
+		}
+		u.logger.Debugw("Received Serial Notify", "serial", p.Serial())
+		return u.query(conn)
+
+	case *protocol.CacheResponsePDU:
+		if u.txn != nil {
+			return errors.New("unexpected Cache Response during a response")
+		}
+		u.mu.Lock()
+		synced, session := u.synced, u.session
+		u.mu.Unlock()
+		if synced && p.Session() != session {
+			u.logger.Warnw("Upstream session changed, resetting", "previous_session", session, "session", p.Session())
+			u.mu.Lock()
+			u.synced = false
+			u.mu.Unlock()
+			return errRTRReconnect
+		}
+		u.txn = &rtrTxn{
+			reset:   !synced,
+			session: p.Session(),
+			roas:    make(map[roaKey]*ROA),
+			aspas:   make(map[uint32]*ASPA),
+			keys:    make(map[routerKeyID]*RouterKey),
+		}
+
+	case *protocol.Ipv4PrefixPDU:
+		prefix := p.Prefix()
+		return u.addROA(p.Flags(), netip.AddrFrom4(prefix), p.PrefixLength(), p.MaxLength(), p.ASN())
+
+	case *protocol.Ipv6PrefixPDU:
+		prefix := p.Prefix()
+		return u.addROA(p.Flags(), netip.AddrFrom16(prefix), p.PrefixLength(), p.MaxLength(), p.ASN())
+
+	case *protocol.AspaPDU:
+		if u.txn == nil {
+			return errors.New("unexpected ASPA outside of a response")
+		}
+		aspa := ASPA{CustomerASN: p.CustomerASN(), ProviderASNs: append([]uint32(nil), p.ProviderASNs()...)}
+		sort.Slice(aspa.ProviderASNs, func(i, j int) bool {
+			return aspa.ProviderASNs[i] < aspa.ProviderASNs[j]
+		})
+		if p.Flags()&protocol.Announce == 0 {
+			u.txn.aspas[aspa.CustomerASN] = nil
+		} else {
+			u.txn.aspas[aspa.CustomerASN] = &aspa
+		}
+
+	case *protocol.RouterKeyPDU:
+		if u.txn == nil {
+			return errors.New("unexpected Router Key outside of a response")
+		}
+		key := RouterKey{SKI: p.SKI(), ASN: p.ASN(), SPKI: append([]byte(nil), p.SubjectPublicKeyInfo()...)}
+		if p.Flags()&protocol.Announce == 0 {
+			u.txn.keys[key.id()] = nil
+		} else {
+			u.txn.keys[key.id()] = &key
+		}
+
+	case *protocol.EndOfDataPDU:
+		if u.txn == nil {
+			return errors.New("unexpected End of Data outside of a response")
+		}
+		if p.Session() != u.txn.session {
+			return fmt.Errorf("End of Data session %d does not match Cache Response session %d", p.Session(), u.txn.session)
+		}
+		u.commit(p)
+		u.srv.rebuildCache(u.addr)
+
+	case *protocol.ErrorReportPDU:
+		if p.Code() == protocol.UnsupportedVersion && u.version > 1 {
+			u.version--
+			u.logger.Infow("Upstream does not support the requested version, downgrading", "version", u.version)
+			return errRTRReconnect
+		}
+		if p.Code() == protocol.NoData {
+			return errors.New("upstream has no data available")
+		}
+		return fmt.Errorf("upstream reported error %d: %s", p.Code(), p.Text())
+
+	default:
+		if pdu.Type() == protocol.CacheReset {
+			if u.txn != nil {
+				return errors.New("unexpected Cache Reset during a response")
+			}
+			u.logger.Info("Upstream cannot provide incremental update, sending Reset Query")
+			u.mu.Lock()
+			u.synced = false
+			u.mu.Unlock()
+			return u.query(conn)
+		}
+		return fmt.Errorf("unexpected PDU type %d from upstream", pdu.Type())
+	}
+
+	return nil
+}
+
+func (u *rtrUpstream) addROA(flags uint8, addr netip.Addr, length, maxLength uint8, asn uint32) error {
+	if u.txn == nil {
+		return errors.New("unexpected prefix outside of a response")
+	}
+	prefix, err := addr.Prefix(int(length))
+	if err != nil {
+		return fmt.Errorf("invalid prefix length %d for %s: %w", length, addr, err)
+	}
+	roa := ROA{Prefix: prefix, ASN: asn, MaxMask: maxLength}
+	if flags&protocol.Announce == 0 {
+		u.txn.roas[roa.key()] = nil
+	} else {
+		u.txn.roas[roa.key()] = &roa
+	}
+	return nil
+}
+
+// commit applies the completed response to the mirrored data set.
+func (u *rtrUpstream) commit(eod *protocol.EndOfDataPDU) {
+	txn := u.txn
+	u.txn = nil
+	u.querying = false
+
+	u.mu.Lock()
+	if txn.reset {
+		u.roas = make(map[roaKey]ROA, len(txn.roas))
+		u.aspas = make(map[uint32]ASPA, len(txn.aspas))
+		u.keys = make(map[routerKeyID]RouterKey, len(txn.keys))
+	}
+	for k, r := range txn.roas {
+		if r == nil {
+			delete(u.roas, k)
+		} else {
+			u.roas[k] = *r
+		}
+	}
+	for k, a := range txn.aspas {
+		if a == nil {
+			delete(u.aspas, k)
+		} else {
+			u.aspas[k] = *a
+		}
+	}
+	for k, key := range txn.keys {
+		if key == nil {
+			delete(u.keys, k)
+		} else {
+			u.keys[k] = *key
+		}
+	}
+	u.session = eod.Session()
+	u.serial = eod.Serial()
+	u.synced = true
+	u.lastSync = time.Now()
+	if eod.Refresh() != 0 {
+		u.intervals.refreshInterval = eod.Refresh()
+	}
+	if eod.Retry() != 0 {
+		u.intervals.retryInterval = eod.Retry()
+	}
+	if eod.Expire() != 0 {
+		u.intervals.expireInterval = eod.Expire()
+	}
+	stats := &UpstreamStatus{
+		LastFetchSuccess: true,
+		LastFetchTime:    u.lastSync,
+		LastSuccessTime:  u.lastSync,
+		ROACount:         len(u.roas),
+		ASPACount:        len(u.aspas),
+		RouterKeyCount:   len(u.keys),
+		SessionID:        u.session,
+		Serial:           u.serial,
+	}
+	u.mu.Unlock()
+
+	u.logger.Debugw("Synced", "serial", stats.Serial, "session", stats.SessionID, "roas", stats.ROACount, "aspas", stats.ASPACount, "router_keys", stats.RouterKeyCount)
+
+	u.srv.upstreamsMu.Lock()
+	u.srv.upstreams[u.addr] = stats
+	u.srv.upstreamsMu.Unlock()
+	observeFetch(u.addr, 0, nil)
+}
+
+// setError records a failed session while keeping the last known counts, session and serial.
+func (u *rtrUpstream) setError(err error) {
+	u.srv.upstreamsMu.Lock()
+	defer u.srv.upstreamsMu.Unlock()
+
+	stats := &UpstreamStatus{}
+	if prev, ok := u.srv.upstreams[u.addr]; ok {
+		*stats = *prev
+	}
+	stats.LastFetchSuccess = false
+	stats.LastFetchTime = time.Now()
+	stats.ErrorMessage = err.Error()
+	stats.RetryCount++
+	stats.NextAttempt = stats.LastFetchTime.Add(u.retryInterval())
+	u.srv.upstreams[u.addr] = stats
+	observeFetch(u.addr, 0, err)
+}
+
+// expireIfStale drops the mirrored data once the upstream's expire interval has
+// passed without a successful update, as required by RFC 8210 section 6.
+func (u *rtrUpstream) expireIfStale() {
+	u.mu.Lock()
+	stale := u.synced && time.Since(u.lastSync) >= time.Duration(u.intervals.expireInterval)*time.Second
+	if stale {
+		u.roas = make(map[roaKey]ROA)
+		u.aspas = make(map[uint32]ASPA)
+		u.keys = make(map[routerKeyID]RouterKey)
+		u.synced = false
+	}
+	u.mu.Unlock()
+
+	if stale {
+		u.logger.Warn("RTR upstream data expired, withdrawing it")
+		u.srv.rebuildCache(u.addr)
+	}
+}
+
+// untilExpiry returns how long the mirrored data may still be served without
+// a successful update, counting from now if the upstream has not synced.
+func (u *rtrUpstream) untilExpiry() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	expire := time.Duration(u.intervals.expireInterval) * time.Second
+	if !u.synced {
+		return expire
+	}
+	return max(expire-time.Since(u.lastSync), 0)
+}
+
+// refreshNow asks the session to query the upstream immediately, or to
+// reconnect at once if it is waiting to retry.
+func (u *rtrUpstream) refreshNow() {
+	select {
+	case u.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (u *rtrUpstream) refreshInterval() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return time.Duration(u.intervals.refreshInterval) * time.Second
+}
+
+func (u *rtrUpstream) retryInterval() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return time.Duration(u.intervals.retryInterval) * time.Second
+}
+
+// snapshot returns a copy of the mirrored data.
+func (u *rtrUpstream) snapshot() upstreamData {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	data := upstreamData{
+		roas:       make([]ROA, 0, len(u.roas)),
+		aspas:      make([]ASPA, 0, len(u.aspas)),
+		routerKeys: make([]RouterKey, 0, len(u.keys)),
+	}
+	for _, r := range u.roas {
+		data.roas = append(data.roas, r)
+	}
+	for _, a := range u.aspas {
+		data.aspas = append(data.aspas, a)
+	}
+	for _, k := range u.keys {
+		data.routerKeys = append(data.routerKeys, k)
+	}
+	return data
+}
+
+// hasSynced reports whether the upstream has completed a sync since startup.
+func (u *rtrUpstream) hasSynced() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !u.lastSync.IsZero()
+}
+
+// checkLoaded ends the startup wait once every RTR upstream has synced, or
+// once rtrStartupWait has passed and some upstream has provided data. Until
+// then routers get No Data Available rather than an empty set, which would
+// make every route NotFound. It is called after each cache update, and
+// reports whether it ended the wait so that routers can be notified.
+func (s *Server) checkLoaded() bool {
+	if !s.cache.loading.Load() {
+		return false
+	}
+	synced := 0
+	for _, u := range s.rtrUpstreams {
+		if u.hasSynced() {
+			synced++
+		}
+	}
+	urls, _, upstreams := s.httpSources()
+	if synced < len(s.rtrUpstreams) && (!s.waitedRTR.Load() || synced == 0 && len(urls)+len(upstreams) == 0) {
+		return false
+	}
+	if !s.cache.loading.CompareAndSwap(true, false) {
+		return false
+	}
+	s.logger.Infow("Cache loaded, answering queries", "rtr_upstreams", len(s.rtrUpstreams), "rtr_upstreams_synced", synced)
+	return true
+}
+
+// waitForRTRUpstreams stops waiting for the RTR upstreams after
+// rtrStartupWait, unless ctx is done first.
+func (s *Server) waitForRTRUpstreams(ctx context.Context) {
+	defer s.wg.Done()
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(rtrStartupWait):
+	}
+	s.waitedRTR.Store(true)
+	if s.checkLoaded() {
+		// Routers told there was no data need not wait for their retry interval
+		s.notifyClients()
+	} else if s.cache.loading.Load() {
+		s.logger.Warnw("No upstream has provided data yet, still answering No Data Available", "waited", rtrStartupWait)
+	}
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"github.com/mellowdrifter/rpkirtr2/internal/protocol"
+	"go.uber.org/zap"
+)
+
+// startTestServer serves srv on a random local port and stops it when the test ends.
+func startTestServer(t *testing.T, srv *Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go func() {
+		_ = srv.ServeListener(l)
+	}()
+	t.Cleanup(func() {
+		_ = srv.Stop(time.Second)
+	})
+	return l.Addr().String()
+}
+
+func waitForState(t *testing.T, srv *Server, desc string, cond func(cacheState) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond(srv.cache.getState()) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	state := srv.cache.getState()
+	t.Fatalf("timed out waiting for %s: %d ROAs, %d ASPAs, %d router keys", desc, len(state.roas), len(state.aspas), len(state.routerKeys))
+}
+
+func TestRTRUpstreamMirrorsCache(t *testing.T) {
+	source := New(&config.Config{}, zap.NewNop().Sugar())
+	roas := []ROA{
+		{Prefix: netip.MustParsePrefix("1.1.1.0/24"), ASN: 13335, MaxMask: 24},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), ASN: 64496, MaxMask: 48},
+	}
+	source.UpdateROAs(roas)
+	source.UpdateASPAs([]ASPA{{CustomerASN: 64496, ProviderASNs: []uint32{64497, 64498}}})
+	source.UpdateRouterKeys([]RouterKey{{SKI: [20]byte{1, 2, 3}, ASN: 64496, SPKI: []byte{1, 2, 3}}})
+	addr := startTestServer(t, source)
+
+	mirror := New(&config.Config{
+		Upstreams: []config.Upstream{{Type: config.UpstreamTypeRTR, URL: addr}},
+	}, zap.NewNop().Sugar())
+	startTestServer(t, mirror)
+
+	waitForState(t, mirror, "initial sync", func(s cacheState) bool {
+		return len(s.roas) == 2 && len(s.aspas) == 1 && len(s.routerKeys) == 1
+	})
+
+	state := mirror.cache.getState()
+	if state.aspas[0].CustomerASN != 64496 || len(state.aspas[0].ProviderASNs) != 2 {
+		t.Errorf("Unexpected mirrored ASPA: %+v", state.aspas[0])
+	}
+	if state.routerKeys[0].ASN != 64496 || string(state.routerKeys[0].SPKI) != "\x01\x02\x03" {
+		t.Errorf("Unexpected mirrored router key: %+v", state.routerKeys[0])
+	}
+
+	mirror.upstreamsMu.RLock()
+	stats := *mirror.upstreams[addr]
+	mirror.upstreamsMu.RUnlock()
+	if !stats.LastFetchSuccess || stats.SessionID != source.getSession() || stats.Serial != source.getSerial() {
+		t.Errorf("Unexpected upstream status %+v, source session %d serial %d", stats, source.getSession(), source.getSerial())
+	}
+
+	// Changes must arrive through Serial Notify, well before the refresh interval.
+	source.UpdateROAs(append(roas[:1:1], ROA{Prefix: netip.MustParsePrefix("9.9.9.0/24"), ASN: 19281, MaxMask: 24}))
+	waitForState(t, mirror, "incremental update", func(s cacheState) bool {
+		if len(s.roas) != 2 {
+			return false
+		}
+		for _, r := range s.roas {
+			if r.ASN == 64496 {
+				return false
+			}
+		}
+		return true
+	})
+
+	source.UpdateASPAs(nil)
+	waitForState(t, mirror, "ASPA withdrawal", func(s cacheState) bool {
+		return len(s.aspas) == 0
+	})
+}
+
+func TestRTRUpstreamVersionDowngrade(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	// A version 1 only cache serving a single ROA.
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				pdu, err := protocol.GetPDU(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if pdu.Version() != 1 {
+					_ = protocol.NewErrorReportPDU(1, protocol.UnsupportedVersion, nil, "version 1 only").Write(conn)
+					return
+				}
+				_ = protocol.NewCacheResponsePDU(1, 42).Write(conn)
+				_ = protocol.WriteIpv4Prefix(conn, 1, protocol.Announce, 24, 24, [4]byte{192, 0, 2, 0}, 64496)
+				_ = protocol.NewEndOfDataPDU(1, 42, 7, 3600, 600, 7200).Write(conn)
+				// Keep the session open until the test ends.
+				_, _ = bufio.NewReader(conn).ReadByte()
+			}(conn)
+		}
+	}()
+
+	mirror := New(&config.Config{
+		Upstreams: []config.Upstream{{Type: config.UpstreamTypeRTR, URL: l.Addr().String()}},
+	}, zap.NewNop().Sugar())
+	startTestServer(t, mirror)
+
+	waitForState(t, mirror, "sync after downgrade", func(s cacheState) bool {
+		return len(s.roas) == 1
+	})
+
+	mirror.upstreamsMu.RLock()
+	stats := *mirror.upstreams[l.Addr().String()]
+	mirror.upstreamsMu.RUnlock()
+	if stats.SessionID != 42 || stats.Serial != 7 || stats.ROACount != 1 {
+		t.Errorf("Unexpected upstream status: %+v", stats)
+	}
+	if got := mirror.rtrUpstreams[0].snapshot().roas[0].Prefix; got != netip.MustParsePrefix("192.0.2.0/24") {
+		t.Errorf("Unexpected mirrored prefix %s", got)
+	}
+}
+
+func TestRTRUpstreamMergesWithHTTPData(t *testing.T) {
+	srv := New(&config.Config{
+		Upstreams: []config.Upstream{{Type: config.UpstreamTypeRTR, URL: "192.0.2.1:8282"}},
+	}, zap.NewNop().Sugar())
+	if len(srv.upstreamCfgs) != 0 || len(srv.rtrUpstreams) != 1 {
+		t.Fatalf("Expected a single RTR upstream, got %d HTTP and %d RTR", len(srv.upstreamCfgs), len(srv.rtrUpstreams))
+	}
+
+	shared := ROA{Prefix: netip.MustParsePrefix("1.1.1.0/24"), ASN: 13335, MaxMask: 24}
+	srv.fetched = upstreamData{roas: []ROA{shared}}
+	u := srv.rtrUpstreams[0]
+	u.roas[shared.key()] = shared
+	extra := ROA{Prefix: netip.MustParsePrefix("9.9.9.0/24"), ASN: 19281, MaxMask: 24}
+	u.roas[extra.key()] = extra
+
+	srv.rebuildCache(u.addr)
+	if got := len(srv.cache.getState().roas); got != 2 {
+		t.Errorf("Expected 2 merged ROAs, got %d", got)
+	}
+	if len(srv.fetched.roas) != 1 {
+		t.Errorf("Merging must not modify the fetched HTTP data, got %+v", srv.fetched.roas)
+	}
+}
+
+func TestResumeWithoutRefreshCycle(t *testing.T) {
+	var doc atomic.Value
+	doc.Store(testRPKIClientJSON)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(doc.Load().(string)))
+	}))
+	defer ts.Close()
+
+	a := ROA{Prefix: netip.MustParsePrefix("192.0.2.0/24"), ASN: 64496, MaxMask: 24}
+	b := ROA{Prefix: netip.MustParsePrefix("198.51.100.0/24"), ASN: 64497, MaxMask: 24}
+	source := New(&config.Config{}, zap.NewNop().Sugar())
+	source.UpdateROAs([]ROA{a})
+	addr := startTestServer(t, source)
+
+	// No refresh cycle, so nothing but resume can fetch the HTTP upstream again
+	mirror := New(&config.Config{
+		Upstreams: []config.Upstream{{URL: ts.URL}, {Type: config.UpstreamTypeRTR, URL: addr}},
+	}, zap.NewNop().Sugar())
+	if err := mirror.TriggerRefresh(context.Background()); err != nil {
+		t.Fatalf("TriggerRefresh failed: %v", err)
+	}
+	startTestServer(t, mirror)
+	waitForState(t, mirror, "initial sync", func(s cacheState) bool { return len(s.roas) == 3 })
+
+	mirror.PauseUpdates()
+	source.UpdateROAs([]ROA{a, b})
+	doc.Store(`{"roas": []}`)
+	u := mirror.rtrUpstreams[0]
+	deadline := time.Now().Add(5 * time.Second)
+	for len(u.snapshot().roas) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the RTR upstream's change")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := len(mirror.cache.getState().roas); got != 3 {
+		t.Fatalf("Expected the change to be held back while paused, got %d ROAs", got)
+	}
+
+	mirror.ResumeUpdates()
+	if !slices.Contains(mirror.cache.getState().roas, b) {
+		t.Error("Expected the held back RTR change to apply on resume")
+	}
+	waitForState(t, mirror, "HTTP refresh on resume", func(s cacheState) bool { return len(s.roas) == 2 })
+	if h := mirror.cache.getHistory(); h[len(h)-2].source != sourceResume {
+		t.Errorf("Expected the held back change to be recorded as %q, got %q", sourceResume, h[len(h)-2].source)
+	}
+}
+
+func TestRTRUpstreamSilentExpires(t *testing.T) {
+	// The upstream answers the first query, with a one second expire
+	// interval, and then stops answering but keeps every connection open.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var conns atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			if conns.Add(1) > 1 {
+				continue
+			}
+			query, err := protocol.GetPDU(bufio.NewReader(conn))
+			if err != nil {
+				return
+			}
+			ver := query.Version()
+			protocol.NewCacheResponsePDU(ver, 42).Write(conn)
+			protocol.NewIpv4PrefixPDU(ver, 1, 24, 24, [4]byte{192, 0, 2, 0}, 64496).Write(conn)
+			protocol.NewEndOfDataPDU(ver, 42, 1, 3600, 1, 1).Write(conn)
+		}
+	}()
+
+	mirror := New(&config.Config{
+		Upstreams: []config.Upstream{{Type: config.UpstreamTypeRTR, URL: l.Addr().String()}},
+	}, zap.NewNop().Sugar())
+	startTestServer(t, mirror)
+
+	waitForState(t, mirror, "initial sync", func(s cacheState) bool { return len(s.roas) == 1 })
+	waitForState(t, mirror, "expiry of the silent upstream", func(s cacheState) bool { return len(s.roas) == 0 })
+
+	mirror.upstreamsMu.RLock()
+	stats := *mirror.upstreams[l.Addr().String()]
+	mirror.upstreamsMu.RUnlock()
+	if stats.LastFetchSuccess || stats.ErrorMessage != errRTRExpired.Error() {
+		t.Errorf("Expected the upstream to be reported as expired, got %+v", stats)
+	}
+}
+
+// gatedListener holds back accepted connections until open is closed.
+type gatedListener struct {
+	net.Listener
+	open chan struct{}
+}
+
+func (l gatedListener) Accept() (net.Conn, error) {
+	<-l.open
+	return l.Listener.Accept()
+}
+
+func TestRTRUpstreamStartupNoData(t *testing.T) {
+	source := New(&config.Config{}, zap.NewNop().Sugar())
+	source.UpdateROAs([]ROA{{Prefix: netip.MustParsePrefix("1.1.1.0/24"), ASN: 13335, MaxMask: 24}})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	gated := gatedListener{Listener: l, open: make(chan struct{})}
+	go func() {
+		_ = source.ServeListener(gated)
+	}()
+	t.Cleanup(func() {
+		_ = source.Stop(time.Second)
+	})
+
+	mirror := New(&config.Config{
+		Upstreams: []config.Upstream{{Type: config.UpstreamTypeRTR, URL: l.Addr().String()}},
+	}, zap.NewNop().Sugar())
+	conn, err := net.Dial("tcp", startTestServer(t, mirror))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+
+	// The upstream has not answered yet, so there is nothing to serve
+	if err := protocol.NewResetQueryPDU(1).Write(conn); err != nil {
+		t.Fatalf("failed to write Reset Query: %v", err)
+	}
+	pdu, err := protocol.GetPDU(r)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if report, ok := pdu.(*protocol.ErrorReportPDU); !ok || report.Code() != protocol.NoData {
+		t.Fatalf("expected No Data Available, got %v", pdu.Type())
+	}
+	if ready, _ := mirror.readiness(time.Now()); ready {
+		t.Error("expected the mirror not to be ready before its upstream synced")
+	}
+
+	// Once the upstream has synced the router is notified and gets the data
+	close(gated.open)
+	pdu, err = protocol.GetPDU(r)
+	if err != nil {
+		t.Fatalf("failed to read Serial Notify: %v", err)
+	}
+	if pdu.Type() != protocol.SerialNotify {
+		t.Fatalf("expected Serial Notify, got %v", pdu.Type())
+	}
+	if err := protocol.NewResetQueryPDU(1).Write(conn); err != nil {
+		t.Fatalf("failed to write Reset Query: %v", err)
+	}
+	var types []protocol.PDUType
+	for len(types) == 0 || types[len(types)-1] != protocol.EndOfData {
+		pdu, err := protocol.GetPDU(r)
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		types = append(types, pdu.Type())
+	}
+	if want := []protocol.PDUType{protocol.CacheResponse, protocol.Ipv4Prefix, protocol.EndOfData}; !slices.Equal(types, want) {
+		t.Errorf("got PDUs %v, want %v", types, want)
+	}
+}
@@ -5,85 +5,170 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/mellowdrifter/rpkirtr2/api/v1"
 	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"github.com/mellowdrifter/rpkirtr2/internal/logging"
+	"go.opentelemetry.io/otel/attribute"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
 	"google.golang.org/grpc/reflection"
 )
 
 type Server struct {
 	// large fields first
-	listener net.Listener
-	logger   *zap.SugaredLogger
-	cfg      *config.Config
-
-	clients    map[string]*Client
-	urls       []string
-	aspaURLs   []string
-	cache      *cache
-	httpClient *http.Client
+	listener  net.Listener
+	logger    *zap.SugaredLogger
+	clientLog *zap.SugaredLogger // logger with per-client sampling, see logging.Sampled
+	cfg       *config.Config     // replaced by Reload, see cfgMu
+
+	clients      map[string]*Client
+	urls         []string
+	aspaURLs     []string
+	upstreamCfgs []config.Upstream
+	rtrUpstreams []*rtrUpstream
+	cache        *cache
+	httpClient   *http.Client
+	rtrACL       *acl
+	grpcACL      *acl    // also applies to the HTTP gateway
+	views        []*view // fixed until restart, see view
+
+	// cfgMu guards cfg, urls, aspaURLs, upstreamCfgs, httpClient and the
+	// ACLs, which Reload replaces while refreshes may be running.
+	cfgMu    sync.RWMutex
+	reloadMu sync.Mutex // serialises Reload
+
+	upstreamClientsMu sync.Mutex
+	upstreamClients   map[string]*http.Client // per-upstream clients with custom settings
 
 	// sync types next
 	wg        sync.WaitGroup
 	clientsMu sync.RWMutex
 
+	// connsMu guards the count of RTR connections, in total and per source
+	// address, checked against the limits on accept.
+	connsMu    sync.Mutex
+	conns      int
+	connsPerIP map[netip.Addr]int
+
 	// smaller fields last
 	shuttingDown atomic.Bool
 	grpcServer   *grpc.Server
+	health       *health.Server // gRPC health service, see watchHealth
+	httpServer   *http.Server   // HTTP/JSON gateway, nil when disabled
 
 	upstreamsMu sync.RWMutex
 	upstreams   map[string]*UpstreamStatus
+	fetches     map[fetchKey]*UpstreamStatus // per kind of HTTP fetch, combined into upstreams
+	lastGood    map[string]upstreamData      // last successful fetch per HTTP upstream
+
+	// sourcesMu serialises cache rebuilds and guards fetched, the most
+	// recent data from all HTTP upstreams, and heldBack, set when a change
+	// was not applied because updates are paused.
+	sourcesMu sync.Mutex
+	fetched   upstreamData
+	heldBack  bool
+
+	watchersMu sync.Mutex
+	watchers   map[chan struct{}]struct{} // WatchUpdates streams
+
+	logLevel   *zap.AtomicLevel // set by SetAtomicLevel
+	paused     atomic.Bool      // automatic updates suspended
+	waitedRTR  atomic.Bool      // rtrStartupWait has passed, see checkLoaded
+	refreshNow chan struct{}    // wakes the updater to refresh immediately
+
+	overrides        *overrides
+	overridesChanged chan struct{} // wakes expireOverrides
+	audit            *auditLog     // nil when auditing is off
 
+	background       context.Context // ends with Stop, for background work
 	cancelBackground context.CancelFunc
 }
 
 type UpstreamStatus struct {
 	LastFetchSuccess bool
 	LastFetchTime    time.Time
+	LastSuccessTime  time.Time // last successful fetch or sync; zero if none yet
 	ErrorMessage     string
+	ROACount         int
+	ASPACount        int
+	RouterKeyCount   int
+	SessionID        uint16        // RTR upstreams only
+	Serial           uint32        // RTR upstreams only
+	RetryCount       int           // consecutive failed attempts
+	NextAttempt      time.Time     // scheduled retry after a failure; zero when healthy
+	FetchDuration    time.Duration // time taken by the last HTTP fetch
 }
 
 // New creates a new Server instance
 func New(cfg *config.Config, logger *zap.SugaredLogger) *Server {
-	return &Server{
-		logger:   logger,
-		cfg:      cfg,
-		clients:  make(map[string]*Client),
-		urls:     cfg.RPKIURLs,
-		aspaURLs: cfg.ASPAURLs,
-		cache:    newCache(),
-		wg:       sync.WaitGroup{},
+	s := &Server{
+		logger:    logger,
+		clientLog: logging.Sampled(logger, cfg.Logging.Sampling),
+		cfg:       cfg,
+		clients:   make(map[string]*Client),
+		urls:      cfg.RPKIURLs,
+		aspaURLs:  cfg.ASPAURLs,
+		cache:     newCache(),
+		wg:        sync.WaitGroup{},
 		httpClient: &http.Client{
-			Timeout: 1 * time.Minute,
+			Timeout: seconds(cfg.FetchTimeout, config.DefaultFetchTimeout),
 		},
+		rtrACL:    newACL(cfg.RTRACL),
+		grpcACL:   newACL(cfg.GRPCACL),
+		views:     newViews(cfg.Views),
 		upstreams: make(map[string]*UpstreamStatus),
+		fetches:   make(map[fetchKey]*UpstreamStatus),
+		lastGood:  make(map[string]upstreamData),
+
+		upstreamClients: make(map[string]*http.Client),
+		watchers:        make(map[chan struct{}]struct{}),
+		connsPerIP:      make(map[netip.Addr]int),
+		refreshNow:      make(chan struct{}, 1),
+		health:          health.NewServer(),
+
+		overrides:        &overrides{path: cfg.OverridesFile},
+		overridesChanged: make(chan struct{}, 1),
+		audit:            newAuditLog(cfg.Audit),
 	}
+	s.background, s.cancelBackground = context.WithCancel(context.Background())
+	for _, u := range cfg.Upstreams {
+		if u.IsRTR() {
+			s.rtrUpstreams = append(s.rtrUpstreams, newRTRUpstream(s, u.URL))
+		} else {
+			s.upstreamCfgs = append(s.upstreamCfgs, u)
+		}
+	}
+	s.cache.loading.Store(len(s.rtrUpstreams) > 0)
+	return s
 }
 
 // Start begins listening and accepting client connections
 func (s *Server) Start() error {
 	ctx := context.Background()
 
-	// Load initial ROAs and ASPAs before listening
-	roas, err := s.loadROAs(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to load initial ROAs: %w", err)
+	if err := s.overrides.load(); err != nil {
+		return err
 	}
-	aspas, err := s.loadASPAs(ctx)
+
+	// Load initial ROAs, ASPAs and router keys before listening
+	loadCtx, span := startSpan(ctx, "refresh", attribute.Bool("refresh.initial", true))
+	roas, aspas, keys, err := s.loadAll(loadCtx, nil)
 	if err != nil {
-		s.logger.Warnf("failed to load initial ASPAs: %v", err)
+		endSpan(span, err)
+		return fmt.Errorf("failed to load initial ROAs: %w", err)
 	}
+	s.sourcesMu.Lock()
+	s.fetched = upstreamData{roas: roas, aspas: aspas, routerKeys: keys}
+	roas, aspas, keys = s.mergeSources(loadCtx)
+	s.sourcesMu.Unlock()
+	span.End()
 
-	s.lock()
-	s.cache.replaceRoas(roas)
-	s.cache.replaceAspas(aspas)
-	s.unlock()
-	s.logger.Infof("Loaded %d initial ROAs and %d initial ASPAs", s.cache.count(), len(aspas))
+	s.loadInitial(ctx, roas, aspas, keys)
 
 	l, err := net.Listen("tcp", s.cfg.ListenAddr)
 	if err != nil {
@@ -91,36 +176,81 @@ func (s *Server) Start() error {
 	}
 
 	// Start gRPC server
-	grpcListener, err := net.Listen("tcp", s.cfg.GRPCAddr)
+	s.grpcServer, err = s.newGRPCServer()
+	if err != nil {
+		return err
+	}
+	grpcListener, err := listenGRPC(s.cfg.GRPCAddr)
 	if err != nil {
 		return fmt.Errorf("failed to listen on gRPC address %s: %w", s.cfg.GRPCAddr, err)
 	}
-	s.grpcServer = grpc.NewServer()
-	rpkirtripb.RegisterRPKIRTRServiceServer(s.grpcServer, &grpcServer{srv: s})
+	grpcListener = aclListener{Listener: grpcListener, s: s, name: listenerGRPC}
 	reflection.Register(s.grpcServer)
 
 	go func() {
-		s.logger.Infof("gRPC Stats API listening on %s", s.cfg.GRPCAddr)
+		s.logger.Infow("gRPC Stats API listening", "addr", s.cfg.GRPCAddr)
 		if err := s.grpcServer.Serve(grpcListener); err != nil && !s.shuttingDown.Load() {
-			s.logger.Errorf("gRPC server error: %v", err)
+			s.logger.Errorw("gRPC server error", "error", err)
 		}
 	}()
 
+	if s.cfg.HTTPAddr != "" {
+		if err := s.startGateway(); err != nil {
+			return err
+		}
+	}
+
 	return s.ServeListener(l)
 }
 
+// loadInitial fills the empty cache with the data loaded at startup, after
+// local overrides and compression, and records it in the audit log.
+func (s *Server) loadInitial(ctx context.Context, roas []ROA, aspas []ASPA, keys []RouterKey) {
+	input := upstreamData{roas: roas, aspas: aspas, routerKeys: keys}
+	roas, aspas = s.overrides.active(time.Now()).apply(roas, aspas)
+	roas, compressed := s.compress(roas)
+
+	s.lock()
+	s.cache.input = input
+	s.cache.compressed = compressed
+	s.cache.replaceRoas(roas)
+	s.cache.replaceAspas(aspas)
+	s.cache.replaceRouterKeys(keys)
+	serial, session := s.cache.serial, s.cache.session
+	s.unlock()
+	s.logger.Infow("Loaded initial data", "roas", s.cache.count(), "aspas", len(aspas), "router_keys", len(keys), "vrps_compressed", compressed)
+	s.recordAudit(ctx, auditRecord{
+		auditHeader: auditHeader{Time: time.Now(), Type: auditSnapshot, Session: session, FromSerial: serial, Serial: serial, Source: auditStartup},
+		Announced:   newAuditObjects(roas, aspas, keys),
+	})
+}
+
 // ServeListener starts the server using the provided listener.
 func (s *Server) ServeListener(l net.Listener) error {
-	ctx, cancel := context.WithCancel(context.Background())
-	s.cancelBackground = cancel
-
+	ctx := s.background
 	s.listener = l
-	s.logger.Infof("Daemon running with session id %d", s.getSession())
+	s.logger.Infow("Daemon running", "session", s.getSession(), "serial", s.getSerial())
 
 	// Start background update ticker
 	s.wg.Add(1)
 	go s.periodicROAUpdater(ctx)
 
+	s.wg.Add(1)
+	go s.expireOverrides(ctx)
+
+	s.wg.Add(1)
+	go s.watchHealth(ctx)
+
+	// Mirror any upstream RTR caches
+	for _, u := range s.rtrUpstreams {
+		s.wg.Add(1)
+		go u.run(ctx)
+	}
+	if s.cache.loading.Load() {
+		s.wg.Add(1)
+		go s.waitForRTRUpstreams(ctx)
+	}
+
 	// Listen for clients
 	for {
 		conn, err := s.listener.Accept()
@@ -128,7 +258,10 @@ func (s *Server) ServeListener(l net.Listener) error {
 			if s.shuttingDown.Load() {
 				return nil // graceful exit
 			}
-			s.logger.Errorf("accept error: %v", err)
+			s.logger.Errorw("Accept error", "error", err)
+			continue
+		}
+		if !s.admit(conn, listenerRTR) {
 			continue
 		}
 
@@ -140,44 +273,56 @@ func (s *Server) ServeListener(l net.Listener) error {
 // handleConnection handles a new client
 func (s *Server) handleConnection(conn net.Conn) {
 	defer s.wg.Done()
+	defer s.releaseConn(conn.RemoteAddr())
 	defer conn.Close()
 
-	client := NewClient(conn, s.logger, s.cache)
+	client := NewClient(conn, s.clientLog, s.cache)
+	s.applyLimits(client)
+	if v := s.viewFor(conn.RemoteAddr()); v != nil {
+		client.view = v
+		client.logger = client.logger.With("view", v.name)
+	}
 	id := client.ID()
 	s.clientsMu.Lock()
 	s.clients[id] = client
 	s.clientsMu.Unlock()
 
-	s.logger.Infof("Client connected: %s", id)
+	s.logger.Infow("Client connected", "client", id)
 
 	if err := client.Handle(); err != nil {
-		s.logger.Warnf("Client %s error: %v", id, err)
+		s.logger.Warnw("Client error", "client", id, "error", err)
 	}
 
 	s.clientsMu.Lock()
 	delete(s.clients, id)
 	s.clientsMu.Unlock()
 
-	s.logger.Infof("Client disconnected: %s", id)
+	s.logger.Infow("Client disconnected", "client", id)
 }
 
 // Stop shuts down the server gracefully
 func (s *Server) Stop(timeout time.Duration) error {
 	s.shuttingDown.Store(true)
+	s.health.Shutdown()
 
-	if s.cancelBackground != nil {
-		s.cancelBackground()
-	}
+	s.cancelBackground()
 
 	s.logger.Info("Shutting down listener...")
 	if s.listener != nil {
 		_ = s.listener.Close()
 	}
 
+	s.closeWatchers()
 	if s.grpcServer != nil {
 		s.logger.Info("Stopping gRPC server...")
 		s.grpcServer.GracefulStop()
 	}
+	if s.httpServer != nil {
+		s.logger.Info("Stopping HTTP gateway...")
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		_ = s.httpServer.Shutdown(ctx)
+		cancel()
+	}
 
 	// Close all client connections
 	s.clientsMu.Lock()
@@ -195,6 +340,11 @@ func (s *Server) Stop(timeout time.Duration) error {
 	select {
 	case <-done:
 		s.logger.Info("All connections closed cleanly")
+		if s.audit != nil {
+			if err := s.audit.close(); err != nil {
+				s.logger.Errorw("Failed to close audit log", "error", err)
+			}
+		}
 		return nil
 	case <-time.After(timeout):
 		s.logger.Warn("Shutdown timed out; some clients may still be active")
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gortrMetadata is the metadata block of a GoRTR / OctoRPKI signed feed.
+// Field order and tags must match GoRTR's prefixfile package, as the
+// signature covers the re-marshalled document.
+type gortrMetadata struct {
+	Counts        int    `json:"counts"`
+	Generated     int    `json:"generated"`
+	Valid         int    `json:"valid,omitempty"`
+	Signature     string `json:"signature,omitempty"`
+	SignatureDate string `json:"signatureDate,omitempty"`
+}
+
+type gortrROA struct {
+	Prefix string      `json:"prefix"`
+	Length uint8       `json:"maxLength"`
+	ASN    interface{} `json:"asn"`
+	TA     string      `json:"ta,omitempty"`
+}
+
+type gortrList struct {
+	Metadata gortrMetadata `json:"metadata,omitempty"`
+	Data     []gortrROA    `json:"roas"`
+}
+
+// digest returns the SHA-256 hash GoRTR signs: the document without its signature.
+func (l *gortrList) digest() ([]byte, error) {
+	unsigned := gortrList{
+		Metadata: gortrMetadata{
+			Counts:        l.Metadata.Counts,
+			Generated:     l.Metadata.Generated,
+			Valid:         l.Metadata.Valid,
+			SignatureDate: l.Metadata.SignatureDate,
+		},
+		Data: l.Data,
+	}
+	b, err := json.Marshal(unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialise document: %w", err)
+	}
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
+
+// verify checks the document signature and validity against the given key.
+func (l *gortrList) verify(key *ecdsa.PublicKey, now time.Time) error {
+	if l.Metadata.Signature == "" {
+		return errors.New("document is not signed")
+	}
+	sig, err := hex.DecodeString(l.Metadata.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+	digest, err := l.digest()
+	if err != nil {
+		return err
+	}
+	if !ecdsa.VerifyASN1(key, digest, sig) {
+		return errors.New("invalid signature")
+	}
+	if l.Metadata.Valid != 0 && now.Unix() > int64(l.Metadata.Valid) {
+		return fmt.Errorf("signed document expired at %s", time.Unix(int64(l.Metadata.Valid), 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (r gortrROA) toROA() (ROA, error) {
+	prefix, err := netip.ParsePrefix(r.Prefix)
+	if err != nil {
+		return ROA{}, fmt.Errorf("invalid prefix %q: %w", r.Prefix, err)
+	}
+	var asn uint64
+	switch v := r.ASN.(type) {
+	case float64:
+		asn = uint64(v)
+	case string:
+		asn, err = strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(v), "AS"), 10, 32)
+		if err != nil {
+			return ROA{}, fmt.Errorf("invalid asn %q: %w", v, err)
+		}
+	default:
+		return ROA{}, fmt.Errorf("invalid asn %v", r.ASN)
+	}
+	return ROA{Prefix: prefix, ASN: uint32(asn), MaxMask: r.Length}, nil
+}
+
+// signedGoRTRDecoder returns a decoder which refuses GoRTR documents that are
+// unsigned, badly signed or past their validity. Unlike decodeRPKIJSON the
+// whole document is held in memory, as the signature covers all of it.
+func signedGoRTRDecoder(key *ecdsa.PublicKey) upstreamDecoder {
+	return func(r io.Reader) (upstreamData, error) {
+		var list gortrList
+		if err := json.NewDecoder(r).Decode(&list); err != nil {
+			return upstreamData{}, fmt.Errorf("failed to decode signed document: %w", err)
+		}
+		if err := list.verify(key, time.Now()); err != nil {
+			return upstreamData{}, fmt.Errorf("signature verification failed: %w", err)
+		}
+
+		data := upstreamData{roas: make([]ROA, 0, len(list.Data))}
+		for _, r := range list.Data {
+			roa, err := r.toROA()
+			if err != nil {
+				return upstreamData{}, err
+			}
+			data.roas = append(data.roas, roa)
+		}
+		return data, nil
+	}
+}
+
+// loadVerifyKey reads a PEM encoded ECDSA public key, as used by GoRTR's -verify.key.
+func loadVerifyKey(path string) (*ecdsa.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read verify key: %w", err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in verify key %s", path)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse verify key: %w", err)
+	}
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("verify key %s is not an ECDSA public key", path)
+	}
+	return key, nil
+}
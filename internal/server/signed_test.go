@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"go.uber.org/zap"
+)
+
+func newTestSigningKey(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "verify.pub")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	return priv, path
+}
+
+// signTestList signs the list the way OctoRPKI does and returns the JSON document.
+func signTestList(t *testing.T, priv *ecdsa.PrivateKey, list gortrList) string {
+	t.Helper()
+	list.Metadata.SignatureDate = time.Now().UTC().Format(time.RFC3339)
+	digest, err := list.digest()
+	if err != nil {
+		t.Fatalf("digest failed: %v", err)
+	}
+	sig, err := ecdsa.SignASN1(rand.Reader, priv, digest)
+	if err != nil {
+		t.Fatalf("sign failed: %v", err)
+	}
+	list.Metadata.Signature = hex.EncodeToString(sig)
+	b, err := json.Marshal(list)
+	if err != nil {
+		t.Fatalf("marshal failed: %v", err)
+	}
+	return string(b)
+}
+
+func testGoRTRList() gortrList {
+	return gortrList{
+		Metadata: gortrMetadata{Counts: 2, Generated: int(time.Now().Unix()), Valid: int(time.Now().Add(time.Hour).Unix())},
+		Data: []gortrROA{
+			{Prefix: "1.1.1.0/24", Length: 24, ASN: "AS13335", TA: "apnic"},
+			{Prefix: "2001:db8::/32", Length: 48, ASN: float64(64496), TA: "ripe"},
+		},
+	}
+}
+
+func TestSignedGoRTRDecoder(t *testing.T) {
+	priv, path := newTestSigningKey(t)
+	key, err := loadVerifyKey(path)
+	if err != nil {
+		t.Fatalf("loadVerifyKey failed: %v", err)
+	}
+	other, _ := newTestSigningKey(t)
+
+	expired := testGoRTRList()
+	expired.Metadata.Valid = int(time.Now().Add(-time.Hour).Unix())
+
+	signed := signTestList(t, priv, testGoRTRList())
+	tests := []struct {
+		name    string
+		doc     string
+		wantErr string
+	}{
+		{name: "valid", doc: signed},
+		{name: "unsigned", doc: `{"metadata": {"counts": 0, "generated": 1}, "roas": []}`, wantErr: "not signed"},
+		{name: "tampered", doc: strings.Replace(signed, "13335", "64511", 1), wantErr: "invalid signature"},
+		{name: "wrong key", doc: signTestList(t, other, testGoRTRList()), wantErr: "invalid signature"},
+		{name: "bad encoding", doc: `{"metadata": {"signature": "zz"}, "roas": []}`, wantErr: "invalid signature encoding"},
+		{name: "expired", doc: signTestList(t, priv, expired), wantErr: "expired"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := signedGoRTRDecoder(key)(strings.NewReader(tt.doc))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Expected error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(data.roas) != 2 || data.roas[0].ASN != 13335 || data.roas[1].ASN != 64496 || data.roas[1].MaxMask != 48 {
+				t.Errorf("Unexpected ROAs: %+v", data.roas)
+			}
+		})
+	}
+}
+
+// TestSignedGoRTRFixture verifies a checked-in document, signed outside this
+// package by testdata/gensigned.go, so that the test does not rest on the
+// digest computed by the verifier itself.
+func TestSignedGoRTRFixture(t *testing.T) {
+	key, err := loadVerifyKey(filepath.Join("testdata", "gortr-signed.pub"))
+	if err != nil {
+		t.Fatalf("loadVerifyKey failed: %v", err)
+	}
+	doc, err := os.ReadFile(filepath.Join("testdata", "gortr-signed.json"))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+
+	data, err := signedGoRTRDecoder(key)(bytes.NewReader(doc))
+	if err != nil {
+		t.Fatalf("fixture refused: %v", err)
+	}
+	want := []ROA{
+		{Prefix: netip.MustParsePrefix("1.1.1.0/24"), ASN: 13335, MaxMask: 24},
+		{Prefix: netip.MustParsePrefix("192.0.2.0/24"), ASN: 64496, MaxMask: 28},
+		{Prefix: netip.MustParsePrefix("2001:db8::/32"), ASN: 64497, MaxMask: 48},
+	}
+	if !slices.Equal(data.roas, want) {
+		t.Errorf("got ROAs %+v, want %+v", data.roas, want)
+	}
+
+	// The signature covers the content, not the layout of the document
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, doc); err != nil {
+		t.Fatalf("failed to compact fixture: %v", err)
+	}
+	if _, err := signedGoRTRDecoder(key)(&compact); err != nil {
+		t.Errorf("compacted fixture refused: %v", err)
+	}
+
+	tampered := bytes.Replace(doc, []byte(`"maxLength": 28`), []byte(`"maxLength": 32`), 1)
+	if _, err := signedGoRTRDecoder(key)(bytes.NewReader(tampered)); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Errorf("expected the tampered fixture to be refused, got %v", err)
+	}
+}
+
+func TestSignedUpstreamRefusal(t *testing.T) {
+	priv, path := newTestSigningKey(t)
+	var body atomic.Value
+	body.Store(signTestList(t, priv, testGoRTRList()))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body.Load().(string)))
+	}))
+	defer ts.Close()
+
+	cfg := &config.Config{
+		Upstreams: []config.Upstream{{URL: ts.URL, Format: config.FormatGoRTR, VerifyKey: path}},
+	}
+	srv := New(cfg, zap.NewNop().Sugar())
+
+	if err := srv.TriggerRefresh(context.Background()); err != nil {
+		t.Fatalf("TriggerRefresh failed: %v", err)
+	}
+	if got := len(srv.cache.getState().roas); got != 2 {
+		t.Fatalf("Expected 2 ROAs from the signed feed, got %d", got)
+	}
+
+	// Unsigned data must be refused and the previous data kept.
+	body.Store(`{"metadata": {"counts": 1, "generated": 1}, "roas": [{"prefix": "9.9.9.0/24", "maxLength": 24, "asn": 19281}]}`)
+	if err := srv.TriggerRefresh(context.Background()); err == nil {
+		t.Error("Expected refresh to fail for an unsigned document")
+	}
+	if got := len(srv.cache.getState().roas); got != 2 {
+		t.Errorf("Expected previous 2 ROAs to be kept, got %d", got)
+	}
+
+	srv.upstreamsMu.RLock()
+	stats := *srv.upstreams[ts.URL]
+	srv.upstreamsMu.RUnlock()
+	if stats.LastFetchSuccess || !strings.Contains(stats.ErrorMessage, "not signed") {
+		t.Errorf("Expected refusal in upstream status, got %+v", stats)
+	}
+}
+
+func TestFailedUpstreamKeepsLastGood(t *testing.T) {
+	var fail atomic.Bool
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"roas": [{"prefix": "9.9.9.0/24", "maxLength": 24, "asn": 19281}]}`))
+	}))
+	defer flaky.Close()
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testRPKIClientJSON))
+	}))
+	defer stable.Close()
+
+	cfg := &config.Config{
+		Upstreams: []config.Upstream{{URL: flaky.URL}, {URL: stable.URL}},
+	}
+	srv := New(cfg, zap.NewNop().Sugar())
+
+	if err := srv.TriggerRefresh(context.Background()); err != nil {
+		t.Fatalf("TriggerRefresh failed: %v", err)
+	}
+	fail.Store(true)
+	if err := srv.TriggerRefresh(context.Background()); err != nil {
+		t.Fatalf("TriggerRefresh failed: %v", err)
+	}
+	if got := len(srv.cache.getState().roas); got != 3 {
+		t.Errorf("Expected the failed upstream's previous ROA to be kept, got %d ROAs", got)
+	}
+}
@@ -0,0 +1,92 @@
+//go:build ignore
+
+// gensigned writes gortr-signed.json and gortr-signed.pub, a signed GoRTR
+// document and the key to verify it, for TestSignedGoRTRFixture.
+//
+// It signs the way GoRTR's prefixfile package does, independently of the
+// verifier in signed.go: the SHA-256 digest of the document marshalled with
+// an empty signature, signed with ECDSA P-256 and hex encoded as ASN.1. The
+// structs below copy the layout of prefixfile.ROAList. A document signed by
+// OctoRPKI itself can replace the output, together with its public key.
+//
+//	go run gensigned.go
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"log"
+	"os"
+)
+
+type ROAJson struct {
+	Prefix string      `json:"prefix"`
+	Length uint8       `json:"maxLength"`
+	ASN    interface{} `json:"asn"`
+	TA     string      `json:"ta,omitempty"`
+}
+
+type MetaData struct {
+	Counts        int    `json:"counts"`
+	Generated     int    `json:"generated"`
+	Valid         int    `json:"valid,omitempty"`
+	Signature     string `json:"signature,omitempty"`
+	SignatureDate string `json:"signatureDate,omitempty"`
+}
+
+type ROAList struct {
+	Metadata MetaData  `json:"metadata,omitempty"`
+	Data     []ROAJson `json:"roas"`
+}
+
+func main() {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	list := ROAList{
+		Metadata: MetaData{
+			Counts:        3,
+			Generated:     1735689600,
+			Valid:         4102444800, // far enough ahead for the test to use the real clock
+			SignatureDate: "2025-01-01T00:00:00Z",
+		},
+		Data: []ROAJson{
+			{Prefix: "1.1.1.0/24", Length: 24, ASN: "AS13335", TA: "apnic"},
+			{Prefix: "192.0.2.0/24", Length: 28, ASN: "AS64496", TA: "ripe"},
+			{Prefix: "2001:db8::/32", Length: 48, ASN: "AS64497", TA: "arin"},
+		},
+	}
+	unsigned, err := json.Marshal(list)
+	if err != nil {
+		log.Fatal(err)
+	}
+	digest := sha256.Sum256(unsigned)
+	sig, err := ecdsa.SignASN1(rand.Reader, priv, digest[:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	list.Metadata.Signature = hex.EncodeToString(sig)
+
+	doc, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("gortr-signed.json", append(doc, '\n'), 0o644); err != nil {
+		log.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile("gortr-signed.pub", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/mellowdrifter/rpkirtr2/internal/server"
+
+// startSpan starts a span with the global tracer provider, which is a no-op
+// unless tracing is configured. The provider is looked up on every call so
+// that it can be installed after the server is created.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends span, marking it failed if err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		failSpan(span, err)
+	}
+	span.End()
+}
+
+// failSpan records err on span and marks it failed.
+func failSpan(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(otelcodes.Error, err.Error())
+}
+
+// fetchDocument sends req and decodes the response body. The wait for the
+// response headers and the decode are traced separately; the body is
+// streamed, so the decode span includes reading it from the network.
+func fetchDocument[T any](client *http.Client, req *http.Request, url string, decode func(io.Reader) (T, error)) (T, error) {
+	var zero T
+	ctx := req.Context()
+
+	_, span := startSpan(ctx, "upstream.request")
+	resp, err := client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("http request error: %w", err)
+		endSpan(span, err)
+		return zero, err
+	}
+	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("unexpected HTTP status: %s", resp.Status)
+		endSpan(span, err)
+		return zero, err
+	}
+	span.End()
+
+	_, span = startSpan(ctx, "upstream.decode")
+	v, err := decode(observeUpstreamBody(url, resp.Body))
+	endSpan(span, err)
+	return v, err
+}
+
+// dataAttributes describes a set of objects on a span.
+func dataAttributes(roas []ROA, aspas []ASPA, keys []RouterKey) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int("rpki.vrps", len(roas)),
+		attribute.Int("rpki.aspas", len(aspas)),
+		attribute.Int("rpki.router_keys", len(keys)),
+	}
+}
+
+// diffAttributes describes a diff on a span.
+func diffAttributes(d diffSet) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.Int("rpki.vrps.announced", len(d.addRoa)),
+		attribute.Int("rpki.vrps.withdrawn", len(d.delRoa)),
+		attribute.Int("rpki.aspas.announced", len(d.addAspa)),
+		attribute.Int("rpki.aspas.withdrawn", len(d.delAspa)),
+		attribute.Int("rpki.router_keys.announced", len(d.addKeys)),
+		attribute.Int("rpki.router_keys.withdrawn", len(d.delKeys)),
+	}
+}
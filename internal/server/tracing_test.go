@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"github.com/mellowdrifter/rpkirtr2/internal/protocol"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"go.uber.org/zap"
+)
+
+// recordSpans installs a tracer provider recording every span until the test ends.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	rec := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+	return rec
+}
+
+// spansByName indexes ended spans by name, keeping the last of each.
+func spansByName(rec *tracetest.SpanRecorder) map[string]sdktrace.ReadOnlySpan {
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range rec.Ended() {
+		spans[s.Name()] = s
+	}
+	return spans
+}
+
+func spanAttr(s sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range s.Attributes() {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+// checkParents verifies that each span in children was started under parent.
+func checkParents(t *testing.T, spans map[string]sdktrace.ReadOnlySpan, parent string, children ...string) {
+	t.Helper()
+	p, ok := spans[parent]
+	if !ok {
+		t.Fatalf("Expected a %s span, got %v", parent, spans)
+	}
+	for _, name := range children {
+		c, ok := spans[name]
+		if !ok {
+			t.Errorf("Expected a %s span", name)
+			continue
+		}
+		if c.Parent().SpanID() != p.SpanContext().SpanID() {
+			t.Errorf("Expected %s to be a child of %s", name, parent)
+		}
+	}
+}
+
+func TestRefreshTracing(t *testing.T) {
+	rec := recordSpans(t)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testRPKIClientJSON))
+	}))
+	defer ts.Close()
+
+	srv := New(&config.Config{Upstreams: []config.Upstream{{URL: ts.URL}}}, zap.NewNop().Sugar())
+	if err := srv.TriggerRefresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := spansByName(rec)
+	checkParents(t, spans, "refresh", "refresh.load", "refresh.validate", "refresh.merge", "cache.update")
+	checkParents(t, spans, "refresh.load", "upstream.fetch")
+	checkParents(t, spans, "upstream.fetch", "upstream.request", "upstream.decode")
+	checkParents(t, spans, "cache.update", "cache.diff", "cache.notify")
+
+	if v, _ := spanAttr(spans["upstream.fetch"], "upstream.url"); v.AsString() != ts.URL {
+		t.Errorf("Expected the upstream URL on the fetch span, got %q", v.AsString())
+	}
+	state := srv.cache.getState()
+	if v, _ := spanAttr(spans["cache.diff"], "rpki.vrps.announced"); v.AsInt64() != int64(len(state.roas)) {
+		t.Errorf("Expected %d announced VRPs on the diff span, got %d", len(state.roas), v.AsInt64())
+	}
+	if spans["refresh"].Status().Code == otelcodes.Error {
+		t.Error("Expected a successful refresh span")
+	}
+
+	// Failures are recorded on the spans
+	ts.Close()
+	if err := srv.TriggerRefresh(context.Background()); err == nil {
+		t.Fatal("Expected the refresh to fail once the upstream is gone")
+	}
+	spans = spansByName(rec)
+	for _, name := range []string{"refresh", "upstream.fetch", "upstream.request"} {
+		if spans[name].Status().Code != otelcodes.Error {
+			t.Errorf("Expected %s to be marked failed", name)
+		}
+	}
+}
+
+func TestClientQueryTracing(t *testing.T) {
+	rec := recordSpans(t)
+	srv := New(&config.Config{}, zap.NewNop().Sugar())
+	srv.UpdateROAs([]ROA{{Prefix: netip.MustParsePrefix("192.0.2.0/24"), ASN: 64496, MaxMask: 24}})
+	srv.UpdateROAs([]ROA{
+		{Prefix: netip.MustParsePrefix("192.0.2.0/24"), ASN: 64496, MaxMask: 24},
+		{Prefix: netip.MustParsePrefix("198.51.100.0/24"), ASN: 64496, MaxMask: 24},
+	})
+	state := srv.cache.getState()
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go io.Copy(io.Discard, clientConn)
+	client := NewClient(serverConn, zap.NewNop().Sugar(), srv.cache)
+	client.setVersion(2)
+
+	if err := client.dispatchPDU(protocol.NewResetQueryPDU(2)); err != nil {
+		t.Fatal(err)
+	}
+	spans := spansByName(rec)
+	checkParents(t, spans, "rtr.reset_query", "rtr.write")
+	if v, _ := spanAttr(spans["rtr.reset_query"], "rtr.response"); v.AsString() != "full" {
+		t.Errorf("Expected a full response, got %q", v.AsString())
+	}
+
+	if err := client.dispatchPDU(protocol.NewSerialQueryPDU(2, state.session, state.serial-1)); err != nil {
+		t.Fatal(err)
+	}
+	spans = spansByName(rec)
+	checkParents(t, spans, "rtr.serial_query", "rtr.diff", "rtr.write")
+	query := spans["rtr.serial_query"]
+	if v, _ := spanAttr(query, "rtr.response"); v.AsString() != "diff" {
+		t.Errorf("Expected a diff response, got %q", v.AsString())
+	}
+	if v, _ := spanAttr(query, "rtr.serial"); v.AsInt64() != int64(state.serial-1) {
+		t.Errorf("Expected the requested serial %d, got %d", state.serial-1, v.AsInt64())
+	}
+	if v, _ := spanAttr(spans["rtr.diff"], "rpki.vrps.announced"); v.AsInt64() != 1 {
+		t.Errorf("Expected 1 announced VRP on the diff span, got %d", v.AsInt64())
+	}
+
+	if err := client.dispatchPDU(protocol.NewSerialQueryPDU(2, state.session+1, state.serial)); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := spanAttr(spansByName(rec)["rtr.serial_query"], "rtr.response"); v.AsString() != "cache_reset" {
+		t.Errorf("Expected a Cache Reset for another session, got %q", v.AsString())
+	}
+}
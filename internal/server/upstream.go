@@ -0,0 +1,306 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// upstreamData holds every object type extracted from a single upstream document.
+type upstreamData struct {
+	roas       []ROA
+	aspas      []ASPA
+	routerKeys []RouterKey
+}
+
+func (s *Server) fetchUpstream(ctx context.Context, u config.Upstream) (upstreamData, error) {
+	decode, err := decoderFor(u.Format)
+	if err != nil {
+		return upstreamData{}, err
+	}
+	if u.VerifyKey != "" {
+		// The key is read on every fetch so it can be rotated without a restart
+		key, err := loadVerifyKey(u.VerifyKey)
+		if err != nil {
+			return upstreamData{}, err
+		}
+		decode = signedGoRTRDecoder(key)
+	}
+
+	client, err := s.upstreamClient(u)
+	if err != nil {
+		return upstreamData{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.URL, nil)
+	if err != nil {
+		return upstreamData{}, fmt.Errorf("failed to create request: %w", err)
+	}
+	for k, v := range u.Headers {
+		req.Header.Set(k, v)
+	}
+
+	return fetchDocument(client, req, u.URL, decode)
+}
+
+// decodeRPKIJSON streams a combined validator document, as published by
+// rpki-client's json output, and extracts the "roas", "aspas" and
+// "bgpsec_keys" arrays in a single pass. Unknown keys are skipped.
+// Routinator jsonext ("routerKeys", per-object "source") and GoRTR style
+// documents share the same layout and are handled here as well.
+func decodeRPKIJSON(r io.Reader) (upstreamData, error) {
+	var data upstreamData
+	dec := json.NewDecoder(r)
+
+	t, err := dec.Token()
+	if err != nil {
+		return data, fmt.Errorf("failed to read start of JSON: %w", err)
+	}
+	if t != json.Delim('{') {
+		return data, fmt.Errorf("expected '{', got %v", t)
+	}
+
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return data, fmt.Errorf("failed to read token: %w", err)
+		}
+		key, ok := t.(string)
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "roas":
+			data.roas = make([]ROA, 0, 500_000)
+			err = decodeArray(dec, key, func() error {
+				var r JSONROA
+				if err := dec.Decode(&r); err != nil {
+					return fmt.Errorf("failed to decode roa: %w", err)
+				}
+				data.roas = append(data.roas, r.toROA())
+				return nil
+			})
+		case "aspas", "aspa":
+			err = decodeArray(dec, key, func() error {
+				var a JSONASPA
+				if err := dec.Decode(&a); err != nil {
+					return fmt.Errorf("failed to decode aspa: %w", err)
+				}
+				data.aspas = append(data.aspas, a.toASPA())
+				return nil
+			})
+		case "bgpsec_keys", "routerKeys":
+			err = decodeArray(dec, key, func() error {
+				var k JSONRouterKey
+				if err := dec.Decode(&k); err != nil {
+					return fmt.Errorf("failed to decode router key: %w", err)
+				}
+				rk, err := k.toRouterKey()
+				if err != nil {
+					return fmt.Errorf("failed to decode router key: %w", err)
+				}
+				data.routerKeys = append(data.routerKeys, rk)
+				return nil
+			})
+		default:
+			// Skip this key's value to stay in sync
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return data, fmt.Errorf("failed to skip value for key %q: %w", key, err)
+			}
+		}
+		if err != nil {
+			return data, err
+		}
+	}
+
+	return data, nil
+}
+
+// decodeArray consumes a JSON array, calling elem once per element.
+func decodeArray(dec *json.Decoder, key string, elem func() error) error {
+	t, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("failed to read start of %s array: %w", key, err)
+	}
+	if t != json.Delim('[') {
+		return fmt.Errorf("expected '[' for %s, got %v", key, t)
+	}
+	for dec.More() {
+		if err := elem(); err != nil {
+			return err
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("failed to read end of %s array: %w", key, err)
+	}
+	return nil
+}
+
+// loadUpstreams fetches the unified upstreams selected by round, or all of them
+// if round is nil, concurrently. An upstream that fails, including one whose
+// signature is refused, or that is not fetched contributes the data from its
+// last successful fetch. If every fetch fails, an error is returned along with
+// the data the upstreams last provided.
+func (s *Server) loadUpstreams(ctx context.Context, round *fetchRound) (upstreamData, error) {
+	_, _, upstreams := s.httpSources()
+	if len(upstreams) == 0 {
+		return upstreamData{}, nil
+	}
+
+	var wg sync.WaitGroup
+	dataCh := make(chan upstreamData, len(upstreams))
+	errsCh := make(chan error, len(upstreams))
+	prevCh := make(chan upstreamData, len(upstreams))
+
+	fetch := func(u config.Upstream) {
+		defer wg.Done()
+		url := u.URL
+		s.logger.Debugw("Fetching upstream", "upstream", url)
+		ctx, span := startSpan(ctx, "upstream.fetch", attribute.String("upstream.url", url))
+		start := time.Now()
+		data, err := s.fetchUpstream(ctx, u)
+		span.SetAttributes(dataAttributes(data.roas, data.aspas, data.routerKeys)...)
+		endSpan(span, err)
+
+		s.upstreamsMu.Lock()
+		stats := &UpstreamStatus{
+			LastFetchTime: time.Now(),
+			FetchDuration: time.Since(start),
+		}
+		if err != nil {
+			errsCh <- fmt.Errorf("%s: %w", url, err)
+			if prev, ok := s.lastGood[url]; ok {
+				prevCh <- prev
+			}
+		} else {
+			stats.ROACount = len(data.roas)
+			stats.ASPACount = len(data.aspas)
+			stats.RouterKeyCount = len(data.routerKeys)
+			data = data.normalise()
+			if !data.equal(s.lastGood[url]) {
+				round.record(url)
+			}
+			s.lastGood[url] = data
+			dataCh <- data
+		}
+		s.recordFetch(url, fetchUnified, stats, err)
+		s.upstreamsMu.Unlock()
+
+		if err != nil {
+			s.logger.Errorw("Failed to fetch upstream", "upstream", url, "error", err)
+		} else {
+			s.logger.Debugw("Upstream retrieved", "upstream", url, "roas", len(data.roas), "aspas", len(data.aspas), "router_keys", len(data.routerKeys))
+		}
+	}
+
+	attempted := 0
+	for _, u := range upstreams {
+		if !round.fetches(u.URL) {
+			if prev, ok := s.previous(u.URL); ok {
+				prevCh <- prev
+			}
+			continue
+		}
+		attempted++
+		wg.Add(1)
+		go fetch(u)
+	}
+	wg.Wait()
+	close(dataCh)
+	close(errsCh)
+	close(prevCh)
+
+	var lastErr error
+	for err := range errsCh {
+		lastErr = err
+	}
+
+	var combined upstreamData
+	fetched := 0
+	for d := range dataCh {
+		fetched++
+		combined.roas = append(combined.roas, d.roas...)
+		combined.aspas = append(combined.aspas, d.aspas...)
+		combined.routerKeys = append(combined.routerKeys, d.routerKeys...)
+	}
+
+	for d := range prevCh {
+		combined.roas = append(combined.roas, d.roas...)
+		combined.aspas = append(combined.aspas, d.aspas...)
+		combined.routerKeys = append(combined.routerKeys, d.routerKeys...)
+	}
+
+	if fetched == 0 && attempted > 0 {
+		return combined, fmt.Errorf("failed to fetch any configured upstream: %w", lastErr)
+	}
+	return combined, nil
+}
+
+// previous returns the data from the last successful fetch of url.
+func (s *Server) previous(url string) (upstreamData, bool) {
+	s.upstreamsMu.RLock()
+	defer s.upstreamsMu.RUnlock()
+	d, ok := s.lastGood[url]
+	return d, ok
+}
+
+// normalise sorts and deduplicates d in place, so that two fetches of an
+// upstream can be compared.
+func (d upstreamData) normalise() upstreamData {
+	return upstreamData{
+		roas:       GetSetOfValidatedROAs(d.roas),
+		aspas:      DeduplicateASPAsInPlace(d.aspas),
+		routerKeys: DeduplicateRouterKeysInPlace(d.routerKeys),
+	}
+}
+
+// equal reports whether two normalised fetches hold the same objects.
+func (d upstreamData) equal(other upstreamData) bool {
+	return slices.Equal(d.roas, other.roas) &&
+		slices.EqualFunc(d.aspas, other.aspas, aspasEqual) &&
+		slices.EqualFunc(d.routerKeys, other.routerKeys, routerKeysEqual)
+}
+
+// fetchRound is one refresh of the HTTP upstreams. It selects the upstreams
+// to fetch and collects those whose data changed since their last successful
+// fetch. A nil round fetches every upstream and collects nothing.
+type fetchRound struct {
+	due func(url string) bool // nil fetches every upstream
+
+	mu      sync.Mutex
+	changed []string
+}
+
+// fetches reports whether url is fetched in this round.
+func (r *fetchRound) fetches(url string) bool {
+	return r == nil || r.due == nil || r.due(url)
+}
+
+// record notes that the data fetched from url changed.
+func (r *fetchRound) record(url string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.changed = append(r.changed, url)
+	r.mu.Unlock()
+}
+
+// changedUpstreams returns the upstreams whose data changed, sorted.
+func (r *fetchRound) changedUpstreams() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	urls := slices.Clone(r.changed)
+	slices.Sort(urls)
+	return slices.Compact(urls)
+}
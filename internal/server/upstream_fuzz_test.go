@@ -0,0 +1,20 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzDecodeRPKIJSON(f *testing.F) {
+	// Seed corpus
+	f.Add([]byte(testRPKIClientJSON))
+	f.Add([]byte(`{"roas": [], "aspas": [], "bgpsec_keys": []}`))
+	f.Add([]byte(`{"aspa": [{"customer": 1234, "providers": [{"asn": 100}]}]}`))
+	f.Add([]byte(`{}`))
+	f.Add([]byte(`invalid json`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		_, _ = decodeRPKIJSON(r)
+	})
+}
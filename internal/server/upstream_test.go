@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"go.uber.org/zap"
+)
+
+const testRPKIClientJSON = `{
+	"metadata": {"buildtime": "2025-01-01T00:00:00Z", "vrps": 2},
+	"roas": [
+		{"asn": 13335, "prefix": "1.1.1.0/24", "maxLength": 24, "ta": "apnic", "expires": 0},
+		{"asn": "AS64496", "prefix": "2001:db8::/32", "maxLength": 48, "ta": "ripe", "expires": 0}
+	],
+	"aspas": [
+		{"customer_asid": 64496, "expires": 0, "providers": [64498, 64497]}
+	],
+	"bgpsec_keys": [
+		{"asn": 64496, "ski": "0102030405060708090A0B0C0D0E0F1011121314", "pubkey": "AQID", "ta": "ripe", "expires": 0}
+	]
+}`
+
+func TestDecodeRPKIJSON(t *testing.T) {
+	data, err := decodeRPKIJSON(strings.NewReader(testRPKIClientJSON))
+	if err != nil {
+		t.Fatalf("decodeRPKIJSON failed: %v", err)
+	}
+
+	if len(data.roas) != 2 {
+		t.Fatalf("Expected 2 ROAs, got %d", len(data.roas))
+	}
+	if data.roas[1].ASN != 64496 || data.roas[1].MaxMask != 48 {
+		t.Errorf("Unexpected second ROA: %+v", data.roas[1])
+	}
+
+	if len(data.aspas) != 1 {
+		t.Fatalf("Expected 1 ASPA, got %d", len(data.aspas))
+	}
+	if data.aspas[0].CustomerASN != 64496 {
+		t.Errorf("Expected customer 64496, got %d", data.aspas[0].CustomerASN)
+	}
+	if got := data.aspas[0].ProviderASNs; len(got) != 2 || got[0] != 64497 || got[1] != 64498 {
+		t.Errorf("Expected sorted providers [64497 64498], got %v", got)
+	}
+
+	if len(data.routerKeys) != 1 {
+		t.Fatalf("Expected 1 router key, got %d", len(data.routerKeys))
+	}
+	k := data.routerKeys[0]
+	if k.ASN != 64496 || k.SKI[0] != 0x01 || k.SKI[19] != 0x14 || string(k.SPKI) != "\x01\x02\x03" {
+		t.Errorf("Unexpected router key: %+v", k)
+	}
+}
+
+func TestDecodeRPKIJSONLegacyASPA(t *testing.T) {
+	data, err := decodeRPKIJSON(strings.NewReader(`{"aspa": [{"customer": 1, "providers": [{"asn": 2}]}]}`))
+	if err != nil {
+		t.Fatalf("decodeRPKIJSON failed: %v", err)
+	}
+	if len(data.roas) != 0 || len(data.routerKeys) != 0 {
+		t.Errorf("Expected only ASPAs, got %+v", data)
+	}
+	if len(data.aspas) != 1 || data.aspas[0].ProviderASNs[0] != 2 {
+		t.Errorf("Unexpected ASPAs: %+v", data.aspas)
+	}
+}
+
+func TestDecodeRPKIJSONErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+	}{
+		{name: "not an object", json: `[]`},
+		{name: "roas not an array", json: `{"roas": {}}`},
+		{name: "bad prefix", json: `{"roas": [{"prefix": "nope", "maxLength": 24, "asn": 1}]}`},
+		{name: "short ski", json: `{"bgpsec_keys": [{"asn": 1, "ski": "0102", "pubkey": "AQID"}]}`},
+		{name: "bad pubkey", json: `{"bgpsec_keys": [{"asn": 1, "ski": "0102030405060708090A0B0C0D0E0F1011121314", "pubkey": "!"}]}`},
+		{name: "truncated", json: `{"roas": [`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeRPKIJSON(strings.NewReader(tt.json)); err == nil {
+				t.Errorf("Expected error for %s", tt.json)
+			}
+		})
+	}
+}
+
+func TestLoadAllUnifiedUpstream(t *testing.T) {
+	var hits atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte(testRPKIClientJSON))
+	}))
+	defer ts.Close()
+
+	cfg := &config.Config{
+		Upstreams: []config.Upstream{{URL: ts.URL}},
+	}
+	srv := New(cfg, zap.NewNop().Sugar())
+
+	if err := srv.TriggerRefresh(context.Background()); err != nil {
+		t.Fatalf("TriggerRefresh failed: %v", err)
+	}
+
+	if got := hits.Load(); got != 1 {
+		t.Errorf("Expected upstream to be fetched once, got %d", got)
+	}
+
+	state := srv.cache.getState()
+	if len(state.roas) != 2 || len(state.aspas) != 1 || len(state.routerKeys) != 1 {
+		t.Errorf("Unexpected cache contents: %d ROAs, %d ASPAs, %d router keys", len(state.roas), len(state.aspas), len(state.routerKeys))
+	}
+
+	srv.upstreamsMu.RLock()
+	stats := srv.upstreams[ts.URL]
+	srv.upstreamsMu.RUnlock()
+	if stats == nil || !stats.LastFetchSuccess {
+		t.Fatalf("Expected successful upstream status, got %+v", stats)
+	}
+	if stats.ROACount != 2 || stats.ASPACount != 1 || stats.RouterKeyCount != 1 {
+		t.Errorf("Unexpected per-type counts: %+v", stats)
+	}
+}
+
+func TestLoadAllMergesLegacyAndUnified(t *testing.T) {
+	legacy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"roas": [{"prefix": "1.1.1.0/24", "maxLength": 24, "asn": 13335}, {"prefix": "9.9.9.0/24", "maxLength": 24, "asn": 19281}]}`))
+	}))
+	defer legacy.Close()
+	unified := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testRPKIClientJSON))
+	}))
+	defer unified.Close()
+
+	cfg := &config.Config{
+		RPKIURLs:  []string{legacy.URL},
+		Upstreams: []config.Upstream{{URL: unified.URL}},
+	}
+	srv := New(cfg, zap.NewNop().Sugar())
+
+	roas, aspas, keys, err := srv.loadAll(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("loadAll failed: %v", err)
+	}
+	// 1.1.1.0/24 AS13335 is present in both feeds and must be deduplicated.
+	if len(roas) != 3 {
+		t.Errorf("Expected 3 ROAs, got %d: %+v", len(roas), roas)
+	}
+	if len(aspas) != 1 || len(keys) != 1 {
+		t.Errorf("Expected 1 ASPA and 1 router key, got %d and %d", len(aspas), len(keys))
+	}
+}
+
+func TestLoadAllUnifiedFailureKeepsPrevious(t *testing.T) {
+	legacy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"roas": [{"prefix": "9.9.9.0/24", "maxLength": 24, "asn": 19281}]}`))
+	}))
+	defer legacy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	cfg := &config.Config{
+		RPKIURLs:  []string{legacy.URL},
+		Upstreams: []config.Upstream{{URL: failing.URL}},
+	}
+	srv := New(cfg, zap.NewNop().Sugar())
+	prevKeys := []RouterKey{{ASN: 1, SPKI: []byte{1}}}
+	srv.lastGood[failing.URL] = upstreamData{routerKeys: prevKeys}
+
+	roas, _, keys, err := srv.loadAll(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("loadAll failed: %v", err)
+	}
+	if len(roas) != 1 {
+		t.Errorf("Expected 1 ROA from the legacy URL, got %d", len(roas))
+	}
+	if len(keys) != 1 || keys[0].ASN != 1 {
+		t.Errorf("Expected previous router keys to be kept, got %+v", keys)
+	}
+
+	srv.urls = nil
+	if _, _, _, err := srv.loadAll(context.Background(), nil); err == nil {
+		t.Error("Expected error when the only upstream fails")
+	}
+}
+
+func TestLoadAllLegacyFailureKeepsPrevious(t *testing.T) {
+	var fail atomic.Bool
+	flapping := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"roas": [{"prefix": "9.9.9.0/24", "maxLength": 24, "asn": 19281}]}`))
+	}))
+	defer flapping.Close()
+	steady := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"roas": [{"prefix": "8.8.8.0/24", "maxLength": 24, "asn": 15169}]}`))
+	}))
+	defer steady.Close()
+	unified := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testRPKIClientJSON))
+	}))
+	defer unified.Close()
+
+	cfg := &config.Config{
+		RPKIURLs:  []string{flapping.URL, steady.URL},
+		Upstreams: []config.Upstream{{URL: unified.URL}},
+	}
+	srv := New(cfg, zap.NewNop().Sugar())
+	if err := srv.TriggerRefresh(context.Background()); err != nil {
+		t.Fatalf("TriggerRefresh failed: %v", err)
+	}
+	want := srv.cache.getState()
+	if len(want.roas) != 4 {
+		t.Fatalf("Expected 4 ROAs, got %d", len(want.roas))
+	}
+
+	// One failing ROA URL keeps its previous ROAs
+	fail.Store(true)
+	if err := srv.TriggerRefresh(context.Background()); err != nil {
+		t.Fatalf("TriggerRefresh failed: %v", err)
+	}
+	if state := srv.cache.getState(); state.serial != want.serial {
+		t.Errorf("Expected no change with one ROA URL failing, got %d ROAs at serial %d", len(state.roas), state.serial)
+	}
+
+	// So does every ROA URL failing while the unified upstream succeeds
+	srv.urls = []string{flapping.URL}
+	roas, _, _, err := srv.loadAll(context.Background(), nil)
+	if err != nil {
+		t.Fatalf("loadAll failed: %v", err)
+	}
+	if len(roas) != 3 {
+		t.Errorf("Expected the previous legacy ROA and 2 unified ROAs, got %+v", roas)
+	}
+}
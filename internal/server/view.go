@@ -0,0 +1,126 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+)
+
+// view filters the data sent to the routers matching it. Each filter looks at
+// one object at a time, so filtering the changes between two serials gives
+// the changes between the filtered data at those serials. A view therefore
+// shares the cache's session, serials and history.
+//
+// A nil *view sends everything.
+type view struct {
+	name        string
+	clients     []netip.Prefix
+	afi         string
+	prefixes    []netip.Prefix
+	asns        map[uint32]bool
+	excludeASPA bool
+}
+
+// newViews parses views that have already been validated.
+func newViews(cfgs []config.View) []*view {
+	views := make([]*view, 0, len(cfgs))
+	for _, c := range cfgs {
+		clients, prefixes, _ := c.ParsePrefixes()
+		v := &view{name: c.Name, clients: clients, afi: c.AFI, prefixes: prefixes, excludeASPA: c.ExcludeASPA}
+		if len(c.ASNs) > 0 {
+			v.asns = make(map[uint32]bool, len(c.ASNs))
+			for _, asn := range c.ASNs {
+				v.asns[asn] = true
+			}
+		}
+		views = append(views, v)
+	}
+	return views
+}
+
+// viewFor returns the first view whose clients include the router at addr,
+// or nil if there is none.
+func (s *Server) viewFor(addr net.Addr) *view {
+	ip, ok := sourceIP(addr)
+	if !ok {
+		return nil
+	}
+	for _, v := range s.views {
+		for _, p := range v.clients {
+			if p.Contains(ip) {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+// label returns the name of the view, or "" for all data.
+func (v *view) label() string {
+	if v == nil {
+		return ""
+	}
+	return v.name
+}
+
+func (v *view) keepROA(r ROA) bool {
+	switch v.afi {
+	case config.AFIIPv4:
+		if !r.Prefix.Addr().Is4() {
+			return false
+		}
+	case config.AFIIPv6:
+		if !r.Prefix.Addr().Is6() {
+			return false
+		}
+	}
+	if v.asns != nil && !v.asns[r.ASN] {
+		return false
+	}
+	if len(v.prefixes) == 0 {
+		return true
+	}
+	// A VRP covering one of the prefixes is kept too, as it affects the
+	// validation of routes within it. Without it a route the covering VRP
+	// makes Invalid would be NotFound to the router, and with compress_vrps
+	// the covering VRP may be all that is left of the more specific ones
+	for _, p := range v.prefixes {
+		if p.Overlaps(r.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *view) filterROAs(roas []ROA) []ROA {
+	if v == nil {
+		return roas
+	}
+	out := make([]ROA, 0, len(roas))
+	for _, r := range roas {
+		if v.keepROA(r) {
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func (v *view) filterASPAs(aspas []ASPA) []ASPA {
+	if v != nil && v.excludeASPA {
+		return nil
+	}
+	return aspas
+}
+
+// filterDiff returns the part of a diff within the view.
+func (v *view) filterDiff(d diffSet) diffSet {
+	if v == nil {
+		return d
+	}
+	d.addRoa = v.filterROAs(d.addRoa)
+	d.delRoa = v.filterROAs(d.delRoa)
+	d.addAspa = v.filterASPAs(d.addAspa)
+	d.delAspa = v.filterASPAs(d.delAspa)
+	return d
+}
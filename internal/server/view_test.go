@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/mellowdrifter/rpkirtr2/internal/config"
+	"github.com/mellowdrifter/rpkirtr2/internal/protocol"
+	"go.uber.org/zap"
+)
+
+var (
+	viewROA4    = ROA{Prefix: netip.MustParsePrefix("10.1.0.0/16"), ASN: 64496, MaxMask: 24}
+	viewROA4Far = ROA{Prefix: netip.MustParsePrefix("192.0.2.0/24"), ASN: 64496, MaxMask: 24}
+	viewROA4AS  = ROA{Prefix: netip.MustParsePrefix("10.2.0.0/16"), ASN: 64511, MaxMask: 16}
+	viewROA6    = ROA{Prefix: netip.MustParsePrefix("2001:db8::/32"), ASN: 64496, MaxMask: 48}
+)
+
+func TestViewFilters(t *testing.T) {
+	views := newViews([]config.View{
+		{Name: "v4", Clients: []string{"198.51.100.0/24"}, AFI: config.AFIIPv4},
+		{Name: "lab", Clients: []string{"198.51.100.7", "2001:db8:ffff::/48"}, Prefixes: []string{"10.0.0.0/8", "2001:db8::/32"}, ASNs: []uint32{64496}, ExcludeASPA: true},
+	})
+	v4, lab := views[0], views[1]
+	all := []ROA{viewROA4, viewROA4Far, viewROA4AS, viewROA6}
+	aspas := []ASPA{{CustomerASN: 64496, ProviderASNs: []uint32{64500}}}
+
+	if got := v4.filterROAs(all); !slices.Equal(got, []ROA{viewROA4, viewROA4Far, viewROA4AS}) {
+		t.Errorf("v4 view: got %v", got)
+	}
+	if got := v4.filterASPAs(aspas); len(got) != 1 {
+		t.Errorf("v4 view should keep ASPAs, got %v", got)
+	}
+	if got := lab.filterROAs(all); !slices.Equal(got, []ROA{viewROA4, viewROA6}) {
+		t.Errorf("lab view: got %v", got)
+	}
+	if got := lab.filterASPAs(aspas); len(got) != 0 {
+		t.Errorf("lab view should drop ASPAs, got %v", got)
+	}
+	wide := ROA{Prefix: netip.MustParsePrefix("10.0.0.0/7"), ASN: 64496, MaxMask: 8}
+	if !lab.keepROA(wide) {
+		t.Error("a VRP covering a prefix of the view should be kept")
+	}
+
+	var none *view
+	if got := none.filterROAs(all); !slices.Equal(got, all) {
+		t.Errorf("nil view should keep everything, got %v", got)
+	}
+
+	srv := New(&config.Config{Views: []config.View{
+		{Name: "v4", Clients: []string{"198.51.100.0/24"}, AFI: config.AFIIPv4},
+		{Name: "lab", Clients: []string{"198.51.100.7"}},
+	}}, zap.NewNop().Sugar())
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 40000}, "v4"}, // first match wins
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:198.51.100.8"), Port: 40000}, "v4"},
+		{&net.TCPAddr{IP: net.ParseIP("203.0.113.1"), Port: 40000}, ""},
+		{&net.UnixAddr{Name: "/run/rtr.sock", Net: "unix"}, ""},
+	}
+	for _, tt := range tests {
+		if got := srv.viewFor(tt.addr).label(); got != tt.want {
+			t.Errorf("viewFor(%v) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// TestViewDiffsConsistent checks that a router following a view's diffs holds
+// exactly the view's data at every serial.
+func TestViewDiffsConsistent(t *testing.T) {
+	srv := New(&config.Config{}, zap.NewNop().Sugar())
+	v := newViews([]config.View{{Name: "lab", Clients: []string{"0.0.0.0/0"}, AFI: config.AFIIPv4, ASNs: []uint32{64496}, ExcludeASPA: true}})[0]
+
+	steps := [][]ROA{
+		{viewROA4, viewROA6},
+		{viewROA4, viewROA4Far, viewROA6},
+		{viewROA4AS, viewROA6},
+		{viewROA4Far},
+		{viewROA4, viewROA4Far, viewROA4AS},
+	}
+	srv.UpdateROAs(steps[0])
+	start := srv.cache.getState()
+	held := v.filterROAs(start.roas)
+	for i, roas := range steps[1:] {
+		before := srv.getSerial()
+		srv.UpdateROAs(roas)
+		diff, ok := srv.cache.getDiffSetFrom(before)
+		if !ok {
+			t.Fatalf("step %d: no diff from serial %d", i, before)
+		}
+		diff = v.filterDiff(diff)
+		held = applyTestDiff(held, diff)
+		want := v.filterROAs(srv.cache.getState().roas)
+		if !sameROAs(held, want) {
+			t.Fatalf("step %d: router holds %v, view has %v", i, held, want)
+		}
+	}
+
+	// A router that missed every step catches up in one diff
+	diff, ok := srv.cache.getDiffSetFrom(start.serial)
+	if !ok {
+		t.Fatal("no diff from the first serial")
+	}
+	if got, want := applyTestDiff(v.filterROAs(start.roas), v.filterDiff(diff)), v.filterROAs(srv.cache.getState().roas); !sameROAs(got, want) {
+		t.Errorf("aggregated diff: router holds %v, view has %v", got, want)
+	}
+}
+
+func applyTestDiff(held []ROA, d diffSet) []ROA {
+	out := slices.DeleteFunc(slices.Clone(held), func(r ROA) bool { return slices.Contains(d.delRoa, r) })
+	return append(out, d.addRoa...)
+}
+
+func sameROAs(a, b []ROA) bool {
+	return len(a) == len(b) && !slices.ContainsFunc(a, func(r ROA) bool { return !slices.Contains(b, r) })
+}
+
+func TestClientViewResetQuery(t *testing.T) {
+	c := newCache()
+	c.replaceRoas([]ROA{viewROA4, viewROA6})
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	client := NewClient(serverConn, zap.NewNop().Sugar(), c)
+	client.version = 1
+	client.view = newViews([]config.View{{Name: "v6", Clients: []string{"::/0"}, AFI: config.AFIIPv6}})[0]
+
+	go func() {
+		_ = protocol.NewResetQueryPDU(1).Write(clientConn)
+	}()
+	go func() {
+		pdu, _ := protocol.GetPDU(bufio.NewReader(serverConn))
+		_ = client.dispatchPDU(pdu)
+	}()
+
+	r := bufio.NewReader(clientConn)
+	var types []protocol.PDUType
+	for {
+		pdu, err := protocol.GetPDU(r)
+		if err != nil {
+			t.Fatalf("failed to read PDU: %v", err)
+		}
+		types = append(types, pdu.Type())
+		if pdu.Type() == protocol.EndOfData {
+			break
+		}
+	}
+	want := []protocol.PDUType{protocol.CacheResponse, protocol.Ipv6Prefix, protocol.EndOfData}
+	if !slices.Equal(types, want) {
+		t.Errorf("got PDUs %v, want %v", types, want)
+	}
+}
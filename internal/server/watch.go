@@ -0,0 +1,69 @@
+package server
+
+// updatesFrom returns the diff records needed to move from serial to the
+// current serial, along with the current state. The boolean is false if serial
+// is no longer covered by the history ring, in which case a snapshot is needed.
+func (c *cache) updatesFrom(serial uint32) ([]diffRecord, cacheState, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	state := cacheState{
+		serial:     c.serial,
+		session:    c.session,
+		roas:       c.roas,
+		aspas:      c.aspas,
+		routerKeys: c.routerKeys,
+		lastUpdate: c.lastUpdate,
+	}
+	if serial == c.serial {
+		return nil, state, true
+	}
+	for i, d := range c.history {
+		if d.from == serial {
+			return append([]diffRecord(nil), c.history[i:]...), state, true
+		}
+	}
+	return nil, state, false
+}
+
+// watchUpdates registers a watcher that is signalled after every serial bump.
+// Signals are coalesced, so a slow watcher must catch up from the history ring.
+// It returns false once the server is shutting down.
+func (s *Server) watchUpdates() (chan struct{}, bool) {
+	s.watchersMu.Lock()
+	defer s.watchersMu.Unlock()
+	if s.shuttingDown.Load() {
+		return nil, false
+	}
+	ch := make(chan struct{}, 1)
+	s.watchers[ch] = struct{}{}
+	return ch, true
+}
+
+func (s *Server) unwatchUpdates(ch chan struct{}) {
+	s.watchersMu.Lock()
+	delete(s.watchers, ch)
+	s.watchersMu.Unlock()
+}
+
+func (s *Server) notifyWatchers() {
+	s.watchersMu.Lock()
+	defer s.watchersMu.Unlock()
+	for ch := range s.watchers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// closeWatchers closes every watcher channel so that streams end and a
+// graceful gRPC stop does not wait on them.
+func (s *Server) closeWatchers() {
+	s.watchersMu.Lock()
+	defer s.watchersMu.Unlock()
+	for ch := range s.watchers {
+		close(ch)
+		delete(s.watchers, ch)
+	}
+}